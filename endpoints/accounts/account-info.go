@@ -14,6 +14,8 @@ import (
 type UserInfo struct {
     Id string `json:"uid"`
     Email string `json:"email"`
+    EmailUndeliverable bool `json:"undeliverable,omitempty"`
+    Phone string `json:"phone,omitempty"`
     FirstName string `json:"fname"`
     LastName string `json:"lname"`
     DisplayName string `json:"dname"`
@@ -42,6 +44,8 @@ func GetUserInfoFromRecord(userRecord *datastore.UserRecord) *UserInfo {
     return &UserInfo{
         Id:   userRecord.GetKeyIntAsString(),
         Email: userRecord.GetData().Email,
+        EmailUndeliverable: userRecord.GetData().EmailUndeliverable,
+        Phone: userRecord.GetData().Phone,
         FirstName: userRecord.GetData().FirstName,
         LastName: userRecord.GetData().LastName,
         DisplayName: userRecord.GetData().DisplayName,
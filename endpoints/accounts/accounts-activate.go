@@ -5,6 +5,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/dakom/basic-site-api/lib/audit"
 	"github.com/dakom/basic-site-api/lib/auth"
 	"github.com/dakom/basic-site-api/lib/auth/jwt_scopes"
 	"github.com/dakom/basic-site-api/lib/datastore"
@@ -18,7 +19,7 @@ import (
 
 func GotActivateRequest(rData *pages.RequestData) {
 
-	if rData.UserRecord.GetData().IsActive {
+	if !rData.UserRecord.IsStatusPending() {
 		rData.SetJsonErrorCodeResponse(statuscodes.ACTIVATION_EXISTS)
 		return
 	} else {
@@ -29,20 +30,10 @@ func GotActivateRequest(rData *pages.RequestData) {
 			return
 		}
 
-		params := url.Values{}
-		params.Set("uid", strconv.FormatInt(rData.UserRecord.GetKey().IntID(), 10))
-		if rData.HttpRequest.FormValue("appId") != "" {
-			params.Set("appId", rData.HttpRequest.FormValue("appId"))
-		}
-		if rData.HttpRequest.FormValue("appPort") != "" {
-			params.Set("appPort", rData.HttpRequest.FormValue("appPort"))
-		}
-		mailingListTask := taskqueue.NewPOSTTask("/"+pagenames.MAILINGLIST_SUBSCRIBE_WEBHOOK, params)
-		_, err = taskqueue.Add(rData.Ctx, mailingListTask, rData.SiteConfig.TASKQUEUE_MAILINGLIST)
+		audit.Record(rData, datastore.AUDIT_EVENT_ACTIVATED, rData.UserRecord.GetKey().IntID(), nil)
+		unsuppressVerifiedEmail(rData, rData.UserRecord)
 
-		if err != nil {
-			rData.LogError("%v", err)
-		}
+		queueMailingListSubscribe(rData, rData.UserRecord)
 
 		rData.SetJsonSuccessCodeResponse(statuscodes.ACTIVATION_COMPLETED)
 		rData.DeleteJwtWhenFinished = true
@@ -68,9 +59,12 @@ func SendActivateTokenRequest(rData *pages.RequestData) {
 		return
 	}
 
-	if userRecord.GetData().IsActive {
+	if userRecord.IsStatusActive() {
 		rData.SetJsonErrorCodeResponse(statuscodes.ALREADY_ACTIVE)
 		return
+	} else if !userRecord.IsStatusPending() {
+		rData.SetJsonErrorCodeResponse(GetUserStatusCode(userRecord))
+		return
 	}
 
 	_, jwtString, err := auth.GetNewUserOobJWT(rData, userRecord, jwt_scopes.OOB_USER_ACTIVATE, nil)
@@ -82,8 +76,10 @@ func SendActivateTokenRequest(rData *pages.RequestData) {
 
 	url := rData.SiteConfig.EMAIL_TARGET_HOSTNAME + pagenames.APP_PAGE_ACCOUNT_ACTION_ACTIVATE + "/" + jwtString + appUrlParamsFromRequest(rData)
 
-	emailMessage := email.GetEmailActivationMessage(rData.HttpRequest.FormValue("locale"), url)
-	err = email.Send(rData, userRecord.GetFullName(), userRecord.GetData().Email, emailMessage)
+	emailMessage, err := email.GetEmailActivationMessage(rData.HttpRequest.FormValue("locale"), url)
+	if err == nil {
+		err = email.Queue(rData, userRecord.GetFullName(), userRecord.GetData().Email, emailMessage)
+	}
 
 	if err != nil {
 		rData.LogError(err.Error())
@@ -94,8 +90,37 @@ func SendActivateTokenRequest(rData *pages.RequestData) {
 	rData.SetJsonSuccessCodeResponse(statuscodes.CHECK_EMAIL)
 }
 
+//non-critical, errors are only logged
+func queueMailingListSubscribe(rData *pages.RequestData, userRecord *datastore.UserRecord) {
+	params := url.Values{}
+	params.Set("uid", strconv.FormatInt(userRecord.GetKey().IntID(), 10))
+	if rData.HttpRequest.FormValue("appId") != "" {
+		params.Set("appId", rData.HttpRequest.FormValue("appId"))
+	}
+	if rData.HttpRequest.FormValue("appPort") != "" {
+		params.Set("appPort", rData.HttpRequest.FormValue("appPort"))
+	}
+	mailingListTask := taskqueue.NewPOSTTask("/"+pagenames.MAILINGLIST_SUBSCRIBE_WEBHOOK, params)
+	_, err := taskqueue.Add(rData.Ctx, mailingListTask, rData.SiteConfig.TASKQUEUE_MAILINGLIST)
+
+	if err != nil {
+		rData.LogError("%v", err)
+	}
+}
+
+//Activation tokens and login links are mailed, so whoever used one just got mail at that address - non-critical, errors are only logged
+func unsuppressVerifiedEmail(rData *pages.RequestData, userRecord *datastore.UserRecord) {
+	if userRecord.GetData().Email == "" {
+		return
+	}
+
+	if err := email.Unsuppress(rData.Ctx, userRecord.GetData().Email); err != nil {
+		rData.LogError("email unsuppress error %v", err)
+	}
+}
+
 func ActivateUser(c context.Context, userRecord *datastore.UserRecord) error {
-	userRecord.GetData().IsActive = true
+	userRecord.SetStatus(datastore.USER_STATUS_ACTIVE, "")
 
 	err := datastore.Save(c, userRecord)
 	if err != nil {
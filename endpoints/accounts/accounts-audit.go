@@ -0,0 +1,91 @@
+package accounts
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/lib/utils/text"
+	"github.com/dakom/basic-site-api/setup/config/static/statuscodes"
+)
+
+const AUDIT_PAGE_SIZE int = 50
+
+type AuditEventInfo struct {
+	Id        string                 `json:"id"`
+	ActorId   string                 `json:"actor"`
+	UserId    string                 `json:"uid"`
+	EventType string                 `json:"event"`
+	IpAddress string                 `json:"ip"`
+	UserAgent string                 `json:"ua"`
+	Date      int64                  `json:"date"`
+	Meta      map[string]interface{} `json:"meta,omitempty"`
+}
+
+func GetAuditEventInfo(auditRecord *datastore.AuditRecord) *AuditEventInfo {
+	data := auditRecord.GetData()
+
+	info := &AuditEventInfo{
+		Id:        auditRecord.GetKeyIntAsString(),
+		ActorId:   strconv.FormatInt(data.ActorId, 10),
+		UserId:    strconv.FormatInt(data.UserId, 10),
+		EventType: data.EventType,
+		IpAddress: data.IpAddress,
+		UserAgent: data.UserAgent,
+		Date:      data.Date.Unix(),
+	}
+
+	if data.Meta != "" {
+		json.Unmarshal([]byte(data.Meta), &info.Meta)
+	}
+
+	return info
+}
+
+//the logged in user's own history
+func GotSecurityHistoryRequest(rData *pages.RequestData) {
+	outputAuditQuery(rData, rData.UserRecord.GetKey().IntID(), "")
+}
+
+//admin only - by user and/or event type
+func GotAdminAuditQueryRequest(rData *pages.RequestData) {
+	var userId int64
+	var err error
+
+	eventType := strings.TrimSpace(rData.HttpRequest.FormValue("event"))
+
+	if rData.HttpRequest.FormValue("uid") != "" {
+		if userId, err = text.StringToInt64(rData.HttpRequest.FormValue("uid")); err != nil {
+			rData.SetJsonErrorCodeResponse(statuscodes.MISSINGINFO)
+			return
+		}
+	}
+
+	if userId == 0 && eventType == "" {
+		rData.SetJsonErrorCodeResponse(statuscodes.MISSINGINFO)
+		return
+	}
+
+	outputAuditQuery(rData, userId, eventType)
+}
+
+func outputAuditQuery(rData *pages.RequestData, userId int64, eventType string) {
+	auditRecords, cursor, err := datastore.QueryAuditRecords(rData.Ctx, userId, eventType, rData.HttpRequest.FormValue("cursor"), AUDIT_PAGE_SIZE)
+	if err != nil {
+		rData.LogError(err.Error())
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+
+	eventList := make([]*AuditEventInfo, len(auditRecords))
+	for idx, auditRecord := range auditRecords {
+		eventList[idx] = GetAuditEventInfo(auditRecord)
+	}
+
+	rData.SetJsonSuccessResponse(pages.JsonMapGeneric{
+		"list":   eventList,
+		"cursor": cursor,
+	})
+}
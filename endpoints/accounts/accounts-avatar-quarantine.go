@@ -0,0 +1,137 @@
+package accounts
+
+import (
+	"image"
+	"strconv"
+	"time"
+
+	"github.com/dakom/basic-site-api/lib/blobstore"
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/lib/utils/text"
+	"github.com/dakom/basic-site-api/setup/config/static/statuscodes"
+)
+
+const AVATAR_QUARANTINE_PAGE_SIZE int = 50
+
+type AvatarQuarantineInfo struct {
+	Id           string `json:"id"`
+	UserId       string `json:"uid"`
+	Status       string `json:"status"`
+	Url          string `json:"url,omitempty"` //gone once reviewed
+	Reason       string `json:"reason"`
+	ReviewerId   string `json:"reviewer,omitempty"`
+	Date         int64  `json:"date"`
+	ReviewedDate int64  `json:"reviewed,omitempty"`
+}
+
+func GetAvatarQuarantineInfo(rData *pages.RequestData, record *datastore.AvatarQuarantineRecord) *AvatarQuarantineInfo {
+	data := record.GetData()
+
+	info := &AvatarQuarantineInfo{
+		Id:     record.GetKeyIntAsString(),
+		UserId: strconv.FormatInt(data.UserId, 10),
+		Status: data.Status,
+		Reason: data.Reason,
+		Date:   data.Date.Unix(),
+	}
+
+	if data.Status == datastore.AVATAR_QUARANTINE_PENDING {
+		info.Url = blobstore.GetAvatarStore(rData).URL(data.Filename)
+	} else {
+		info.ReviewerId = strconv.FormatInt(data.ReviewerId, 10)
+		info.ReviewedDate = data.ReviewedDate.Unix()
+	}
+
+	return info
+}
+
+//the avatars waiting for review, oldest first
+func GotAdminAvatarQuarantineListRequest(rData *pages.RequestData) {
+	records, cursor, err := datastore.QueryPendingAvatarQuarantineRecords(rData.Ctx, rData.HttpRequest.FormValue("cursor"), AVATAR_QUARANTINE_PAGE_SIZE)
+	if err != nil {
+		rData.LogError(err.Error())
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+
+	list := make([]*AvatarQuarantineInfo, len(records))
+	for idx, record := range records {
+		list[idx] = GetAvatarQuarantineInfo(rData, record)
+	}
+
+	rData.SetJsonSuccessResponse(pages.JsonMapGeneric{
+		"list":   list,
+		"cursor": cursor,
+	})
+}
+
+//id of the quarantined avatar, and approve=true to make it the user's avatar (replacing whatever they have by now) - otherwise it's rejected
+func GotAdminAvatarQuarantineReviewRequest(rData *pages.RequestData) {
+	var record datastore.AvatarQuarantineRecord
+
+	recordId, err := text.StringToInt64(rData.HttpRequest.FormValue("id"))
+	if err != nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.MISSINGINFO)
+		return
+	}
+
+	if err := datastore.LoadFromKey(rData.Ctx, &record, recordId); err != nil || record.GetData().Status != datastore.AVATAR_QUARANTINE_PENDING {
+		rData.SetJsonErrorCodeResponse(statuscodes.NODATA)
+		return
+	}
+
+	data := record.GetData()
+	store := blobstore.GetAvatarStore(rData)
+
+	if rData.HttpRequest.FormValue("approve") == "true" {
+		var userRecord datastore.UserRecord
+
+		if err := datastore.LoadFromKey(rData.Ctx, &userRecord, data.UserId); err != nil {
+			rData.SetJsonErrorCodeResponse(statuscodes.NODATA)
+			return
+		}
+
+		reader, _, err := store.Open(rData.Ctx, data.Filename)
+		if err != nil {
+			rData.LogError("failed to open quarantined avatar %s: %v", data.Filename, err)
+			rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+			return
+		}
+
+		//it's our own square crop, so it doesn't need the upload checks again
+		croppedImg, _, err := image.Decode(reader)
+		reader.Close()
+		if err != nil {
+			rData.LogError("failed to decode quarantined avatar %s: %v", data.Filename, err)
+			rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+			return
+		}
+
+		if err := setAvatar(rData, croppedImg, &userRecord); err != nil {
+			rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+			return
+		}
+
+		data.Status = datastore.AVATAR_QUARANTINE_APPROVED
+	} else {
+		data.Status = datastore.AVATAR_QUARANTINE_REJECTED
+	}
+
+	data.ReviewerId = rData.UserRecord.GetKey().IntID()
+	data.ReviewedDate = time.Now()
+
+	if err := datastore.Save(rData.Ctx, &record); err != nil {
+		rData.LogError(err.Error())
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+
+	if err := store.Delete(rData.Ctx, data.Filename); err != nil {
+		rData.LogError("failed to delete quarantined avatar %s: %v", data.Filename, err)
+	}
+
+	rData.SetJsonSuccessResponse(pages.JsonMapGeneric{
+		"quarantine": GetAvatarQuarantineInfo(rData, &record),
+	})
+}
@@ -0,0 +1,70 @@
+package accounts
+
+import (
+	"github.com/dakom/basic-site-api/lib/avatars"
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/lib/utils/text"
+	"github.com/dakom/basic-site-api/setup/config/static/statuscodes"
+)
+
+type AvatarRegenerateInfo struct {
+	Job         string `json:"job"`
+	Status      string `json:"status"`
+	Checked     int    `json:"checked"`
+	Regenerated int    `json:"regenerated"`
+	Skipped     int    `json:"skipped"`
+	Failed      int    `json:"failed"`
+	LastError   string `json:"error,omitempty"`
+	Date        int64  `json:"date"`
+	UpdatedDate int64  `json:"updated"`
+}
+
+func GetAvatarRegenerateInfo(record *datastore.AvatarRegenerateRecord) *AvatarRegenerateInfo {
+	data := record.GetData()
+
+	return &AvatarRegenerateInfo{
+		Job:         record.GetKeyIntAsString(),
+		Status:      data.Status,
+		Checked:     data.Checked,
+		Regenerated: data.Regenerated,
+		Skipped:     data.Skipped,
+		Failed:      data.Failed,
+		LastError:   data.LastError,
+		Date:        data.Date.Unix(),
+		UpdatedDate: data.UpdatedDate.Unix(),
+	}
+}
+
+//Rebuilds every avatar's renditions from its original, see avatars.StartRegenerate
+func GotAdminAvatarRegenerateStartRequest(rData *pages.RequestData) {
+	record, err := avatars.StartRegenerate(rData)
+	if err != nil {
+		rData.LogError(err.Error())
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+
+	rData.SetJsonSuccessResponse(pages.JsonMapGeneric{
+		"regenerate": GetAvatarRegenerateInfo(record),
+	})
+}
+
+func GotAdminAvatarRegenerateReportRequest(rData *pages.RequestData) {
+	var record datastore.AvatarRegenerateRecord
+
+	jobId, err := text.StringToInt64(rData.HttpRequest.FormValue("job"))
+	if err != nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.MISSINGINFO)
+		return
+	}
+
+	if err := datastore.LoadFromKey(rData.Ctx, &record, jobId); err != nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.NODATA)
+		return
+	}
+
+	rData.SetJsonSuccessResponse(pages.JsonMapGeneric{
+		"regenerate": GetAvatarRegenerateInfo(&record),
+	})
+}
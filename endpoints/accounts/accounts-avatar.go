@@ -3,22 +3,28 @@ package accounts
 import (
 	"encoding/base64"
 	"image"
-	"image/jpeg"
 	"io"
+	"io/ioutil"
 	"strconv"
 	"strings"
 
-	"cloud.google.com/go/storage"
-	"github.com/nfnt/resize"
-	"github.com/oliamb/cutter"
-
-	"github.com/dakom/basic-site-api/setup/config/static/statuscodes"
+	"github.com/dakom/basic-site-api/lib/avatars"
+	"github.com/dakom/basic-site-api/lib/blobstore"
 	"github.com/dakom/basic-site-api/lib/datastore"
 	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/lib/utils/text"
+	"github.com/dakom/basic-site-api/setup/config/static/statuscodes"
 )
 
+//x, y and size are an optional crop square (see avatars.CropRect), the centered one is used if they're not given
 func GotAvatarFileChangeServiceRequest(rData *pages.RequestData) {
 	//default is 128x128
+	crop, err := getAvatarCropRect(rData)
+	if err != nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.INVALID_CROP)
+		return
+	}
+
 	file, _, err := rData.HttpRequest.FormFile("file")
 	if err != nil {
 		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
@@ -26,32 +32,47 @@ func GotAvatarFileChangeServiceRequest(rData *pages.RequestData) {
 	}
 	defer file.Close()
 
-	srcImage, _, err := image.Decode(io.LimitReader(file, rData.SiteConfig.MAX_READ_SIZE))
+	srcImage, err := avatars.Decode(rData, io.LimitReader(file, rData.SiteConfig.MAX_READ_SIZE))
 	if err != nil {
-		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		rData.SetJsonErrorCodeResponse(getAvatarErrorCode(err))
 		return
 	}
 
-	err = UpdateAvatar(rData, srcImage, rData.UserRecord)
+	err = UpdateAvatar(rData, srcImage, crop, rData.UserRecord)
+	if err == avatars.ErrQuarantined {
+		rData.SetJsonSuccessCodeResponse(statuscodes.AVATAR_PENDING)
+		return
+	}
 	if err != nil {
-		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		rData.SetJsonErrorCodeResponse(getAvatarErrorCode(err))
 		return
 	}
 
 	rData.SetJsonSuccessCodeResponse(statuscodes.AVATAR_CHANGED)
 }
 
+//same crop params as GotAvatarFileChangeServiceRequest
 func GotAvatarBase64ChangeServiceRequest(rData *pages.RequestData) {
+	crop, err := getAvatarCropRect(rData)
+	if err != nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.INVALID_CROP)
+		return
+	}
+
 	reader := base64.NewDecoder(base64.URLEncoding, io.LimitReader(strings.NewReader(rData.HttpRequest.FormValue("imgbytes")), rData.SiteConfig.MAX_READ_SIZE))
-	srcImage, _, err := image.Decode(reader)
+	srcImage, err := avatars.Decode(rData, reader)
 	if err != nil {
-		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		rData.SetJsonErrorCodeResponse(getAvatarErrorCode(err))
 		return
 	}
 
-	err = UpdateAvatar(rData, srcImage, rData.UserRecord)
+	err = UpdateAvatar(rData, srcImage, crop, rData.UserRecord)
+	if err == avatars.ErrQuarantined {
+		rData.SetJsonSuccessCodeResponse(statuscodes.AVATAR_PENDING)
+		return
+	}
 	if err != nil {
-		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		rData.SetJsonErrorCodeResponse(getAvatarErrorCode(err))
 		return
 	}
 
@@ -59,132 +80,201 @@ func GotAvatarBase64ChangeServiceRequest(rData *pages.RequestData) {
 
 }
 
-func UpdateAvatar(rData *pages.RequestData, srcImage image.Image, userRecord *datastore.UserRecord) error {
-	jpegOptions := &jpeg.Options{
-		Quality: 90,
+//srcImage should already be upright (see avatars.Decode), crop is validated against it and nil means the centered square
+//the result goes through moderation first, so avatars.ErrRejected or avatars.ErrQuarantined leave the current avatar as it is
+//nothing is written to the response, that's up to the caller
+func UpdateAvatar(rData *pages.RequestData, srcImage image.Image, crop *avatars.CropRect, userRecord *datastore.UserRecord) error {
+	croppedImg, err := avatars.Crop(srcImage, crop)
+	if err != nil {
+		rData.LogError("error on image crop: %v", err)
+		return err
 	}
 
-	jpegSize := uint(128)
-	jpegSmallSize := uint(32)
+	if err := avatars.Moderate(rData, userRecord.GetKey().IntID(), croppedImg); err != nil {
+		if err != avatars.ErrQuarantined {
+			rData.LogError("avatar for %d not accepted: %v", userRecord.GetKey().IntID(), err)
+		}
+		return err
+	}
 
-	newAvatarId := userRecord.GetData().AvatarId + 1
-	//store original too so in case we need to batch convert them at some point for new avatar sizes or whatever
-	newFilenameOriginal := avatarFilename(userRecord.GetKey().IntID(), newAvatarId, "-orig")
-	newFilename := avatarFilename(userRecord.GetKey().IntID(), newAvatarId, "")
-	newFilenameSmall := avatarFilename(userRecord.GetKey().IntID(), newAvatarId, "_32")
+	return setAvatar(rData, croppedImg, userRecord)
+}
 
-	//crop image to center square
-	croppedImg, err := cutter.Crop(srcImage, cutter.Config{
-		Width:   1,
-		Height:  1,
-		Mode:    cutter.Centered,
-		Options: cutter.Ratio,
-	})
+//Stores the square image as a new avatar, without any further checks
+//the user only switches to it once every file was written and read back, and the previous one is kept to revert to
+func setAvatar(rData *pages.RequestData, croppedImg image.Image, userRecord *datastore.UserRecord) error {
+	userId := userRecord.GetKey().IntID()
 
+	newAvatarId, err := avatars.ReserveId(rData, userId)
 	if err != nil {
-		rData.LogError("error on image crop: %v", err)
-		rData.SetHttpStatusResponse(400, statuscodes.MISSINGINFO)
+		rData.LogError("failed to reserve avatar id: %v", err)
 		return err
 	}
 
-	//resize square for standard avatar size
-	resizedImg := resize.Resize(jpegSize, jpegSize, croppedImg, resize.Lanczos3)
-	resizedImgSmall := resize.Resize(jpegSmallSize, jpegSmallSize, croppedImg, resize.Lanczos3)
+	store := blobstore.GetAvatarStore(rData)
 
-	//open connection to google cloud storage
-	client, err := storage.NewClient(rData.Ctx)
-	if err != nil {
-		rData.LogError("failed to get gcs client: %v", err)
-		rData.SetHttpStatusResponse(400, statuscodes.MISSINGINFO)
+	//the square crop is kept too, so the renditions can be rebuilt when they change (see avatars.StartRegenerate)
+	if err := avatars.StoreVerified(rData, store, userId, newAvatarId, croppedImg); err != nil {
+		rData.LogError("failed to save avatar images: %v", err)
 		return err
 	}
 
-	defer client.Close()
-
-	bucket := client.Bucket(rData.SiteConfig.GCS_BUCKET_AVATAR)
-
-	originalObject := bucket.Object(newFilenameOriginal)
+	if err := avatars.Activate(rData, userRecord, newAvatarId); err != nil {
+		rData.LogError("failed to save update user record: %v", err)
+		avatars.Delete(rData, store, userId, newAvatarId)
+		return err
+	}
 
-	originalWriter := originalObject.NewWriter(rData.Ctx)
-	originalWriter.ContentType = "image/jpeg"
-	defer originalWriter.Close()
+	return nil
+}
 
-	err = jpeg.Encode(originalWriter, croppedImg, jpegOptions)
+//avid is one of the previous avatars (see "history" in GotAvatarUrlsRequest)
+func GotAvatarRevertRequest(rData *pages.RequestData) {
+	avatarId, err := text.StringToInt64(rData.HttpRequest.FormValue("avid"))
 	if err != nil {
-		rData.LogError("failed to save original cropped image: %v", err)
-		rData.SetHttpStatusResponse(400, statuscodes.MISSINGINFO)
-		return err
+		rData.SetJsonErrorCodeResponse(statuscodes.MISSINGINFO)
+		return
 	}
 
-	//main resized avatar
-	resizedObject := bucket.Object(newFilename)
-	resizedWriter := resizedObject.NewWriter(rData.Ctx)
-	resizedWriter.ContentType = "image/jpeg"
-	defer resizedWriter.Close()
+	err = avatars.Revert(rData, rData.UserRecord, avatarId)
+	if err == avatars.ErrNotInHistory {
+		rData.SetJsonErrorCodeResponse(statuscodes.NODATA)
+		return
+	} else if err != nil {
+		rData.LogError(err.Error())
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
 
-	err = jpeg.Encode(resizedWriter, resizedImg, jpegOptions)
-	if err != nil {
-		rData.LogError("failed to save resized image: %v", err)
-		rData.SetHttpStatusResponse(400, statuscodes.MISSINGINFO)
-		return err
+	rData.SetJsonSuccessCodeResponse(statuscodes.AVATAR_CHANGED)
+}
+
+//the current avatar can still be reverted to afterwards, unless purge=true (which deletes all previous ones too)
+func GotAvatarRemoveRequest(rData *pages.RequestData) {
+	if err := avatars.Remove(rData, rData.UserRecord, rData.HttpRequest.FormValue("purge") == "true"); err != nil {
+		rData.LogError(err.Error())
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
 	}
 
-	//small resized avatar
-	resizedObjectSmall := bucket.Object(newFilenameSmall)
-	resizedWriterSmall := resizedObjectSmall.NewWriter(rData.Ctx)
-	resizedWriterSmall.ContentType = "image/jpeg"
-	defer resizedWriterSmall.Close()
+	rData.SetJsonSuccessCodeResponse(statuscodes.AVATAR_REMOVED)
+}
 
-	err = jpeg.Encode(resizedWriterSmall, resizedImgSmall, jpegOptions)
-	if err != nil {
-		rData.LogError("failed to save resized image: %v", err)
-		rData.SetHttpStatusResponse(400, statuscodes.MISSINGINFO)
-		return err
+func getAvatarErrorCode(err error) string {
+	switch err {
+	case avatars.ErrInvalidCrop:
+		return statuscodes.INVALID_CROP
+	case avatars.ErrFormatNotAllowed:
+		return statuscodes.INVALID_IMAGE_FORMAT
+	case avatars.ErrTooLarge:
+		return statuscodes.IMAGE_TOO_LARGE
+	case avatars.ErrRejected:
+		return statuscodes.AVATAR_REJECTED
 	}
+	return statuscodes.TECHNICAL
+}
 
-	//save new avatar id to datastore
-	userRecord.GetData().AvatarId = newAvatarId
+//nil if there's no size, x and y default to 0
+func getAvatarCropRect(rData *pages.RequestData) (*avatars.CropRect, error) {
+	var err error
 
-	err = datastore.Save(rData.Ctx, userRecord)
-	if err != nil {
-		rData.LogError("failed to save update user record: %v", err)
-		rData.SetHttpStatusResponse(400, statuscodes.MISSINGINFO)
-		return err
+	if rData.HttpRequest.FormValue("size") == "" {
+		return nil, nil
 	}
 
-	//delete the old one
-	oldAvatarId := newAvatarId - 1
+	crop := &avatars.CropRect{}
 
-	if oldAvatarId > 0 {
-		oldFilenameOriginal := avatarFilename(userRecord.GetKey().IntID(), oldAvatarId, "-orig")
-		oldFilenameSmall := avatarFilename(userRecord.GetKey().IntID(), oldAvatarId, "_32")
-		oldFilename := avatarFilename(userRecord.GetKey().IntID(), oldAvatarId, "")
+	if crop.Size, err = strconv.Atoi(rData.HttpRequest.FormValue("size")); err != nil {
+		return nil, err
+	}
+	if rData.HttpRequest.FormValue("x") != "" {
+		if crop.X, err = strconv.Atoi(rData.HttpRequest.FormValue("x")); err != nil {
+			return nil, err
+		}
+	}
+	if rData.HttpRequest.FormValue("y") != "" {
+		if crop.Y, err = strconv.Atoi(rData.HttpRequest.FormValue("y")); err != nil {
+			return nil, err
+		}
+	}
 
-		oldObjectOriginal := bucket.Object(oldFilenameOriginal)
-		oldObjectSmall := bucket.Object(oldFilenameSmall)
-		oldObject := bucket.Object(oldFilename)
+	return crop, nil
+}
 
-		err = oldObjectOriginal.Delete(rData.Ctx)
-		if err != nil {
-			rData.LogError("failed to delete object, but still created new one: %v", err)
+//The url of every rendition (see Config.AVATAR_RENDITIONS) - of the logged in user, or whoever uid is
+//the previous avatars are only listed for the user's own
+func GotAvatarUrlsRequest(rData *pages.RequestData) {
+	userRecord := rData.UserRecord
 
-		}
-		err = oldObjectSmall.Delete(rData.Ctx)
+	if rData.HttpRequest.FormValue("uid") != "" {
+		userId, err := text.StringToInt64(rData.HttpRequest.FormValue("uid"))
 		if err != nil {
-			rData.LogError("failed to delete object, but still created new one: %v", err)
-
+			rData.SetJsonErrorCodeResponse(statuscodes.MISSINGINFO)
+			return
 		}
-		err = oldObject.Delete(rData.Ctx)
-		if err != nil {
-			rData.LogError("failed to delete object, but still created new one: %v", err)
 
+		userRecord = &datastore.UserRecord{}
+		if err := datastore.LoadFromKey(rData.Ctx, userRecord, userId); err != nil {
+			rData.SetJsonErrorCodeResponse(statuscodes.NODATA)
+			return
 		}
+	}
 
+	userId := userRecord.GetKey().IntID()
+	avatarId := userRecord.GetData().AvatarId
+
+	history := []pages.JsonMapGeneric{}
+	if userId == rData.UserRecord.GetKey().IntID() {
+		for _, historyId := range userRecord.GetData().AvatarHistory {
+			history = append(history, pages.JsonMapGeneric{
+				"avid":       strconv.FormatInt(historyId, 10),
+				"renditions": avatars.GetUrls(rData, userId, historyId),
+			})
+		}
 	}
 
-	return nil
+	rData.SetJsonSuccessResponse(pages.JsonMapGeneric{
+		"uid":        userRecord.GetKeyIntAsString(),
+		"avid":       strconv.FormatInt(avatarId, 10),
+		"renditions": avatars.GetUrls(rData, userId, avatarId),
+		"history":    history,
+	})
 }
 
-func avatarFilename(userID int64, avatarID int64, suffix string) string {
-	return strconv.FormatInt(userID, 10) + "/" + strconv.FormatInt(avatarID, 10) + suffix + ".jpg"
+//Serves avatars straight from the store, for when it's not publicly reachable by itself (e.g. blobstore.FileStore in development)
+//the avatar id is part of the name so they never change and can be cached forever
+func GotAvatarServeRequest(rData *pages.RequestData) {
+	name := strings.Trim(strings.Join(rData.ExtraUrlParams, "/"), "/")
+	if !blobstore.IsValidName(name) {
+		rData.SetHttpStatusResponse(404, "not found")
+		return
+	}
+
+	//GCS serves its own public urls
+	store := blobstore.GetAvatarStore(rData)
+	if _, isGcs := store.(*blobstore.GcsStore); isGcs {
+		rData.SetHttpStatusResponse(404, "not found")
+		return
+	}
+
+	reader, contentType, err := store.Open(rData.Ctx, name)
+	if err == blobstore.ErrNotFound || err == blobstore.ErrInvalidName {
+		rData.SetHttpStatusResponse(404, "not found")
+		return
+	} else if err != nil {
+		rData.LogError("failed to open avatar %s: %v", name, err)
+		rData.SetHttpStatusResponse(500, err.Error())
+		return
+	}
+	defer reader.Close()
+
+	rData.HttpStatusResponseBytes, err = ioutil.ReadAll(reader)
+	if err != nil {
+		rData.LogError("failed to read avatar %s: %v", name, err)
+		rData.SetHttpStatusResponse(500, err.Error())
+		return
+	}
+
+	rData.SetContentType(contentType)
+	rData.HttpWriter.Header().Set("Cache-Control", "public, max-age=31536000")
 }
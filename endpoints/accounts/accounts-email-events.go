@@ -0,0 +1,90 @@
+package accounts
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	gaeds "google.golang.org/appengine/datastore"
+
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/email"
+	"github.com/dakom/basic-site-api/lib/pages"
+)
+
+//Inbound SendGrid event webhook - non-2xx makes SendGrid resend the whole batch, which is fine since events are keyed by their id
+func GotEmailEventsWebhook(rData *pages.RequestData) {
+	body, err := ioutil.ReadAll(io.LimitReader(rData.HttpRequest.Body, rData.SiteConfig.MAX_READ_SIZE))
+	if err != nil {
+		rData.SetHttpStatusResponse(400, err.Error())
+		return
+	}
+
+	events, err := email.ParseSendgridEvents(rData, body)
+	if err == email.ErrInvalidSignature {
+		rData.SetHttpStatusResponse(403, err.Error())
+		return
+	} else if err != nil {
+		rData.SetHttpStatusResponse(400, err.Error())
+		return
+	}
+
+	for _, event := range events {
+		if err := email.RecordDeliveryEvent(rData.Ctx, event); err != nil {
+			rData.LogError(err.Error())
+			rData.SetHttpStatusResponse(500, err.Error())
+			return
+		}
+
+		if event.Suppress {
+			if err := markEmailUndeliverable(rData, event); err != nil {
+				rData.LogError(err.Error())
+				rData.SetHttpStatusResponse(500, err.Error())
+				return
+			}
+		}
+	}
+}
+
+//Flags the accounts whose current address it is, so the client can ask for a new one (see UserInfo)
+//by the Email property, the address is only the username for some of them
+func markEmailUndeliverable(rData *pages.RequestData, event *email.DeliveryEvent) error {
+	address := strings.ToLower(strings.TrimSpace(event.Address))
+
+	userRecords, err := datastore.GetUserRecordsViaEmail(rData.Ctx, address)
+	if err != nil {
+		return err
+	}
+
+	for _, userRecord := range userRecords {
+		if userRecord.GetData().EmailUndeliverable {
+			continue
+		}
+
+		//the query result may be stale, so it's set on a freshly loaded record - which may not even have that address anymore
+		err := gaeds.RunInTransaction(rData.Ctx, func(c context.Context) error {
+			var freshRecord datastore.UserRecord
+
+			if err := datastore.LoadFromKey(c, &freshRecord, userRecord.GetKey().IntID()); err != nil {
+				return err
+			}
+
+			if freshRecord.GetData().EmailUndeliverable || strings.ToLower(freshRecord.GetData().Email) != address {
+				return nil
+			}
+
+			freshRecord.GetData().EmailUndeliverable = true
+			freshRecord.GetData().EmailUndeliverableReason = event.Event
+
+			return datastore.Save(c, &freshRecord)
+		}, nil)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
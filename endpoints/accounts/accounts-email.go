@@ -13,6 +13,7 @@ import (
 
 	"github.com/asaskevich/govalidator"
 
+	"github.com/dakom/basic-site-api/lib/audit"
 	"github.com/dakom/basic-site-api/lib/auth"
 	"github.com/dakom/basic-site-api/lib/auth/jwt_scopes"
 	"github.com/dakom/basic-site-api/lib/datastore"
@@ -57,8 +58,10 @@ func GotEmailChangeTokenRequest(rData *pages.RequestData) {
 
 	url := rData.SiteConfig.EMAIL_TARGET_HOSTNAME + pagenames.APP_PAGE_ACCOUNT_ACTION_EMAIL_CHANGE + "/" + jwtString + appUrlParamsFromRequest(rData)
 
-	emailMessage := email.GetEmailChangeEmailAddressMessage(rData.HttpRequest.FormValue("locale"), url)
-	err = email.Send(rData, rData.UserRecord.GetFullName(), emailAddress, emailMessage)
+	emailMessage, err := email.GetEmailChangeEmailAddressMessage(rData.HttpRequest.FormValue("locale"), url)
+	if err == nil {
+		err = email.Queue(rData, rData.UserRecord.GetFullName(), emailAddress, emailMessage)
+	}
 
 	if err != nil {
 		rData.LogError(err.Error())
@@ -107,6 +110,8 @@ func GotEmailChangeActionRequest(rData *pages.RequestData) {
 
 	}
 
+	oldEmailAddress := rData.UserRecord.GetData().Email
+
 	opts := gaeds.TransactionOptions{
 		XG: true,
 	}
@@ -132,6 +137,8 @@ func GotEmailChangeActionRequest(rData *pages.RequestData) {
 
 		//update user's email address
 		rData.UserRecord.GetData().Email = emailAddress
+		rData.UserRecord.GetData().EmailUndeliverable = false
+		rData.UserRecord.GetData().EmailUndeliverableReason = ""
 
 		err = datastore.Save(rData.Ctx, rData.UserRecord)
 		if err != nil {
@@ -166,6 +173,22 @@ func GotEmailChangeActionRequest(rData *pages.RequestData) {
 		return
 	}
 
+	//they got the token at the new address, so it isn't undeliverable (anymore) - non-critical
+	if err := email.Unsuppress(rData.Ctx, emailAddress); err != nil {
+		rData.LogError("email unsuppress error %v", err)
+	}
+
+	audit.Record(rData, datastore.AUDIT_EVENT_EMAIL_CHANGED, rData.UserRecord.GetKey().IntID(), map[string]interface{}{"old": oldEmailAddress, "new": emailAddress})
+
+	if oldEmailAddress != "" {
+		notifyParams := url.Values{}
+		notifyParams.Set("old", oldEmailAddress)
+		notifyParams.Set("new", emailAddress)
+		if err := email.QueueNotification(rData, rData.UserRecord, email.NOTIFY_EMAIL_CHANGED, notifyParams); err != nil {
+			rData.LogError("TaskQueue non-critical (notification) error %v", err)
+		}
+	}
+
 	rData.SetJsonSuccessCodeResponse(statuscodes.EMAIL_CHANGED)
 
 	rData.DeleteJwtWhenFinished = true
@@ -0,0 +1,123 @@
+package accounts
+
+import (
+	"strings"
+
+	"github.com/dakom/basic-site-api/lib/audit"
+	"github.com/dakom/basic-site-api/lib/auth"
+	"github.com/dakom/basic-site-api/lib/auth/jwt_scopes"
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/email"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/setup/config/static/pagenames"
+	"github.com/dakom/basic-site-api/setup/config/static/statuscodes"
+)
+
+//"email me a login link" - works for pending accounts too, since following the link proves the address
+func SendLoginLinkRequest(rData *pages.RequestData) {
+	username := strings.ToLower(strings.TrimSpace(rData.HttpRequest.FormValue("uname")))
+	if len(username) < 1 {
+		rData.SetJsonErrorCodeResponse(statuscodes.MISSING_USERNAME)
+		return
+	}
+
+	if strings.HasPrefix(username, rData.SiteConfig.OAUTH_USERID_PREFIX) {
+		rData.SetJsonErrorCodeResponse(statuscodes.NOUSERNAME)
+		return
+	}
+
+	userRecord, err := GetUserRecordViaUsername(rData.Ctx, username)
+	if err != nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+	if userRecord == nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.NOUSERNAME)
+		return
+	}
+
+	if !userRecord.IsStatusActive() && !userRecord.IsStatusPending() {
+		rData.SetJsonErrorCodeResponse(GetUserStatusCode(userRecord))
+		return
+	}
+
+	emailAddress := userRecord.GetData().Email
+
+	//same as password reset - subaccounts go through the parent's address
+	if userRecord.GetData().ParentId != 0 {
+		parentRecord, err := GetUserRecordViaKey(rData.Ctx, userRecord.GetData().ParentId)
+		if err != nil {
+			rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+			return
+		} else if parentRecord == nil {
+			rData.SetJsonErrorCodeResponse(statuscodes.MISSINGINFO)
+			return
+		}
+
+		emailAddress = parentRecord.GetData().Email
+	}
+
+	_, jwtString, err := auth.GetNewUserOobJWT(rData, userRecord, jwt_scopes.OOB_USER_LOGIN, nil)
+	if err != nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+
+	url := rData.SiteConfig.EMAIL_TARGET_HOSTNAME + pagenames.APP_PAGE_ACCOUNT_ACTION_LOGIN + "/" + jwtString + appUrlParamsFromRequest(rData)
+
+	emailMessage, err := email.GetEmailLoginLinkMessage(rData.HttpRequest.FormValue("locale"), url)
+	if err == nil {
+		err = email.Queue(rData, userRecord.GetFullName(), emailAddress, emailMessage)
+	}
+
+	if err != nil {
+		rData.LogError(err.Error())
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+
+	rData.SetJsonSuccessCodeResponse(statuscodes.CHECK_EMAIL)
+}
+
+//The link's jwt is single use and swapped for a regular login jwt (aud as for account/login)
+func GotLoginLinkRequest(rData *pages.RequestData) {
+	audience := strings.ToLower(strings.TrimSpace(rData.HttpRequest.FormValue("aud")))
+	if audience != auth.JWT_AUDIENCE_APP && audience != auth.JWT_AUDIENCE_COOKIE {
+		rData.SetJsonErrorCodeResponse(statuscodes.MISSINGINFO)
+		return
+	}
+
+	//not DeleteJwtWhenFinished - DestroyToken would also wipe the login cookie we're about to set
+	if err := datastore.Delete(rData.Ctx, rData.JwtRecord); err != nil {
+		rData.LogError(err.Error())
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+
+	userRecord := rData.UserRecord
+
+	if userRecord.IsStatusPending() {
+		if err := ActivateUser(rData.Ctx, userRecord); err != nil {
+			rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+			return
+		}
+
+		audit.Record(rData, datastore.AUDIT_EVENT_ACTIVATED, userRecord.GetKey().IntID(), map[string]interface{}{"via": "login-link"})
+
+		queueMailingListSubscribe(rData, userRecord)
+	}
+
+	//the link was mailed to them as well
+	unsuppressVerifiedEmail(rData, userRecord)
+
+	_, jwtString, err := issueLogin(rData, userRecord, audience, "link")
+	if err != nil {
+		rData.SetJsonErrorCodeResponse(err.Error())
+		return
+	}
+
+	userInfo := GetUserInfoFromRecord(userRecord)
+	userInfo.SetJwt(jwtString)
+
+	rData.SetJsonSuccessCodeWithDataResponse(statuscodes.LOGIN_COMPLETED, userInfo)
+}
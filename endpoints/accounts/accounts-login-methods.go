@@ -0,0 +1,169 @@
+package accounts
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	gaeds "google.golang.org/appengine/datastore"
+
+	"github.com/dakom/basic-site-api/lib/audit"
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/lib/utils/slice"
+	"github.com/dakom/basic-site-api/setup/config/static/statuscodes"
+)
+
+type LoginMethodInfo struct {
+	Username string `json:"uname"`
+	Type     string `json:"type"`               //"password", "phone" or "oauth"
+	Provider string `json:"provider,omitempty"` //only for oauth
+}
+
+func GetLoginMethodInfos(rData *pages.RequestData, userRecord *datastore.UserRecord) []*LoginMethodInfo {
+	lookups := userRecord.GetData().UsernameLookups
+	infos := make([]*LoginMethodInfo, len(lookups))
+
+	for idx, username := range lookups {
+		if provider, ok := getOauthProviderFromUsername(rData, username); ok {
+			infos[idx] = &LoginMethodInfo{Username: username, Type: "oauth", Provider: provider}
+		} else if username == userRecord.GetData().Phone {
+			infos[idx] = &LoginMethodInfo{Username: username, Type: "phone"}
+		} else {
+			infos[idx] = &LoginMethodInfo{Username: username, Type: "password"}
+		}
+	}
+
+	return infos
+}
+
+func GotLoginMethodsListRequest(rData *pages.RequestData) {
+	rData.SetJsonSuccessResponse(pages.JsonMapGeneric{
+		"methods": GetLoginMethodInfos(rData, rData.UserRecord),
+	})
+}
+
+//Only oauth identities can be unlinked, and only if there's still some other way to log in afterwards
+func GotLoginMethodUnlinkRequest(rData *pages.RequestData) {
+	username := strings.TrimSpace(rData.HttpRequest.FormValue("uname"))
+
+	provider, ok := getOauthProviderFromUsername(rData, username)
+	if !ok || !slice.StringInSlice(username, rData.UserRecord.GetData().UsernameLookups) {
+		rData.SetJsonErrorCodeResponse(statuscodes.IDENTITY_NOT_FOUND)
+		return
+	}
+
+	if len(rData.UserRecord.GetData().UsernameLookups) < 2 {
+		rData.SetJsonErrorCodeResponse(statuscodes.LAST_LOGIN_METHOD)
+		return
+	}
+
+	opts := gaeds.TransactionOptions{
+		XG: true,
+	}
+
+	err := gaeds.RunInTransaction(rData.Ctx, func(c context.Context) error {
+		var lookupRecord datastore.UsernameLookupRecord
+
+		err := datastore.LoadFromKey(c, &lookupRecord, username)
+		if err == nil {
+			//sanity check - never delete someone else's lookup
+			if lookupRecord.GetData().UserId != rData.UserRecord.GetKey().IntID() {
+				return errors.New(statuscodes.IDENTITY_EXISTS)
+			}
+			if err := datastore.Delete(c, &lookupRecord); err != nil {
+				return err
+			}
+		} else if err != gaeds.ErrNoSuchEntity {
+			return err
+		}
+
+		rData.UserRecord.GetData().UsernameLookups, _ = slice.DeleteFromString(rData.UserRecord.GetData().UsernameLookups, username)
+
+		return datastore.Save(c, rData.UserRecord)
+	}, &opts)
+
+	if err != nil {
+		if err.Error() == statuscodes.IDENTITY_EXISTS {
+			rData.SetJsonErrorCodeResponse(statuscodes.IDENTITY_EXISTS)
+		} else {
+			rData.LogError(err.Error())
+			rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		}
+		return
+	}
+
+	audit.Record(rData, datastore.AUDIT_EVENT_OAUTH_UNLINKED, rData.UserRecord.GetKey().IntID(), map[string]interface{}{"provider": provider})
+
+	deleteProviderToken(rData, rData.UserRecord.GetKey().IntID(), provider, username)
+
+	rData.SetJsonSuccessCodeWithDataResponse(statuscodes.IDENTITY_UNLINKED, pages.JsonMapGeneric{
+		"methods": GetLoginMethodInfos(rData, rData.UserRecord),
+	})
+}
+
+//Adds another UsernameLookupRecord pointing at userRecord
+//returned error is a statuscode
+func LinkLoginMethod(rData *pages.RequestData, userRecord *datastore.UserRecord, username string, provider string) error {
+	userId := userRecord.GetKey().IntID()
+
+	opts := gaeds.TransactionOptions{
+		XG: true,
+	}
+
+	err := gaeds.RunInTransaction(rData.Ctx, func(c context.Context) error {
+		var lookupRecord datastore.UsernameLookupRecord
+
+		err := datastore.LoadFromKey(c, &lookupRecord, username)
+		if err == nil {
+			if lookupRecord.GetData().UserId != userId {
+				return errors.New(statuscodes.IDENTITY_EXISTS)
+			}
+			//already linked to this user, nothing to do for the lookup itself
+		} else if err == gaeds.ErrNoSuchEntity {
+			lookupRecord.GetData().UserId = userId
+			if err := datastore.SaveToKey(c, &lookupRecord, username); err != nil {
+				return err
+			}
+		} else {
+			return err
+		}
+
+		if !slice.StringInSlice(username, userRecord.GetData().UsernameLookups) {
+			userRecord.GetData().UsernameLookups = append(userRecord.GetData().UsernameLookups, username)
+			if err := datastore.Save(c, userRecord); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, &opts)
+
+	if err != nil {
+		if err.Error() == statuscodes.IDENTITY_EXISTS {
+			return err
+		}
+		rData.LogError(err.Error())
+		return errors.New(statuscodes.TECHNICAL)
+	}
+
+	audit.Record(rData, datastore.AUDIT_EVENT_OAUTH_LINKED, userId, map[string]interface{}{"provider": provider, "via": "link"})
+
+	return nil
+}
+
+//oauth usernames look like PREFIX-provider-id
+func getOauthProviderFromUsername(rData *pages.RequestData, username string) (string, bool) {
+	prefix := rData.SiteConfig.OAUTH_USERID_PREFIX + "-"
+	if rData.SiteConfig.OAUTH_USERID_PREFIX == "" || !strings.HasPrefix(username, prefix) {
+		return "", false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(username, prefix), "-", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+
+	return parts[0], true
+}
@@ -4,9 +4,11 @@ import (
 	"errors"
 	"strings"
 
+	"github.com/dakom/basic-site-api/lib/audit"
 	"github.com/dakom/basic-site-api/lib/auth"
 	"github.com/dakom/basic-site-api/lib/datastore"
 	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/lib/sms"
 	"github.com/dakom/basic-site-api/lib/utils/cipher"
 	"github.com/dakom/basic-site-api/setup/config/static/statuscodes"
 )
@@ -17,21 +19,19 @@ func GotLoginServiceRequest(rData *pages.RequestData) {
 	password := rData.HttpRequest.FormValue("pw")
 	audience := strings.ToLower(strings.TrimSpace(rData.HttpRequest.FormValue("aud"))) //for web environments, we might want to allow setting this to cookie...
 
-	userRecord, userInfo, _, jwtString, err := DoLogin(rData, username, password, audience, LOOKUP_TYPE_USERNAME)
+	_, userInfo, _, jwtString, err := DoLogin(rData, username, password, audience, LOOKUP_TYPE_USERNAME)
 
-	if err != nil {
-
-		if userRecord == nil {
-
-			rData.SetJsonErrorCodeResponse(err.Error()) //nousername
-		} else {
-			rData.SetJsonErrorCodeWithDataResponse(err.Error(), userInfo)
-		}
+	setLoginResponse(rData, userInfo, jwtString, err)
+}
 
+//Nothing about the user unless they got in - the username can be anyone's email or phone number
+func setLoginResponse(rData *pages.RequestData, userInfo *UserInfo, jwtString string, err error) {
+	if err != nil {
+		rData.SetJsonErrorCodeResponse(err.Error())
 		return
 	}
 
-        userInfo.SetJwt(jwtString)
+	userInfo.SetJwt(jwtString)
 
 	rData.SetJsonSuccessResponse(userInfo)
 }
@@ -46,6 +46,13 @@ func DoLogin(rData *pages.RequestData, username string, password string, audienc
 		return nil, nil, nil, "", errors.New(statuscodes.NOUSERNAME)
 	}
 
+	//verified phone numbers are stored as E.164 lookups, whatever the formatting here
+	if lookupType != LOOKUP_TYPE_OAUTH {
+		if phone, ok := sms.NormalizePhone(username); ok {
+			username = phone
+		}
+	}
+
 	userRecord, err := GetUserRecordViaUsername(rData.Ctx, username)
 	if err != nil {
 		rData.LogError(err.Error())
@@ -53,35 +60,58 @@ func DoLogin(rData *pages.RequestData, username string, password string, audienc
 	}
 
 	if userRecord == nil {
+		audit.RecordWithActor(rData, datastore.AUDIT_EVENT_LOGIN_FAILED, 0, 0, map[string]interface{}{"reason": statuscodes.NOUSERNAME, "method": loginMethodName(lookupType), "uname": username})
 		return nil, nil, nil, "", errors.New(statuscodes.NOUSERNAME)
 
 	}
 
-        userInfo := GetUserInfoFromRecord(userRecord)
-
-	if !userRecord.GetData().IsActive {
-		return userRecord, userInfo, nil, "", errors.New(statuscodes.NOT_ACTIVATED)
+	//no UserInfo until they're in, so it can't end up in an error response
+	if !userRecord.IsStatusActive() {
+		audit.Record(rData, datastore.AUDIT_EVENT_LOGIN_FAILED, userRecord.GetKey().IntID(), map[string]interface{}{"reason": GetUserStatusCode(userRecord), "method": loginMethodName(lookupType)})
+		return userRecord, nil, nil, "", errors.New(GetUserStatusCode(userRecord))
 	}
 
 	if lookupType != LOOKUP_TYPE_OAUTH {
 		if len(password) < 1 {
-			return userRecord, userInfo, nil, "", errors.New(statuscodes.MISSING_PASSWORD)
+			return userRecord, nil, nil, "", errors.New(statuscodes.MISSING_PASSWORD)
 		}
 
 		if !cipher.ComparePWHash(password, userRecord.GetData().Password) {
-			return userRecord, userInfo, nil, "", errors.New(statuscodes.WRONG_PASSWORD)
+			audit.Record(rData, datastore.AUDIT_EVENT_LOGIN_FAILED, userRecord.GetKey().IntID(), map[string]interface{}{"reason": statuscodes.WRONG_PASSWORD, "method": loginMethodName(lookupType)})
+			return userRecord, nil, nil, "", errors.New(statuscodes.WRONG_PASSWORD)
 		}
 	}
 
+	jwtRecord, jwtString, err := issueLogin(rData, userRecord, audience, loginMethodName(lookupType))
+	if err != nil {
+		return userRecord, nil, nil, "", err
+	}
+
+	return userRecord, GetUserInfoFromRecord(userRecord), jwtRecord, jwtString, nil
+}
+
+//Issues the login jwt (and cookie) once the user has been verified, whichever way that was
+func issueLogin(rData *pages.RequestData, userRecord *datastore.UserRecord, audience string, method string) (*datastore.JwtRecord, string, error) {
 	jwtRecord, jwtString, err := auth.GetNewLoginJWT(rData, userRecord, audience)
 
 	if err != nil {
-		return userRecord, userInfo, nil, "", errors.New(statuscodes.TECHNICAL)
+		return nil, "", errors.New(statuscodes.TECHNICAL)
 	}
 
 	if audience == auth.JWT_AUDIENCE_COOKIE {
 		auth.SetJWTCookie(rData, jwtString, jwtRecord.GetData().SessionId, int(auth.GetFinalDurationByAudience(jwtRecord.GetData().Audience)))
 	}
 
-	return userRecord, userInfo, jwtRecord, jwtString, nil
+	//nobody is logged in yet, but they just proved who they are
+	audit.RecordWithActor(rData, datastore.AUDIT_EVENT_LOGIN, userRecord.GetKey().IntID(), userRecord.GetKey().IntID(), map[string]interface{}{"method": method, "aud": audience})
+	checkLoginDevice(rData, userRecord, audience)
+
+	return jwtRecord, jwtString, nil
+}
+
+func loginMethodName(lookupType int64) string {
+	if lookupType == LOOKUP_TYPE_OAUTH {
+		return "oauth"
+	}
+	return "password"
 }
@@ -0,0 +1,60 @@
+package accounts
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/setup/config/static/statuscodes"
+)
+
+func TestSetLoginResponse(t *testing.T) {
+	userInfo := func() *UserInfo {
+		return &UserInfo{
+			Id:          "1234",
+			Email:       "victim@example.com",
+			Phone:       "+15551234567",
+			FirstName:   "Victoria",
+			LastName:    "Tim",
+			DisplayName: "Victoria T",
+			AvatarId:    "7",
+		}
+	}
+	private := []string{"1234", "victim@example.com", "+15551234567", "Victoria", "Tim", "uid", "email", "phone"}
+
+	for _, code := range []string{statuscodes.WRONG_PASSWORD, statuscodes.NOT_ACTIVATED, statuscodes.MISSING_PASSWORD, statuscodes.NOUSERNAME, statuscodes.TECHNICAL} {
+		rData := &pages.RequestData{}
+
+		//even if a UserInfo is handed over
+		setLoginResponse(rData, userInfo(), "", errors.New(code))
+
+		if rData.HttpStatusResponseCode != 400 {
+			t.Errorf("%s: expected a 400, got %d", code, rData.HttpStatusResponseCode)
+		}
+
+		response, err := rData.JsonResponse.GetString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(response, code) {
+			t.Errorf("%s: the code is missing from %s", code, response)
+		}
+		for _, value := range private {
+			if strings.Contains(response, value) {
+				t.Errorf("%s: %q is in the response %s", code, value, response)
+			}
+		}
+	}
+
+	rData := &pages.RequestData{}
+	setLoginResponse(rData, userInfo(), "the.jwt", nil)
+
+	response, err := rData.JsonResponse.GetString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rData.HttpStatusResponseCode != 200 || !strings.Contains(response, "victim@example.com") || !strings.Contains(response, "the.jwt") {
+		t.Errorf("successful login got %d %s", rData.HttpStatusResponseCode, response)
+	}
+}
@@ -0,0 +1,106 @@
+package accounts
+
+import (
+	"time"
+
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/email"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/lib/utils/text"
+	"github.com/dakom/basic-site-api/setup/config/static/statuscodes"
+)
+
+type MailingListResyncInfo struct {
+	Job         string   `json:"job"`
+	Status      string   `json:"status"`
+	DryRun      bool     `json:"dry"`
+	ActiveOnly  bool     `json:"active"`
+	CullPending bool     `json:"cull"`
+	AddedAfter  int64    `json:"after,omitempty"` //unix seconds
+	Checked     int      `json:"checked"`
+	InSync      int      `json:"insync"`
+	Drifted     int      `json:"drifted"`
+	Failed      int      `json:"failed"`
+	Changes     []string `json:"changes"`
+	LastError   string   `json:"error,omitempty"`
+	Date        int64    `json:"date"`
+	UpdatedDate int64    `json:"updated"`
+}
+
+func GetMailingListResyncInfo(record *datastore.MailingListResyncRecord) *MailingListResyncInfo {
+	data := record.GetData()
+
+	info := &MailingListResyncInfo{
+		Job:         record.GetKeyIntAsString(),
+		Status:      data.Status,
+		DryRun:      data.DryRun,
+		ActiveOnly:  data.ActiveOnly,
+		CullPending: data.CullPending,
+		Checked:     data.Checked,
+		InSync:      data.InSync,
+		Drifted:     data.Drifted,
+		Failed:      data.Failed,
+		Changes:     data.Changes,
+		LastError:   data.LastError,
+		Date:        data.Date.Unix(),
+		UpdatedDate: data.UpdatedDate.Unix(),
+	}
+	if !data.AddedAfter.IsZero() {
+		info.AddedAfter = data.AddedAfter.Unix()
+	}
+	if info.Changes == nil {
+		info.Changes = []string{}
+	}
+
+	return info
+}
+
+//Reconciles users with the mailing list provider, see email.StartMailingListResync
+//it's a dry run unless dry=false, active=true skips users who never activated, cull=true takes them off the list instead
+//after=unix seconds only looks at users added since then
+func GotAdminMailingListResyncStartRequest(rData *pages.RequestData) {
+	options := &email.MailingListResyncOptions{
+		DryRun:      rData.HttpRequest.FormValue("dry") != "false",
+		ActiveOnly:  rData.HttpRequest.FormValue("active") == "true",
+		CullPending: rData.HttpRequest.FormValue("cull") == "true",
+	}
+
+	if rData.HttpRequest.FormValue("after") != "" {
+		after, err := text.StringToInt64(rData.HttpRequest.FormValue("after"))
+		if err != nil {
+			rData.SetJsonErrorCodeResponse(statuscodes.MISSINGINFO)
+			return
+		}
+		options.AddedAfter = time.Unix(after, 0)
+	}
+
+	record, err := email.StartMailingListResync(rData, options)
+	if err != nil {
+		rData.LogError(err.Error())
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+
+	rData.SetJsonSuccessResponse(pages.JsonMapGeneric{
+		"resync": GetMailingListResyncInfo(record),
+	})
+}
+
+func GotAdminMailingListResyncReportRequest(rData *pages.RequestData) {
+	var record datastore.MailingListResyncRecord
+
+	jobId, err := text.StringToInt64(rData.HttpRequest.FormValue("job"))
+	if err != nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.MISSINGINFO)
+		return
+	}
+
+	if err := datastore.LoadFromKey(rData.Ctx, &record, jobId); err != nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.NODATA)
+		return
+	}
+
+	rData.SetJsonSuccessResponse(pages.JsonMapGeneric{
+		"resync": GetMailingListResyncInfo(&record),
+	})
+}
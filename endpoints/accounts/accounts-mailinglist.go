@@ -0,0 +1,255 @@
+package accounts
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine/taskqueue"
+
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/email"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/setup/config/static/pagenames"
+	"github.com/dakom/basic-site-api/setup/config/static/statuscodes"
+)
+
+type MailingListSettingsInfo struct {
+	Subscribed bool            `json:"subscribed"`
+	Interests  map[string]bool `json:"interests"` //only the ones users may change
+}
+
+func GetMailingListSettingsInfo(rData *pages.RequestData, userRecord *datastore.UserRecord) *MailingListSettingsInfo {
+	info := &MailingListSettingsInfo{
+		Subscribed: !userRecord.GetData().UserMailinglistData.Unsubscribed,
+		Interests:  make(map[string]bool),
+	}
+
+	for _, name := range email.GetMailingListUserInterests(rData) {
+		info.Interests[name] = email.HasMailingListInterest(userRecord, name)
+	}
+
+	return info
+}
+
+func GotMailingListSettingsRequest(rData *pages.RequestData) {
+	rData.SetJsonSuccessResponse(pages.JsonMapGeneric{
+		"mailinglist": GetMailingListSettingsInfo(rData, rData.UserRecord),
+	})
+}
+
+//subscribed=true|false and/or interests=comma separated names of *all* wanted interests (empty for none)
+func GotMailingListSettingsChangeRequest(rData *pages.RequestData) {
+	prefs := &rData.UserRecord.GetData().UserMailinglistData
+	subscriptionChanged := false
+	interestsChanged := false
+	missingInfo := true
+
+	if val := rData.HttpRequest.FormValue("subscribed"); val != "" {
+		unsubscribed := (val != "true")
+		if unsubscribed != prefs.Unsubscribed {
+			prefs.Unsubscribed = unsubscribed
+			if unsubscribed {
+				prefs.UnsubscribedDate = time.Now()
+			}
+			subscriptionChanged = true
+		}
+		missingInfo = false
+	}
+
+	//FormValue can't tell an empty list from a missing one
+	if _, sent := rData.HttpRequest.Form["interests"]; sent {
+		wanted := make(map[string]bool)
+		for _, name := range strings.Split(rData.HttpRequest.FormValue("interests"), ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			if !email.IsMailingListUserInterest(rData, name) {
+				rData.SetJsonErrorCodeResponse(statuscodes.INVALID_INTEREST)
+				return
+			}
+			wanted[name] = true
+		}
+
+		for _, name := range email.GetMailingListUserInterests(rData) {
+			if email.HasMailingListInterest(rData.UserRecord, name) != wanted[name] {
+				email.SetMailingListInterest(rData.UserRecord, name, wanted[name])
+				interestsChanged = true
+			}
+		}
+		missingInfo = false
+	}
+
+	if missingInfo {
+		rData.SetJsonErrorCodeResponse(statuscodes.MISSINGINFO)
+		return
+	}
+
+	if subscriptionChanged || interestsChanged {
+		if err := datastore.Save(rData.Ctx, rData.UserRecord); err != nil {
+			rData.LogError(err.Error())
+			rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+			return
+		}
+
+		//(re)subscribing sends the interests along, and unsubscribed contacts get them when they come back
+		if subscriptionChanged {
+			queueMailingListUpdate(rData, rData.UserRecord, pagenames.MAILINGLIST_UPDATE_SUBSCRIPTION_WEBHOOK)
+		} else if !prefs.Unsubscribed {
+			queueMailingListUpdate(rData, rData.UserRecord, pagenames.MAILINGLIST_UPDATE_INTERESTS_WEBHOOK)
+		}
+	}
+
+	rData.SetJsonSuccessCodeWithDataResponse(statuscodes.MAILINGLIST_CHANGED, pages.JsonMapGeneric{
+		"mailinglist": GetMailingListSettingsInfo(rData, rData.UserRecord),
+	})
+}
+
+//One-click unsubscribe via the signed token from email.GetMailingListUnsubscribeToken, no login needed
+//Mail clients POST here directly for List-Unsubscribe-Post (token in the path, see email.GetMailingListUnsubscribeHeaderUrl), so repeating it is fine
+//the app posts it as "token" instead. Only a POST does anything - link scanners and prefetchers GET whatever is in an email (RFC 8058)
+func GotMailingListUnsubscribeRequest(rData *pages.RequestData) {
+	var userRecord datastore.UserRecord
+
+	if rData.HttpRequest.Method != "POST" {
+		rData.SetJsonErrorCodeResponse(statuscodes.MISSINGINFO)
+		return
+	}
+
+	token := strings.Trim(strings.Join(rData.ExtraUrlParams, "/"), "/")
+	if token == "" {
+		token = rData.HttpRequest.PostFormValue("token")
+	}
+
+	userId, ok := email.ValidateMailingListUnsubscribeToken(rData, token)
+	if !ok {
+		rData.SetJsonErrorCodeResponse(statuscodes.AUTH_OOB)
+		return
+	}
+
+	if err := datastore.LoadFromKey(rData.Ctx, &userRecord, userId); err != nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.AUTH_OOB)
+		return
+	}
+
+	prefs := &userRecord.GetData().UserMailinglistData
+	if !prefs.Unsubscribed {
+		prefs.Unsubscribed = true
+		prefs.UnsubscribedDate = time.Now()
+
+		if err := datastore.Save(rData.Ctx, &userRecord); err != nil {
+			rData.LogError(err.Error())
+			rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+			return
+		}
+
+		queueMailingListUpdate(rData, &userRecord, pagenames.MAILINGLIST_UPDATE_SUBSCRIPTION_WEBHOOK)
+	}
+
+	rData.SetJsonSuccessCodeResponse(statuscodes.UNSUBSCRIBED)
+}
+
+//non-critical, errors are only logged
+func queueMailingListUpdate(rData *pages.RequestData, userRecord *datastore.UserRecord, webhook string) {
+	params := url.Values{}
+	params.Set("uid", strconv.FormatInt(userRecord.GetKey().IntID(), 10))
+
+	mailingListTask := taskqueue.NewPOSTTask("/"+webhook, params)
+	if _, err := taskqueue.Add(rData.Ctx, mailingListTask, rData.SiteConfig.TASKQUEUE_MAILINGLIST); err != nil {
+		rData.LogError("%v", err)
+	}
+}
+
+//Inbound provider webhooks - these only ever change our own state and never queue anything back to the provider
+//non-2xx makes the provider retry, so that's only for errors which might go away
+
+//Mailchimp checks the url with a GET when the webhook is set up
+func GotMailchimpWebhook(rData *pages.RequestData) {
+	if err := email.ValidateMailingListWebhookKey(rData); err != nil {
+		rData.SetHttpStatusResponse(403, err.Error())
+		return
+	}
+
+	if rData.HttpRequest.Method != "POST" {
+		return
+	}
+
+	event, err := email.ParseMailchimpWebhook(rData)
+	if err != nil {
+		rData.SetHttpStatusResponse(400, err.Error())
+		return
+	}
+
+	if event != nil {
+		if err := applyMailingListEvent(rData, event); err != nil {
+			rData.LogError(err.Error())
+			rData.SetHttpStatusResponse(500, err.Error())
+			return
+		}
+	}
+}
+
+func GotConstantContactWebhook(rData *pages.RequestData) {
+	events, err := email.ParseConstantContactWebhook(rData)
+	if err == email.ErrInvalidWebhookKey {
+		rData.SetHttpStatusResponse(403, err.Error())
+		return
+	} else if err != nil {
+		rData.SetHttpStatusResponse(400, err.Error())
+		return
+	}
+
+	for _, event := range events {
+		if err := applyMailingListEvent(rData, event); err != nil {
+			rData.LogError(err.Error())
+			rData.SetHttpStatusResponse(500, err.Error())
+			return
+		}
+	}
+}
+
+//Unknown contacts are ignored, they may have signed up to the list some other way
+func applyMailingListEvent(rData *pages.RequestData, event *email.MailingListEvent) error {
+	userRecord, err := getUserRecordForMailingListEvent(rData, event)
+	if err != nil || userRecord == nil {
+		return err
+	}
+
+	prefs := &userRecord.GetData().UserMailinglistData
+	unsubscribed := (event.Type == email.MAILINGLIST_EVENT_UNSUBSCRIBE)
+
+	if prefs.Unsubscribed == unsubscribed {
+		return nil
+	}
+
+	prefs.Unsubscribed = unsubscribed
+	if unsubscribed {
+		prefs.UnsubscribedDate = time.Now()
+	}
+
+	rData.LogInfo("mailing list %s for user %d via %s: %s", event.Type, userRecord.GetKey().IntID(), event.Provider, event.Reason)
+
+	return datastore.Save(rData.Ctx, userRecord)
+}
+
+//ids first since the address may have changed on either side, and only the current address counts
+func getUserRecordForMailingListEvent(rData *pages.RequestData, event *email.MailingListEvent) (*datastore.UserRecord, error) {
+	for _, mailingListId := range event.MailingListIds {
+		userRecord, err := datastore.GetUserRecordViaMailingListId(rData.Ctx, mailingListId)
+		if err != nil || userRecord != nil {
+			return userRecord, err
+		}
+	}
+
+	if event.Email == "" {
+		return nil, nil
+	}
+
+	userRecord, err := GetUserRecordViaUsername(rData.Ctx, event.Email)
+	if err != nil || userRecord == nil || !strings.EqualFold(userRecord.GetData().Email, event.Email) {
+		return nil, err
+	}
+
+	return userRecord, nil
+}
@@ -0,0 +1,63 @@
+package accounts
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/dakom/basic-site-api/lib/email"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/setup/config/custom"
+	"github.com/dakom/basic-site-api/setup/config/static/statuscodes"
+)
+
+//only the requests which are turned away before the datastore (which would need a real context)
+func TestGotMailingListUnsubscribeRequest(t *testing.T) {
+	siteConfig := &custom.Config{MAILINGLIST_UNSUBSCRIBE_KEY: "secret"}
+
+	token, err := email.GetMailingListUnsubscribeToken(&pages.RequestData{SiteConfig: siteConfig}, 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oneClick := url.Values{"List-Unsubscribe": {"One-Click"}}.Encode()
+
+	tests := []struct {
+		name      string
+		method    string
+		target    string
+		extraPath []string
+		body      string
+		code      string
+	}{
+		{"GET with the token in the path", "GET", "/account/mailinglist-unsubscribe/" + token, []string{"", token}, "", statuscodes.MISSINGINFO},
+		{"GET with the token in the query", "GET", "/account/mailinglist-unsubscribe?token=" + token, nil, "", statuscodes.MISSINGINFO},
+		{"HEAD", "HEAD", "/account/mailinglist-unsubscribe/" + token, []string{"", token}, "", statuscodes.MISSINGINFO},
+		{"POST with the token only in the query", "POST", "/account/mailinglist-unsubscribe?token=" + token, nil, oneClick, statuscodes.AUTH_OOB},
+		{"POST without a token", "POST", "/account/mailinglist-unsubscribe", nil, oneClick, statuscodes.AUTH_OOB},
+		{"POST with a bad token in the path", "POST", "/account/mailinglist-unsubscribe/1234-AAAA", []string{"", "1234-AAAA"}, oneClick, statuscodes.AUTH_OOB},
+		{"POST with a bad token in the body", "POST", "/account/mailinglist-unsubscribe", nil, "token=1234-AAAA", statuscodes.AUTH_OOB},
+	}
+
+	for _, test := range tests {
+		httpRequest := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+		httpRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rData := &pages.RequestData{
+			HttpRequest:    httpRequest,
+			SiteConfig:     siteConfig,
+			ExtraUrlParams: test.extraPath,
+		}
+
+		GotMailingListUnsubscribeRequest(rData)
+
+		response, err := rData.JsonResponse.GetString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rData.HttpStatusResponseCode != 400 || !strings.Contains(response, `"`+test.code+`"`) {
+			t.Errorf("%s: expected %s, got %d %s", test.name, test.code, rData.HttpStatusResponseCode, response)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package accounts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/dakom/basic-site-api/lib/auth"
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/email"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/lib/utils/text"
+	"github.com/dakom/basic-site-api/setup/config/static/statuscodes"
+)
+
+const MAX_KNOWN_DEVICES int = 20
+
+const DEVICE_ID_LENGTH = 16
+const DEVICE_COOKIE_DEFAULT_NAME = "device"
+const DEVICE_COOKIE_MAX_AGE int = 60 * 60 * 24 * 365 * 2
+
+type NotificationSettingsInfo struct {
+	Login    bool `json:"login"`
+	Password bool `json:"password"`
+	Email    bool `json:"email"`
+}
+
+func GetNotificationSettingsInfo(userRecord *datastore.UserRecord) *NotificationSettingsInfo {
+	prefs := userRecord.GetData().UserNotificationData
+
+	return &NotificationSettingsInfo{
+		Login:    !prefs.MuteLoginNotices,
+		Password: !prefs.MutePasswordNotices,
+		Email:    !prefs.MuteEmailNotices,
+	}
+}
+
+func GotNotificationSettingsRequest(rData *pages.RequestData) {
+	rData.SetJsonSuccessResponse(pages.JsonMapGeneric{
+		"notifications": GetNotificationSettingsInfo(rData.UserRecord),
+	})
+}
+
+//only the params which are sent get changed, e.g. login=false leaves password and email as-is
+func GotNotificationSettingsChangeRequest(rData *pages.RequestData) {
+	prefs := &rData.UserRecord.GetData().UserNotificationData
+	missingInfo := true
+
+	if val := rData.HttpRequest.FormValue("login"); val != "" {
+		prefs.MuteLoginNotices = (val != "true")
+		missingInfo = false
+	}
+	if val := rData.HttpRequest.FormValue("password"); val != "" {
+		prefs.MutePasswordNotices = (val != "true")
+		missingInfo = false
+	}
+	if val := rData.HttpRequest.FormValue("email"); val != "" {
+		prefs.MuteEmailNotices = (val != "true")
+		missingInfo = false
+	}
+
+	if missingInfo {
+		rData.SetJsonErrorCodeResponse(statuscodes.MISSINGINFO)
+		return
+	}
+
+	if err := datastore.Save(rData.Ctx, rData.UserRecord); err != nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+
+	rData.SetJsonSuccessCodeWithDataResponse(statuscodes.NOTIFICATIONS_CHANGED, pages.JsonMapGeneric{
+		"notifications": GetNotificationSettingsInfo(rData.UserRecord),
+	})
+}
+
+//Remembers the device for this request and queues a notice if it hasn't been seen before
+//The very first login isn't considered "new" since there's nothing to compare against
+//Devices are told apart by a long-lived random cookie, the user agent hash only identifies clients without a cookie jar (see rememberDevice)
+func checkLoginDevice(rData *pages.RequestData, userRecord *datastore.UserRecord, audience string) {
+	uaHash := getUserAgentHash(rData)
+	deviceId := getDeviceCookieId(rData)
+
+	if deviceId == "" && audience == auth.JWT_AUDIENCE_COOKIE {
+		var err error
+		if deviceId, err = text.RandomHexString(DEVICE_ID_LENGTH); err != nil {
+			rData.LogError("unable to create device id: %v", err)
+			return
+		}
+		setDeviceCookie(rData, deviceId)
+	}
+
+	knownDevices := userRecord.GetData().UserNotificationData.KnownDevices
+	isFirstDevice := len(knownDevices) == 0
+
+	knownDevices, isKnown, changed := rememberDevice(knownDevices, deviceId, uaHash)
+	if !changed {
+		return
+	}
+	userRecord.GetData().UserNotificationData.KnownDevices = knownDevices
+
+	if err := datastore.Save(rData.Ctx, userRecord); err != nil {
+		rData.LogError("unable to save known device: %v", err)
+		return
+	}
+
+	if !isKnown && !isFirstDevice {
+		params := url.Values{}
+		params.Set("ip", rData.HttpRequest.RemoteAddr)
+		params.Set("ua", rData.HttpRequest.UserAgent())
+
+		if err := email.QueueNotification(rData, userRecord, email.NOTIFY_NEW_DEVICE, params); err != nil {
+			rData.LogError("TaskQueue non-critical (notification) error %v", err)
+		}
+	}
+}
+
+//Known devices are "<device id>:<user agent hash>", with an empty device id for clients which never sent the cookie
+//A device with a cookie is only matched by it (the user agent changes with every browser update and is the same for lots of people),
+//one without by the user agent, and entries from before the cookie (just the hash) are taken over by the first device with that user agent
+func rememberDevice(knownDevices []string, deviceId string, uaHash string) ([]string, bool, bool) {
+	entry := deviceId + ":" + uaHash
+
+	for idx, knownDevice := range knownDevices {
+		sep := strings.Index(knownDevice, ":")
+
+		var isMatch bool
+		switch {
+		case sep == -1:
+			isMatch = knownDevice == uaHash
+		case deviceId != "":
+			isMatch = knownDevice[:sep] == deviceId
+		default:
+			isMatch = knownDevice == entry
+		}
+
+		if isMatch {
+			changed := knownDevice != entry
+			knownDevices[idx] = entry
+			return knownDevices, true, changed
+		}
+	}
+
+	knownDevices = append(knownDevices, entry)
+	if len(knownDevices) > MAX_KNOWN_DEVICES {
+		knownDevices = knownDevices[len(knownDevices)-MAX_KNOWN_DEVICES:]
+	}
+
+	return knownDevices, false, true
+}
+
+func getUserAgentHash(rData *pages.RequestData) string {
+	hash := sha256.Sum256([]byte(rData.HttpRequest.UserAgent()))
+	return hex.EncodeToString(hash[:8])
+}
+
+//empty if there's no device cookie, or it isn't one we set
+func getDeviceCookieId(rData *pages.RequestData) string {
+	cookie, err := rData.HttpRequest.Cookie(getDeviceCookieName(rData))
+	if err != nil {
+		return ""
+	}
+
+	if decoded, err := hex.DecodeString(cookie.Value); err != nil || len(decoded) != DEVICE_ID_LENGTH {
+		return ""
+	}
+
+	return cookie.Value
+}
+
+func setDeviceCookie(rData *pages.RequestData, deviceId string) {
+	if rData.HttpWriter != nil {
+		http.SetCookie(rData.HttpWriter, &http.Cookie{Name: getDeviceCookieName(rData), Value: deviceId, MaxAge: DEVICE_COOKIE_MAX_AGE, HttpOnly: true, Secure: rData.SiteConfig.COOKIE_SECURE, Path: "/", Domain: rData.SiteConfig.COOKIE_DOMAIN})
+	}
+}
+
+func getDeviceCookieName(rData *pages.RequestData) string {
+	if rData.SiteConfig.DEVICE_COOKIE_NAME != "" {
+		return rData.SiteConfig.DEVICE_COOKIE_NAME
+	}
+	return DEVICE_COOKIE_DEFAULT_NAME
+}
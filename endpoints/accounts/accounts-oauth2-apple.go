@@ -0,0 +1,134 @@
+package accounts
+
+import (
+	"encoding/json"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/dakom/basic-site-api/lib/oidc"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/setup/config/static/statuscodes"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const APPLE_ISSUER string = "https://appleid.apple.com"
+const APPLE_DISCOVERY_URL string = APPLE_ISSUER + "/.well-known/openid-configuration"
+
+//apple allows up to 6 months, but there's no reason to keep it around - it's regenerated per flow
+const APPLE_CLIENT_SECRET_DURATION = 5 * time.Minute
+
+var APPLE_ENDPOINT = oauth2.Endpoint{
+	AuthURL:  APPLE_ISSUER + "/auth/authorize",
+	TokenURL: APPLE_ISSUER + "/auth/token",
+}
+
+//only sent (as the "user" form value) the very first time a user authorizes the app
+type AppleUser struct {
+	Name struct {
+		FirstName string `json:"firstName"`
+		LastName  string `json:"lastName"`
+	} `json:"name"`
+	Email string `json:"email"`
+}
+
+func getEndpointConfig_Apple(rData *pages.RequestData, state *StateInfo) *oauth2.Config {
+	clientSecret, err := getClientSecret_Apple(rData)
+	if err != nil {
+		rData.LogError("apple client secret error: %v", err)
+		return nil
+	}
+
+	return &oauth2.Config{
+		ClientID:     rData.SiteConfig.OAUTH_APPLE_CLIENTID,
+		ClientSecret: clientSecret,
+		RedirectURL:  state.ResponseUrl(rData.SiteConfig.API_HOSTNAME),
+		Scopes:       []string{"name", "email"},
+		Endpoint:     APPLE_ENDPOINT,
+	}
+}
+
+//apple requires form_post whenever name or email are requested, so OauthResponse gets a POST
+func getAuthOptions_Apple() []oauth2.AuthCodeOption {
+	return []oauth2.AuthCodeOption{oauth2.SetAuthURLParam("response_mode", "form_post")}
+}
+
+//apple only accepts the client credentials in the body
+func getExchangeOptions_Apple(endpointConfig *oauth2.Config) []oauth2.AuthCodeOption {
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("client_id", endpointConfig.ClientID),
+		oauth2.SetAuthURLParam("client_secret", endpointConfig.ClientSecret),
+	}
+}
+
+//The client secret is an ES256 jwt signed with the private key from the apple developer account
+func getClientSecret_Apple(rData *pages.RequestData) (string, error) {
+	privateKey, err := jwt.ParseECPrivateKeyFromPEM([]byte(rData.SiteConfig.OAUTH_APPLE_PRIVATEKEY))
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.StandardClaims{
+		Issuer:    rData.SiteConfig.OAUTH_APPLE_TEAMID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(APPLE_CLIENT_SECRET_DURATION).Unix(),
+		Audience:  APPLE_ISSUER,
+		Subject:   rData.SiteConfig.OAUTH_APPLE_CLIENTID,
+	})
+	token.Header["kid"] = rData.SiteConfig.OAUTH_APPLE_KEYID
+
+	return token.SignedString(privateKey)
+}
+
+//apple has no userinfo endpoint - the id comes from the id_token, and the name (first time only) from the posted form
+func getInfo_Apple(rData *pages.RequestData, state *StateInfo, tok *oauth2.Token) (*OAuthUserInfo, error) {
+	rawIdToken, ok := tok.Extra("id_token").(string)
+	if !ok || rawIdToken == "" {
+		return nil, statuscodes.Error(statuscodes.MISSINGINFO)
+	}
+
+	if state.Nonce == "" {
+		return nil, statuscodes.Error(statuscodes.AUTH)
+	}
+
+	discovery, err := oidc.GetDiscovery(rData.Ctx, APPLE_DISCOVERY_URL)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := oidc.ValidateIdToken(rData.Ctx, discovery, rData.SiteConfig.OAUTH_APPLE_CLIENTID, rawIdToken, state.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	userInfo := &OAuthUserInfo{
+		Id:    oidc.GetClaimString(claims, "sub"),
+		Email: oidc.GetClaimString(claims, "email"),
+	}
+
+	if userInfo.Id == "" {
+		return nil, statuscodes.Error(statuscodes.MISSINGINFO)
+	}
+
+	if !oidc.IsEmailVerified(claims) {
+		userInfo.Email = ""
+	}
+
+	if userJson := rData.HttpRequest.FormValue("user"); userJson != "" {
+		var appleUser AppleUser
+		if err := json.Unmarshal([]byte(userJson), &appleUser); err == nil {
+			userInfo.FirstName = appleUser.Name.FirstName
+			userInfo.LastName = appleUser.Name.LastName
+		}
+	}
+
+	//the name is only sent on the very first authorization, and the user may not share it at all
+	if userInfo.FirstName == "" {
+		userInfo.FirstName = getEmailLocalPart(userInfo.Email)
+	}
+
+	return userInfo, nil
+}
@@ -0,0 +1,120 @@
+package accounts
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/oauth2"
+
+	"github.com/dakom/basic-site-api/lib/pages"
+)
+
+const GITHUB_API string = "https://api.github.com"
+
+var GITHUB_ENDPOINT = oauth2.Endpoint{
+	AuthURL:  "https://github.com/login/oauth/authorize",
+	TokenURL: "https://github.com/login/oauth/access_token",
+}
+
+type GithubUser struct {
+	Id        int64  `json:"id"`
+	Login     string `json:"login"`
+	Name      string `json:"name"`
+	AvatarUrl string `json:"avatar_url"`
+}
+
+type GithubEmail struct {
+	Email    string `json:"email"`
+	Primary  bool   `json:"primary"`
+	Verified bool   `json:"verified"`
+}
+
+func getEndpointConfig_Github(rData *pages.RequestData, state *StateInfo) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     rData.SiteConfig.OAUTH_GITHUB_CLIENTID,
+		ClientSecret: rData.SiteConfig.OAUTH_GITHUB_CLIENTSECRET,
+		RedirectURL:  state.ResponseUrl(rData.SiteConfig.API_HOSTNAME),
+		Scopes:       []string{"read:user", "user:email"},
+		Endpoint:     GITHUB_ENDPOINT,
+	}
+}
+
+//the profile's email is only the public one (if any), so the address comes from the separate emails endpoint
+func getInfo_Github(rData *pages.RequestData, client *http.Client) (*OAuthUserInfo, error) {
+	var githubUser GithubUser
+	var githubEmails []GithubEmail
+
+	if err := getJson_Github(client, "/user", &githubUser); err != nil {
+		return nil, err
+	}
+
+	if err := getJson_Github(client, "/user/emails", &githubEmails); err != nil {
+		return nil, err
+	}
+
+	userInfo := &OAuthUserInfo{
+		Id:        strconv.FormatInt(githubUser.Id, 10),
+		Email:     getPrimaryEmail_Github(githubEmails),
+		AvatarURL: githubUser.AvatarUrl,
+	}
+
+	//github only has a single display name
+	if names := strings.Fields(githubUser.Name); len(names) > 0 {
+		userInfo.FirstName = names[0]
+		userInfo.LastName = strings.Join(names[1:], " ")
+	} else if githubUser.Login != "" {
+		userInfo.FirstName = githubUser.Login
+	} else {
+		userInfo.FirstName = getEmailLocalPart(userInfo.Email)
+	}
+
+	return userInfo, nil
+}
+
+//unverified addresses are never used
+func getPrimaryEmail_Github(githubEmails []GithubEmail) string {
+	var fallback string
+
+	for _, githubEmail := range githubEmails {
+		if !githubEmail.Verified {
+			continue
+		}
+		if githubEmail.Primary {
+			return githubEmail.Email
+		}
+		if fallback == "" {
+			fallback = githubEmail.Email
+		}
+	}
+
+	return fallback
+}
+
+func getJson_Github(client *http.Client, path string, target interface{}) error {
+	request, err := http.NewRequest("GET", GITHUB_API+path, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/vnd.github+json")
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return fmt.Errorf("github %s returned %s", path, response.Status)
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(body, target)
+}
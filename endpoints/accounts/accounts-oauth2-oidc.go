@@ -0,0 +1,134 @@
+package accounts
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/oauth2"
+
+	"github.com/dakom/basic-site-api/lib/oidc"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/lib/utils/slice"
+	"github.com/dakom/basic-site-api/setup/config/custom"
+	"github.com/dakom/basic-site-api/setup/config/static/statuscodes"
+)
+
+var OIDC_DEFAULT_SCOPES = []string{"openid", "email", "profile"}
+
+//standard claims, overridden per provider by OidcProvider.ClaimMap
+var OIDC_DEFAULT_CLAIMS = map[string]string{
+	"uid":   "sub",
+	"email": "email",
+	"fname": "given_name",
+	"lname": "family_name",
+	"aurl":  "picture",
+}
+
+func isAllowedProvider(rData *pages.RequestData, providerName string) bool {
+	return slice.StringInSlice(providerName, OAUTH_ALLOWED_PROVIDERS) || getOidcProvider(rData, providerName) != nil
+}
+
+//Checked at startup - the provider name is the part of an oauth username up to the next "-" (see getOauthProviderFromUsername)
+//so it can't contain one, and it can't take over a built-in provider's users
+func ValidateOidcProviders(providers map[string]*custom.OidcProvider) error {
+	for providerName, provider := range providers {
+		switch {
+		case providerName == "":
+			return fmt.Errorf("oidc provider with an empty name")
+		case strings.Contains(providerName, "-"):
+			return fmt.Errorf("oidc provider name %q can't contain a \"-\"", providerName)
+		case slice.StringInSlice(providerName, OAUTH_ALLOWED_PROVIDERS):
+			return fmt.Errorf("oidc provider name %q is already a built-in provider", providerName)
+		case provider == nil || provider.DiscoveryUrl == "":
+			return fmt.Errorf("oidc provider %q has no discovery url", providerName)
+		}
+	}
+
+	return nil
+}
+
+func getOidcProvider(rData *pages.RequestData, providerName string) *custom.OidcProvider {
+	if rData.SiteConfig.OIDC_PROVIDERS == nil {
+		return nil
+	}
+
+	return rData.SiteConfig.OIDC_PROVIDERS[providerName]
+}
+
+func getEndpointConfig_Oidc(rData *pages.RequestData, provider *custom.OidcProvider, state *StateInfo) *oauth2.Config {
+	discovery, err := oidc.GetDiscovery(rData.Ctx, provider.DiscoveryUrl)
+	if err != nil {
+		rData.LogError("oidc discovery (%s) error: %v", state.Provider, err)
+		return nil
+	}
+
+	scopes := provider.Scopes
+	if len(scopes) == 0 {
+		scopes = OIDC_DEFAULT_SCOPES
+	}
+
+	//standard oidc way to ask for a refresh token (copied so the configured list isn't touched)
+	if isOfflineProvider(rData, state.Provider) && !slice.StringInSlice("offline_access", scopes) {
+		scopes = append(append([]string{}, scopes...), "offline_access")
+	}
+
+	return &oauth2.Config{
+		ClientID:     provider.ClientId,
+		ClientSecret: provider.ClientSecret,
+		RedirectURL:  state.ResponseUrl(rData.SiteConfig.API_HOSTNAME),
+		Scopes:       scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  discovery.AuthorizationEndpoint,
+			TokenURL: discovery.TokenEndpoint,
+		},
+	}
+}
+
+//validates the id_token that came along with the access token and maps its claims
+func getInfo_Oidc(rData *pages.RequestData, provider *custom.OidcProvider, state *StateInfo, tok *oauth2.Token) (*OAuthUserInfo, error) {
+	rawIdToken, ok := tok.Extra("id_token").(string)
+	if !ok || rawIdToken == "" {
+		return nil, statuscodes.Error(statuscodes.MISSINGINFO)
+	}
+
+	discovery, err := oidc.GetDiscovery(rData.Ctx, provider.DiscoveryUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	//nonce is required - it was generated in startOauthRequest for every oidc provider
+	if state.Nonce == "" {
+		return nil, statuscodes.Error(statuscodes.AUTH)
+	}
+
+	claims, err := oidc.ValidateIdToken(rData.Ctx, discovery, provider.ClientId, rawIdToken, state.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	claimName := func(field string) string {
+		if name, ok := provider.ClaimMap[field]; ok {
+			return name
+		}
+		return OIDC_DEFAULT_CLAIMS[field]
+	}
+
+	userInfo := &OAuthUserInfo{
+		Id:        oidc.GetClaimString(claims, claimName("uid")),
+		Email:     oidc.GetClaimString(claims, claimName("email")),
+		FirstName: oidc.GetClaimString(claims, claimName("fname")),
+		LastName:  oidc.GetClaimString(claims, claimName("lname")),
+		AvatarURL: oidc.GetClaimString(claims, claimName("aurl")),
+	}
+
+	if userInfo.Id == "" {
+		return nil, statuscodes.Error(statuscodes.MISSINGINFO)
+	}
+
+	//an unverified address would let anyone claim the account registered with it
+	if !oidc.IsEmailVerified(claims) {
+		userInfo.Email = ""
+	}
+
+	return userInfo, nil
+}
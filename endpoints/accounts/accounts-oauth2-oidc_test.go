@@ -0,0 +1,61 @@
+package accounts
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/setup/config/custom"
+)
+
+func TestValidateOidcProviders(t *testing.T) {
+	provider := &custom.OidcProvider{DiscoveryUrl: "https://login.example.com/.well-known/openid-configuration"}
+
+	tests := []struct {
+		name      string
+		providers map[string]*custom.OidcProvider
+		valid     bool
+	}{
+		{"not set", nil, true},
+		{"plain names", map[string]*custom.OidcProvider{"clever": provider, "microsoft": provider}, true},
+		{"with a dash", map[string]*custom.OidcProvider{"company-idp": provider}, false},
+		{"empty name", map[string]*custom.OidcProvider{"": provider}, false},
+		{"built-in name", map[string]*custom.OidcProvider{"google": provider}, false},
+		{"no discovery url", map[string]*custom.OidcProvider{"clever": {}}, false},
+		{"nil", map[string]*custom.OidcProvider{"clever": nil}, false},
+	}
+
+	for _, test := range tests {
+		err := ValidateOidcProviders(test.providers)
+		if test.valid && err != nil {
+			t.Errorf("%s: expected it to be accepted, got %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected it to be rejected", test.name)
+		}
+	}
+}
+
+func TestGetOauthProviderFromUsername(t *testing.T) {
+	rData := &pages.RequestData{Ctx: context.Background(), SiteConfig: &custom.Config{OAUTH_USERID_PREFIX: "oauth"}}
+
+	tests := []struct {
+		username string
+		provider string
+		ok       bool
+	}{
+		{"oauth-google-1234", "google", true},
+		{"oauth-clever-abc-def", "clever", true},
+		{"oauth-google", "", false},
+		{"someone", "", false},
+		{"oauthgoogle-1234", "", false},
+	}
+
+	for _, test := range tests {
+		provider, ok := getOauthProviderFromUsername(rData, test.username)
+		if provider != test.provider || ok != test.ok {
+			t.Errorf("%s: expected %q %v, got %q %v", test.username, test.provider, test.ok, provider, ok)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package accounts
+
+import (
+	"sync"
+
+	"golang.org/x/oauth2"
+
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/lib/utils/slice"
+)
+
+//the link destination is only ever set by OauthLinkRequest, so it doesn't need to be configured
+const OAUTH_LINK_DESTINATION string = "oauth-action/link"
+
+//used when SiteConfig.OAUTH_ALLOWED_DESTINATIONS is empty
+var OAUTH_DEFAULT_DESTINATIONS = []string{"oauth-action/login", "oauth-action/register"}
+
+//Describes a kind of oauth request (the "request" param of OauthRequest)
+//Process runs at OauthResponse with the exchanged token - whatever it returns is kept as state.Response
+//Actions are looked up by the "action" param of OauthAction, and get the state with that Response
+type OauthRequestHandler struct {
+	Scopes  map[string][]string //extra scopes to ask for, per provider name, on top of the provider's login scopes
+	Process func(rData *pages.RequestData, state *StateInfo, endpointConfig *oauth2.Config, tok *oauth2.Token) (string, error)
+	Actions map[string]func(rData *pages.RequestData, state *StateInfo)
+}
+
+var oauthRequestHandlers = make(map[string]*OauthRequestHandler)
+var oauthRequestHandlersLock sync.RWMutex
+
+func init() {
+	RegisterOauthRequest("userinfo", &OauthRequestHandler{
+		Process: processUserInfo,
+		Actions: map[string]func(*pages.RequestData, *StateInfo){
+			"login":    oauthActionLogin,
+			"register": oauthActionRegister,
+			"link":     oauthActionLink,
+		},
+	})
+}
+
+//Site code calls this at startup (e.g. "contacts-import") - registering an existing name replaces it
+func RegisterOauthRequest(requestName string, handler *OauthRequestHandler) {
+	oauthRequestHandlersLock.Lock()
+	defer oauthRequestHandlersLock.Unlock()
+
+	oauthRequestHandlers[requestName] = handler
+}
+
+func getOauthRequestHandler(requestName string) *OauthRequestHandler {
+	oauthRequestHandlersLock.RLock()
+	defer oauthRequestHandlersLock.RUnlock()
+
+	return oauthRequestHandlers[requestName]
+}
+
+func isAllowedDestination(rData *pages.RequestData, state *StateInfo) bool {
+	if state.Destination == OAUTH_LINK_DESTINATION {
+		return state.LinkUserId != 0
+	}
+
+	if len(rData.SiteConfig.OAUTH_ALLOWED_DESTINATIONS) == 0 {
+		return slice.StringInSlice(state.Destination, OAUTH_DEFAULT_DESTINATIONS)
+	}
+
+	return slice.StringInSlice(state.Destination, rData.SiteConfig.OAUTH_ALLOWED_DESTINATIONS)
+}
@@ -0,0 +1,57 @@
+package accounts
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+
+	"golang.org/x/oauth2"
+
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/lib/utils/slice"
+	"github.com/dakom/basic-site-api/lib/utils/text"
+)
+
+//built-in providers which accept PKCE - oidc providers always use it unless DisablePkce is set
+var OAUTH_PKCE_PROVIDERS = []string{"google"}
+
+//built-in providers which get an id_token and so need a nonce - oidc providers always do
+var OAUTH_NONCE_PROVIDERS = []string{"apple"}
+
+//Generates the PKCE verifier and (for oidc and apple) the nonce for this flow, and sets them on the state
+//Returns the extra options for the auth url - state must be re-saved by the caller if there are any
+func addFlowSecrets(rData *pages.RequestData, state *StateInfo) ([]oauth2.AuthCodeOption, error) {
+	var options []oauth2.AuthCodeOption
+
+	oidcProvider := getOidcProvider(rData, state.Provider)
+
+	if (oidcProvider != nil && !oidcProvider.DisablePkce) || (oidcProvider == nil && slice.StringInSlice(state.Provider, OAUTH_PKCE_PROVIDERS)) {
+		//64 hex chars - within the 43-128 unreserved characters required by rfc7636
+		verifier, err := text.RandomHexString(32)
+		if err != nil {
+			return nil, err
+		}
+		state.CodeVerifier = verifier
+
+		options = append(options,
+			oauth2.SetAuthURLParam("code_challenge", getPkceChallenge(verifier)),
+			oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+		)
+	}
+
+	if oidcProvider != nil || slice.StringInSlice(state.Provider, OAUTH_NONCE_PROVIDERS) {
+		nonce, err := text.RandomHexString(16)
+		if err != nil {
+			return nil, err
+		}
+		state.Nonce = nonce
+
+		options = append(options, oauth2.SetAuthURLParam("nonce", nonce))
+	}
+
+	return options, nil
+}
+
+func getPkceChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
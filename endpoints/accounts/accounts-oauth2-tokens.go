@@ -0,0 +1,194 @@
+package accounts
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	gaeds "google.golang.org/appengine/datastore"
+
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/lib/utils/cipher"
+	"github.com/dakom/basic-site-api/lib/utils/slice"
+	"github.com/dakom/basic-site-api/setup/config/static/statuscodes"
+)
+
+func isOfflineProvider(rData *pages.RequestData, providerName string) bool {
+	return slice.StringInSlice(providerName, rData.SiteConfig.OAUTH_OFFLINE_PROVIDERS)
+}
+
+//Returns an *http.Client which calls the provider's apis as the given user
+//The access token is refreshed as needed and the refreshed token is stored again
+//error is statuscodes.IDENTITY_NOT_FOUND if there's no stored token (i.e. the user needs to log in via the provider again)
+func GetProviderHttpClient(rData *pages.RequestData, userId int64, providerName string) (*http.Client, error) {
+	var tokenRecord datastore.ProviderTokenRecord
+
+	err := datastore.LoadFromKey(rData.Ctx, &tokenRecord, datastore.GetProviderTokenKey(userId, providerName))
+	if err == gaeds.ErrNoSuchEntity {
+		return nil, errors.New(statuscodes.IDENTITY_NOT_FOUND)
+	} else if err != nil {
+		return nil, err
+	}
+
+	tok, err := decryptProviderToken(rData, tokenRecord.GetData().Token)
+	if err != nil {
+		return nil, err
+	}
+
+	endpointConfig := getEndpointConfig(rData, &StateInfo{Provider: providerName})
+	if endpointConfig == nil {
+		return nil, errors.New(statuscodes.TECHNICAL)
+	}
+
+	tokenSource := &storedTokenSource{
+		rData:           rData,
+		tokenRecord:     &tokenRecord,
+		source:          endpointConfig.TokenSource(rData.Ctx, tok),
+		lastAccessToken: tok.AccessToken,
+	}
+
+	return oauth2.NewClient(rData.Ctx, tokenSource), nil
+}
+
+//Saves the token that came along with the login/register/link (see OauthResponse)
+//non-critical, errors are only logged
+func storeProviderToken(rData *pages.RequestData, userId int64, state *StateInfo, username string) {
+	var tokenRecord datastore.ProviderTokenRecord
+
+	if state.ProviderToken == "" {
+		return
+	}
+
+	tok, err := decryptProviderToken(rData, state.ProviderToken)
+	if err != nil {
+		rData.LogError("unable to decrypt provider token: %v", err)
+		return
+	}
+
+	tokenKey := datastore.GetProviderTokenKey(userId, state.Provider)
+
+	//providers usually only send the refresh token on first consent - keep the one we have
+	if tok.RefreshToken == "" {
+		if err := datastore.LoadFromKey(rData.Ctx, &tokenRecord, tokenKey); err == nil && tokenRecord.GetData().Username == username {
+			if oldTok, err := decryptProviderToken(rData, tokenRecord.GetData().Token); err == nil {
+				tok.RefreshToken = oldTok.RefreshToken
+			}
+		}
+	}
+
+	tokenRecord.SetData(&datastore.ProviderTokenData{
+		UserId:   userId,
+		Provider: state.Provider,
+		Username: username,
+	})
+
+	if err := saveProviderToken(rData, &tokenRecord, tok, tokenKey); err != nil {
+		rData.LogError("unable to save provider token: %v", err)
+	}
+}
+
+//when an identity is unlinked, its token goes with it
+func deleteProviderToken(rData *pages.RequestData, userId int64, providerName string, username string) {
+	var tokenRecord datastore.ProviderTokenRecord
+
+	if err := datastore.LoadFromKey(rData.Ctx, &tokenRecord, datastore.GetProviderTokenKey(userId, providerName)); err != nil {
+		return
+	}
+
+	if tokenRecord.GetData().Username == username {
+		if err := datastore.Delete(rData.Ctx, &tokenRecord); err != nil {
+			rData.LogError("unable to delete provider token: %v", err)
+		}
+	}
+}
+
+func saveProviderToken(rData *pages.RequestData, tokenRecord *datastore.ProviderTokenRecord, tok *oauth2.Token, keyVal interface{}) error {
+	encrypted, err := encryptProviderToken(rData, tok)
+	if err != nil {
+		return err
+	}
+
+	tokenRecord.GetData().Token = encrypted
+	tokenRecord.GetData().Date = time.Now()
+
+	return datastore.SaveToKey(rData.Ctx, tokenRecord, keyVal)
+}
+
+func encryptProviderToken(rData *pages.RequestData, tok *oauth2.Token) (string, error) {
+	key, err := getProviderTokenKey(rData)
+	if err != nil {
+		return "", err
+	}
+
+	tokBytes, err := json.Marshal(tok)
+	if err != nil {
+		return "", err
+	}
+
+	return cipher.EncryptAesGcm(key, tokBytes)
+}
+
+func decryptProviderToken(rData *pages.RequestData, encrypted string) (*oauth2.Token, error) {
+	var tok oauth2.Token
+
+	key, err := getProviderTokenKey(rData)
+	if err != nil {
+		return nil, err
+	}
+
+	tokBytes, err := cipher.DecryptAesGcm(key, encrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(tokBytes, &tok); err != nil {
+		return nil, err
+	}
+
+	return &tok, nil
+}
+
+//hex encoded, 32 bytes for AES-256
+func getProviderTokenKey(rData *pages.RequestData) ([]byte, error) {
+	key, err := hex.DecodeString(rData.SiteConfig.OAUTH_TOKEN_KEY)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+		return nil, errors.New("OAUTH_TOKEN_KEY must be a hex encoded AES key")
+	}
+
+	return key, nil
+}
+
+//Wraps the provider's refreshing token source to store the token whenever it changes
+type storedTokenSource struct {
+	rData           *pages.RequestData
+	tokenRecord     *datastore.ProviderTokenRecord
+	source          oauth2.TokenSource
+	lastAccessToken string
+}
+
+func (s *storedTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.source.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok.AccessToken != s.lastAccessToken {
+		s.lastAccessToken = tok.AccessToken
+
+		if err := saveProviderToken(s.rData, s.tokenRecord, tok, s.tokenRecord.GetKey().StringID()); err != nil {
+			//the token is still good for this client, it'll just be refreshed again next time
+			s.rData.LogError("unable to save refreshed provider token: %v", err)
+		}
+	}
+
+	return tok, nil
+}
@@ -10,12 +10,15 @@ Oauth flow is like this:
 		 	c. provider name (vetted) - required for knowing how to get user data
 			d. request (vetted) - required for knowing how to get user data
 		Creates the third-party consent page url with the jwt as state param
+		Adds the PKCE challenge (and nonce for oidc/apple) - the matching secrets are stored with the state in db only, never in the signed jwt
 		Returns that url
 2. IN BROWSER - User opens that url and completes third-party oauth page (note - "state" is there, and that's fine since the user must know it, threat vector is malicious interceptor only)
 3. IN BROWSER - Page is redirected to OauthResponse() from third party, given both "state" and "code" and whatever else provider provides
+	(apple uses form_post, i.e. this arrives as a POST and the final redirect is a 303)
 4. SERVERSIDE/REDIRECT - OauthResponse()
 	authenticates the state (i.e. jwt signing)
-	issues oauth request with code to get relevant data, and stores as Response field in state
+	issues oauth request with code (and PKCE verifier), then the registered request's Process gets the relevant data, stored as Response field in state
+	for oidc, the id_token's nonce must match the one stored in state
 	redirects to destination schema + destination with original jwt (not re-generated one, serves as a sanity check that token is still valid when used)
 5. AT CLIENT - loads destination (in browser, via schema, etc.)
 	Grabs jwt
@@ -23,7 +26,7 @@ Oauth flow is like this:
 6. OauthAction()
 	Protected by Jwt auth checking (scope)
 	Loads info from db (requires db check)
-	Uses State/Response and whatever request params to issue action
+	Uses State/Response and whatever request params to issue the registered action (see accounts-oauth2-registry.go)
 	Returns result
 */
 
@@ -32,6 +35,7 @@ package accounts
 import (
 	"errors"
 
+	"github.com/dakom/basic-site-api/lib/audit"
 	"github.com/dakom/basic-site-api/lib/auth/jwt_scopes"
 	"github.com/dakom/basic-site-api/lib/datastore"
 	"github.com/dakom/basic-site-api/lib/utils/slice"
@@ -40,6 +44,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
 	"github.com/dakom/basic-site-api/lib/auth"
 	"github.com/dakom/basic-site-api/lib/pages"
@@ -52,17 +57,20 @@ import (
 	goauth2 "google.golang.org/api/oauth2/v2"
 )
 
-var OAUTH_ALLOWED_REQUESTS = []string{"userinfo"}
-var OAUTH_ALLOWED_PROVIDERS = []string{"google", "facebook", "clever"}
-var OAUTH_ALLOWED_DESTINATIONS = []string{"oauth-action/login", "oauth-action/register"}
+//built-in providers - anything else (clever, microsoft, company idp...) is configured via SiteConfig.OIDC_PROVIDERS
+var OAUTH_ALLOWED_PROVIDERS = []string{"google", "facebook", "apple", "github"}
 
 type StateInfo struct {
-	Destination string `json:"dest"`
-	Request     string `json:"request"`
-	RequestMeta string `json:"requestMeta,omitempty" datastore:",noindex"`
-	Scheme      string `json:"scheme"`
-	Provider    string `json:"provider"`
-	Response    string `json:"response,omitempty" datastore:",noindex"`
+	Destination   string `json:"dest"`
+	Request       string `json:"request"`
+	RequestMeta   string `json:"requestMeta,omitempty" datastore:",noindex"`
+	Scheme        string `json:"scheme"`
+	Provider      string `json:"provider"`
+	Response      string `json:"response,omitempty" datastore:",noindex"`
+	LinkUserId    int64  `json:"linkUid,omitempty" datastore:",noindex"` //only set via OauthLinkRequest, where the user is already authenticated
+	Nonce         string `json:"nonce,omitempty" datastore:",noindex"`   //oidc and apple, checked against the id_token
+	CodeVerifier  string `json:"cv,omitempty" datastore:",noindex"`      //pkce, sent on code exchange
+	ProviderToken string `json:"ptok,omitempty" datastore:",noindex"`    //encrypted, offline providers only - stored for the user by OauthAction
 }
 
 type RegisterRequestMeta struct {
@@ -146,15 +154,39 @@ type FacebookUser struct {
 
 func OauthRequest(rData *pages.RequestData) {
 
-	state := StateInfo{
+	state := getStateFromRequest(rData)
+
+	//linking must go through OauthLinkRequest so we know who's asking
+	state.LinkUserId = 0
+
+	startOauthRequest(rData, state)
+}
+
+//Same as OauthRequest but for an already logged-in user who wants to add another login method
+func OauthLinkRequest(rData *pages.RequestData) {
+
+	state := getStateFromRequest(rData)
+	state.Destination = OAUTH_LINK_DESTINATION
+	state.LinkUserId = rData.UserRecord.GetKey().IntID()
+
+	startOauthRequest(rData, state)
+}
+
+func getStateFromRequest(rData *pages.RequestData) StateInfo {
+	return StateInfo{
 		Destination: rData.HttpRequest.FormValue("dest"),
 		Scheme:      rData.HttpRequest.FormValue("scheme"),
 		Provider:    rData.HttpRequest.FormValue("provider"),
 		Request:     rData.HttpRequest.FormValue("request"),
 		RequestMeta: rData.HttpRequest.FormValue("meta"),
 	}
+}
 
-	if !slice.StringInSlice(state.Destination, OAUTH_ALLOWED_DESTINATIONS) || !slice.StringInSlice(state.Scheme, rData.SiteConfig.OAUTH_ALLOWED_SCHEMES) || !slice.StringInSlice(state.Provider, OAUTH_ALLOWED_PROVIDERS) || !slice.StringInSlice(state.Request, OAUTH_ALLOWED_REQUESTS) {
+func startOauthRequest(rData *pages.RequestData, state StateInfo) {
+
+	handler := getOauthRequestHandler(state.Request)
+
+	if handler == nil || !isAllowedDestination(rData, &state) || !slice.StringInSlice(state.Scheme, rData.SiteConfig.OAUTH_ALLOWED_SCHEMES) || !isAllowedProvider(rData, state.Provider) {
 		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
 		return
 	}
@@ -165,7 +197,7 @@ func OauthRequest(rData *pages.RequestData) {
 		return
 	}
 
-	_, stateJwtString, err := auth.GetNewSystemsOobJWT(rData, auth.SYSTEM_ID_OAUTH, jwt_scopes.OAUTH_STATE, string(stateBytes))
+	stateJwtRecord, stateJwtString, err := auth.GetNewSystemsOobJWT(rData, auth.SYSTEM_ID_OAUTH, jwt_scopes.OAUTH_STATE, string(stateBytes))
 	if err != nil {
 		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
 		return
@@ -176,8 +208,43 @@ func OauthRequest(rData *pages.RequestData) {
 		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
 		return
 	}
+	if extraScopes := handler.Scopes[state.Provider]; len(extraScopes) > 0 {
+		endpoint.Scopes = append(append([]string{}, endpoint.Scopes...), extraScopes...)
+	}
+
+	accessType := oauth2.AccessTypeOnline
+	if isOfflineProvider(rData, state.Provider) {
+		accessType = oauth2.AccessTypeOffline
+	}
+
+	authOptions := []oauth2.AuthCodeOption{oauth2.ApprovalForce, accessType}
+	if state.Provider == "apple" {
+		authOptions = append(authOptions, getAuthOptions_Apple()...)
+	}
+
+	//the per-flow secrets are added to the stored state only *after* signing
+	//so they never show up in the state param that goes through the browser
+	secretOptions, err := addFlowSecrets(rData, &state)
+	if err != nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
 
-	authUrl := endpoint.AuthCodeURL(stateJwtString, oauth2.ApprovalForce, oauth2.AccessTypeOnline)
+	if len(secretOptions) > 0 {
+		authOptions = append(authOptions, secretOptions...)
+
+		if stateBytes, err = json.Marshal(state); err != nil {
+			rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+			return
+		}
+		stateJwtRecord.GetData().Extra = string(stateBytes)
+		if err := datastore.Save(rData.Ctx, stateJwtRecord); err != nil {
+			rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+			return
+		}
+	}
+
+	authUrl := endpoint.AuthCodeURL(stateJwtString, authOptions...)
 
 	authUrlFormatted := fmt.Sprintf("%s", authUrl)
 	rData.LogInfo(authUrlFormatted)
@@ -197,17 +264,29 @@ func OauthResponse(rData *pages.RequestData) {
 	if code != "" && err == nil {
 		var response string
 
-		if state.Request == "userinfo" {
-			userInfo := getUserInfoFromRequest(rData, state, code)
-			if userInfo != nil {
-				if infoBytes, err := json.Marshal(userInfo); err == nil {
-					response = string(infoBytes)
+		if handler := getOauthRequestHandler(state.Request); handler != nil {
+			if endpointConfig, tok := exchangeCode(rData, state, code); tok != nil {
+				if response, err = handler.Process(rData, state, endpointConfig, tok); err != nil {
+					rData.LogError("oauth %s (%s) error: %v", state.Request, state.Provider, err)
+					response = ""
+				}
+
+				//kept (db only, never signed) until an action knows which user it belongs to
+				if response != "" && isOfflineProvider(rData, state.Provider) {
+					if encrypted, err := encryptProviderToken(rData, tok); err == nil {
+						state.ProviderToken = encrypted
+					} else {
+						rData.LogError("unable to encrypt provider token: %v", err)
+					}
 				}
 			}
 		}
 
 		if response != "" {
 			state.Response = response
+			//single use, no need to keep these around for the action
+			state.Nonce = ""
+			state.CodeVerifier = ""
 			if stateBytes, err := json.Marshal(state); err == nil {
 				stateJwtRecord.GetData().Extra = string(stateBytes)
 				if err := datastore.Save(rData.Ctx, stateJwtRecord); err == nil {
@@ -237,108 +316,204 @@ func OauthResponse(rData *pages.RequestData) {
 func OauthAction(rData *pages.RequestData) {
 	rData.LogInfo("JWT: %v", rData.JwtString)
 	
-	response := pages.JsonMapGeneric{}
-
 	state, err := getStateFromJwtRecord(rData.JwtRecord)
 	if err != nil {
 		rData.SetJsonErrorCodeResponse(statuscodes.AUTH)
 		return
 	}
 
-	if state.Request == "userinfo" {
-		var userInfo OAuthUserInfo
-		if err := json.Unmarshal([]byte(state.Response), &userInfo); err != nil {
-			rData.SetJsonErrorCodeResponse(statuscodes.AUTH)
+	handler := getOauthRequestHandler(state.Request)
+	if handler == nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.AUTH)
+		return
+	}
+
+	action, ok := handler.Actions[rData.HttpRequest.FormValue("action")]
+	if !ok {
+		rData.SetJsonErrorCodeResponse(statuscodes.AUTH)
+		return
+	}
+
+	action(rData, state)
+}
+
+//the built-in "userinfo" request - see accounts-oauth2-registry.go
+func processUserInfo(rData *pages.RequestData, state *StateInfo, endpointConfig *oauth2.Config, tok *oauth2.Token) (string, error) {
+	userInfo := getUserInfoFromToken(rData, state, endpointConfig, tok)
+	if userInfo == nil {
+		return "", errors.New(statuscodes.MISSINGINFO)
+	}
+
+	infoBytes, err := json.Marshal(userInfo)
+	if err != nil {
+		return "", err
+	}
+
+	return string(infoBytes), nil
+}
+
+func getUserInfoFromState(rData *pages.RequestData, state *StateInfo) *OAuthUserInfo {
+	var userInfo OAuthUserInfo
+
+	if err := json.Unmarshal([]byte(state.Response), &userInfo); err != nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.AUTH)
+		return nil
+	}
+
+	return &userInfo
+}
+
+//a name of last resort for providers which may not have one, empty if there's no email either
+func getEmailLocalPart(email string) string {
+	if idx := strings.LastIndex(email, "@"); idx != -1 {
+		return email[:idx]
+	}
+	return email
+}
+
+func oauthActionLogin(rData *pages.RequestData, state *StateInfo) {
+	response := pages.JsonMapGeneric{}
+
+	userInfo := getUserInfoFromState(rData, state)
+	if userInfo == nil {
+		return
+	}
+
+	var requestMeta LoginRequestMeta
+
+	if state.RequestMeta != "" {
+		if err := json.Unmarshal([]byte(state.RequestMeta), &requestMeta); err != nil {
+			rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
 			return
 		}
+		response["meta"] = requestMeta
+	}
 
-		actionType := rData.HttpRequest.FormValue("action")
+	loginRecord, userRecordInfo, _, jwtString, err := DoLogin(rData, userInfo.Id, "", requestMeta.Audience, LOOKUP_TYPE_OAUTH)
 
-		if actionType == "login" {
-			var requestMeta LoginRequestMeta
+	if err != nil {
+		response["code"] = err.Error()
+		rData.SetJsonErrorResponse(response)
+		return
+	}
 
-			if state.RequestMeta != "" {
-				if err := json.Unmarshal([]byte(state.RequestMeta), &requestMeta); err != nil {
-					rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
-					return
-				}
-				response["meta"] = requestMeta
-			}
+	storeProviderToken(rData, loginRecord.GetKey().IntID(), state, userInfo.Id)
 
-                        _, userRecordInfo, _, jwtString, err := DoLogin(rData, userInfo.Id, "", requestMeta.Audience, LOOKUP_TYPE_OAUTH)
+	response["jwt"] = jwtString
+	response["userInfo"] = userRecordInfo
+	rData.SetJsonSuccessResponse(response)
+}
 
-			if err != nil {
-				response["code"] = err.Error()
-				rData.SetJsonErrorResponse(response)
-				return
-			}
+func oauthActionRegister(rData *pages.RequestData, state *StateInfo) {
+	response := pages.JsonMapGeneric{}
 
-			response["jwt"] = jwtString
-                        response["userInfo"] = userRecordInfo
-			rData.SetJsonSuccessResponse(response)
-			return
+	userInfo := getUserInfoFromState(rData, state)
+	if userInfo == nil {
+		return
+	}
 
-		} else if actionType == "register" {
-			var requestMeta RegisterRequestMeta
-			if err := json.Unmarshal([]byte(state.RequestMeta), &requestMeta); err != nil {
-				rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
-				return
-			}
+	var requestMeta RegisterRequestMeta
+	if err := json.Unmarshal([]byte(state.RequestMeta), &requestMeta); err != nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
 
-			response["meta"] = requestMeta
-
-			registerInfo := &RegisterInfo{
-				Terms:        requestMeta.Terms,
-				Newsletter:   requestMeta.Newsletter,
-				Username:     userInfo.Id,
-				EmailAddress: userInfo.Email,
-				FirstName:    userInfo.FirstName,
-				LastName:     userInfo.LastName,
-				LookupType:   LOOKUP_TYPE_OAUTH,
-				AvatarUrl:    userInfo.AvatarURL,
-				AppId:        requestMeta.AppId,
-				AppPort:      requestMeta.AppPort,
-			}
+	response["meta"] = requestMeta
+
+	registerInfo := &RegisterInfo{
+		Terms:        requestMeta.Terms,
+		Newsletter:   requestMeta.Newsletter,
+		Username:     userInfo.Id,
+		EmailAddress: userInfo.Email,
+		FirstName:    userInfo.FirstName,
+		LastName:     userInfo.LastName,
+		LookupType:   LOOKUP_TYPE_OAUTH,
+		AvatarUrl:    userInfo.AvatarURL,
+		AppId:        requestMeta.AppId,
+		AppPort:      requestMeta.AppPort,
+	}
 
-			//theoretically, we could lookup the user's email address and allow syncing multiple accounts based on that email...
-			//but decided not to, a separate service could be created to connect/disconnect accounts, and that would be better
-			//so the structure is there to separate lookup from actual record, and multiple lookups can be used to reference a single record
-			//and it was given lots of thought... but not actually used atm
-			if err := DoRegister(rData, registerInfo); err != nil {
-				response["code"] = err.Error()
-				rData.SetJsonErrorResponse(response)
-				return
-			}
+	//theoretically, we could lookup the user's email address and allow syncing multiple accounts based on that email...
+	//but decided not to, a separate service could be created to connect/disconnect accounts, and that would be better
+	//so the structure is there to separate lookup from actual record, and multiple lookups can be used to reference a single record
+	//and it was given lots of thought... but not actually used atm
+	if err := DoRegister(rData, registerInfo); err != nil {
+		response["code"] = err.Error()
+		rData.SetJsonErrorResponse(response)
+		return
+	}
 
-			//At this point, registration is done and we now log the user in
-			//maybe we should just return and let the client issue a login with the same token?
-			//would be a bit cleaner to keep the logic in one place...
+	//At this point, registration is done and we now log the user in
+	//maybe we should just return and let the client issue a login with the same token?
+	//would be a bit cleaner to keep the logic in one place...
 
-			userRecord, err := GetUserRecordViaUsername(rData.Ctx, userInfo.Id)
-			if err != nil {
-				userRecord = nil
-			}
-			jwtRecord, jwtString, err := auth.GetNewLoginJWT(rData, userRecord, requestMeta.Audience)
+	userRecord, err := GetUserRecordViaUsername(rData.Ctx, userInfo.Id)
+	if err != nil {
+		userRecord = nil
+	}
 
-			if err != nil {
-				response["code"] = statuscodes.TECHNICAL
-				rData.SetJsonErrorResponse(response)
-				return
-			}
+	if userRecord != nil {
+		audit.RecordWithActor(rData, datastore.AUDIT_EVENT_OAUTH_LINKED, userRecord.GetKey().IntID(), userRecord.GetKey().IntID(), map[string]interface{}{"provider": state.Provider, "via": "register"})
+		storeProviderToken(rData, userRecord.GetKey().IntID(), state, userInfo.Id)
+	}
+	jwtRecord, jwtString, err := auth.GetNewLoginJWT(rData, userRecord, requestMeta.Audience)
 
-			//not this because it will destroy cookie-based login token too! rData.DeleteJwtWhenFinished = true
-			auth.DestroyToken(rData)
+	if err != nil {
+		response["code"] = statuscodes.TECHNICAL
+		rData.SetJsonErrorResponse(response)
+		return
+	}
 
-			response["jwt"] = jwtString
-                        response["userInfo"] = GetUserInfoFromRecord(userRecord)
-			rData.SetJsonSuccessResponse(response)
+	//not this because it will destroy cookie-based login token too! rData.DeleteJwtWhenFinished = true
+	auth.DestroyToken(rData)
 
-			if requestMeta.Audience == auth.JWT_AUDIENCE_COOKIE {
-				auth.SetJWTCookie(rData, jwtString, jwtRecord.GetData().SessionId, int(auth.GetFinalDurationByAudience(jwtRecord.GetData().Audience)))
-			}
-		}
+	response["jwt"] = jwtString
+	response["userInfo"] = GetUserInfoFromRecord(userRecord)
+	rData.SetJsonSuccessResponse(response)
+
+	if requestMeta.Audience == auth.JWT_AUDIENCE_COOKIE {
+		auth.SetJWTCookie(rData, jwtString, jwtRecord.GetData().SessionId, int(auth.GetFinalDurationByAudience(jwtRecord.GetData().Audience)))
 	}
+}
 
+func oauthActionLink(rData *pages.RequestData, state *StateInfo) {
+	response := pages.JsonMapGeneric{}
+
+	userInfo := getUserInfoFromState(rData, state)
+	if userInfo == nil {
+		return
+	}
+
+	if state.Destination != OAUTH_LINK_DESTINATION || state.LinkUserId == 0 {
+		rData.SetJsonErrorCodeResponse(statuscodes.AUTH)
+		return
+	}
+
+	userRecord, err := GetUserRecordViaKey(rData.Ctx, state.LinkUserId)
+	if err != nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+	if userRecord == nil || !userRecord.IsStatusActive() {
+		rData.SetJsonErrorCodeResponse(statuscodes.AUTH)
+		return
+	}
+
+	if err := LinkLoginMethod(rData, userRecord, userInfo.Id, state.Provider); err != nil {
+		rData.SetJsonErrorCodeResponse(err.Error())
+		return
+	}
+
+	storeProviderToken(rData, state.LinkUserId, state, userInfo.Id)
+
+	//state token is single-use - but don't use DestroyToken, that would clear the user's login cookie
+	if err := datastore.Delete(rData.Ctx, rData.JwtRecord); err != nil {
+		rData.LogError(err.Error())
+	}
+
+	response["methods"] = GetLoginMethodInfos(rData, userRecord)
+	response["code"] = statuscodes.IDENTITY_LINKED
+	rData.SetJsonSuccessResponse(response)
 }
 
 func getStateFromJwtRecord(stateJwtRecord *datastore.JwtRecord) (*StateInfo, error) {
@@ -361,25 +536,44 @@ func getStateAndRecordFromJwtString(rData *pages.RequestData, stateJwtString str
 	return stateJwtRecord, nil, errors.New(statuscodes.AUTH)
 }
 
-func getUserInfoFromRequest(rData *pages.RequestData, state *StateInfo, code string) *OAuthUserInfo {
+func exchangeCode(rData *pages.RequestData, state *StateInfo, code string) (*oauth2.Config, *oauth2.Token) {
 
 	endpointConfig := getEndpointConfig(rData, state)
 	if endpointConfig == nil {
-		return nil
+		return nil, nil
+	}
+
+	var exchangeOptions []oauth2.AuthCodeOption
+	if state.CodeVerifier != "" {
+		exchangeOptions = append(exchangeOptions, oauth2.SetAuthURLParam("code_verifier", state.CodeVerifier))
+	}
+	if state.Provider == "apple" {
+		exchangeOptions = append(exchangeOptions, getExchangeOptions_Apple(endpointConfig)...)
 	}
 
-	tok, err := endpointConfig.Exchange(rData.Ctx, code)
+	tok, err := endpointConfig.Exchange(rData.Ctx, code, exchangeOptions...)
 	if err != nil {
 		rData.LogInfo("ERROR!!! %v", err)
 
-		return nil
+		return nil, nil
 	}
 
+	return endpointConfig, tok
+}
+
+func getUserInfoFromToken(rData *pages.RequestData, state *StateInfo, endpointConfig *oauth2.Config, tok *oauth2.Token) *OAuthUserInfo {
+	var err error
+
 	client := endpointConfig.Client(rData.Ctx, tok)
 
 	var userInfo *OAuthUserInfo
 
-	if state.Provider == "google" {
+	if provider := getOidcProvider(rData, state.Provider); provider != nil {
+		userInfo, err = getInfo_Oidc(rData, provider, state, tok)
+		if err != nil {
+			rData.LogError("oidc (%s) error: %v", state.Provider, err)
+		}
+	} else if state.Provider == "google" {
 		googleUserInfo, err := getInfo_Google(rData, client)
 		if err == nil {
 			userInfo = &OAuthUserInfo{
@@ -401,6 +595,16 @@ func getUserInfoFromRequest(rData *pages.RequestData, state *StateInfo, code str
 				AvatarURL: facebookUserInfo.AvatarPicture.Data.Url,
 			}
 		}
+	} else if state.Provider == "apple" {
+		userInfo, err = getInfo_Apple(rData, state, tok)
+		if err != nil {
+			rData.LogError("apple error: %v", err)
+		}
+	} else if state.Provider == "github" {
+		userInfo, err = getInfo_Github(rData, client)
+		if err != nil {
+			rData.LogError("github error: %v", err)
+		}
 	}
 
 	if userInfo != nil {
@@ -412,7 +616,9 @@ func getUserInfoFromRequest(rData *pages.RequestData, state *StateInfo, code str
 
 func getEndpointConfig(rData *pages.RequestData, state *StateInfo) *oauth2.Config {
 
-	if state.Provider == "google" {
+	if provider := getOidcProvider(rData, state.Provider); provider != nil {
+		return getEndpointConfig_Oidc(rData, provider, state)
+	} else if state.Provider == "google" {
 		config := &oauth2.Config{
 			ClientID:     rData.SiteConfig.OAUTH_GOOGLE_CLIENTID,
 			ClientSecret: rData.SiteConfig.OAUTH_GOOGLE_CLIENTSECRET,
@@ -430,6 +636,10 @@ func getEndpointConfig(rData *pages.RequestData, state *StateInfo) *oauth2.Confi
 			Scopes:       []string{"email", "user_about_me", "public_profile"},
 			Endpoint:     facebook.Endpoint,
 		}
+	} else if state.Provider == "apple" {
+		return getEndpointConfig_Apple(rData, state)
+	} else if state.Provider == "github" {
+		return getEndpointConfig_Github(rData, state)
 	}
 	return nil
 
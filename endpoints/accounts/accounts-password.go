@@ -4,6 +4,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/dakom/basic-site-api/lib/audit"
 	"github.com/dakom/basic-site-api/lib/auth"
 	"github.com/dakom/basic-site-api/lib/auth/jwt_scopes"
 	"github.com/dakom/basic-site-api/lib/datastore"
@@ -36,7 +37,7 @@ func ForgotPasswordByUsername(rData *pages.RequestData) {
 		return
 	}
 
-	if !userRecord.GetData().IsActive {
+	if userRecord.IsStatusPending() {
 		rData.SetJsonErrorCodeWithDataResponse(statuscodes.NOT_ACTIVATED, pages.JsonMapGeneric{
 			"uid":   userRecord.GetKeyIntAsString(),
 			"email": userRecord.GetData().Email,
@@ -45,6 +46,9 @@ func ForgotPasswordByUsername(rData *pages.RequestData) {
 			"avid":  strconv.FormatInt(userRecord.GetData().AvatarId, 10),
 		})
 
+		return
+	} else if !userRecord.IsStatusActive() {
+		rData.SetJsonErrorCodeResponse(GetUserStatusCode(userRecord))
 		return
 	}
 
@@ -80,9 +84,11 @@ func sendChangePasswordToken(rData *pages.RequestData, userRecord *datastore.Use
 	url := rData.SiteConfig.EMAIL_TARGET_HOSTNAME + pagenames.APP_PAGE_ACCOUNT_ACTION_PASSWORD_RESET + "/" + jwtString + appUrlParamsFromRequest(rData)
 	//check if userRecord.IsChild() and then get record of parent to actually get email address....
 
-	emailMessage := email.GetEmailChangePasswordMessage(rData.HttpRequest.FormValue("locale"), url)
+	emailMessage, err := email.GetEmailChangePasswordMessage(rData.HttpRequest.FormValue("locale"), url)
 
-	err = email.Send(rData, userRecord.GetFullName(), emailAddress, emailMessage)
+	if err == nil {
+		err = email.Queue(rData, userRecord.GetFullName(), emailAddress, emailMessage)
+	}
 
 	if err != nil {
 		rData.LogError(err.Error())
@@ -115,6 +121,12 @@ func GotChangePasswordActionRequest(rData *pages.RequestData) {
 		return
 	}
 
+	audit.Record(rData, datastore.AUDIT_EVENT_PASSWORD_CHANGED, rData.UserRecord.GetKey().IntID(), nil)
+
+	if err := email.QueueNotification(rData, rData.UserRecord, email.NOTIFY_PASSWORD_CHANGED, nil); err != nil {
+		rData.LogError("TaskQueue non-critical (notification) error %v", err)
+	}
+
 	rData.SetJsonSuccessResponse(nil)
 	rData.DeleteJwtWhenFinished = true
 }
@@ -0,0 +1,439 @@
+package accounts
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	gaeds "google.golang.org/appengine/datastore"
+
+	"github.com/dakom/basic-site-api/lib/audit"
+	"github.com/dakom/basic-site-api/lib/auth"
+	"github.com/dakom/basic-site-api/lib/auth/jwt_scopes"
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/lib/sms"
+	"github.com/dakom/basic-site-api/lib/utils/cipher"
+	"github.com/dakom/basic-site-api/lib/utils/slice"
+	"github.com/dakom/basic-site-api/setup/config/static/statuscodes"
+)
+
+const PHONE_CODE_DIGITS = 6
+const PHONE_CODE_DURATION = 10 * time.Minute
+const PHONE_CODE_RESEND_DELAY = time.Minute
+const PHONE_CODE_MAX_ATTEMPTS = 5 //per number and purpose within PHONE_CODE_WINDOW, not per code
+const PHONE_CODE_MAX_SENDS = 5
+const PHONE_CODE_WINDOW = 24 * time.Hour
+
+var ErrNoPhoneCodeKey = errors.New("PHONE_CODE_KEY is not set")
+
+//Sends a code to a new number, which only gets attached to the account once GotPhoneVerifyRequest confirms it
+func GotPhoneAddRequest(rData *pages.RequestData) {
+	phone, ok := sms.NormalizePhone(rData.HttpRequest.FormValue("phone"))
+	if !ok {
+		rData.SetJsonErrorCodeResponse(statuscodes.INVALID_PHONE)
+		return
+	}
+
+	existingUserRecord, err := GetUserRecordViaUsername(rData.Ctx, phone)
+	if err != nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+	if existingUserRecord != nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.PHONE_EXISTS)
+		return
+	}
+
+	userId := rData.UserRecord.GetKey().IntID()
+	codeKey := datastore.GetPhoneCodeKey(datastore.PHONE_CODE_PURPOSE_VERIFY, strconv.FormatInt(userId, 10))
+
+	code, err := savePhoneCode(rData, codeKey, userId, phone, datastore.PHONE_CODE_PURPOSE_VERIFY)
+	if err != nil {
+		rData.SetJsonErrorCodeResponse(err.Error())
+		return
+	}
+
+	if err := sms.Send(rData, phone, sms.GetPhoneVerifyMessage(rData.HttpRequest.FormValue("locale"), code)); err != nil {
+		rData.LogError(err.Error())
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+
+	rData.SetJsonSuccessCodeResponse(statuscodes.CHECK_PHONE)
+}
+
+//Replaces any previously verified number (and its lookup)
+func GotPhoneVerifyRequest(rData *pages.RequestData) {
+	userId := rData.UserRecord.GetKey().IntID()
+	codeKey := datastore.GetPhoneCodeKey(datastore.PHONE_CODE_PURPOSE_VERIFY, strconv.FormatInt(userId, 10))
+
+	codeRecord, err := checkPhoneCode(rData, codeKey, strings.TrimSpace(rData.HttpRequest.FormValue("code")))
+	if err != nil {
+		rData.SetJsonErrorCodeResponse(err.Error())
+		return
+	}
+
+	phone := codeRecord.GetData().Phone
+	oldPhone := rData.UserRecord.GetData().Phone
+
+	opts := gaeds.TransactionOptions{
+		XG: true,
+	}
+
+	err = gaeds.RunInTransaction(rData.Ctx, func(c context.Context) error {
+		var lookupRecord datastore.UsernameLookupRecord
+
+		err := datastore.LoadFromKey(c, &lookupRecord, phone)
+		if err == nil {
+			if lookupRecord.GetData().UserId != userId {
+				return errors.New(statuscodes.PHONE_EXISTS)
+			}
+		} else if err == gaeds.ErrNoSuchEntity {
+			lookupRecord.GetData().UserId = userId
+			if err := datastore.SaveToKey(c, &lookupRecord, phone); err != nil {
+				return err
+			}
+		} else {
+			return err
+		}
+
+		if oldPhone != "" && oldPhone != phone {
+			var oldLookupRecord datastore.UsernameLookupRecord
+			if err := datastore.LoadFromKey(c, &oldLookupRecord, oldPhone); err == nil {
+				if err := datastore.Delete(c, &oldLookupRecord); err != nil {
+					return err
+				}
+			} else if err != gaeds.ErrNoSuchEntity {
+				return err
+			}
+			rData.UserRecord.GetData().UsernameLookups, _ = slice.DeleteFromString(rData.UserRecord.GetData().UsernameLookups, oldPhone)
+		}
+
+		if !slice.StringInSlice(phone, rData.UserRecord.GetData().UsernameLookups) {
+			rData.UserRecord.GetData().UsernameLookups = append(rData.UserRecord.GetData().UsernameLookups, phone)
+		}
+		rData.UserRecord.GetData().Phone = phone
+		rData.UserRecord.GetData().PhoneDate = time.Now()
+
+		return datastore.Save(c, rData.UserRecord)
+	}, &opts)
+
+	if err != nil {
+		if err.Error() == statuscodes.PHONE_EXISTS {
+			rData.SetJsonErrorCodeResponse(statuscodes.PHONE_EXISTS)
+		} else {
+			rData.LogError(err.Error())
+			rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		}
+		return
+	}
+
+	deletePhoneCode(rData, codeRecord)
+
+	audit.Record(rData, datastore.AUDIT_EVENT_PHONE_CHANGED, userId, map[string]interface{}{"old": oldPhone, "new": phone})
+
+	rData.SetJsonSuccessCodeWithDataResponse(statuscodes.PHONE_CHANGED, GetUserInfoFromRecord(rData.UserRecord))
+}
+
+//Same rule as unlinking an oauth identity - there must still be some other way to log in
+func GotPhoneRemoveRequest(rData *pages.RequestData) {
+	phone := rData.UserRecord.GetData().Phone
+	if phone == "" {
+		rData.SetJsonErrorCodeResponse(statuscodes.IDENTITY_NOT_FOUND)
+		return
+	}
+
+	if len(rData.UserRecord.GetData().UsernameLookups) < 2 {
+		rData.SetJsonErrorCodeResponse(statuscodes.LAST_LOGIN_METHOD)
+		return
+	}
+
+	userId := rData.UserRecord.GetKey().IntID()
+
+	opts := gaeds.TransactionOptions{
+		XG: true,
+	}
+
+	err := gaeds.RunInTransaction(rData.Ctx, func(c context.Context) error {
+		var lookupRecord datastore.UsernameLookupRecord
+
+		err := datastore.LoadFromKey(c, &lookupRecord, phone)
+		if err == nil {
+			//sanity check - never delete someone else's lookup
+			if lookupRecord.GetData().UserId == userId {
+				if err := datastore.Delete(c, &lookupRecord); err != nil {
+					return err
+				}
+			}
+		} else if err != gaeds.ErrNoSuchEntity {
+			return err
+		}
+
+		rData.UserRecord.GetData().UsernameLookups, _ = slice.DeleteFromString(rData.UserRecord.GetData().UsernameLookups, phone)
+		rData.UserRecord.GetData().Phone = ""
+		rData.UserRecord.GetData().PhoneDate = time.Now()
+
+		return datastore.Save(c, rData.UserRecord)
+	}, &opts)
+
+	if err != nil {
+		rData.LogError(err.Error())
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+
+	audit.Record(rData, datastore.AUDIT_EVENT_PHONE_CHANGED, userId, map[string]interface{}{"old": phone, "new": ""})
+
+	rData.SetJsonSuccessCodeWithDataResponse(statuscodes.PHONE_CHANGED, GetUserInfoFromRecord(rData.UserRecord))
+}
+
+//Alternative to ForgotPasswordByUsername - the code is swapped for the same oob jwt the email link carries (see GotPhonePasswordCodeRequest)
+func ForgotPasswordByPhone(rData *pages.RequestData) {
+	phone, ok := sms.NormalizePhone(rData.HttpRequest.FormValue("phone"))
+	if !ok {
+		rData.SetJsonErrorCodeResponse(statuscodes.INVALID_PHONE)
+		return
+	}
+
+	userRecord, err := GetUserRecordViaUsername(rData.Ctx, phone)
+	if err != nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+
+	//the lookup could in theory outlive a removed number
+	if userRecord == nil || userRecord.GetData().Phone != phone {
+		rData.SetJsonErrorCodeResponse(statuscodes.NOUSERNAME)
+		return
+	}
+
+	if !userRecord.IsStatusActive() {
+		rData.SetJsonErrorCodeResponse(GetUserStatusCode(userRecord))
+		return
+	}
+
+	codeKey := datastore.GetPhoneCodeKey(datastore.PHONE_CODE_PURPOSE_PASSWORD, phone)
+
+	code, err := savePhoneCode(rData, codeKey, userRecord.GetKey().IntID(), phone, datastore.PHONE_CODE_PURPOSE_PASSWORD)
+	if err != nil {
+		rData.SetJsonErrorCodeResponse(err.Error())
+		return
+	}
+
+	if err := sms.Send(rData, phone, sms.GetPasswordResetMessage(rData.HttpRequest.FormValue("locale"), code)); err != nil {
+		rData.LogError(err.Error())
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+
+	rData.SetJsonSuccessCodeResponse(statuscodes.CHECK_PHONE)
+}
+
+//The returned jwt is then used with account/password-change-action, exactly like the emailed link
+func GotPhonePasswordCodeRequest(rData *pages.RequestData) {
+	phone, ok := sms.NormalizePhone(rData.HttpRequest.FormValue("phone"))
+	if !ok {
+		rData.SetJsonErrorCodeResponse(statuscodes.INVALID_PHONE)
+		return
+	}
+
+	codeKey := datastore.GetPhoneCodeKey(datastore.PHONE_CODE_PURPOSE_PASSWORD, phone)
+
+	codeRecord, err := checkPhoneCode(rData, codeKey, strings.TrimSpace(rData.HttpRequest.FormValue("code")))
+	if err != nil {
+		rData.SetJsonErrorCodeResponse(err.Error())
+		return
+	}
+
+	deletePhoneCode(rData, codeRecord)
+
+	userRecord, err := GetUserRecordViaKey(rData.Ctx, codeRecord.GetData().UserId)
+	if err != nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+	if userRecord == nil || userRecord.GetData().Phone != phone {
+		rData.SetJsonErrorCodeResponse(statuscodes.NOUSERNAME)
+		return
+	}
+	if !userRecord.IsStatusActive() {
+		rData.SetJsonErrorCodeResponse(GetUserStatusCode(userRecord))
+		return
+	}
+
+	_, jwtString, err := auth.GetNewUserOobJWT(rData, userRecord, jwt_scopes.OOB_USER_PASSWORD_CHANGE|jwt_scopes.ACCOUNT_READ, nil)
+	if err != nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+
+	rData.SetJsonSuccessCodeWithDataResponse(statuscodes.CODE_VERIFIED, pages.JsonMapGeneric{"jwt": jwtString})
+}
+
+//Replaces whatever code was pending under codeKey, returns the plain code for sending
+//The attempts and sends are carried over within PHONE_CODE_WINDOW, after which it's a clean slate
+//returned error is a statuscode
+func savePhoneCode(rData *pages.RequestData, codeKey string, userId int64, phone string, purpose string) (string, error) {
+	var failCode string
+
+	code, err := newPhoneCode()
+	if err != nil {
+		return "", errors.New(statuscodes.TECHNICAL)
+	}
+
+	codeHash, err := getPhoneCodeHash(rData, codeKey, code)
+	if err != nil {
+		rData.LogError(err.Error())
+		return "", errors.New(statuscodes.TECHNICAL)
+	}
+
+	err = gaeds.RunInTransaction(rData.Ctx, func(c context.Context) error {
+		var codeRecord datastore.PhoneCodeRecord
+
+		failCode = ""
+		now := time.Now()
+
+		newData := &datastore.PhoneCodeData{
+			UserId:      userId,
+			Phone:       phone,
+			Purpose:     purpose,
+			CodeHash:    hex.EncodeToString(codeHash),
+			Sends:       1,
+			WindowStart: now,
+			Expires:     now.Add(PHONE_CODE_DURATION),
+			Date:        now,
+		}
+
+		err := datastore.LoadFromKey(c, &codeRecord, codeKey)
+		if err == nil {
+			data := codeRecord.GetData()
+
+			if now.Sub(data.Date) < PHONE_CODE_RESEND_DELAY {
+				failCode = statuscodes.TRY_LATER
+				return nil
+			}
+
+			if now.Sub(data.WindowStart) < PHONE_CODE_WINDOW {
+				if data.Sends >= PHONE_CODE_MAX_SENDS || data.Attempts >= PHONE_CODE_MAX_ATTEMPTS {
+					failCode = statuscodes.TRY_LATER
+					return nil
+				}
+
+				newData.Attempts = data.Attempts
+				newData.Sends = data.Sends + 1
+				newData.WindowStart = data.WindowStart
+			}
+		} else if err != gaeds.ErrNoSuchEntity {
+			return err
+		}
+
+		codeRecord.SetData(newData)
+		return datastore.SaveToKey(c, &codeRecord, codeKey)
+	}, nil)
+
+	if err != nil {
+		rData.LogError(err.Error())
+		return "", errors.New(statuscodes.TECHNICAL)
+	}
+
+	if failCode != "" {
+		return "", errors.New(failCode)
+	}
+
+	return code, nil
+}
+
+//Wrong guesses count against the number (see savePhoneCode), the code is useless after PHONE_CODE_MAX_ATTEMPTS of them
+//returned error is a statuscode
+func checkPhoneCode(rData *pages.RequestData, codeKey string, code string) (*datastore.PhoneCodeRecord, error) {
+	if code == "" {
+		return nil, errors.New(statuscodes.MISSINGINFO)
+	}
+
+	codeHash, err := getPhoneCodeHash(rData, codeKey, code)
+	if err != nil {
+		rData.LogError(err.Error())
+		return nil, errors.New(statuscodes.TECHNICAL)
+	}
+
+	var codeRecord datastore.PhoneCodeRecord
+	var failCode string
+
+	//failures which change the record still have to commit, so they're passed out via failCode rather than the error
+	err = gaeds.RunInTransaction(rData.Ctx, func(c context.Context) error {
+		failCode = ""
+
+		err := datastore.LoadFromKey(c, &codeRecord, codeKey)
+		if err == gaeds.ErrNoSuchEntity {
+			failCode = statuscodes.INVALID_CODE
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		//kept rather than deleted, so the attempts still count against the next code
+		if time.Now().After(codeRecord.GetData().Expires) || codeRecord.GetData().Attempts >= PHONE_CODE_MAX_ATTEMPTS {
+			failCode = statuscodes.EXPIRED
+			return nil
+		}
+
+		storedHash, err := hex.DecodeString(codeRecord.GetData().CodeHash)
+		if err != nil {
+			return err
+		}
+
+		if !hmac.Equal(storedHash, codeHash) {
+			failCode = statuscodes.INVALID_CODE
+			codeRecord.GetData().Attempts++
+			return datastore.Save(c, &codeRecord)
+		}
+
+		return nil
+	}, nil)
+
+	if err != nil {
+		rData.LogError(err.Error())
+		return nil, errors.New(statuscodes.TECHNICAL)
+	}
+
+	if failCode != "" {
+		return nil, errors.New(failCode)
+	}
+
+	return &codeRecord, nil
+}
+
+//the record key is part of the message, so a code is only good for the number and purpose it was sent for
+func getPhoneCodeHash(rData *pages.RequestData, codeKey string, code string) ([]byte, error) {
+	if rData.SiteConfig.PHONE_CODE_KEY == "" {
+		return nil, ErrNoPhoneCodeKey
+	}
+	return cipher.CreateHmac([]byte(codeKey+"-"+code), []byte(rData.SiteConfig.PHONE_CODE_KEY)), nil
+}
+
+//non-critical, the code expires anyway
+func deletePhoneCode(rData *pages.RequestData, codeRecord *datastore.PhoneCodeRecord) {
+	if err := datastore.Delete(rData.Ctx, codeRecord); err != nil {
+		rData.LogError(err.Error())
+	}
+}
+
+func newPhoneCode() (string, error) {
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(PHONE_CODE_DIGITS), nil)
+
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%0*d", PHONE_CODE_DIGITS, n), nil
+}
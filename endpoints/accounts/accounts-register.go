@@ -115,7 +115,10 @@ func DoRegister(rData *pages.RequestData, info *RegisterInfo) error {
 		}
 	}
 
-	if info.Username == "" || info.FirstName == "" || info.LastName == "" || info.Password == "" {
+	//oauth providers don't always have a last name (github only has a single display name, apple only sends the name once, if at all)
+	lastNameRequired := info.LookupType != LOOKUP_TYPE_OAUTH
+
+	if info.Username == "" || info.FirstName == "" || (info.LastName == "" && lastNameRequired) || info.Password == "" {
 		return errors.New(statuscodes.MISSINGINFO)
 	}
 
@@ -123,7 +126,10 @@ func DoRegister(rData *pages.RequestData, info *RegisterInfo) error {
 		return errors.New(statuscodes.INVALID_PASSWORD)
 	}
 
-	displayName := info.FirstName + " " + info.LastName[0:1] + "."
+	displayName := info.FirstName
+	if info.LastName != "" {
+		displayName += " " + info.LastName[0:1] + "."
+	}
 	if rData.SiteConfig.DisplayNameValidator != nil && !rData.SiteConfig.DisplayNameValidator(displayName) {
 		return errors.New(statuscodes.INVALID_DISPLAYNAME)
 	}
@@ -167,7 +173,9 @@ func DoRegister(rData *pages.RequestData, info *RegisterInfo) error {
 			userRecord.GetData().ParentId = info.ParentId
 		}
 		if info.LookupType == LOOKUP_TYPE_OAUTH || parentRecord != nil {
-			userRecord.GetData().IsActive = true
+			userRecord.SetStatus(datastore.USER_STATUS_ACTIVE, "")
+		} else {
+			userRecord.SetStatus(datastore.USER_STATUS_PENDING, "")
 		}
 		if info.Newsletter {
 			userRecord.GetData().UserMailinglistData.HasMarketingNewsletter = true
@@ -193,7 +201,7 @@ func DoRegister(rData *pages.RequestData, info *RegisterInfo) error {
 			}
 		}
 
-		if !userRecord.GetData().IsActive {
+		if userRecord.IsStatusPending() {
 			params := url.Values{}
 			params.Set("uname", info.Username)
 			if info.AppId != "" {
@@ -213,7 +221,7 @@ func DoRegister(rData *pages.RequestData, info *RegisterInfo) error {
 		if info.EmailAddress != "" {
 			//note... theoretically this could easily be a bad/spam address... but on the other hand they might just not complete the activation process
 			//makes sense to grab it and then change it if we get in trouble with spam
-			//similarly since we have the flag in datastore, we could write a utility that culls the list before sending, even with tuning (i.e. cull 70% of non-activated addresses before sending a blast)
+			//similarly since we have the flag in datastore, the list can be culled before sending a blast (see admin/mailinglist-resync with cull=true)
 			params := url.Values{}
 			params.Set("uid", strconv.FormatInt(userRecord.GetKey().IntID(), 10))
 			if info.AppId != "" {
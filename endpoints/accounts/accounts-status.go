@@ -0,0 +1,86 @@
+package accounts
+
+import (
+	"strings"
+
+	"github.com/dakom/basic-site-api/lib/audit"
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/lib/utils/text"
+	"github.com/dakom/basic-site-api/setup/config/static/statuscodes"
+)
+
+//maps the user's account status to the code that's sent back to the client
+func GetUserStatusCode(userRecord *datastore.UserRecord) string {
+	switch userRecord.GetStatus() {
+	case datastore.USER_STATUS_ACTIVE:
+		return statuscodes.ACCOUNT_ACTIVE
+	case datastore.USER_STATUS_SUSPENDED:
+		return statuscodes.ACCOUNT_SUSPENDED
+	case datastore.USER_STATUS_DELETED:
+		return statuscodes.ACCOUNT_DELETED
+	default:
+		return statuscodes.NOT_ACTIVATED
+	}
+}
+
+//admin only - suspend, reinstate, delete etc.
+func GotStatusChangeRequest(rData *pages.RequestData) {
+	status := strings.ToLower(strings.TrimSpace(rData.HttpRequest.FormValue("status")))
+	reason := strings.TrimSpace(rData.HttpRequest.FormValue("reason"))
+
+	if !datastore.IsValidUserStatus(status) {
+		rData.SetJsonErrorCodeResponse(statuscodes.INVALID_STATUS)
+		return
+	}
+
+	userId, err := text.StringToInt64(rData.HttpRequest.FormValue("uid"))
+	if err != nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.MISSINGINFO)
+		return
+	}
+
+	if userId == rData.UserRecord.GetKey().IntID() {
+		//don't let an admin lock themselves out
+		rData.SetJsonErrorCodeResponse(statuscodes.INVALID_STATUS)
+		return
+	}
+
+	userRecord, err := GetUserRecordViaKey(rData.Ctx, userId)
+	if err != nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+	if userRecord == nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.NOUSERNAME)
+		return
+	}
+
+	oldStatus := userRecord.GetStatus()
+	userRecord.SetStatus(status, reason)
+
+	if err := datastore.Save(rData.Ctx, userRecord); err != nil {
+		rData.LogError(err.Error())
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+
+	audit.Record(rData, datastore.AUDIT_EVENT_STATUS_CHANGED, userId, map[string]interface{}{"old": oldStatus, "new": status, "reason": reason})
+
+	//search errors aren't critical but should be investigated by backend
+	if status == datastore.USER_STATUS_ACTIVE {
+		if err := userRecord.AddToSearch(rData.Ctx); err != nil {
+			rData.LogError("%v", err)
+		}
+	} else if status == datastore.USER_STATUS_SUSPENDED || status == datastore.USER_STATUS_DELETED {
+		if err := RemoveFromSearch(rData.Ctx, userRecord.GetKeyIntAsString()); err != nil {
+			rData.LogError("%v", err)
+		}
+	}
+
+	rData.SetJsonSuccessCodeWithDataResponse(statuscodes.STATUS_CHANGED, pages.JsonMapGeneric{
+		"uid":    userRecord.GetKeyIntAsString(),
+		"status": userRecord.GetStatus(),
+		"reason": userRecord.GetData().StatusReason,
+	})
+}
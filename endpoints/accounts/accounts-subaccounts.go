@@ -3,6 +3,8 @@ package accounts
 import (
 	"strings"
 
+	"github.com/dakom/basic-site-api/lib/audit"
+	"github.com/dakom/basic-site-api/lib/datastore"
 	"github.com/dakom/basic-site-api/lib/pages"
 )
 
@@ -62,5 +64,8 @@ func CreateSubaccountRequest(rData *pages.RequestData) {
 		rData.SetJsonErrorCodeResponse(err.Error())
 		return
 	}
+
+	audit.Record(rData, datastore.AUDIT_EVENT_SUBACCOUNT_CREATED, info.ParentId, map[string]interface{}{"uname": info.Username})
+
 	rData.SetJsonSuccessResponse(nil)
 }
@@ -1,11 +1,11 @@
 package webhooks
 
 import (
-	"image"
 	"io"
 	"strconv"
 
 	"github.com/dakom/basic-site-api/endpoints/accounts"
+	"github.com/dakom/basic-site-api/lib/avatars"
 	"github.com/dakom/basic-site-api/lib/datastore"
 	"github.com/dakom/basic-site-api/lib/email"
 	"github.com/dakom/basic-site-api/lib/pages"
@@ -41,14 +41,19 @@ func AvatarPull(rData *pages.RequestData) {
 	defer resp.Body.Close()
 
 	//Read in full image
-	srcImage, _, err := image.Decode(io.LimitReader(resp.Body, rData.SiteConfig.MAX_READ_SIZE))
-	if err != nil {
-		rData.SetHttpStatusResponse(400, err.Error())
-		return
+	srcImage, err := avatars.Decode(rData, io.LimitReader(resp.Body, rData.SiteConfig.MAX_READ_SIZE))
+	if err == nil {
+		err = accounts.UpdateAvatar(rData, srcImage, nil, &userRecord)
 	}
 
-	accounts.UpdateAvatar(rData, srcImage, &userRecord)
-
+	//a task is retried until it gets a 2xx, which would only turn out the same for these (and quarantine it again every time)
+	switch err {
+	case nil:
+	case avatars.ErrQuarantined, avatars.ErrRejected, avatars.ErrFormatNotAllowed, avatars.ErrTooLarge:
+		rData.LogInfo("avatar from %s for %d not used: %v", aurl, intID, err)
+	default:
+		rData.SetHttpStatusResponse(500, err.Error())
+	}
 }
 
 func MailingListSubscribe(rData *pages.RequestData) {
@@ -73,12 +78,63 @@ func MailingListSubscribe(rData *pages.RequestData) {
 	}
 }
 
+func NotificationSend(rData *pages.RequestData) {
+	var userRecord datastore.UserRecord
+
+	if intID, err := strconv.ParseInt(rData.HttpRequest.FormValue("uid"), 10, 64); err != nil {
+		rData.SetHttpStatusResponse(400, err.Error())
+		return
+	} else if err := datastore.LoadFromKey(rData.Ctx, &userRecord, intID); err != nil {
+		rData.SetHttpStatusResponse(400, err.Error())
+		return
+	}
+
+	if err := email.SendNotification(rData, &userRecord, rData.HttpRequest.FormValue("ntype"), rData.HttpRequest.Form); err != nil {
+		rData.SetHttpStatusResponse(400, err.Error())
+		return
+	}
+}
+
+func EmailSend(rData *pages.RequestData) {
+	if err := email.DeliverQueued(rData); err != nil {
+		rData.SetHttpStatusResponse(500, err.Error())
+		return
+	}
+}
+
+func EmailDeliveryCleanup(rData *pages.RequestData) {
+	if err := email.CleanupDeliveries(rData); err != nil {
+		rData.SetHttpStatusResponse(500, err.Error())
+		return
+	}
+}
+
 func MailingListUpdateEmail(rData *pages.RequestData) {
 	MailingListUpdate(rData, "email")
 }
 func MailingListUpdateName(rData *pages.RequestData) {
 	MailingListUpdate(rData, "name")
 }
+func MailingListUpdateSubscription(rData *pages.RequestData) {
+	MailingListUpdate(rData, "subscription")
+}
+func MailingListUpdateInterests(rData *pages.RequestData) {
+	MailingListUpdate(rData, "interests")
+}
+
+func MailingListResync(rData *pages.RequestData) {
+	if err := email.RunMailingListResyncBatch(rData); err != nil {
+		rData.SetHttpStatusResponse(500, err.Error())
+		return
+	}
+}
+
+func AvatarRegenerate(rData *pages.RequestData) {
+	if err := avatars.RunRegenerateBatch(rData); err != nil {
+		rData.SetHttpStatusResponse(500, err.Error())
+		return
+	}
+}
 
 func MailingListUpdate(rData *pages.RequestData, updateType string) {
 	var userRecord datastore.UserRecord
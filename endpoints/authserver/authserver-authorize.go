@@ -0,0 +1,285 @@
+package authserver
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+
+	gaeds "google.golang.org/appengine/datastore"
+
+	"github.com/dakom/basic-site-api/lib/audit"
+	"github.com/dakom/basic-site-api/lib/auth"
+	"github.com/dakom/basic-site-api/lib/auth/jwt_scopes"
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/setup/config/static/pagenames"
+	"github.com/dakom/basic-site-api/setup/config/static/statuscodes"
+)
+
+//The validated /authorize params, carried in the Extra of a short-lived system oob jwt
+//while the user is on the consent page of the app
+type AuthorizeRequest struct {
+	ClientId            string `json:"cid"`
+	RedirectUri         string `json:"ruri"`
+	RedirectUriSent     bool   `json:"rsent,omitempty"` //i.e. not the client's only registered one, the token request must repeat it then
+	Scopes              int64  `json:"scopes"`
+	State               string `json:"state,omitempty"`
+	CodeChallenge       string `json:"cc,omitempty"`
+	CodeChallengeMethod string `json:"ccm,omitempty"`
+}
+
+//Flow:
+//1. client sends the browser here, we validate and bounce to APP_PAGE_OAUTH_CONSENT/<request>
+//2. app gets the details via GotAuthorizeInfoRequest and shows a consent screen (or not, if consent isn't required)
+//3. app posts the user's decision to GotAuthorizeDecisionRequest and sends the browser to the redirect it gets back
+func Authorize(rData *pages.RequestData) {
+	clientRecord, err := getClient(rData, rData.HttpRequest.FormValue("client_id"))
+	if err != nil {
+		rData.LogError(err.Error())
+		rData.SetHttpStatusResponse(500, ERROR_SERVER_ERROR)
+		return
+	}
+	if clientRecord == nil {
+		rData.SetHttpStatusResponse(400, ERROR_INVALID_CLIENT)
+		return
+	}
+
+	//never redirect to an unregistered uri - that's how codes get stolen
+	redirectUri := rData.HttpRequest.FormValue("redirect_uri")
+	if redirectUri == "" && len(clientRecord.GetData().RedirectUris) == 1 {
+		redirectUri = clientRecord.GetData().RedirectUris[0]
+	}
+	if !isAllowedRedirectUri(clientRecord, redirectUri) {
+		rData.SetHttpStatusResponse(400, ERROR_INVALID_REQUEST)
+		return
+	}
+
+	state := rData.HttpRequest.FormValue("state")
+
+	//from here on in errors go back to the client
+	if rData.HttpRequest.FormValue("response_type") != "code" {
+		rData.HttpRedirectDestination = getRedirectUrl(redirectUri, state, url.Values{"error": {ERROR_UNSUPPORTED_RESPONSE}})
+		return
+	}
+
+	scopes, ok := getRequestedScopes(clientRecord, rData.HttpRequest.FormValue("scope"))
+	if !ok {
+		rData.HttpRedirectDestination = getRedirectUrl(redirectUri, state, url.Values{"error": {ERROR_INVALID_SCOPE}})
+		return
+	}
+
+	//only S256 is supported, and public clients have no secret so PKCE is mandatory for them
+	codeChallenge := rData.HttpRequest.FormValue("code_challenge")
+	codeChallengeMethod := rData.HttpRequest.FormValue("code_challenge_method")
+	if (codeChallenge != "" && codeChallengeMethod != "S256") || (codeChallenge == "" && !clientRecord.IsConfidential()) {
+		rData.HttpRedirectDestination = getRedirectUrl(redirectUri, state, url.Values{"error": {ERROR_INVALID_REQUEST}})
+		return
+	}
+
+	request := &AuthorizeRequest{
+		ClientId:            clientRecord.GetKey().StringID(),
+		RedirectUri:         redirectUri,
+		RedirectUriSent:     rData.HttpRequest.FormValue("redirect_uri") != "",
+		Scopes:              scopes,
+		State:               state,
+		CodeChallenge:       codeChallenge,
+		CodeChallengeMethod: codeChallengeMethod,
+	}
+
+	extraBytes, err := json.Marshal(request)
+	if err != nil {
+		rData.HttpRedirectDestination = getRedirectUrl(redirectUri, state, url.Values{"error": {ERROR_SERVER_ERROR}})
+		return
+	}
+
+	_, jwtString, err := auth.GetNewSystemsOobJWT(rData, auth.SYSTEM_ID_OAUTH_SERVER, 0, string(extraBytes))
+	if err != nil {
+		rData.LogError(err.Error())
+		rData.HttpRedirectDestination = getRedirectUrl(redirectUri, state, url.Values{"error": {ERROR_SERVER_ERROR}})
+		return
+	}
+
+	rData.HttpRedirectDestination = rData.SiteConfig.EMAIL_TARGET_HOSTNAME + pagenames.APP_PAGE_OAUTH_CONSENT + "/" + jwtString
+}
+
+//what the consent screen needs to show
+func GotAuthorizeInfoRequest(rData *pages.RequestData) {
+	_, request, clientRecord := getAuthorizeRequest(rData)
+	if request == nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.AUTH_OOB)
+		return
+	}
+
+	consentRequired, err := isConsentRequired(rData, clientRecord, request.Scopes)
+	if err != nil {
+		rData.LogError(err.Error())
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+
+	rData.SetJsonSuccessResponse(pages.JsonMapGeneric{
+		"client": pages.JsonMapGeneric{
+			"id":         request.ClientId,
+			"name":       clientRecord.GetData().Name,
+			"firstParty": clientRecord.GetData().IsFirstParty,
+		},
+		"scope":           getScopeNames(request.Scopes),
+		"redirectUri":     request.RedirectUri,
+		"consentRequired": consentRequired,
+	})
+}
+
+//approve=true to grant, anything else denies
+//the response is always a redirect back to the client (which gets either a code or an error)
+func GotAuthorizeDecisionRequest(rData *pages.RequestData) {
+	requestRecord, request, clientRecord := getAuthorizeRequest(rData)
+	if request == nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.AUTH_OOB)
+		return
+	}
+
+	//single use
+	if err := datastore.Delete(rData.Ctx, requestRecord); err != nil {
+		rData.LogError(err.Error())
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+
+	if rData.HttpRequest.FormValue("approve") != "true" {
+		rData.SetJsonSuccessResponse(pages.JsonMapGeneric{
+			"redirect": getRedirectUrl(request.RedirectUri, request.State, url.Values{"error": {ERROR_ACCESS_DENIED}}),
+		})
+		return
+	}
+
+	userId := rData.UserRecord.GetKey().IntID()
+
+	if err := saveConsent(rData, userId, request.ClientId, request.Scopes); err != nil {
+		rData.LogError(err.Error())
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+
+	extraMap := map[string]interface{}{
+		"ruri": request.RedirectUri,
+	}
+	if request.RedirectUriSent {
+		extraMap["rsent"] = true
+	}
+	if request.CodeChallenge != "" {
+		extraMap["cc"] = request.CodeChallenge
+	}
+
+	//codes are never accepted as bearer tokens, so it's safe for them to carry the granted scopes
+	_, code, err := auth.GetNewOauthJWT(rData, clientRecord.GetKey().StringID(), userId, auth.JWT_USERTYPE_USER_RECORD, request.Scopes, auth.JWT_AUDIENCE_OAUTH_CODE, extraMap)
+	if err != nil {
+		rData.LogError(err.Error())
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+
+	audit.Record(rData, datastore.AUDIT_EVENT_OAUTH_AUTHORIZED, userId, map[string]interface{}{"client": request.ClientId, "scope": getScopeNames(request.Scopes)})
+
+	rData.SetJsonSuccessResponse(pages.JsonMapGeneric{
+		"redirect": getRedirectUrl(request.RedirectUri, request.State, url.Values{"code": {code}}),
+	})
+}
+
+//the "request" param is the jwt that Authorize sent along to the consent page
+func getAuthorizeRequest(rData *pages.RequestData) (*datastore.JwtRecord, *AuthorizeRequest, *datastore.OauthClientRecord) {
+	var request AuthorizeRequest
+
+	jwtRecord, isExpired := auth.GetJwtFromString(rData, rData.HttpRequest.FormValue("request"), true)
+	if jwtRecord == nil || isExpired {
+		return nil, nil, nil
+	}
+
+	jwtData := jwtRecord.GetData()
+	if jwtData.Audience != auth.JWT_AUDIENCE_OOB || jwtData.UserType != auth.JWT_USERTYPE_SYSTEM_ID || jwtData.UserId != auth.SYSTEM_ID_OAUTH_SERVER {
+		return nil, nil, nil
+	}
+
+	if err := json.Unmarshal([]byte(jwtData.Extra), &request); err != nil {
+		return nil, nil, nil
+	}
+
+	//client may have been removed in the meantime
+	clientRecord, err := getClient(rData, request.ClientId)
+	if err != nil || clientRecord == nil || !isAllowedRedirectUri(clientRecord, request.RedirectUri) {
+		return nil, nil, nil
+	}
+
+	return jwtRecord, &request, clientRecord
+}
+
+//empty scope string means everything the client is allowed
+func getRequestedScopes(clientRecord *datastore.OauthClientRecord, scopeString string) (int64, bool) {
+	allowedScopes := clientRecord.GetData().AllowedScopes &^ jwt_scopes.OAUTH_CLIENT
+
+	if strings.TrimSpace(scopeString) == "" {
+		return allowedScopes, allowedScopes != 0
+	}
+
+	scopes, ok := jwt_scopes.FromNames(scopeString)
+	if !ok || scopes == 0 || (scopes&allowedScopes) != scopes {
+		return 0, false
+	}
+
+	return scopes, true
+}
+
+func isConsentRequired(rData *pages.RequestData, clientRecord *datastore.OauthClientRecord, scopes int64) (bool, error) {
+	var consentRecord datastore.OauthConsentRecord
+
+	if clientRecord.GetData().IsFirstParty {
+		return false, nil
+	}
+
+	err := datastore.LoadFromKey(rData.Ctx, &consentRecord, datastore.GetOauthConsentKey(rData.UserRecord.GetKey().IntID(), clientRecord.GetKey().StringID()))
+	if err == gaeds.ErrNoSuchEntity {
+		return true, nil
+	} else if err != nil {
+		return true, err
+	}
+
+	return (consentRecord.GetData().Scopes & scopes) != scopes, nil
+}
+
+//consent only ever grows here - revoking it is a matter of deleting the record
+func saveConsent(rData *pages.RequestData, userId int64, clientId string, scopes int64) error {
+	var consentRecord datastore.OauthConsentRecord
+
+	consentKey := datastore.GetOauthConsentKey(userId, clientId)
+
+	err := datastore.LoadFromKey(rData.Ctx, &consentRecord, consentKey)
+	if err != nil && err != gaeds.ErrNoSuchEntity {
+		return err
+	}
+
+	consentRecord.GetData().UserId = userId
+	consentRecord.GetData().ClientId = clientId
+	consentRecord.GetData().Scopes |= scopes
+	consentRecord.GetData().Date = time.Now()
+
+	return datastore.SaveToKey(rData.Ctx, &consentRecord, consentKey)
+}
+
+func getRedirectUrl(redirectUri string, state string, params url.Values) string {
+	if state != "" {
+		params.Set("state", state)
+	}
+
+	parsedUrl, err := url.Parse(redirectUri)
+	if err != nil {
+		return redirectUri
+	}
+
+	query := parsedUrl.Query()
+	for key, vals := range params {
+		query[key] = vals
+	}
+	parsedUrl.RawQuery = query.Encode()
+
+	return parsedUrl.String()
+}
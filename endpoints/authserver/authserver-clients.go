@@ -0,0 +1,171 @@
+package authserver
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dakom/basic-site-api/lib/auth/jwt_scopes"
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/lib/utils/cipher"
+	"github.com/dakom/basic-site-api/lib/utils/text"
+	"github.com/dakom/basic-site-api/setup/config/static/statuscodes"
+)
+
+type ClientInfo struct {
+	Id           string   `json:"id"`
+	Name         string   `json:"name"`
+	RedirectUris []string `json:"redirectUris"`
+	Scope        string   `json:"scope"`
+	Public       bool     `json:"public"`
+	FirstParty   bool     `json:"firstParty"`
+	Machine      bool     `json:"machine"`
+	OwnerId      string   `json:"owner"`
+	Date         int64    `json:"date"`
+}
+
+func GetClientInfo(clientRecord *datastore.OauthClientRecord) *ClientInfo {
+	data := clientRecord.GetData()
+
+	return &ClientInfo{
+		Id:           clientRecord.GetKey().StringID(),
+		Name:         data.Name,
+		RedirectUris: data.RedirectUris,
+		Scope:        getScopeNames(data.AllowedScopes),
+		Public:       !clientRecord.IsConfidential(),
+		FirstParty:   data.IsFirstParty,
+		Machine:      (data.AllowedScopes & jwt_scopes.OAUTH_CLIENT) != 0,
+		OwnerId:      strconv.FormatInt(data.OwnerId, 10),
+		Date:         data.AddedDate.Unix(),
+	}
+}
+
+//admin only
+//params: name, redirect_uris (space separated), scope (space separated names)
+//and "true"/"false" for public, firstparty, machine (allows client_credentials)
+//the secret is only ever returned here, we just keep the hash
+func GotClientCreateRequest(rData *pages.RequestData) {
+	var clientSecret string
+
+	name := strings.TrimSpace(rData.HttpRequest.FormValue("name"))
+	redirectUris := strings.Fields(rData.HttpRequest.FormValue("redirect_uris"))
+	isPublic := rData.HttpRequest.FormValue("public") == "true"
+	isMachine := rData.HttpRequest.FormValue("machine") == "true"
+
+	if name == "" || (len(redirectUris) == 0 && !isMachine) {
+		rData.SetJsonErrorCodeResponse(statuscodes.MISSINGINFO)
+		return
+	}
+
+	for _, redirectUri := range redirectUris {
+		if parsedUrl, err := url.Parse(redirectUri); err != nil || parsedUrl.Scheme == "" || parsedUrl.Fragment != "" {
+			rData.SetJsonErrorCodeResponse(statuscodes.INVALID_REDIRECT)
+			return
+		}
+	}
+
+	scopes, ok := jwt_scopes.FromNames(rData.HttpRequest.FormValue("scope"))
+	if !ok {
+		rData.SetJsonErrorCodeResponse(statuscodes.INVALID_SCOPE)
+		return
+	}
+
+	if isMachine {
+		if isPublic {
+			//no secret means no way to authenticate without a user
+			rData.SetJsonErrorCodeResponse(statuscodes.INVALID_SCOPE)
+			return
+		}
+		scopes |= jwt_scopes.OAUTH_CLIENT
+	}
+
+	if scopes == 0 {
+		rData.SetJsonErrorCodeResponse(statuscodes.INVALID_SCOPE)
+		return
+	}
+
+	clientId, err := text.RandomHexString(12)
+	if err != nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+
+	var clientRecord datastore.OauthClientRecord
+	clientRecord.SetData(&datastore.OauthClientData{
+		Name:          name,
+		RedirectUris:  redirectUris,
+		AllowedScopes: scopes,
+		IsFirstParty:  rData.HttpRequest.FormValue("firstparty") == "true",
+		OwnerId:       rData.UserRecord.GetKey().IntID(),
+		AddedDate:     time.Now(),
+	})
+
+	if !isPublic {
+		if clientSecret, err = text.RandomHexString(32); err != nil {
+			rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+			return
+		}
+		if clientRecord.GetData().SecretHash, err = cipher.NewPWHash(clientSecret, nil); err != nil {
+			rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+			return
+		}
+	}
+
+	if err := datastore.SaveToKey(rData.Ctx, &clientRecord, clientId); err != nil {
+		rData.LogError(err.Error())
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+
+	response := pages.JsonMapGeneric{
+		"client": GetClientInfo(&clientRecord),
+	}
+	if clientSecret != "" {
+		response["secret"] = clientSecret
+	}
+
+	rData.SetJsonSuccessCodeWithDataResponse(statuscodes.CLIENT_CREATED, response)
+}
+
+//admin only
+func GotClientListRequest(rData *pages.RequestData) {
+	clientRecords, err := datastore.GetAllOauthClients(rData.Ctx)
+	if err != nil {
+		rData.LogError(err.Error())
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+
+	infos := make([]*ClientInfo, len(clientRecords))
+	for idx, clientRecord := range clientRecords {
+		infos[idx] = GetClientInfo(clientRecord)
+	}
+
+	rData.SetJsonSuccessResponse(pages.JsonMapGeneric{
+		"clients": infos,
+	})
+}
+
+//admin only - outstanding tokens die with the client, since every use checks that it still exists
+func GotClientDeleteRequest(rData *pages.RequestData) {
+	clientRecord, err := getClient(rData, rData.HttpRequest.FormValue("client_id"))
+	if err != nil {
+		rData.LogError(err.Error())
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+	if clientRecord == nil {
+		rData.SetJsonErrorCodeResponse(statuscodes.CLIENT_NOT_FOUND)
+		return
+	}
+
+	if err := datastore.Delete(rData.Ctx, clientRecord); err != nil {
+		rData.LogError(err.Error())
+		rData.SetJsonErrorCodeResponse(statuscodes.TECHNICAL)
+		return
+	}
+
+	rData.SetJsonSuccessCodeResponse(statuscodes.CLIENT_DELETED)
+}
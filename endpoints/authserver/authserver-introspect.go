@@ -0,0 +1,93 @@
+package authserver
+
+import (
+	"github.com/dakom/basic-site-api/lib/auth"
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/pages"
+)
+
+//RFC 7662 - for resource servers (confidential clients) to check a token
+//first party clients may introspect any token, everyone else only their own
+func GotIntrospectRequest(rData *pages.RequestData) {
+	rData.HttpWriter.Header().Set("Cache-Control", "no-store")
+
+	clientRecord := authenticateClient(rData)
+	if clientRecord == nil || !clientRecord.IsConfidential() {
+		setOauthError(rData, ERROR_INVALID_CLIENT)
+		return
+	}
+
+	jwtRecord, isExpired := auth.GetJwtFromString(rData, rData.HttpRequest.FormValue("token"), true)
+	if jwtRecord == nil || isExpired || !isIntrospectable(clientRecord, jwtRecord) {
+		rData.SetJsonSuccessResponse(pages.JsonMapGeneric{"active": false})
+		return
+	}
+
+	jwtData := jwtRecord.GetData()
+
+	if jwtData.Subject != clientRecord.GetKey().StringID() {
+		if issuer, err := getClient(rData, jwtData.Subject); err != nil || issuer == nil {
+			rData.SetJsonSuccessResponse(pages.JsonMapGeneric{"active": false})
+			return
+		}
+	}
+
+	if jwtData.UserType == auth.JWT_USERTYPE_USER_RECORD && !isUserActive(rData, jwtData.UserId) {
+		rData.SetJsonSuccessResponse(pages.JsonMapGeneric{"active": false})
+		return
+	}
+
+	response := pages.JsonMapGeneric{
+		"active":     true,
+		"client_id":  jwtData.Subject,
+		"scope":      getScopeNames(jwtData.Scopes),
+		"token_type": "Bearer",
+		"exp":        jwtData.ExpiresAt,
+		"iat":        jwtData.IssuedAt,
+	}
+
+	if jwtData.Audience == auth.JWT_AUDIENCE_OAUTH_REFRESH {
+		response["token_type"] = "refresh_token"
+		response["exp"] = jwtData.FinalExpires
+	}
+
+	if userId := getUserIdString(jwtRecord); userId != "" {
+		response["sub"] = userId
+	}
+
+	rData.SetJsonSuccessResponse(response)
+}
+
+//RFC 7009 - clients can revoke their own access or refresh tokens
+//always succeeds, as per spec, so as not to leak whether the token was valid
+func GotRevokeRequest(rData *pages.RequestData) {
+	clientRecord := authenticateClient(rData)
+	if clientRecord == nil {
+		setOauthError(rData, ERROR_INVALID_CLIENT)
+		return
+	}
+
+	jwtRecord, _ := auth.GetJwtFromString(rData, rData.HttpRequest.FormValue("token"), true)
+	if jwtRecord != nil && jwtRecord.GetData().Subject == clientRecord.GetKey().StringID() && isOauthToken(jwtRecord) {
+		if err := datastore.Delete(rData.Ctx, jwtRecord); err != nil {
+			rData.LogError(err.Error())
+			setOauthError(rData, ERROR_SERVER_ERROR)
+			return
+		}
+	}
+
+	rData.SetJsonSuccessResponse(pages.JsonMapGeneric{})
+}
+
+func isOauthToken(jwtRecord *datastore.JwtRecord) bool {
+	audience := jwtRecord.GetData().Audience
+	return audience == auth.JWT_AUDIENCE_OAUTH_ACCESS || audience == auth.JWT_AUDIENCE_OAUTH_REFRESH
+}
+
+func isIntrospectable(clientRecord *datastore.OauthClientRecord, jwtRecord *datastore.JwtRecord) bool {
+	if !isOauthToken(jwtRecord) {
+		return false
+	}
+
+	return clientRecord.GetData().IsFirstParty || jwtRecord.GetData().Subject == clientRecord.GetKey().StringID()
+}
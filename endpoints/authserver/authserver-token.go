@@ -0,0 +1,177 @@
+package authserver
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/dakom/basic-site-api/lib/auth"
+	"github.com/dakom/basic-site-api/lib/auth/jwt_scopes"
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/pages"
+)
+
+func GotTokenRequest(rData *pages.RequestData) {
+	rData.HttpWriter.Header().Set("Cache-Control", "no-store")
+
+	clientRecord := authenticateClient(rData)
+	if clientRecord == nil {
+		setOauthError(rData, ERROR_INVALID_CLIENT)
+		return
+	}
+
+	switch rData.HttpRequest.FormValue("grant_type") {
+	case GRANT_TYPE_AUTHORIZATION_CODE:
+		gotAuthorizationCodeGrant(rData, clientRecord)
+	case GRANT_TYPE_REFRESH_TOKEN:
+		gotRefreshTokenGrant(rData, clientRecord)
+	case GRANT_TYPE_CLIENT_CREDENTIALS:
+		gotClientCredentialsGrant(rData, clientRecord)
+	default:
+		setOauthError(rData, ERROR_UNSUPPORTED_GRANT_TYPE)
+	}
+}
+
+func gotAuthorizationCodeGrant(rData *pages.RequestData, clientRecord *datastore.OauthClientRecord) {
+	var extra struct {
+		RedirectUri     string `json:"ruri"`
+		RedirectUriSent bool   `json:"rsent"`
+		CodeChallenge   string `json:"cc"`
+	}
+
+	clientId := clientRecord.GetKey().StringID()
+
+	codeRecord := getClientToken(rData, clientId, rData.HttpRequest.FormValue("code"), auth.JWT_AUDIENCE_OAUTH_CODE)
+	if codeRecord == nil {
+		setOauthError(rData, ERROR_INVALID_GRANT)
+		return
+	}
+
+	//single use, whether or not the rest checks out
+	if err := redeemClientToken(rData, codeRecord); err == errTokenAlreadyRedeemed {
+		setOauthError(rData, ERROR_INVALID_GRANT)
+		return
+	} else if err != nil {
+		rData.LogError(err.Error())
+		setOauthError(rData, ERROR_SERVER_ERROR)
+		return
+	}
+
+	if err := json.Unmarshal([]byte(codeRecord.GetData().Extra), &extra); err != nil {
+		setOauthError(rData, ERROR_INVALID_GRANT)
+		return
+	}
+
+	//only required if /authorize had it (RFC 6749 4.1.3), but if it's sent anyway it has to be the right one
+	redirectUri := rData.HttpRequest.FormValue("redirect_uri")
+	if (extra.RedirectUriSent || redirectUri != "") && redirectUri != extra.RedirectUri {
+		setOauthError(rData, ERROR_INVALID_GRANT)
+		return
+	}
+
+	if extra.CodeChallenge != "" && !isValidCodeVerifier(rData.HttpRequest.FormValue("code_verifier"), extra.CodeChallenge) {
+		setOauthError(rData, ERROR_INVALID_GRANT)
+		return
+	}
+
+	userId := codeRecord.GetData().UserId
+	if !isUserActive(rData, userId) {
+		setOauthError(rData, ERROR_INVALID_GRANT)
+		return
+	}
+
+	setTokenResponse(rData, clientId, userId, codeRecord.GetData().Scopes)
+}
+
+//refresh tokens are rotated - the old one is gone once a new pair is issued
+//"scope" may narrow (never widen) what was originally granted, see getRefreshScopes
+func gotRefreshTokenGrant(rData *pages.RequestData, clientRecord *datastore.OauthClientRecord) {
+	clientId := clientRecord.GetKey().StringID()
+
+	refreshRecord := getClientToken(rData, clientId, rData.HttpRequest.FormValue("refresh_token"), auth.JWT_AUDIENCE_OAUTH_REFRESH)
+	if refreshRecord == nil {
+		setOauthError(rData, ERROR_INVALID_GRANT)
+		return
+	}
+
+	scopes, ok := getRefreshScopes(refreshRecord.GetData().Scopes, clientRecord.GetData().AllowedScopes, rData.HttpRequest.FormValue("scope"))
+	if !ok {
+		setOauthError(rData, ERROR_INVALID_SCOPE)
+		return
+	}
+
+	userId := refreshRecord.GetData().UserId
+	if !isUserActive(rData, userId) {
+		setOauthError(rData, ERROR_INVALID_GRANT)
+		return
+	}
+
+	if err := redeemClientToken(rData, refreshRecord); err == errTokenAlreadyRedeemed {
+		setOauthError(rData, ERROR_INVALID_GRANT)
+		return
+	} else if err != nil {
+		rData.LogError(err.Error())
+		setOauthError(rData, ERROR_SERVER_ERROR)
+		return
+	}
+
+	setTokenResponse(rData, clientId, userId, scopes)
+}
+
+//machine to machine - there's no user, so never any account scopes
+func gotClientCredentialsGrant(rData *pages.RequestData, clientRecord *datastore.OauthClientRecord) {
+	if !clientRecord.IsConfidential() {
+		setOauthError(rData, ERROR_UNAUTHORIZED_CLIENT)
+		return
+	}
+
+	allowedScopes := clientRecord.GetData().AllowedScopes &^ jwt_scopes.ACCOUNT_ANY
+	if (allowedScopes & jwt_scopes.OAUTH_CLIENT) == 0 {
+		setOauthError(rData, ERROR_UNAUTHORIZED_CLIENT)
+		return
+	}
+
+	scopes := allowedScopes
+
+	if scopeString := rData.HttpRequest.FormValue("scope"); scopeString != "" {
+		requestedScopes, ok := jwt_scopes.FromNames(scopeString)
+		if !ok || (requestedScopes&allowedScopes) != requestedScopes {
+			setOauthError(rData, ERROR_INVALID_SCOPE)
+			return
+		}
+		scopes = requestedScopes | jwt_scopes.OAUTH_CLIENT
+	}
+
+	setTokenResponse(rData, clientRecord.GetKey().StringID(), 0, scopes)
+}
+
+//What a refreshed pair gets - scopeString (optional) may narrow but never widen what was granted,
+//and the client's allowed scopes may have been reduced since. ok is false if nothing would be left
+func getRefreshScopes(granted int64, allowed int64, scopeString string) (int64, bool) {
+	scopes := granted
+
+	if scopeString != "" {
+		requestedScopes, ok := jwt_scopes.FromNames(scopeString)
+		if !ok || requestedScopes == 0 || (requestedScopes&scopes) != requestedScopes {
+			return 0, false
+		}
+		scopes = requestedScopes
+	}
+
+	scopes &= allowed
+
+	return scopes, scopes != 0
+}
+
+//S256 only, see Authorize
+func isValidCodeVerifier(verifier string, challenge string) bool {
+	if verifier == "" {
+		return false
+	}
+
+	hash := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(hash[:])
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
@@ -0,0 +1,64 @@
+package authserver
+
+import (
+	"testing"
+
+	"github.com/dakom/basic-site-api/lib/auth/jwt_scopes"
+)
+
+func TestIsValidCodeVerifier(t *testing.T) {
+	//RFC 7636 appendix B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	tests := []struct {
+		name      string
+		verifier  string
+		challenge string
+		valid     bool
+	}{
+		{"rfc example", verifier, challenge, true},
+		{"wrong verifier", verifier[:len(verifier)-1] + "l", challenge, false},
+		{"no verifier", "", challenge, false},
+		{"the challenge as the verifier (plain method)", challenge, challenge, false},
+		{"padded challenge", verifier, challenge + "=", false},
+		{"standard base64 challenge", verifier, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw+cM", false},
+		{"no challenge", verifier, "", false},
+	}
+
+	for _, test := range tests {
+		if valid := isValidCodeVerifier(test.verifier, test.challenge); valid != test.valid {
+			t.Errorf("%s: expected %v, got %v", test.name, test.valid, valid)
+		}
+	}
+}
+
+func TestGetRefreshScopes(t *testing.T) {
+	readWrite := int64(jwt_scopes.ACCOUNT_READ | jwt_scopes.ACCOUNT_WRITE)
+
+	tests := []struct {
+		name        string
+		granted     int64
+		allowed     int64
+		scopeString string
+		scopes      int64
+		ok          bool
+	}{
+		{"same as granted", readWrite, readWrite, "", readWrite, true},
+		{"narrowed", readWrite, readWrite, "account.read", jwt_scopes.ACCOUNT_READ, true},
+		{"narrowed to all of it", readWrite, readWrite, "account.write account.read", readWrite, true},
+		{"widened", jwt_scopes.ACCOUNT_READ, readWrite, "account.read account.write", 0, false},
+		{"unknown scope", readWrite, readWrite, "account.read admin", 0, false},
+		{"only whitespace", readWrite, readWrite, " ", 0, false},
+		{"client allowed less since", readWrite, jwt_scopes.ACCOUNT_READ, "", jwt_scopes.ACCOUNT_READ, true},
+		{"client allowed nothing of it since", jwt_scopes.ACCOUNT_WRITE, jwt_scopes.ACCOUNT_READ, "", 0, false},
+		{"narrowed to what the client can't have anymore", readWrite, jwt_scopes.ACCOUNT_READ, "account.write", 0, false},
+	}
+
+	for _, test := range tests {
+		scopes, ok := getRefreshScopes(test.granted, test.allowed, test.scopeString)
+		if scopes != test.scopes || ok != test.ok {
+			t.Errorf("%s: expected %d %v, got %d %v", test.name, test.scopes, test.ok, scopes, ok)
+		}
+	}
+}
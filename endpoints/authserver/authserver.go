@@ -0,0 +1,191 @@
+//OAuth2 authorization server - lets other apps (first or third party) get tokens for our users
+//Codes, access tokens and refresh tokens are all regular JwtRecords, see the JWT_AUDIENCE_OAUTH_* audiences in lib/auth
+package authserver
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+
+	gaeds "google.golang.org/appengine/datastore"
+
+	"github.com/dakom/basic-site-api/lib/auth"
+	"github.com/dakom/basic-site-api/lib/auth/jwt_scopes"
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/lib/utils/cipher"
+)
+
+//error codes as per RFC 6749 (these are what clients expect, not our statuscodes)
+const (
+	ERROR_INVALID_REQUEST        string = "invalid_request"
+	ERROR_INVALID_CLIENT         string = "invalid_client"
+	ERROR_INVALID_GRANT          string = "invalid_grant"
+	ERROR_INVALID_SCOPE          string = "invalid_scope"
+	ERROR_UNAUTHORIZED_CLIENT    string = "unauthorized_client"
+	ERROR_UNSUPPORTED_GRANT_TYPE string = "unsupported_grant_type"
+	ERROR_UNSUPPORTED_RESPONSE   string = "unsupported_response_type"
+	ERROR_ACCESS_DENIED          string = "access_denied"
+	ERROR_SERVER_ERROR           string = "server_error"
+)
+
+const (
+	GRANT_TYPE_AUTHORIZATION_CODE string = "authorization_code"
+	GRANT_TYPE_REFRESH_TOKEN      string = "refresh_token"
+	GRANT_TYPE_CLIENT_CREDENTIALS string = "client_credentials"
+)
+
+//returns nil if there's no such client
+func getClient(rData *pages.RequestData, clientId string) (*datastore.OauthClientRecord, error) {
+	var clientRecord datastore.OauthClientRecord
+
+	if clientId == "" {
+		return nil, nil
+	}
+
+	if err := datastore.LoadFromKey(rData.Ctx, &clientRecord, clientId); err != nil {
+		if err == gaeds.ErrNoSuchEntity {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &clientRecord, nil
+}
+
+//client credentials come via http basic auth or form params
+//public clients only send client_id, confidential clients must also send a matching secret
+func authenticateClient(rData *pages.RequestData) *datastore.OauthClientRecord {
+	clientId, clientSecret, hasBasicAuth := rData.HttpRequest.BasicAuth()
+	if !hasBasicAuth {
+		clientId = rData.HttpRequest.FormValue("client_id")
+		clientSecret = rData.HttpRequest.FormValue("client_secret")
+	}
+
+	clientRecord, err := getClient(rData, clientId)
+	if err != nil {
+		rData.LogError(err.Error())
+		return nil
+	}
+	if clientRecord == nil {
+		return nil
+	}
+
+	if clientRecord.IsConfidential() && !cipher.ComparePWHash(clientSecret, clientRecord.GetData().SecretHash) {
+		return nil
+	}
+
+	return clientRecord
+}
+
+func setOauthError(rData *pages.RequestData, errorCode string) {
+	rData.SetJsonErrorResponse(pages.JsonMapGeneric{
+		"error": errorCode,
+	})
+
+	if errorCode == ERROR_INVALID_CLIENT {
+		rData.HttpStatusResponseCode = 401
+	}
+}
+
+//Issues the access token (and refresh token if userId isn't 0) and sets the standard token response
+func setTokenResponse(rData *pages.RequestData, clientId string, userId int64, scopes int64) {
+	var accessRecord *datastore.JwtRecord
+	var accessString, refreshString string
+	var err error
+
+	if userId == 0 {
+		accessRecord, accessString, err = auth.GetNewOauthJWT(rData, clientId, 0, auth.JWT_USERTYPE_OAUTH_CLIENT, scopes, auth.JWT_AUDIENCE_OAUTH_ACCESS, nil)
+	} else {
+		accessRecord, accessString, err = auth.GetNewOauthJWT(rData, clientId, userId, auth.JWT_USERTYPE_USER_RECORD, scopes, auth.JWT_AUDIENCE_OAUTH_ACCESS, nil)
+		if err == nil {
+			//refresh tokens are never accepted as bearer tokens, so it's safe for them to carry the granted scopes
+			_, refreshString, err = auth.GetNewOauthJWT(rData, clientId, userId, auth.JWT_USERTYPE_USER_RECORD, scopes, auth.JWT_AUDIENCE_OAUTH_REFRESH, nil)
+		}
+	}
+
+	if err != nil {
+		rData.LogError(err.Error())
+		setOauthError(rData, ERROR_SERVER_ERROR)
+		return
+	}
+
+	response := pages.JsonMapGeneric{
+		"access_token": accessString,
+		"token_type":   "Bearer",
+		"expires_in":   accessRecord.GetData().ExpiresAt - time.Now().Unix(),
+		"scope":        getScopeNames(scopes),
+	}
+
+	if refreshString != "" {
+		response["refresh_token"] = refreshString
+	}
+
+	rData.SetJsonSuccessResponse(response)
+}
+
+//the OAUTH_CLIENT bit is implied by the token type, so it's not listed by name
+func getScopeNames(scopes int64) string {
+	return jwt_scopes.ToNames(scopes &^ jwt_scopes.OAUTH_CLIENT)
+}
+
+//loads a code/refresh/access token that was issued to the given client, or nil if it's not valid
+func getClientToken(rData *pages.RequestData, clientId string, tokenString string, audience string) *datastore.JwtRecord {
+	jwtRecord, isExpired := auth.GetJwtFromString(rData, tokenString, true)
+	if jwtRecord == nil || isExpired {
+		return nil
+	}
+
+	if jwtRecord.GetData().Audience != audience || jwtRecord.GetData().Subject != clientId {
+		return nil
+	}
+
+	return jwtRecord
+}
+
+var errTokenAlreadyRedeemed = errors.New("code or refresh token was already redeemed")
+
+//Codes and refresh tokens are single use - the one request that gets to delete it wins, any other gets errTokenAlreadyRedeemed
+func redeemClientToken(rData *pages.RequestData, jwtRecord *datastore.JwtRecord) error {
+	return gaeds.RunInTransaction(rData.Ctx, func(c context.Context) error {
+		var freshRecord datastore.JwtRecord
+
+		freshRecord.SetKey(jwtRecord.GetKey())
+		if err := datastore.Load(c, &freshRecord); err == gaeds.ErrNoSuchEntity {
+			return errTokenAlreadyRedeemed
+		} else if err != nil {
+			return err
+		}
+
+		return datastore.Delete(c, &freshRecord)
+	}, nil)
+}
+
+//tokens issued on behalf of a user are only good while that user is active
+func isUserActive(rData *pages.RequestData, userId int64) bool {
+	var userRecord datastore.UserRecord
+
+	if err := datastore.LoadFromKey(rData.Ctx, &userRecord, userId); err != nil {
+		return false
+	}
+
+	return userRecord.IsStatusActive()
+}
+
+func isAllowedRedirectUri(clientRecord *datastore.OauthClientRecord, redirectUri string) bool {
+	for _, allowed := range clientRecord.GetData().RedirectUris {
+		if allowed == redirectUri {
+			return true
+		}
+	}
+	return false
+}
+
+func getUserIdString(jwtRecord *datastore.JwtRecord) string {
+	if jwtRecord.GetData().UserType != auth.JWT_USERTYPE_USER_RECORD {
+		return ""
+	}
+	return strconv.FormatInt(jwtRecord.GetData().UserId, 10)
+}
@@ -4,8 +4,11 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/dakom/basic-site-api/endpoints/accounts"
 	"github.com/dakom/basic-site-api/lib/auth"
 	"github.com/dakom/basic-site-api/lib/auth/jwt_scopes"
+	"github.com/dakom/basic-site-api/lib/avatars"
+	"github.com/dakom/basic-site-api/lib/email"
 	"github.com/dakom/basic-site-api/lib/pages"
 	"github.com/dakom/basic-site-api/setup/config/custom"
 	"github.com/dakom/basic-site-api/setup/config/extendable/pageconfig"
@@ -18,6 +21,18 @@ import (
 func Start(extraPageConfigs map[string]*pages.PageConfig, siteConfig *custom.Config) {
 	pageConfigs := pageconfig.GetPageConfigs(extraPageConfigs)
 
+	email.SetTemplateConfig(siteConfig.EmailTemplates, siteConfig.EMAIL_DEFAULT_LOCALE)
+
+	//a bad config would overwrite or orphan avatar files, better not to start at all
+	if err := avatars.ValidateRenditions(siteConfig.AVATAR_RENDITIONS); err != nil {
+		panic(err)
+	}
+
+	//same for oidc provider names, which end up in usernames
+	if err := accounts.ValidateOidcProviders(siteConfig.OIDC_PROVIDERS); err != nil {
+		panic(err)
+	}
+
 	http.HandleFunc("/", wrapRequest(pageConfigs, siteConfig))
 }
 
@@ -144,7 +159,7 @@ func gotPageRequest(w http.ResponseWriter, r *http.Request, pageConfigs map[stri
 		statusCode := statuscodes.AUTH
 
 		switch rData.PageConfig.Scopes {
-		case jwt_scopes.OOB_USER_PASSWORD_CHANGE, jwt_scopes.OOB_USER_EMAIL_CHANGE, jwt_scopes.OOB_USER_ACTIVATE:
+		case jwt_scopes.OOB_USER_PASSWORD_CHANGE, jwt_scopes.OOB_USER_EMAIL_CHANGE, jwt_scopes.OOB_USER_ACTIVATE, jwt_scopes.OOB_USER_LOGIN:
 			statusCode = statuscodes.AUTH_OOB
 		}
 
@@ -198,6 +213,9 @@ func gotPageRequest(w http.ResponseWriter, r *http.Request, pageConfigs map[stri
 	} else if rData.PageConfig.HandlerType == pages.HANDLER_TYPE_HTTP_REDIRECT {
 		if rData.HttpRedirectIsPermanent {
 			http.Redirect(rData.HttpWriter, rData.HttpRequest, rData.HttpRedirectDestination, http.StatusMovedPermanently)
+		} else if rData.HttpRequest.Method == "POST" {
+			//e.g. form_post oauth responses - a 307 would re-post to the destination
+			http.Redirect(rData.HttpWriter, rData.HttpRequest, rData.HttpRedirectDestination, http.StatusSeeOther)
 		} else {
 			http.Redirect(rData.HttpWriter, rData.HttpRequest, rData.HttpRedirectDestination, http.StatusTemporaryRedirect)
 		}
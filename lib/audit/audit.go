@@ -0,0 +1,46 @@
+package audit
+
+import (
+	"time"
+
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/lib/utils/text"
+)
+
+//Records a security-relevant event against userId
+//The actor is whoever is logged in for this request, 0 if nobody is
+//Where the subject proved who they are without being logged in (e.g. a successful login), use RecordWithActor
+//Failures are logged but never returned - auditing must not break the action being audited
+func Record(rData *pages.RequestData, eventType string, userId int64, meta map[string]interface{}) {
+	var actorId int64
+
+	if rData.UserRecord != nil && rData.UserRecord.GetKey() != nil {
+		actorId = rData.UserRecord.GetKey().IntID()
+	}
+
+	RecordWithActor(rData, eventType, actorId, userId, meta)
+}
+
+func RecordWithActor(rData *pages.RequestData, eventType string, actorId int64, userId int64, meta map[string]interface{}) {
+	var auditRecord datastore.AuditRecord
+
+	metaString, err := text.MakeJsonString(meta)
+	if err != nil {
+		rData.LogError("audit meta error (%s): %v", eventType, err)
+	}
+
+	auditRecord.SetData(&datastore.AuditData{
+		ActorId:   actorId,
+		UserId:    userId,
+		EventType: eventType,
+		IpAddress: rData.HttpRequest.RemoteAddr,
+		UserAgent: rData.HttpRequest.UserAgent(),
+		Date:      time.Now(),
+		Meta:      metaString,
+	})
+
+	if err := datastore.SaveToAutoKey(rData.Ctx, &auditRecord); err != nil {
+		rData.LogError("audit save error (%s): %v", eventType, err)
+	}
+}
@@ -21,24 +21,34 @@ import (
 
 const (
 	//descripes how the userid is used
-	JWT_USERTYPE_USER_RECORD string = "usr"
-	JWT_USERTYPE_SYSTEM_ID   string = "sys"
+	JWT_USERTYPE_USER_RECORD  string = "usr"
+	JWT_USERTYPE_SYSTEM_ID    string = "sys"
+	JWT_USERTYPE_OAUTH_CLIENT string = "cli" //client_credentials grant, Subject is the client id
 
 	JWT_DURATION_SHORT int64 = 3600
 	JWT_DURATION_LONG  int64 = 604800
 
 	JWT_DURATION_NEVER int64 = -1
 
+	JWT_DURATION_OAUTH_CODE    int64 = 600
+	JWT_DURATION_OAUTH_REFRESH int64 = 2592000
+
 	REQUEST_SOURCE_APPENGINE_TASK string = "appengine-task"
 
 	JWT_AUDIENCE_COOKIE string = "cookie" //will vet cookie / header, does not necessarily vet against db
 	JWT_AUDIENCE_APP    string = "app"    //for app usual usage, does not necessarily vet against db
 	JWT_AUDIENCE_OOB    string = "oob"    //for passing around via email, page embeds, etc. - always vets against db
+
+	//issued by the oauth authorization server. Subject is always the client id
+	JWT_AUDIENCE_OAUTH_CODE    string = "oauth-code"    //authorization code, only ever exchanged at the token endpoint
+	JWT_AUDIENCE_OAUTH_ACCESS  string = "oauth-access"  //bearer token for clients - always vets against db so revocation is immediate
+	JWT_AUDIENCE_OAUTH_REFRESH string = "oauth-refresh" //only ever exchanged at the token endpoint
 )
 
 const (
 	_ = iota
 	SYSTEM_ID_OAUTH
+	SYSTEM_ID_OAUTH_SERVER
 )
 
 func ValidateUserType(rData *pages.RequestData, jwtRecord *datastore.JwtRecord) (bool, interface{}) {
@@ -56,6 +66,10 @@ func ValidateUserType(rData *pages.RequestData, jwtRecord *datastore.JwtRecord)
 			if jwtRecord.GetData().UserId > 0 {
 				return true, jwtRecord.GetData().UserId
 			}
+		} else if jwtRecord.GetData().UserType == JWT_USERTYPE_OAUTH_CLIENT {
+			if jwtRecord.GetData().Subject != "" {
+				return true, jwtRecord.GetData().Subject
+			}
 		}
 	}
 
@@ -73,6 +87,13 @@ func ValidatePageRequest(rData *pages.RequestData) (bool, bool) {
 
 	rData.JwtRecord, isExpired = GetJwtFromString(rData, rData.JwtString, false) //for the case of validating a page request, only check db below based on scope logic etc
 
+	//codes and refresh tokens are never accepted as bearer tokens, and oauth access tokens are never refreshed in-place
+	if rData.JwtRecord != nil {
+		if !IsBearerAudience(rData.JwtRecord.GetData().Audience) || (isExpired && rData.JwtRecord.GetData().Audience == JWT_AUDIENCE_OAUTH_ACCESS) {
+			rData.JwtRecord = nil
+		}
+	}
+
 	rData.UserRecord = nil
 
 	//even if the jwt will ultimately be invalid, let's set the user info if it's available
@@ -102,8 +123,13 @@ func ValidatePageRequest(rData *pages.RequestData) (bool, bool) {
 	//failure here resets jwtMap to nil, i.e. as though no valid one were ever supplied
 	if rData.JwtRecord != nil {
 
-		if isExpired || rData.PageConfig.RequiresDBScopeCheck || rData.JwtRecord.GetData().Audience == JWT_AUDIENCE_OOB {
+		if isExpired || rData.PageConfig.RequiresDBScopeCheck || rData.JwtRecord.GetData().Audience == JWT_AUDIENCE_OOB || rData.JwtRecord.GetData().Audience == JWT_AUDIENCE_OAUTH_ACCESS {
 			dbRecord, dbIsValid = GetJwtFromDb(rData, rData.JwtRecord.GetKey())
+			if dbIsValid && dbRecord.GetData().Audience == JWT_AUDIENCE_OAUTH_ACCESS {
+				//deleting a client kills its outstanding tokens
+				var clientRecord datastore.OauthClientRecord
+				dbIsValid = datastore.LoadFromKey(rData.Ctx, &clientRecord, dbRecord.GetData().Subject) == nil
+			}
 			if !dbIsValid {
 				rData.JwtRecord = nil
 			} else {
@@ -123,9 +149,11 @@ func ValidatePageRequest(rData *pages.RequestData) (bool, bool) {
 
 			goto fail
 		}
-		//inactive user for anything other than activate request is not ok
-		if rData.UserRecord != nil && !rData.UserRecord.GetData().IsActive && rData.PageConfig.PageName != pagenames.ACCOUNT_ACTIVATE_SERVICE {
-			goto fail
+		//pending user for anything other than activate (or login link, which activates) is not ok, suspended or deleted user is never ok
+		if rData.UserRecord != nil && !rData.UserRecord.IsStatusActive() {
+			if !rData.UserRecord.IsStatusPending() || (rData.PageConfig.PageName != pagenames.ACCOUNT_ACTIVATE_SERVICE && rData.PageConfig.PageName != pagenames.ACCOUNT_LOGIN_LINK_SERVICE) {
+				goto fail
+			}
 		}
 
 		if rData.SiteConfig.SKIP_CSRF_CHECK != true && rData.PageConfig.SkipCsrfCheck != true && rData.JwtRecord.GetData().Audience == JWT_AUDIENCE_COOKIE && (rData.JwtRecord.GetData().SessionId == "" || rData.HttpRequest.Header.Get(rData.SiteConfig.JWT_HEADER_SID_NAME) == "" || rData.JwtRecord.GetData().SessionId != rData.HttpRequest.Header.Get(rData.SiteConfig.JWT_HEADER_SID_NAME)) {
@@ -156,7 +184,8 @@ func ValidatePageRequest(rData *pages.RequestData) (bool, bool) {
 
 	//all is validated... if we grabbed the rData.JwtRecord at some point (check against db), might as well update long expirey here
 	//f it's too close (i.e. time remaining is less than half of original duration)... lets sessions last longer while active
-	if rData.JwtRecord != nil {
+	//oauth access tokens are fixed-lifetime, clients use their refresh token instead
+	if rData.JwtRecord != nil && rData.JwtRecord.GetData().Audience != JWT_AUDIENCE_OAUTH_ACCESS {
 		var updateDb bool
 		durationByAudience := GetFinalDurationByAudience(rData.JwtRecord.GetData().Audience)
 		if durationByAudience != JWT_DURATION_NEVER {
@@ -296,6 +325,26 @@ func GetNewSystemsOobJWT(rData *pages.RequestData, systemId int64, scopes int64,
 	return makeNewJwtFromInfo(rData, systemId, JWT_USERTYPE_SYSTEM_ID, scopes, JWT_AUDIENCE_OOB, "", "", extra)
 }
 
+//For tokens issued by the oauth authorization server - codes, access and refresh tokens
+//userType is JWT_USERTYPE_USER_RECORD, or JWT_USERTYPE_OAUTH_CLIENT for client_credentials (userId is then 0)
+func GetNewOauthJWT(rData *pages.RequestData, clientId string, userId int64, userType string, scopes int64, audience string, extraMap map[string]interface{}) (*datastore.JwtRecord, string, error) {
+	var extra string
+
+	if clientId == "" || (audience != JWT_AUDIENCE_OAUTH_CODE && audience != JWT_AUDIENCE_OAUTH_ACCESS && audience != JWT_AUDIENCE_OAUTH_REFRESH) {
+		return nil, "", fmt.Errorf(statuscodes.MISSINGINFO)
+	}
+
+	if extraMap != nil {
+		if extraString, err := text.MakeJsonString(extraMap); err != nil {
+			return nil, "", fmt.Errorf(statuscodes.TECHNICAL)
+		} else {
+			extra = extraString
+		}
+	}
+
+	return makeNewJwtFromInfo(rData, userId, userType, scopes, audience, "", clientId, extra)
+}
+
 func DestroyToken(rData *pages.RequestData) error {
 
 	rData.HttpRequest.Header.Set("Authorization", "")
@@ -315,6 +364,10 @@ func GetInitialDurationByAudience(audience string) int64 {
 		return JWT_DURATION_LONG
         case JWT_AUDIENCE_COOKIE:
                 return JWT_DURATION_LONG
+	case JWT_AUDIENCE_OAUTH_CODE:
+		return JWT_DURATION_OAUTH_CODE
+	case JWT_AUDIENCE_OAUTH_REFRESH:
+		return JWT_DURATION_OAUTH_REFRESH
 	default:
 		return JWT_DURATION_SHORT
 	}
@@ -326,12 +379,20 @@ func GetFinalDurationByAudience(audience string) int64 {
 		//return JWT_DURATION_NEVER
 	case JWT_AUDIENCE_COOKIE:
 		return JWT_DURATION_LONG
-	default: //oob and system
+	case JWT_AUDIENCE_OAUTH_CODE:
+		return JWT_DURATION_OAUTH_CODE
+	case JWT_AUDIENCE_OAUTH_REFRESH:
+		return JWT_DURATION_OAUTH_REFRESH
+	default: //oob, system and oauth access
 		return JWT_DURATION_SHORT //same as initial expiration
 
 	}
 }
 
+func IsBearerAudience(audience string) bool {
+	return audience != JWT_AUDIENCE_OAUTH_CODE && audience != JWT_AUDIENCE_OAUTH_REFRESH
+}
+
 func GetJwtFromString(rData *pages.RequestData, jwtString string, forceDbCheck bool) (*datastore.JwtRecord, bool) {
 	var isExpired bool
 	var jwtRecord datastore.JwtRecord
@@ -1,5 +1,10 @@
 package jwt_scopes
 
+import (
+	"sort"
+	"strings"
+)
+
 const (
 	_ = 1 << iota
 
@@ -16,8 +21,53 @@ const (
 
 	//OAUTH
 	OAUTH_STATE
+
+	//ADMIN - only ever granted via a user's ExtraScopes
+	ADMIN
+
+	//OAUTH SERVER - machine to machine tokens (client_credentials), there's no user behind these
+	OAUTH_CLIENT
+
+	//OOB (appended here rather than above so existing bits keep their values)
+	OOB_USER_LOGIN
 )
 
 const ACCOUNT_FULL_ANY = ACCOUNT_READ | ACCOUNT_WRITE
 const ACCOUNT_FULL_MASTER = ACCOUNT_READ | ACCOUNT_WRITE | ACCOUNT_MASTER
 const ACCOUNT_FULL_SUB = ACCOUNT_READ | ACCOUNT_WRITE | ACCOUNT_SUB
+const ACCOUNT_ANY = ACCOUNT_READ | ACCOUNT_WRITE | ACCOUNT_MASTER | ACCOUNT_SUB
+
+//Scope names as used by the oauth authorization server (space separated "scope" param)
+//Sites can add their own entries for their own scope bits
+var NAMES = map[string]int64{
+	"account.read":  ACCOUNT_READ,
+	"account.write": ACCOUNT_WRITE,
+}
+
+//returns the combined scopes, and ok is false if any name is unknown
+func FromNames(scopeString string) (int64, bool) {
+	var scopes int64
+
+	for _, name := range strings.Fields(scopeString) {
+		scope, exists := NAMES[name]
+		if !exists {
+			return 0, false
+		}
+		scopes |= scope
+	}
+
+	return scopes, true
+}
+
+func ToNames(scopes int64) string {
+	var names []string
+
+	for name, scope := range NAMES {
+		if scope != 0 && (scopes&scope) == scope {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names) //map iteration order shouldn't leak into responses
+	return strings.Join(names, " ")
+}
@@ -0,0 +1,38 @@
+package jwt_scopes
+
+import "testing"
+
+func TestFromNames(t *testing.T) {
+	tests := []struct {
+		scopeString string
+		scopes      int64
+		ok          bool
+	}{
+		{"", 0, true},
+		{"account.read", ACCOUNT_READ, true},
+		{"account.read account.write", ACCOUNT_READ | ACCOUNT_WRITE, true},
+		{"  account.write\taccount.read  ", ACCOUNT_READ | ACCOUNT_WRITE, true},
+		{"account.read account.read", ACCOUNT_READ, true},
+		{"account.read unknown", 0, false},
+		{"Account.Read", 0, false},
+		{"account.read,account.write", 0, false},
+	}
+
+	for _, test := range tests {
+		scopes, ok := FromNames(test.scopeString)
+		if scopes != test.scopes || ok != test.ok {
+			t.Errorf("%q: expected %d %v, got %d %v", test.scopeString, test.scopes, test.ok, scopes, ok)
+		}
+	}
+}
+
+func TestToNames(t *testing.T) {
+	if names := ToNames(ACCOUNT_WRITE | ACCOUNT_READ | ADMIN); names != "account.read account.write" {
+		t.Errorf("got %q", names)
+	}
+
+	scopes, ok := FromNames(ToNames(ACCOUNT_READ | ACCOUNT_WRITE))
+	if !ok || scopes != ACCOUNT_READ|ACCOUNT_WRITE {
+		t.Errorf("round trip got %d %v", scopes, ok)
+	}
+}
@@ -0,0 +1,98 @@
+package avatars
+
+import (
+	"errors"
+	"image"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/dakom/basic-site-api/lib/blobstore"
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/lib/utils/text"
+	"github.com/dakom/basic-site-api/setup/config/custom"
+)
+
+var ErrRejected = errors.New("avatar was rejected by moderation")
+var ErrQuarantined = errors.New("avatar is waiting for review")
+
+//Config.AvatarModerator, or NoopModerator if that's not set
+func GetModerator(rData *pages.RequestData) custom.AvatarModerator {
+	if rData.SiteConfig.AvatarModerator != nil {
+		return rData.SiteConfig.AvatarModerator
+	}
+
+	return NoopModerator{}
+}
+
+//Returns nil if the (square) image may become the user's avatar right away
+//otherwise ErrRejected, or ErrQuarantined once it's been put aside for review (see admin/avatar-quarantine-list)
+func Moderate(rData *pages.RequestData, userId int64, squareImg image.Image) error {
+	moderation, err := GetModerator(rData).Moderate(rData.Ctx, userId, squareImg)
+	if err != nil {
+		return err
+	}
+
+	switch moderation.Verdict {
+	case custom.AVATAR_MODERATION_APPROVE:
+		return nil
+	case custom.AVATAR_MODERATION_QUARANTINE:
+		if err := quarantine(rData, userId, squareImg, moderation.Reason); err != nil {
+			return err
+		}
+		return ErrQuarantined
+	}
+
+	return ErrRejected
+}
+
+//Random name so it can't be guessed, since stores like GCS serve everything publicly
+func quarantine(rData *pages.RequestData, userId int64, squareImg image.Image, reason string) error {
+	var record datastore.AvatarQuarantineRecord
+
+	randomName, err := text.RandomHexString(16)
+	if err != nil {
+		return err
+	}
+	filename := "quarantine/" + randomName + ".jpg"
+
+	store := blobstore.GetAvatarStore(rData)
+	if err := putImage(rData, store, filename, squareImg, custom.AvatarRendition{Format: AVATAR_FORMAT_JPEG}); err != nil {
+		return err
+	}
+
+	record.SetData(&datastore.AvatarQuarantineData{
+		UserId:   userId,
+		Status:   datastore.AVATAR_QUARANTINE_PENDING,
+		Filename: filename,
+		Reason:   reason,
+		Date:     time.Now(),
+	})
+
+	if err := datastore.SaveToAutoKey(rData.Ctx, &record); err != nil {
+		store.Delete(rData.Ctx, filename)
+		return err
+	}
+
+	return nil
+}
+
+/* Approves everything */
+
+type NoopModerator struct{}
+
+func (moderator NoopModerator) Moderate(c context.Context, userId int64, img image.Image) (*custom.AvatarModeration, error) {
+	return &custom.AvatarModeration{Verdict: custom.AVATAR_MODERATION_APPROVE}, nil
+}
+
+/* Stand-in for local development and tests - gives every avatar the same verdict, e.g. to try out the quarantine review */
+
+type FakeModerator struct {
+	Verdict string
+	Reason  string
+}
+
+func (moderator *FakeModerator) Moderate(c context.Context, userId int64, img image.Image) (*custom.AvatarModeration, error) {
+	return &custom.AvatarModeration{Verdict: moderator.Verdict, Reason: moderator.Reason}, nil
+}
@@ -0,0 +1,201 @@
+package avatars
+
+import (
+	"image"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+
+	gaeds "google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/taskqueue"
+
+	"github.com/dakom/basic-site-api/lib/blobstore"
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/setup/config/static/pagenames"
+)
+
+const AVATAR_REGENERATE_BATCH_SIZE = 50
+
+//Creates the job record (which is also the report) and queues its first batch
+//Every user's renditions are rebuilt from their stored original, e.g. after AVATAR_RENDITIONS changed
+func StartRegenerate(rData *pages.RequestData) (*datastore.AvatarRegenerateRecord, error) {
+	var record datastore.AvatarRegenerateRecord
+
+	now := time.Now()
+	record.SetData(&datastore.AvatarRegenerateData{
+		Status:      datastore.AVATAR_REGENERATE_RUNNING,
+		Date:        now,
+		UpdatedDate: now,
+	})
+
+	err := gaeds.RunInTransaction(rData.Ctx, func(c context.Context) error {
+		if err := datastore.SaveToAutoKey(c, &record); err != nil {
+			return err
+		}
+		return queueRegenerateBatch(c, rData, record.GetKey().IntID(), "")
+	}, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+//Called from the task queue, one batch per task, each queueing the next one
+//A retried task whose batch was already counted does nothing, and redoing a batch which wasn't only writes the same files again
+func RunRegenerateBatch(rData *pages.RequestData) error {
+	var record datastore.AvatarRegenerateRecord
+
+	jobId, err := strconv.ParseInt(rData.HttpRequest.FormValue("job"), 10, 64)
+	if err != nil {
+		rData.LogError("avatar regenerate task without a job")
+		return nil
+	}
+	cursor := rData.HttpRequest.FormValue("cursor")
+
+	if err := datastore.LoadFromKey(rData.Ctx, &record, jobId); err != nil {
+		return err
+	}
+	if record.GetData().Status != datastore.AVATAR_REGENERATE_RUNNING || record.GetData().NextCursor != cursor {
+		return nil
+	}
+
+	userRecords, nextCursor, err := datastore.QueryUserRecords(rData.Ctx, false, time.Time{}, cursor, AVATAR_REGENERATE_BATCH_SIZE)
+	if err != nil {
+		return finishRegenerate(rData, jobId, cursor, datastore.AVATAR_REGENERATE_FAILED, err.Error())
+	}
+
+	batch := datastore.AvatarRegenerateData{}
+	for _, userRecord := range userRecords {
+		batch.Checked++
+
+		regenerated, err := regenerateUser(rData, userRecord)
+		if err != nil {
+			batch.Failed++
+			batch.LastError = strconv.FormatInt(userRecord.GetKey().IntID(), 10) + ": " + err.Error()
+		} else if regenerated {
+			batch.Regenerated++
+		} else {
+			batch.Skipped++
+		}
+	}
+
+	return gaeds.RunInTransaction(rData.Ctx, func(c context.Context) error {
+		if err := datastore.LoadFromKey(c, &record, jobId); err != nil {
+			return err
+		}
+
+		data := record.GetData()
+		if data.Status != datastore.AVATAR_REGENERATE_RUNNING || data.NextCursor != cursor {
+			return nil
+		}
+
+		data.Checked += batch.Checked
+		data.Regenerated += batch.Regenerated
+		data.Skipped += batch.Skipped
+		data.Failed += batch.Failed
+		if batch.LastError != "" {
+			data.LastError = batch.LastError
+		}
+
+		data.NextCursor = nextCursor
+		data.UpdatedDate = time.Now()
+
+		if nextCursor == "" {
+			data.Status = datastore.AVATAR_REGENERATE_DONE
+		} else if err := queueRegenerateBatch(c, rData, jobId, nextCursor); err != nil {
+			return err
+		}
+
+		return datastore.Save(c, &record)
+	}, nil)
+}
+
+func finishRegenerate(rData *pages.RequestData, jobId int64, cursor string, status string, lastError string) error {
+	var record datastore.AvatarRegenerateRecord
+
+	return gaeds.RunInTransaction(rData.Ctx, func(c context.Context) error {
+		if err := datastore.LoadFromKey(c, &record, jobId); err != nil {
+			return err
+		}
+		if record.GetData().NextCursor != cursor {
+			return nil
+		}
+
+		record.GetData().Status = status
+		record.GetData().LastError = lastError
+		record.GetData().UpdatedDate = time.Now()
+
+		return datastore.Save(c, &record)
+	}, nil)
+}
+
+//must be called within the transaction that moves the cursor along, so each batch is queued exactly once
+func queueRegenerateBatch(c context.Context, rData *pages.RequestData, jobId int64, cursor string) error {
+	params := url.Values{}
+	params.Set("job", strconv.FormatInt(jobId, 10))
+	params.Set("cursor", cursor)
+
+	regenerateTask := taskqueue.NewPOSTTask("/"+pagenames.AVATAR_REGENERATE_WEBHOOK, params)
+	_, err := taskqueue.Add(c, regenerateTask, rData.SiteConfig.TASKQUEUE_AVATAR)
+
+	return err
+}
+
+//The current avatar and the previous ones, false if there's nothing to regenerate from
+func regenerateUser(rData *pages.RequestData, userRecord *datastore.UserRecord) (bool, error) {
+	var regenerated bool
+
+	userId := userRecord.GetKey().IntID()
+	avatarIds := append([]int64{userRecord.GetData().AvatarId}, userRecord.GetData().AvatarHistory...)
+
+	store := blobstore.GetAvatarStore(rData)
+
+	for _, avatarId := range avatarIds {
+		if avatarId == 0 {
+			continue
+		}
+
+		reader, _, err := store.Open(rData.Ctx, GetOriginalFilename(userId, avatarId))
+		if err == blobstore.ErrNotFound {
+			continue
+		} else if err != nil {
+			return regenerated, err
+		}
+
+		originalImg, _, err := image.Decode(reader)
+		reader.Close()
+		if err != nil {
+			return regenerated, err
+		}
+
+		if err := Store(rData, store, userId, avatarId, originalImg, false); err != nil {
+			return regenerated, err
+		}
+
+		regenerated = true
+	}
+
+	if !regenerated {
+		return false, nil
+	}
+
+	//avatars may have been replaced meanwhile, in which case the ones no longer kept were just orphaned
+	var currentRecord datastore.UserRecord
+	if err := datastore.LoadFromKey(rData.Ctx, &currentRecord, userId); err != nil {
+		return true, nil
+	}
+
+	currentIds := append([]int64{currentRecord.GetData().AvatarId}, currentRecord.GetData().AvatarHistory...)
+	for _, avatarId := range avatarIds {
+		if avatarId != 0 && indexOf(currentIds, avatarId) == -1 {
+			Delete(rData, store, userId, avatarId)
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,265 @@
+package avatars
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+	"io/ioutil"
+
+	"github.com/oliamb/cutter"
+
+	"github.com/dakom/basic-site-api/lib/pages"
+)
+
+const exifOrientationTag = 0x0112
+
+const AVATAR_DEFAULT_MAX_DIMENSION = 8192
+
+//a decoded image takes 4 bytes a pixel, and a JPEG that has to be turned upright is copied once more - so about 32MB at most
+const AVATAR_DEFAULT_MAX_PIXELS = 4000000
+
+var defaultFormats = []string{"jpeg", "png", "gif"}
+
+var ErrInvalidCrop = errors.New("crop rectangle is outside of the image")
+var ErrFormatNotAllowed = errors.New("image format isn't allowed for avatars")
+var ErrTooLarge = errors.New("image dimensions are too large for an avatar")
+
+//Square, in pixels of the image as it's displayed (i.e. after the EXIF orientation was applied)
+type CropRect struct {
+	X    int
+	Y    int
+	Size int
+}
+
+//Decodes an uploaded image and turns it upright according to its EXIF orientation (which only JPEGs have)
+//The format and dimensions are checked from the header first, since a few bytes can claim a huge bitmap (see Config.AVATAR_MAX_*)
+func Decode(rData *pages.RequestData, reader io.Reader) (image.Image, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	imgConfig, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err == image.ErrFormat {
+		return nil, ErrFormatNotAllowed
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !isAllowedFormat(rData, format) {
+		return nil, ErrFormatNotAllowed
+	}
+
+	maxDimension := rData.SiteConfig.AVATAR_MAX_DIMENSION
+	if maxDimension == 0 {
+		maxDimension = AVATAR_DEFAULT_MAX_DIMENSION
+	}
+	maxPixels := int64(rData.SiteConfig.AVATAR_MAX_PIXELS)
+	if maxPixels == 0 {
+		maxPixels = AVATAR_DEFAULT_MAX_PIXELS
+	}
+
+	if imgConfig.Width <= 0 || imgConfig.Height <= 0 || imgConfig.Width > maxDimension || imgConfig.Height > maxDimension || int64(imgConfig.Width)*int64(imgConfig.Height) > maxPixels {
+		return nil, ErrTooLarge
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if format == "jpeg" {
+		img = applyOrientation(img, getJpegOrientation(data))
+	}
+
+	return img, nil
+}
+
+//The given square, or the centered one if crop is nil
+func Crop(img image.Image, crop *CropRect) (image.Image, error) {
+	if crop == nil {
+		return cutter.Crop(img, cutter.Config{
+			Width:   1,
+			Height:  1,
+			Mode:    cutter.Centered,
+			Options: cutter.Ratio,
+		})
+	}
+
+	bounds := img.Bounds()
+	//subtracted rather than added, so huge values can't overflow past the check
+	if crop.X < 0 || crop.Y < 0 || crop.Size <= 0 || crop.Size > bounds.Dx()-crop.X || crop.Size > bounds.Dy()-crop.Y {
+		return nil, ErrInvalidCrop
+	}
+
+	croppedImg := image.NewRGBA(image.Rect(0, 0, crop.Size, crop.Size))
+	draw.Draw(croppedImg, croppedImg.Bounds(), img, bounds.Min.Add(image.Pt(crop.X, crop.Y)), draw.Src)
+
+	return croppedImg, nil
+}
+
+func isAllowedFormat(rData *pages.RequestData, format string) bool {
+	formats := rData.SiteConfig.AVATAR_FORMATS
+	if len(formats) == 0 {
+		formats = defaultFormats
+	}
+
+	for _, allowedFormat := range formats {
+		if allowedFormat == format {
+			return true
+		}
+	}
+
+	return false
+}
+
+//1 (upright) if there's no EXIF orientation, only the segments before the image data are looked at
+func getJpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return 1
+		}
+
+		marker := data[pos+1]
+		switch {
+		case marker == 0xFF:
+			//fill byte
+			pos++
+			continue
+		case marker == 0xD9 || marker == 0xDA:
+			//end of image or start of scan, no metadata after this
+			return 1
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			//no length
+			pos += 2
+			continue
+		}
+
+		segmentLength := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if segmentLength < 2 || pos+2+segmentLength > len(data) {
+			return 1
+		}
+
+		if marker == 0xE1 {
+			if orientation := getExifOrientation(data[pos+4 : pos+2+segmentLength]); orientation != 0 {
+				return orientation
+			}
+		}
+
+		pos += 2 + segmentLength
+	}
+
+	return 1
+}
+
+//0 if the APP1 segment isn't EXIF or has no valid orientation in IFD0
+func getExifOrientation(segment []byte) int {
+	var byteOrder binary.ByteOrder
+
+	if len(segment) < 14 || string(segment[:6]) != "Exif\x00\x00" {
+		return 0
+	}
+
+	tiff := segment[6:]
+	switch string(tiff[:2]) {
+	case "II":
+		byteOrder = binary.LittleEndian
+	case "MM":
+		byteOrder = binary.BigEndian
+	default:
+		return 0
+	}
+
+	if byteOrder.Uint16(tiff[2:]) != 42 {
+		return 0
+	}
+
+	ifdOffset := int64(byteOrder.Uint32(tiff[4:]))
+	if ifdOffset < 8 || ifdOffset+2 > int64(len(tiff)) {
+		return 0
+	}
+	ifd := int(ifdOffset)
+
+	entryCount := int(byteOrder.Uint16(tiff[ifd:]))
+	for i := 0; i < entryCount; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+
+		if byteOrder.Uint16(tiff[entry:]) != exifOrientationTag {
+			continue
+		}
+
+		//a SHORT, which sits at the start of the value field
+		if byteOrder.Uint16(tiff[entry+2:]) != 3 {
+			return 0
+		}
+
+		orientation := int(byteOrder.Uint16(tiff[entry+8:]))
+		if orientation < 1 || orientation > 8 {
+			return 0
+		}
+		return orientation
+	}
+
+	return 0
+}
+
+//See the EXIF spec for the 8 orientations, 5-8 swap width and height
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	//copied to RGBA first so the pixels can be moved around directly
+	src := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dstX, dstY int
+
+			switch orientation {
+			case 2: //mirrored
+				dstX, dstY = width-1-x, y
+			case 3: //upside down
+				dstX, dstY = width-1-x, height-1-y
+			case 4: //mirrored upside down
+				dstX, dstY = x, height-1-y
+			case 5: //mirrored, rotated 90 counter-clockwise
+				dstX, dstY = y, x
+			case 6: //rotated 90 counter-clockwise, so turn it clockwise
+				dstX, dstY = height-1-y, x
+			case 7: //mirrored, rotated 90 clockwise
+				dstX, dstY = height-1-y, width-1-x
+			case 8: //rotated 90 clockwise, so turn it counter-clockwise
+				dstX, dstY = y, width-1-x
+			}
+
+			srcOffset := src.PixOffset(x, y)
+			dstOffset := dst.PixOffset(dstX, dstY)
+			copy(dst.Pix[dstOffset:dstOffset+4], src.Pix[srcOffset:srcOffset+4])
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,382 @@
+package avatars
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/setup/config/custom"
+)
+
+var marked = color.RGBA{R: 255, A: 255}
+
+var errAny = errors.New("any error")
+
+//"Exif\0\0" and a TIFF header with IFD0 holding an image width and the orientation
+func exifSegment(byteOrderMark string, fieldType uint16, orientation uint16) []byte {
+	var byteOrder binary.ByteOrder = binary.LittleEndian
+	if byteOrderMark == "MM" {
+		byteOrder = binary.BigEndian
+	}
+
+	tiff := make([]byte, 8+2+2*12+4)
+	copy(tiff, byteOrderMark)
+	byteOrder.PutUint16(tiff[2:], 42)
+	byteOrder.PutUint32(tiff[4:], 8)
+
+	byteOrder.PutUint16(tiff[8:], 2)
+
+	width := tiff[10:]
+	byteOrder.PutUint16(width, 0x0100)
+	byteOrder.PutUint16(width[2:], 3)
+	byteOrder.PutUint32(width[4:], 1)
+	byteOrder.PutUint16(width[8:], 640)
+
+	entry := tiff[22:]
+	byteOrder.PutUint16(entry, exifOrientationTag)
+	byteOrder.PutUint16(entry[2:], fieldType)
+	byteOrder.PutUint32(entry[4:], 1)
+	byteOrder.PutUint16(entry[8:], orientation)
+
+	return append([]byte("Exif\x00\x00"), tiff...)
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	segment := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+//SOI, the segments, then the start of a scan
+func jpegWith(segments ...[]byte) []byte {
+	data := []byte{0xFF, 0xD8}
+	for _, segment := range segments {
+		data = append(data, segment...)
+	}
+	return append(data, jpegSegment(0xDA, []byte{1, 1, 0, 0, 63, 0})...)
+}
+
+func TestGetExifOrientation(t *testing.T) {
+	for _, byteOrderMark := range []string{"II", "MM"} {
+		for orientation := 1; orientation <= 8; orientation++ {
+			if result := getExifOrientation(exifSegment(byteOrderMark, 3, uint16(orientation))); result != orientation {
+				t.Errorf("%s orientation %d: got %d", byteOrderMark, orientation, result)
+			}
+		}
+	}
+
+	valid := exifSegment("II", 3, 6)
+
+	withIfdOffset := func(offset uint32) []byte {
+		segment := exifSegment("II", 3, 6)
+		binary.LittleEndian.PutUint32(segment[10:], offset)
+		return segment
+	}
+	withEntryCount := func(count uint16) []byte {
+		segment := exifSegment("II", 3, 6)
+		binary.LittleEndian.PutUint16(segment[14:], count)
+		return segment
+	}
+	withMagic := func(magic uint16) []byte {
+		segment := exifSegment("II", 3, 6)
+		binary.LittleEndian.PutUint16(segment[8:], magic)
+		return segment
+	}
+
+	tests := []struct {
+		name    string
+		segment []byte
+	}{
+		{"empty", nil},
+		{"not exif", append([]byte("http://ns.adobe.com/xap/1.0/\x00"), valid[6:]...)},
+		{"only the header", valid[:14]},
+		{"shorter than a tiff header", valid[:12]},
+		{"unknown byte order", append([]byte("Exif\x00\x00XX"), valid[8:]...)},
+		{"byte order doesn't match", append([]byte("Exif\x00\x00MM"), valid[8:]...)},
+		{"not 42", withMagic(43)},
+		{"ifd offset inside the header", withIfdOffset(4)},
+		{"ifd offset past the end", withIfdOffset(1000)},
+		{"ifd offset overflowing", withIfdOffset(0xFFFFFFFF)},
+		{"entries cut off", valid[:len(valid)-8]},
+		{"entry count past the end", withEntryCount(0xFFFF)[:6+8+2+12]},
+		{"orientation entry not counted", withEntryCount(1)},
+		{"orientation not a SHORT", exifSegment("II", 4, 6)},
+		{"orientation 0", exifSegment("MM", 3, 0)},
+		{"orientation 9", exifSegment("MM", 3, 9)},
+	}
+
+	for _, test := range tests {
+		if result := getExifOrientation(test.segment); result != 0 {
+			t.Errorf("%s: expected 0, got %d", test.name, result)
+		}
+	}
+}
+
+func TestGetJpegOrientation(t *testing.T) {
+	app0 := jpegSegment(0xE0, []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00"))
+	exif := jpegSegment(0xE1, exifSegment("MM", 3, 6))
+	xmp := jpegSegment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>"))
+
+	truncated := jpegWith(app0, exif)
+	truncated = truncated[:len(app0)+12]
+
+	lengthTooShort := jpegWith(app0, exif)
+	lengthTooShort[len(app0)+4] = 0
+	lengthTooShort[len(app0)+5] = 1
+
+	tests := []struct {
+		name        string
+		data        []byte
+		orientation int
+	}{
+		{"exif", jpegWith(exif), 6},
+		{"exif after app0", jpegWith(app0, exif), 6},
+		{"exif after xmp", jpegWith(app0, xmp, exif), 6},
+		{"fill bytes before the marker", jpegWith(app0, []byte{0xFF, 0xFF}, exif), 6},
+		{"restart marker before it", jpegWith([]byte{0xFF, 0xD0}, exif), 6},
+		{"first of two exif segments", jpegWith(exif, jpegSegment(0xE1, exifSegment("II", 3, 3))), 6},
+		{"invalid exif skipped", jpegWith(jpegSegment(0xE1, exifSegment("II", 3, 9)), exif), 6},
+		{"no exif", jpegWith(app0), 1},
+		{"only xmp", jpegWith(app0, xmp), 1},
+		{"exif after the start of scan", append(jpegWith(app0), exif...), 1},
+		{"not a jpeg", append([]byte{0x89, 'P', 'N', 'G'}, exif...), 1},
+		{"empty", nil, 1},
+		{"only the soi", []byte{0xFF, 0xD8}, 1},
+		{"truncated segment", truncated, 1},
+		{"segment length below 2", lengthTooShort, 1},
+		{"garbage instead of a marker", jpegWith([]byte{0x00, 0x00}, exif), 1},
+	}
+
+	for _, test := range tests {
+		if result := getJpegOrientation(test.data); result != test.orientation {
+			t.Errorf("%s: expected %d, got %d", test.name, test.orientation, result)
+		}
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	//4x2 with the pixel at (1, 0) marked, offset so bounds that don't start at 0 are covered too
+	img := image.NewRGBA(image.Rect(10, 20, 14, 22))
+	img.Set(11, 20, marked)
+
+	tests := []struct {
+		orientation int
+		width       int
+		height      int
+		x           int
+		y           int
+	}{
+		{0, 4, 2, 11, 20}, //not set, untouched
+		{1, 4, 2, 11, 20},
+		{2, 4, 2, 2, 0},
+		{3, 4, 2, 2, 1},
+		{4, 4, 2, 1, 1},
+		{5, 2, 4, 0, 1},
+		{6, 2, 4, 1, 1},
+		{7, 2, 4, 1, 2},
+		{8, 2, 4, 0, 2},
+		{9, 4, 2, 11, 20}, //invalid, untouched
+	}
+
+	for _, test := range tests {
+		result := applyOrientation(img, test.orientation)
+		bounds := result.Bounds()
+
+		if bounds.Dx() != test.width || bounds.Dy() != test.height {
+			t.Errorf("orientation %d: expected %dx%d, got %dx%d", test.orientation, test.width, test.height, bounds.Dx(), bounds.Dy())
+			continue
+		}
+
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				isMarked := color.RGBAModel.Convert(result.At(x, y)) == marked
+				if isMarked != (x == test.x && y == test.y) {
+					t.Errorf("orientation %d: expected the marked pixel at (%d, %d), (%d, %d) is marked: %v", test.orientation, test.x, test.y, x, y, isMarked)
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeOrientation(t *testing.T) {
+	rData := &pages.RequestData{Ctx: context.Background(), SiteConfig: &custom.Config{}}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 32, 16)), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	for orientation := 1; orientation <= 8; orientation++ {
+		//right after the SOI
+		withExif := append([]byte{0xFF, 0xD8}, jpegSegment(0xE1, exifSegment("II", 3, uint16(orientation)))...)
+		withExif = append(withExif, data[2:]...)
+
+		img, err := Decode(rData, bytes.NewReader(withExif))
+		if err != nil {
+			t.Fatalf("orientation %d: %v", orientation, err)
+		}
+
+		width, height := 32, 16
+		if orientation >= 5 {
+			width, height = 16, 32
+		}
+		if img.Bounds().Dx() != width || img.Bounds().Dy() != height {
+			t.Errorf("orientation %d: expected %dx%d, got %v", orientation, width, height, img.Bounds())
+		}
+	}
+}
+
+//the signature and an IHDR claiming the size, with nothing after it
+func pngHeader(width uint32, height uint32) []byte {
+	chunk := make([]byte, 4+13)
+	copy(chunk, "IHDR")
+	binary.BigEndian.PutUint32(chunk[4:], width)
+	binary.BigEndian.PutUint32(chunk[8:], height)
+	chunk[12] = 8 //bit depth
+	chunk[13] = 6 //RGBA
+
+	checksum := make([]byte, 4)
+	binary.BigEndian.PutUint32(checksum, crc32.ChecksumIEEE(chunk))
+
+	data := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0d")
+	data = append(data, chunk...)
+	return append(data, checksum...)
+}
+
+//the header and logical screen descriptor, with nothing after it
+func gifHeader(width uint16, height uint16) []byte {
+	data := []byte("GIF89a\x00\x00\x00\x00\x00\x00\x00")
+	binary.LittleEndian.PutUint16(data[6:], width)
+	binary.LittleEndian.PutUint16(data[8:], height)
+	return data
+}
+
+func TestDecodeLimits(t *testing.T) {
+	defaults := &custom.Config{}
+	configured := &custom.Config{AVATAR_MAX_DIMENSION: 16, AVATAR_MAX_PIXELS: 200, AVATAR_FORMATS: []string{"png"}}
+
+	encoded := func(encode func(*bytes.Buffer, image.Image) error) []byte {
+		var buf bytes.Buffer
+		if err := encode(&buf, image.NewRGBA(image.Rect(0, 0, 16, 8))); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	pngData := encoded(func(buf *bytes.Buffer, img image.Image) error { return png.Encode(buf, img) })
+	gifData := encoded(func(buf *bytes.Buffer, img image.Image) error { return gif.Encode(buf, img, nil) })
+	jpegData := encoded(func(buf *bytes.Buffer, img image.Image) error { return jpeg.Encode(buf, img, nil) })
+
+	tests := []struct {
+		name   string
+		config *custom.Config
+		data   []byte
+		err    error //errAny - passed the checks, but there's nothing to decode after the header
+	}{
+		{"png", defaults, pngData, nil},
+		{"gif", defaults, gifData, nil},
+		{"jpeg", defaults, jpegData, nil},
+		{"png too wide", defaults, pngHeader(AVATAR_DEFAULT_MAX_DIMENSION+1, 1), ErrTooLarge},
+		{"png too high", defaults, pngHeader(1, AVATAR_DEFAULT_MAX_DIMENSION+1), ErrTooLarge},
+		{"png too many pixels", defaults, pngHeader(AVATAR_DEFAULT_MAX_DIMENSION, AVATAR_DEFAULT_MAX_DIMENSION), ErrTooLarge},
+		{"png at the pixel limit", defaults, pngHeader(2000, 2000), errAny},
+		{"png at the dimension limit", defaults, pngHeader(AVATAR_DEFAULT_MAX_DIMENSION, 1), errAny},
+		{"png huge", defaults, pngHeader(0x7FFFFFFF, 0x7FFFFFFF), errAny},
+		{"gif too many pixels", defaults, gifHeader(0xFFFF, 0xFFFF), ErrTooLarge},
+		{"gif too wide", defaults, gifHeader(AVATAR_DEFAULT_MAX_DIMENSION+1, 1), ErrTooLarge},
+		{"gif without a width", defaults, gifHeader(0, 10), ErrTooLarge},
+		{"gif without a height", defaults, gifHeader(10, 0), ErrTooLarge},
+		{"gif without a size", defaults, gifHeader(0, 0), ErrTooLarge},
+		{"configured dimension", configured, pngHeader(17, 1), ErrTooLarge},
+		{"configured pixels", configured, pngHeader(16, 13), ErrTooLarge},
+		{"within the configured limits", configured, pngData[:len(pngData)-1], errAny},
+		{"configured format", configured, pngData, nil},
+		{"format not configured", configured, gifData, ErrFormatNotAllowed},
+		{"jpeg not configured", configured, jpegData, ErrFormatNotAllowed},
+		{"unknown format", defaults, []byte("BM not a bitmap decoder we have"), ErrFormatNotAllowed},
+		{"empty", defaults, nil, ErrFormatNotAllowed},
+	}
+
+	for _, test := range tests {
+		rData := &pages.RequestData{Ctx: context.Background(), SiteConfig: test.config}
+		img, err := Decode(rData, bytes.NewReader(test.data))
+
+		switch test.err {
+		case nil:
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			} else if img.Bounds().Dx() != 16 || img.Bounds().Dy() != 8 {
+				t.Errorf("%s: expected 16x8, got %v", test.name, img.Bounds())
+			}
+		case errAny:
+			if err == nil || err == ErrTooLarge || err == ErrFormatNotAllowed {
+				t.Errorf("%s: expected a decoding error, got %v", test.name, err)
+			}
+		default:
+			if err != test.err {
+				t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+			}
+		}
+	}
+}
+
+func TestCrop(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 40, 30))
+	img.Set(12, 7, marked)
+
+	maxInt := int(^uint(0) >> 1)
+
+	tests := []struct {
+		name string
+		crop CropRect
+		ok   bool
+	}{
+		{"inside", CropRect{X: 10, Y: 5, Size: 20}, true},
+		{"whole height", CropRect{X: 0, Y: 0, Size: 30}, true},
+		{"at the edge", CropRect{X: 10, Y: 0, Size: 30}, true},
+		{"past the right", CropRect{X: 11, Y: 0, Size: 30}, false},
+		{"past the bottom", CropRect{X: 0, Y: 1, Size: 30}, false},
+		{"negative", CropRect{X: -1, Y: 0, Size: 10}, false},
+		{"no size", CropRect{X: 0, Y: 0, Size: 0}, false},
+		{"x overflowing", CropRect{X: maxInt - 5, Y: 0, Size: 10}, false},
+		{"y overflowing", CropRect{X: 0, Y: maxInt - 5, Size: 10}, false},
+		{"size overflowing", CropRect{X: 10, Y: 10, Size: maxInt}, false},
+	}
+
+	for _, test := range tests {
+		crop := test.crop
+		result, err := Crop(img, &crop)
+
+		if !test.ok {
+			if err != ErrInvalidCrop {
+				t.Errorf("%s: expected ErrInvalidCrop, got %v", test.name, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if result.Bounds().Dx() != crop.Size || result.Bounds().Dy() != crop.Size {
+			t.Errorf("%s: expected %dx%d, got %v", test.name, crop.Size, crop.Size, result.Bounds())
+		}
+
+		markedX, markedY := 12-crop.X, 7-crop.Y
+		if markedX >= 0 && markedX < crop.Size && markedY >= 0 && markedY < crop.Size {
+			if color.RGBAModel.Convert(result.At(markedX, markedY)) != marked {
+				t.Errorf("%s: the marked pixel isn't at (%d, %d)", test.name, markedX, markedY)
+			}
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package avatars
+
+import (
+	"errors"
+	"image"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/net/context"
+
+	gaeds "google.golang.org/appengine/datastore"
+
+	"github.com/dakom/basic-site-api/lib/blobstore"
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/setup/config/custom"
+)
+
+const AVATAR_DEFAULT_HISTORY_SIZE = 3
+
+var ErrNotInHistory = errors.New("not one of the user's previous avatars")
+var ErrEmptyFile = errors.New("avatar file is empty")
+
+//Reserves the id the next avatar is stored under
+//ids are never reused (AvatarId+1 would be, after a revert), so files being written never clash with ones in use
+func ReserveId(rData *pages.RequestData, userId int64) (int64, error) {
+	var avatarId int64
+
+	err := gaeds.RunInTransaction(rData.Ctx, func(c context.Context) error {
+		var userRecord datastore.UserRecord
+
+		if err := datastore.LoadFromKey(c, &userRecord, userId); err != nil {
+			return err
+		}
+
+		data := userRecord.GetData()
+		//records from before AvatarLastId only have AvatarId
+		if data.AvatarLastId < data.AvatarId {
+			data.AvatarLastId = data.AvatarId
+		}
+		data.AvatarLastId++
+		avatarId = data.AvatarLastId
+
+		return datastore.Save(c, &userRecord)
+	}, nil)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return avatarId, nil
+}
+
+//Writes every file of the avatar and reads them all back, and cleans up after itself if any of that fails
+func StoreVerified(rData *pages.RequestData, store custom.BlobStore, userId int64, avatarId int64, squareImg image.Image) error {
+	err := Store(rData, store, userId, avatarId, squareImg, true)
+	if err == nil {
+		err = Verify(rData, store, userId, avatarId)
+	}
+
+	if err != nil {
+		Delete(rData, store, userId, avatarId)
+	}
+
+	return err
+}
+
+func Verify(rData *pages.RequestData, store custom.BlobStore, userId int64, avatarId int64) error {
+	for _, filename := range getFilenames(rData, userId, avatarId) {
+		reader, _, err := store.Open(rData.Ctx, filename)
+		if err != nil {
+			return err
+		}
+
+		size, err := io.Copy(ioutil.Discard, reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			return ErrEmptyFile
+		}
+	}
+
+	return nil
+}
+
+//Makes the (stored and verified) avatar the user's current one, the previous one goes into the history
+func Activate(rData *pages.RequestData, userRecord *datastore.UserRecord, avatarId int64) error {
+	return changeVersions(rData, userRecord, activating(avatarId))
+}
+
+//Back to one of the avatars in the history, the current one takes its place there
+func Revert(rData *pages.RequestData, userRecord *datastore.UserRecord, avatarId int64) error {
+	return changeVersions(rData, userRecord, reverting(avatarId))
+}
+
+//No avatar - the current one can still be reverted to, unless purge is set, which deletes the history as well
+func Remove(rData *pages.RequestData, userRecord *datastore.UserRecord, purge bool) error {
+	return changeVersions(rData, userRecord, removing(purge))
+}
+
+//Changes the user's avatar ids and returns the avatars it dropped, see changeVersions
+type versionChange func(data *datastore.UserData) ([]int64, error)
+
+func activating(avatarId int64) versionChange {
+	return func(data *datastore.UserData) ([]int64, error) {
+		switchTo(data, avatarId)
+		return nil, nil
+	}
+}
+
+func reverting(avatarId int64) versionChange {
+	return func(data *datastore.UserData) ([]int64, error) {
+		if avatarId == 0 || indexOf(data.AvatarHistory, avatarId) == -1 {
+			return nil, ErrNotInHistory
+		}
+
+		switchTo(data, avatarId)
+		return nil, nil
+	}
+}
+
+func removing(purge bool) versionChange {
+	return func(data *datastore.UserData) ([]int64, error) {
+		if !purge {
+			switchTo(data, 0)
+			return nil, nil
+		}
+
+		dropped := data.AvatarHistory
+		if data.AvatarId != 0 {
+			dropped = append([]int64{data.AvatarId}, dropped...)
+		}
+
+		data.AvatarId = 0
+		data.AvatarHistory = nil
+
+		return dropped, nil
+	}
+}
+
+//Config.AVATAR_HISTORY_SIZE, with 0 meaning the default and anything negative none at all
+func getHistorySize(rData *pages.RequestData) int {
+	switch {
+	case rData.SiteConfig.AVATAR_HISTORY_SIZE == 0:
+		return AVATAR_DEFAULT_HISTORY_SIZE
+	case rData.SiteConfig.AVATAR_HISTORY_SIZE < 0:
+		return 0
+	}
+	return rData.SiteConfig.AVATAR_HISTORY_SIZE
+}
+
+//Runs change on the freshly loaded user within a transaction, then deletes the files of whatever it dropped or fell off the end of the history
+//userRecord ends up with what was saved
+func changeVersions(rData *pages.RequestData, userRecord *datastore.UserRecord, change versionChange) error {
+	var freshRecord *datastore.UserRecord
+	var dropped []int64
+
+	userId := userRecord.GetKey().IntID()
+	historySize := getHistorySize(rData)
+
+	err := gaeds.RunInTransaction(rData.Ctx, func(c context.Context) error {
+		var err error
+
+		//loading appends to slices, so it has to start from scratch on every attempt
+		freshRecord = &datastore.UserRecord{}
+		if err := datastore.LoadFromKey(c, freshRecord, userId); err != nil {
+			return err
+		}
+
+		if dropped, err = applyVersionChange(freshRecord.GetData(), historySize, change); err != nil {
+			return err
+		}
+
+		return datastore.Save(c, freshRecord)
+	}, nil)
+
+	if err != nil {
+		return err
+	}
+
+	userRecord.SetData(freshRecord.GetData())
+
+	deleteDropped(rData, blobstore.GetAvatarStore(rData), userId, dropped)
+
+	return nil
+}
+
+//Runs change, then cuts the history down to historySize - returns whatever was dropped or fell off its end
+func applyVersionChange(data *datastore.UserData, historySize int, change versionChange) ([]int64, error) {
+	dropped, err := change(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data.AvatarHistory) > historySize {
+		dropped = append(dropped, data.AvatarHistory[historySize:]...)
+		data.AvatarHistory = data.AvatarHistory[:historySize]
+	}
+
+	return dropped, nil
+}
+
+//the change is saved by now, so a file which can't be deleted is only logged
+func deleteDropped(rData *pages.RequestData, store custom.BlobStore, userId int64, dropped []int64) {
+	for _, avatarId := range dropped {
+		if err := Delete(rData, store, userId, avatarId); err != nil {
+			rData.LogError("failed to delete old avatar %d of %d: %v", avatarId, userId, err)
+		}
+	}
+}
+
+//the current avatar (if any) becomes the most recent one in the history
+func switchTo(data *datastore.UserData, avatarId int64) {
+	history := []int64{}
+	if data.AvatarId != 0 && data.AvatarId != avatarId {
+		history = append(history, data.AvatarId)
+	}
+
+	for _, historyId := range data.AvatarHistory {
+		if historyId != avatarId && historyId != data.AvatarId {
+			history = append(history, historyId)
+		}
+	}
+
+	data.AvatarId = avatarId
+	data.AvatarHistory = history
+}
+
+func indexOf(avatarIds []int64, avatarId int64) int {
+	for idx, id := range avatarIds {
+		if id == avatarId {
+			return idx
+		}
+	}
+	return -1
+}
@@ -0,0 +1,113 @@
+package avatars
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/dakom/basic-site-api/lib/blobstore"
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/setup/config/custom"
+)
+
+func TestApplyVersionChange(t *testing.T) {
+	data := &datastore.UserData{}
+
+	steps := []struct {
+		name        string
+		historySize int
+		change      versionChange
+		err         error
+		avatarId    int64
+		history     []int64
+		dropped     []int64
+	}{
+		{"first", 3, activating(1), nil, 1, []int64{}, nil},
+		{"second", 3, activating(2), nil, 2, []int64{1}, nil},
+		{"third", 3, activating(3), nil, 3, []int64{2, 1}, nil},
+		{"fourth", 3, activating(4), nil, 4, []int64{3, 2, 1}, nil},
+		{"fifth pushes out the first", 3, activating(5), nil, 5, []int64{4, 3, 2}, []int64{1}},
+		{"revert", 3, reverting(3), nil, 3, []int64{5, 4, 2}, nil},
+		{"revert to the oldest", 3, reverting(2), nil, 2, []int64{3, 5, 4}, nil},
+		{"revert to one which fell off", 3, reverting(1), ErrNotInHistory, 2, []int64{3, 5, 4}, nil},
+		{"revert to the current one", 3, reverting(2), ErrNotInHistory, 2, []int64{3, 5, 4}, nil},
+		{"revert to none", 3, reverting(0), ErrNotInHistory, 2, []int64{3, 5, 4}, nil},
+		{"remove pushes out the oldest", 3, removing(false), nil, 0, []int64{2, 3, 5}, []int64{4}},
+		{"remove again", 3, removing(false), nil, 0, []int64{2, 3, 5}, nil},
+		{"revert after removing", 3, reverting(3), nil, 3, []int64{2, 5}, nil},
+		{"smaller history", 1, activating(6), nil, 6, []int64{3}, []int64{2, 5}},
+		{"no history", 0, activating(7), nil, 7, []int64{}, []int64{6, 3}},
+		{"purge", 3, removing(true), nil, 0, nil, []int64{7}},
+		{"purge with nothing left", 3, removing(true), nil, 0, nil, nil},
+	}
+
+	for _, step := range steps {
+		dropped, err := applyVersionChange(data, step.historySize, step.change)
+
+		if err != step.err {
+			t.Fatalf("%s: expected %v, got %v", step.name, step.err, err)
+		}
+		if data.AvatarId != step.avatarId || !reflect.DeepEqual(data.AvatarHistory, step.history) {
+			t.Fatalf("%s: expected %d %v, got %d %v", step.name, step.avatarId, step.history, data.AvatarId, data.AvatarHistory)
+		}
+		if !reflect.DeepEqual(dropped, step.dropped) {
+			t.Errorf("%s: expected %v to be dropped, got %v", step.name, step.dropped, dropped)
+		}
+	}
+
+	//purging the current one along with the history, current first
+	data = &datastore.UserData{AvatarId: 3, AvatarHistory: []int64{2, 1}}
+	dropped, _ := applyVersionChange(data, 3, removing(true))
+	if !reflect.DeepEqual(dropped, []int64{3, 2, 1}) || data.AvatarId != 0 || data.AvatarHistory != nil {
+		t.Errorf("purge: dropped %v, left %d %v", dropped, data.AvatarId, data.AvatarHistory)
+	}
+}
+
+func TestGetHistorySize(t *testing.T) {
+	for configured, expected := range map[int]int{0: AVATAR_DEFAULT_HISTORY_SIZE, -1: 0, 1: 1, 10: 10} {
+		rData := &pages.RequestData{SiteConfig: &custom.Config{AVATAR_HISTORY_SIZE: configured}}
+		if result := getHistorySize(rData); result != expected {
+			t.Errorf("%d: expected %d, got %d", configured, expected, result)
+		}
+	}
+}
+
+func TestDeleteDropped(t *testing.T) {
+	rData := &pages.RequestData{Ctx: context.Background(), SiteConfig: &custom.Config{}}
+	store := blobstore.NewMemoryStore("")
+
+	data := &datastore.UserData{}
+	var dropped []int64
+	for avatarId := int64(1); avatarId <= 5; avatarId++ {
+		for _, filename := range []string{"1/" + strconv.FormatInt(avatarId, 10) + ".jpg", "1/" + strconv.FormatInt(avatarId, 10) + "_32.jpg"} {
+			if err := store.Put(rData.Ctx, filename, "image/jpeg", strings.NewReader("data")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		changeDropped, err := applyVersionChange(data, 2, activating(avatarId))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dropped = append(dropped, changeDropped...)
+	}
+
+	deleteDropped(rData, store, 1, dropped)
+
+	remaining, err := store.List(rData.Ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(remaining)
+
+	//current and the two in the history
+	expected := []string{"1/3.jpg", "1/3_32.jpg", "1/4.jpg", "1/4_32.jpg", "1/5.jpg", "1/5_32.jpg"}
+	if !reflect.DeepEqual(remaining, expected) {
+		t.Errorf("expected %v to be left, got %v", expected, remaining)
+	}
+}
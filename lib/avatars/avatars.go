@@ -0,0 +1,216 @@
+package avatars
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"strconv"
+	"strings"
+
+	"github.com/nfnt/resize"
+
+	"github.com/dakom/basic-site-api/lib/blobstore"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/setup/config/custom"
+)
+
+const (
+	AVATAR_FORMAT_JPEG string = "JPEG"
+	AVATAR_FORMAT_PNG  string = "PNG"
+	AVATAR_FORMAT_WEBP string = "WEBP"
+)
+
+const AVATAR_DEFAULT_QUALITY = 90
+
+//the square crop everything is made from, kept so the renditions can be rebuilt (see avatars-regenerate.go)
+const AVATAR_ORIGINAL_SUFFIX = "-orig"
+
+var ErrUnknownFormat = errors.New("unknown avatar format")
+var ErrNoWebpEncoder = errors.New("WEBP avatar renditions need Config.AvatarWebpEncoder")
+
+var defaultRenditions = []custom.AvatarRendition{
+	{Name: "default", Suffix: "", Size: 128, Format: AVATAR_FORMAT_JPEG},
+	{Name: "small", Suffix: "_32", Size: 32, Format: AVATAR_FORMAT_JPEG},
+}
+
+type AvatarUrlInfo struct {
+	Url    string `json:"url"`
+	Size   uint   `json:"size"`
+	Format string `json:"format"`
+}
+
+//Config.AVATAR_RENDITIONS, or the original two JPEGs if that's not set
+func GetRenditions(rData *pages.RequestData) []custom.AvatarRendition {
+	if len(rData.SiteConfig.AVATAR_RENDITIONS) > 0 {
+		return rData.SiteConfig.AVATAR_RENDITIONS
+	}
+	return defaultRenditions
+}
+
+func GetOriginalFilename(userId int64, avatarId int64) string {
+	return getFilename(userId, avatarId, AVATAR_ORIGINAL_SUFFIX, ".jpg")
+}
+
+func GetRenditionFilename(userId int64, avatarId int64, rendition custom.AvatarRendition) string {
+	return getFilename(userId, avatarId, rendition.Suffix, getExtension(rendition.Format))
+}
+
+//Writes every rendition of the square source image (and the image itself as the original, unless it's being rebuilt from that)
+func Store(rData *pages.RequestData, store custom.BlobStore, userId int64, avatarId int64, squareImg image.Image, storeOriginal bool) error {
+	if storeOriginal {
+		original := custom.AvatarRendition{Format: AVATAR_FORMAT_JPEG}
+		if err := putImage(rData, store, GetOriginalFilename(userId, avatarId), squareImg, original); err != nil {
+			return err
+		}
+	}
+
+	for _, rendition := range GetRenditions(rData) {
+		resizedImg := resize.Resize(rendition.Size, rendition.Size, squareImg, resize.Lanczos3)
+
+		if err := putImage(rData, store, GetRenditionFilename(userId, avatarId, rendition), resizedImg, rendition); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Everything under <user id>/<avatar id>, so renditions which aren't configured anymore go too
+func Delete(rData *pages.RequestData, store custom.BlobStore, userId int64, avatarId int64) error {
+	prefix := getFilename(userId, avatarId, "", "")
+
+	filenames, err := store.List(rData.Ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+
+	for _, filename := range filenames {
+		//another avatar whose id starts with this one's (suffixes can't start with a digit)
+		if rest := filename[len(prefix):]; rest != "" && rest[0] >= '0' && rest[0] <= '9' {
+			continue
+		}
+
+		if err := store.Delete(rData.Ctx, filename); err != nil {
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+//Checked at startup - the file names of the renditions mustn't clash with each other, the original, or another avatar's
+//and their names have to be different for the url api
+func ValidateRenditions(renditions []custom.AvatarRendition) error {
+	names := make(map[string]bool)
+	suffixes := make(map[string]bool)
+
+	for _, rendition := range renditions {
+		switch {
+		case names[rendition.Name]:
+			return fmt.Errorf("avatar rendition name %q is used twice", rendition.Name)
+		case suffixes[rendition.Suffix]:
+			return fmt.Errorf("avatar rendition suffix %q is used twice", rendition.Suffix)
+		case rendition.Suffix == AVATAR_ORIGINAL_SUFFIX:
+			return fmt.Errorf("avatar rendition %q can't have the original's suffix %q", rendition.Name, AVATAR_ORIGINAL_SUFFIX)
+		case rendition.Suffix != "" && rendition.Suffix[0] >= '0' && rendition.Suffix[0] <= '9':
+			return fmt.Errorf("avatar rendition suffix %q can't start with a digit", rendition.Suffix)
+		case strings.Contains(rendition.Suffix, "/"):
+			return fmt.Errorf("avatar rendition suffix %q can't contain a slash", rendition.Suffix)
+		case rendition.Size == 0:
+			return fmt.Errorf("avatar rendition %q has no size", rendition.Name)
+		}
+
+		switch rendition.Format {
+		case AVATAR_FORMAT_JPEG, AVATAR_FORMAT_PNG, AVATAR_FORMAT_WEBP:
+		default:
+			return fmt.Errorf("avatar rendition %q: %v %q", rendition.Name, ErrUnknownFormat, rendition.Format)
+		}
+
+		names[rendition.Name] = true
+		suffixes[rendition.Suffix] = true
+	}
+
+	return nil
+}
+
+//By rendition name, empty if there's no avatar
+func GetUrls(rData *pages.RequestData, userId int64, avatarId int64) map[string]*AvatarUrlInfo {
+	urls := make(map[string]*AvatarUrlInfo)
+
+	if avatarId == 0 {
+		return urls
+	}
+
+	store := blobstore.GetAvatarStore(rData)
+	for _, rendition := range GetRenditions(rData) {
+		urls[rendition.Name] = &AvatarUrlInfo{
+			Url:    store.URL(GetRenditionFilename(userId, avatarId, rendition)),
+			Size:   rendition.Size,
+			Format: rendition.Format,
+		}
+	}
+
+	return urls
+}
+
+//the original and every rendition
+func getFilenames(rData *pages.RequestData, userId int64, avatarId int64) []string {
+	filenames := []string{GetOriginalFilename(userId, avatarId)}
+	for _, rendition := range GetRenditions(rData) {
+		filenames = append(filenames, GetRenditionFilename(userId, avatarId, rendition))
+	}
+	return filenames
+}
+
+func getFilename(userId int64, avatarId int64, suffix string, extension string) string {
+	return strconv.FormatInt(userId, 10) + "/" + strconv.FormatInt(avatarId, 10) + suffix + extension
+}
+
+func getExtension(format string) string {
+	switch format {
+	case AVATAR_FORMAT_PNG:
+		return ".png"
+	case AVATAR_FORMAT_WEBP:
+		return ".webp"
+	}
+	return ".jpg"
+}
+
+func putImage(rData *pages.RequestData, store custom.BlobStore, filename string, img image.Image, rendition custom.AvatarRendition) error {
+	var buf bytes.Buffer
+	var contentType string
+	var err error
+
+	quality := rendition.Quality
+	if quality == 0 {
+		quality = AVATAR_DEFAULT_QUALITY
+	}
+
+	switch rendition.Format {
+	case AVATAR_FORMAT_JPEG:
+		contentType = "image/jpeg"
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	case AVATAR_FORMAT_PNG:
+		contentType = "image/png"
+		err = png.Encode(&buf, img)
+	case AVATAR_FORMAT_WEBP:
+		if rData.SiteConfig.AvatarWebpEncoder == nil {
+			return ErrNoWebpEncoder
+		}
+		contentType = "image/webp"
+		err = rData.SiteConfig.AvatarWebpEncoder(&buf, img, quality)
+	default:
+		return ErrUnknownFormat
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return store.Put(rData.Ctx, filename, contentType, &buf)
+}
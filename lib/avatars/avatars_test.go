@@ -0,0 +1,106 @@
+package avatars
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/dakom/basic-site-api/lib/blobstore"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/setup/config/custom"
+)
+
+func TestDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "avatars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stores := map[string]custom.BlobStore{
+		"memory": blobstore.NewMemoryStore(""),
+		"file":   &blobstore.FileStore{Dir: dir},
+	}
+
+	rData := &pages.RequestData{Ctx: context.Background(), SiteConfig: &custom.Config{}}
+
+	filenames := []string{
+		"1/12-orig.jpg",
+		"1/12.jpg",
+		"1/12_32.jpg",
+		"1/12_512.webp", //from a rendition which isn't configured anymore
+		"1/123.jpg",     //another avatar
+		"1/123_32.jpg",
+		"1/13.jpg",
+		"2/12.jpg", //another user
+		"quarantine/12.jpg",
+	}
+	expected := []string{"1/123.jpg", "1/123_32.jpg", "1/13.jpg", "2/12.jpg", "quarantine/12.jpg"}
+
+	for storeName, store := range stores {
+		for _, filename := range filenames {
+			if err := store.Put(rData.Ctx, filename, "image/jpeg", strings.NewReader("data")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := Delete(rData, store, 1, 12); err != nil {
+			t.Fatalf("%s: %v", storeName, err)
+		}
+
+		remaining, err := store.List(rData.Ctx, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(remaining)
+
+		if !reflect.DeepEqual(remaining, expected) {
+			t.Errorf("%s: expected %v to be left, got %v", storeName, expected, remaining)
+		}
+
+		//nothing there anymore is fine
+		if err := Delete(rData, store, 1, 12); err != nil {
+			t.Errorf("%s: deleting again failed: %v", storeName, err)
+		}
+	}
+}
+
+func TestValidateRenditions(t *testing.T) {
+	small := custom.AvatarRendition{Name: "small", Suffix: "_32", Size: 32, Format: AVATAR_FORMAT_JPEG}
+
+	tests := []struct {
+		name       string
+		renditions []custom.AvatarRendition
+		valid      bool
+	}{
+		{"not set", nil, true},
+		{"defaults", defaultRenditions, true},
+		{"different formats", []custom.AvatarRendition{
+			{Name: "default", Size: 128, Format: AVATAR_FORMAT_JPEG},
+			{Name: "png", Suffix: "_png", Size: 128, Format: AVATAR_FORMAT_PNG},
+			{Name: "webp", Suffix: "_webp", Size: 128, Format: AVATAR_FORMAT_WEBP, Quality: 80},
+		}, true},
+		{"same suffix", []custom.AvatarRendition{small, {Name: "small-png", Suffix: "_32", Size: 32, Format: AVATAR_FORMAT_PNG}}, false},
+		{"same name", []custom.AvatarRendition{small, {Name: "small", Suffix: "_64", Size: 64, Format: AVATAR_FORMAT_JPEG}}, false},
+		{"original's suffix", []custom.AvatarRendition{{Name: "big", Suffix: AVATAR_ORIGINAL_SUFFIX, Size: 512, Format: AVATAR_FORMAT_JPEG}}, false},
+		{"suffix starts with a digit", []custom.AvatarRendition{{Name: "small", Suffix: "32", Size: 32, Format: AVATAR_FORMAT_JPEG}}, false},
+		{"suffix with a slash", []custom.AvatarRendition{{Name: "small", Suffix: "/32", Size: 32, Format: AVATAR_FORMAT_JPEG}}, false},
+		{"no size", []custom.AvatarRendition{{Name: "small", Suffix: "_32", Format: AVATAR_FORMAT_JPEG}}, false},
+		{"unknown format", []custom.AvatarRendition{{Name: "small", Suffix: "_32", Size: 32, Format: "GIF"}}, false},
+	}
+
+	for _, test := range tests {
+		err := ValidateRenditions(test.renditions)
+		if test.valid && err != nil {
+			t.Errorf("%s: expected it to be accepted, got %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected it to be rejected", test.name)
+		}
+	}
+}
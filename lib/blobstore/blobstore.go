@@ -0,0 +1,347 @@
+package blobstore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/setup/config/custom"
+)
+
+var ErrNotFound = errors.New("blob not found")
+var ErrInvalidName = errors.New("invalid blob name")
+
+//Config.AvatarStore, or the GCS_BUCKET_AVATAR bucket if that's not set
+func GetAvatarStore(rData *pages.RequestData) custom.BlobStore {
+	if rData.SiteConfig.AvatarStore != nil {
+		return rData.SiteConfig.AvatarStore
+	}
+
+	return &GcsStore{Bucket: rData.SiteConfig.GCS_BUCKET_AVATAR}
+}
+
+//names are relative slash separated paths, nothing that could climb out of wherever the store keeps them
+func IsValidName(name string) bool {
+	if name == "" || name == "." || strings.HasPrefix(name, "/") || strings.Contains(name, "\\") {
+		return false
+	}
+	return path.Clean(name) == name && name != ".." && !strings.HasPrefix(name, "../")
+}
+
+/* Google Cloud Storage - the bucket must be publicly readable for URL to work */
+
+type GcsStore struct {
+	Bucket string
+}
+
+func (store *GcsStore) Put(c context.Context, name string, contentType string, data io.Reader) error {
+	client, err := storage.NewClient(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	writer := client.Bucket(store.Bucket).Object(name).NewWriter(c)
+	writer.ContentType = contentType
+
+	if _, err := io.Copy(writer, data); err != nil {
+		writer.Close()
+		return err
+	}
+
+	//the upload is only finished (or failed) once it's closed
+	return writer.Close()
+}
+
+func (store *GcsStore) Open(c context.Context, name string) (io.ReadCloser, string, error) {
+	client, err := storage.NewClient(c)
+	if err != nil {
+		return nil, "", err
+	}
+
+	reader, err := client.Bucket(store.Bucket).Object(name).NewReader(c)
+	if err == storage.ErrObjectNotExist {
+		client.Close()
+		return nil, "", ErrNotFound
+	} else if err != nil {
+		client.Close()
+		return nil, "", err
+	}
+
+	return &gcsReadCloser{Reader: reader, client: client}, reader.ContentType(), nil
+}
+
+func (store *GcsStore) Delete(c context.Context, name string) error {
+	client, err := storage.NewClient(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	err = client.Bucket(store.Bucket).Object(name).Delete(c)
+	if err == storage.ErrObjectNotExist {
+		return nil
+	}
+	return err
+}
+
+func (store *GcsStore) List(c context.Context, prefix string) ([]string, error) {
+	client, err := storage.NewClient(c)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	var names []string
+
+	objects := client.Bucket(store.Bucket).Objects(c, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := objects.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		names = append(names, attrs.Name)
+	}
+
+	return names, nil
+}
+
+func (store *GcsStore) URL(name string) string {
+	return "https://storage.googleapis.com/" + store.Bucket + "/" + name
+}
+
+//closes the client along with the reader
+type gcsReadCloser struct {
+	*storage.Reader
+	client *storage.Client
+}
+
+func (reader *gcsReadCloser) Close() error {
+	err := reader.Reader.Close()
+	reader.client.Close()
+	return err
+}
+
+/* Local filesystem, for development - BaseUrl is where it's served from, e.g. API_HOSTNAME + "avatars/" (see accounts.GotAvatarServeRequest)
+ * the content type comes from the file extension
+ */
+
+type FileStore struct {
+	Dir     string
+	BaseUrl string
+}
+
+func (store *FileStore) Put(c context.Context, name string, contentType string, data io.Reader) error {
+	fullPath, err := store.getPath(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+
+	//written next to it and renamed, so nobody ever reads half a file
+	tempFile, err := ioutil.TempFile(filepath.Dir(fullPath), ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tempFile, data)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempFile.Name(), fullPath)
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+	}
+
+	return err
+}
+
+func (store *FileStore) Open(c context.Context, name string) (io.ReadCloser, string, error) {
+	fullPath, err := store.getPath(name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	file, err := os.Open(fullPath)
+	if os.IsNotExist(err) {
+		return nil, "", ErrNotFound
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	return file, getContentTypeFromName(name), nil
+}
+
+func (store *FileStore) Delete(c context.Context, name string) error {
+	fullPath, err := store.getPath(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+//the prefix doesn't have to end at a directory, so this walks the one it's in
+func (store *FileStore) List(c context.Context, prefix string) ([]string, error) {
+	dirName := path.Dir(prefix + "x")
+	if dirName != "." && !IsValidName(dirName) {
+		return nil, ErrInvalidName
+	}
+
+	var names []string
+
+	root := filepath.Join(store.Dir, filepath.FromSlash(dirName))
+	err := filepath.Walk(root, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		//half written ones (see Put)
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(store.Dir, fullPath)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(relPath); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+
+	return names, err
+}
+
+func (store *FileStore) URL(name string) string {
+	return store.BaseUrl + name
+}
+
+func (store *FileStore) getPath(name string) (string, error) {
+	if !IsValidName(name) {
+		return "", ErrInvalidName
+	}
+	return filepath.Join(store.Dir, filepath.FromSlash(name)), nil
+}
+
+/* In-memory, for tests */
+
+type MemoryStore struct {
+	BaseUrl string
+	lock    sync.Mutex
+	blobs   map[string]*memoryBlob
+}
+
+type memoryBlob struct {
+	data        []byte
+	contentType string
+}
+
+func NewMemoryStore(baseUrl string) *MemoryStore {
+	return &MemoryStore{BaseUrl: baseUrl, blobs: make(map[string]*memoryBlob)}
+}
+
+func (store *MemoryStore) Put(c context.Context, name string, contentType string, data io.Reader) error {
+	if !IsValidName(name) {
+		return ErrInvalidName
+	}
+
+	dataBytes, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.blobs[name] = &memoryBlob{data: dataBytes, contentType: contentType}
+	return nil
+}
+
+func (store *MemoryStore) Open(c context.Context, name string) (io.ReadCloser, string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	blob := store.blobs[name]
+	if blob == nil {
+		return nil, "", ErrNotFound
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(blob.data)), blob.contentType, nil
+}
+
+func (store *MemoryStore) Delete(c context.Context, name string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	delete(store.blobs, name)
+	return nil
+}
+
+func (store *MemoryStore) List(c context.Context, prefix string) ([]string, error) {
+	var names []string
+
+	for _, name := range store.Names() {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+func (store *MemoryStore) URL(name string) string {
+	return store.BaseUrl + name
+}
+
+//sorted
+func (store *MemoryStore) Names() []string {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	names := make([]string, 0, len(store.blobs))
+	for name := range store.blobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func getContentTypeFromName(name string) string {
+	//not in the builtin table of older runtimes
+	if path.Ext(name) == ".webp" {
+		return "image/webp"
+	}
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,124 @@
+package blobstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+var nameTests = []struct {
+	name  string
+	valid bool
+}{
+	{"12.jpg", true},
+	{"1/12_32.jpg", true},
+	{"quarantine/12.jpg", true},
+	{"..12.jpg", true}, //only a file name starting with dots
+	{"1/..12.jpg", true},
+	{"", false},
+	{".", false},
+	{"..", false},
+	{"../x", false},
+	{"a/..", false},
+	{"a/../x", false},
+	{"a/../../x", false},
+	{"/x", false},
+	{"/", false},
+	{"//x", false},
+	{"a//x", false},
+	{"a/", false},
+	{"./x", false},
+	{"a/./x", false},
+	{"a\\x", false},
+	{"..\\x", false},
+	{"a\\..\\..\\x", false},
+	{"\\x", false},
+}
+
+func TestIsValidName(t *testing.T) {
+	for _, test := range nameTests {
+		if result := IsValidName(test.name); result != test.valid {
+			t.Errorf("%q: expected %v, got %v", test.name, test.valid, result)
+		}
+	}
+}
+
+func TestFileStoreGetPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &FileStore{Dir: filepath.Join(dir, "store")}
+
+	for _, test := range nameTests {
+		fullPath, err := store.getPath(test.name)
+
+		if !test.valid {
+			if err != ErrInvalidName {
+				t.Errorf("%q: expected ErrInvalidName, got %q %v", test.name, fullPath, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %v", test.name, err)
+			continue
+		}
+		if !strings.HasPrefix(fullPath, store.Dir+string(filepath.Separator)) {
+			t.Errorf("%q: %q is outside of %q", test.name, fullPath, store.Dir)
+		}
+	}
+
+	//and nothing gets written, read or deleted outside of it
+	c := context.Background()
+	outside := filepath.Join(dir, "outside.jpg")
+	if err := ioutil.WriteFile(outside, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"../outside.jpg", "a/../../outside.jpg", outside, "..\\outside.jpg"} {
+		if err := store.Put(c, name, "image/jpeg", strings.NewReader("overwritten")); err != ErrInvalidName {
+			t.Errorf("put %q: expected ErrInvalidName, got %v", name, err)
+		}
+		if _, _, err := store.Open(c, name); err != ErrInvalidName {
+			t.Errorf("open %q: expected ErrInvalidName, got %v", name, err)
+		}
+		if err := store.Delete(c, name); err != ErrInvalidName {
+			t.Errorf("delete %q: expected ErrInvalidName, got %v", name, err)
+		}
+	}
+	if _, err := store.List(c, "../"); err != ErrInvalidName {
+		t.Errorf("list: expected ErrInvalidName, got %v", err)
+	}
+
+	if data, err := ioutil.ReadFile(outside); err != nil || string(data) != "data" {
+		t.Errorf("the file outside was touched: %q %v", data, err)
+	}
+
+	if err := store.Put(c, "1/12.jpg", "image/jpeg", strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(store.Dir, "1", "12.jpg")); err != nil {
+		t.Errorf("not stored where expected: %v", err)
+	}
+}
+
+func TestMemoryStoreName(t *testing.T) {
+	store := NewMemoryStore("")
+
+	for _, test := range nameTests {
+		err := store.Put(context.Background(), test.name, "image/jpeg", strings.NewReader("data"))
+		if test.valid && err != nil {
+			t.Errorf("%q: %v", test.name, err)
+		}
+		if !test.valid && err != ErrInvalidName {
+			t.Errorf("%q: expected ErrInvalidName, got %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package datastore
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	gaeds "google.golang.org/appengine/datastore"
+)
+
+const AUDIT_TYPE = "AuditEvent"
+
+const (
+	AUDIT_EVENT_LOGIN              string = "login"
+	AUDIT_EVENT_LOGIN_FAILED       string = "login-failed"
+	AUDIT_EVENT_PASSWORD_CHANGED   string = "password-changed"
+	AUDIT_EVENT_EMAIL_CHANGED      string = "email-changed"
+	AUDIT_EVENT_OAUTH_LINKED       string = "oauth-linked"
+	AUDIT_EVENT_OAUTH_UNLINKED     string = "oauth-unlinked"
+	AUDIT_EVENT_SUBACCOUNT_CREATED string = "subaccount-created"
+	AUDIT_EVENT_ACTIVATED          string = "activated"
+	AUDIT_EVENT_STATUS_CHANGED     string = "status-changed"
+	AUDIT_EVENT_OAUTH_AUTHORIZED   string = "oauth-authorized"
+	AUDIT_EVENT_PHONE_CHANGED      string = "phone-changed"
+)
+
+//Audit records are append-only - there's deliberately no update or delete helper here
+//Querying requires composite indexes on (UserId, -Date), (EventType, -Date) and (UserId, EventType, -Date)
+type AuditData struct {
+	ActorId   int64 //who did it (0 if anonymous, e.g. failed login with unknown username)
+	UserId    int64 //who it was done to
+	EventType string
+	IpAddress string
+	UserAgent string `datastore:",noindex"`
+	Date      time.Time
+	Meta      string `datastore:",noindex"` //json
+}
+
+type AuditRecord struct {
+	DsRecord
+	data *AuditData
+}
+
+func (dsr *AuditRecord) GetRawData() interface{} {
+	return dsr.GetData()
+}
+func (dsr *AuditRecord) GetType() string {
+	return AUDIT_TYPE
+}
+
+func (dsr *AuditRecord) GetData() *AuditData {
+	if dsr.data == nil {
+		dsr.SetData(&AuditData{})
+	}
+	return dsr.data
+}
+
+func (dsr *AuditRecord) SetData(newData *AuditData) {
+	dsr.data = newData
+}
+
+//userId and eventType are optional filters (zero value means don't filter)
+//returns the records and the cursor to pass in for the next page ("" when there are no more)
+func QueryAuditRecords(c context.Context, userId int64, eventType string, cursorString string, limit int) ([]*AuditRecord, string, error) {
+	query := gaeds.NewQuery(AUDIT_TYPE)
+
+	if userId != 0 {
+		query = query.Filter("UserId =", userId)
+	}
+	if eventType != "" {
+		query = query.Filter("EventType =", eventType)
+	}
+
+	query = query.Order("-Date").Limit(limit)
+
+	if cursorString != "" {
+		cursor, err := gaeds.DecodeCursor(cursorString)
+		if err != nil {
+			return nil, "", err
+		}
+		query = query.Start(cursor)
+	}
+
+	var records []*AuditRecord
+
+	iter := query.Run(c)
+	for {
+		var data AuditData
+		key, err := iter.Next(&data)
+		if err == gaeds.Done {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		record := &AuditRecord{}
+		record.SetKey(key)
+		record.SetData(&data)
+		records = append(records, record)
+	}
+
+	if len(records) < limit {
+		return records, "", nil
+	}
+
+	cursor, err := iter.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return records, cursor.String(), nil
+}
@@ -0,0 +1,95 @@
+package datastore
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	gaeds "google.golang.org/appengine/datastore"
+)
+
+const AVATAR_QUARANTINE_TYPE = "AvatarQuarantine"
+
+const (
+	AVATAR_QUARANTINE_PENDING  string = "pending"
+	AVATAR_QUARANTINE_APPROVED string = "approved"
+	AVATAR_QUARANTINE_REJECTED string = "rejected"
+)
+
+//An avatar the moderator wasn't sure about (see lib/avatars/avatars-moderation.go), kept until an admin reviews it
+type AvatarQuarantineData struct {
+	UserId       int64
+	Status       string
+	Filename     string //the square crop, in the avatar store - deleted once reviewed
+	Reason       string `datastore:",noindex"`
+	ReviewerId   int64
+	Date         time.Time
+	ReviewedDate time.Time
+}
+
+type AvatarQuarantineRecord struct {
+	DsRecord
+	data *AvatarQuarantineData
+}
+
+func (dsr *AvatarQuarantineRecord) GetRawData() interface{} {
+	return dsr.GetData()
+}
+func (dsr *AvatarQuarantineRecord) GetType() string {
+	return AVATAR_QUARANTINE_TYPE
+}
+
+func (dsr *AvatarQuarantineRecord) GetData() *AvatarQuarantineData {
+	if dsr.data == nil {
+		dsr.SetData(&AvatarQuarantineData{})
+	}
+	return dsr.data
+}
+
+func (dsr *AvatarQuarantineRecord) SetData(newData *AvatarQuarantineData) {
+	dsr.data = newData
+}
+
+//The ones still waiting for review, oldest first (in key order, so no composite index is needed)
+//returns the records and the cursor to pass in for the next page ("" when there are no more)
+func QueryPendingAvatarQuarantineRecords(c context.Context, cursorString string, limit int) ([]*AvatarQuarantineRecord, string, error) {
+	query := gaeds.NewQuery(AVATAR_QUARANTINE_TYPE).Filter("Status =", AVATAR_QUARANTINE_PENDING).Limit(limit)
+
+	if cursorString != "" {
+		cursor, err := gaeds.DecodeCursor(cursorString)
+		if err != nil {
+			return nil, "", err
+		}
+		query = query.Start(cursor)
+	}
+
+	var records []*AvatarQuarantineRecord
+
+	iter := query.Run(c)
+	for {
+		var data AvatarQuarantineData
+		key, err := iter.Next(&data)
+		if err == gaeds.Done {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		record := &AvatarQuarantineRecord{}
+		record.SetKey(key)
+		record.SetData(&data)
+		records = append(records, record)
+	}
+
+	if len(records) < limit {
+		return records, "", nil
+	}
+
+	cursor, err := iter.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return records, cursor.String(), nil
+}
@@ -0,0 +1,49 @@
+package datastore
+
+import (
+	"time"
+)
+
+const AVATAR_REGENERATE_TYPE = "AvatarRegenerate"
+
+const (
+	AVATAR_REGENERATE_RUNNING string = "running"
+	AVATAR_REGENERATE_DONE    string = "done"
+	AVATAR_REGENERATE_FAILED  string = "failed"
+)
+
+//One per regeneration job (see lib/avatars/avatars-regenerate.go), doubles as its report
+type AvatarRegenerateData struct {
+	Status      string
+	NextCursor  string `datastore:",noindex"` //where the next batch starts, a batch for any other cursor was already done
+	Checked     int    `datastore:",noindex"`
+	Regenerated int    `datastore:",noindex"`
+	Skipped     int    `datastore:",noindex"` //no avatars, or only ones from before originals were kept
+	Failed      int    `datastore:",noindex"`
+	LastError   string `datastore:",noindex"`
+	Date        time.Time
+	UpdatedDate time.Time
+}
+
+type AvatarRegenerateRecord struct {
+	DsRecord
+	data *AvatarRegenerateData
+}
+
+func (dsr *AvatarRegenerateRecord) GetRawData() interface{} {
+	return dsr.GetData()
+}
+func (dsr *AvatarRegenerateRecord) GetType() string {
+	return AVATAR_REGENERATE_TYPE
+}
+
+func (dsr *AvatarRegenerateRecord) GetData() *AvatarRegenerateData {
+	if dsr.data == nil {
+		dsr.SetData(&AvatarRegenerateData{})
+	}
+	return dsr.data
+}
+
+func (dsr *AvatarRegenerateRecord) SetData(newData *AvatarRegenerateData) {
+	dsr.data = newData
+}
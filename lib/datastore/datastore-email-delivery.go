@@ -0,0 +1,58 @@
+package datastore
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	gaeds "google.golang.org/appengine/datastore"
+)
+
+const EMAIL_DELIVERY_TYPE = "EmailDelivery"
+
+const (
+	EMAIL_DELIVERY_SENDING string = "sending" //claimed by a task, see lib/email/email-queue.go
+	EMAIL_DELIVERY_SENT    string = "sent"
+	EMAIL_DELIVERY_FAILED  string = "failed" //will be retried
+	EMAIL_DELIVERY_DEAD    string = "dead"   //gave up, see LastError
+)
+
+//One per queued email, keyed by its idempotency key so a retried task can tell it was already sent
+//The message itself isn't kept (it may hold login links and such), and records are deleted after a while, see lib/email/email-queue.go
+type EmailDeliveryData struct {
+	ToAddress   string
+	Subject     string `datastore:",noindex"`
+	Status      string
+	Attempts    int    `datastore:",noindex"`
+	LastError   string `datastore:",noindex"`
+	Date        time.Time
+	UpdatedDate time.Time
+}
+
+type EmailDeliveryRecord struct {
+	DsRecord
+	data *EmailDeliveryData
+}
+
+func (dsr *EmailDeliveryRecord) GetRawData() interface{} {
+	return dsr.GetData()
+}
+func (dsr *EmailDeliveryRecord) GetType() string {
+	return EMAIL_DELIVERY_TYPE
+}
+
+func (dsr *EmailDeliveryRecord) GetData() *EmailDeliveryData {
+	if dsr.data == nil {
+		dsr.SetData(&EmailDeliveryData{})
+	}
+	return dsr.data
+}
+
+func (dsr *EmailDeliveryRecord) SetData(newData *EmailDeliveryData) {
+	dsr.data = newData
+}
+
+//Keys of deliveries which weren't touched since before, oldest first
+func GetStaleEmailDeliveryKeys(c context.Context, before time.Time, limit int) ([]*gaeds.Key, error) {
+	return gaeds.NewQuery(EMAIL_DELIVERY_TYPE).Filter("UpdatedDate <", before).Order("UpdatedDate").KeysOnly().Limit(limit).GetAll(c, nil)
+}
@@ -0,0 +1,76 @@
+package datastore
+
+import (
+	"strings"
+	"time"
+)
+
+const EMAIL_EVENT_TYPE = "EmailEvent"
+const EMAIL_SUPPRESSION_TYPE = "EmailSuppression"
+
+//Delivery feedback from the mail provider, keyed by the provider's event id when there is one (so resent batches don't duplicate)
+//Querying per address requires a composite index on (Address, -Date)
+type EmailEventData struct {
+	Address  string
+	Event    string //bounce, dropped, deferred, delivered, spamreport
+	Reason   string `datastore:",noindex"`
+	Provider string
+	Date     time.Time
+}
+
+type EmailEventRecord struct {
+	DsRecord
+	data *EmailEventData
+}
+
+func (dsr *EmailEventRecord) GetRawData() interface{} {
+	return dsr.GetData()
+}
+func (dsr *EmailEventRecord) GetType() string {
+	return EMAIL_EVENT_TYPE
+}
+
+func (dsr *EmailEventRecord) GetData() *EmailEventData {
+	if dsr.data == nil {
+		dsr.SetData(&EmailEventData{})
+	}
+	return dsr.data
+}
+
+func (dsr *EmailEventRecord) SetData(newData *EmailEventData) {
+	dsr.data = newData
+}
+
+//Addresses we no longer send to (hard bounce or spam complaint), keyed via GetEmailSuppressionKey
+type EmailSuppressionData struct {
+	Event  string
+	Reason string `datastore:",noindex"`
+	Date   time.Time
+}
+
+type EmailSuppressionRecord struct {
+	DsRecord
+	data *EmailSuppressionData
+}
+
+func (dsr *EmailSuppressionRecord) GetRawData() interface{} {
+	return dsr.GetData()
+}
+func (dsr *EmailSuppressionRecord) GetType() string {
+	return EMAIL_SUPPRESSION_TYPE
+}
+
+func (dsr *EmailSuppressionRecord) GetData() *EmailSuppressionData {
+	if dsr.data == nil {
+		dsr.SetData(&EmailSuppressionData{})
+	}
+	return dsr.data
+}
+
+func (dsr *EmailSuppressionRecord) SetData(newData *EmailSuppressionData) {
+	dsr.data = newData
+}
+
+func GetEmailSuppressionKey(address string) string {
+	return strings.ToLower(strings.TrimSpace(address))
+}
@@ -0,0 +1,54 @@
+package datastore
+
+import (
+	"time"
+)
+
+const MAILINGLIST_RESYNC_TYPE = "MailingListResync"
+
+const (
+	MAILINGLIST_RESYNC_RUNNING string = "running"
+	MAILINGLIST_RESYNC_DONE    string = "done"
+	MAILINGLIST_RESYNC_FAILED  string = "failed"
+)
+
+//One per resync job (see lib/email/mailinglist-resync.go), doubles as its report
+type MailingListResyncData struct {
+	Status      string
+	DryRun      bool
+	ActiveOnly  bool
+	CullPending bool
+	AddedAfter  time.Time
+	NextCursor  string   `datastore:",noindex"` //where the next batch starts, a batch for any other cursor was already done
+	Checked     int      `datastore:",noindex"`
+	InSync      int      `datastore:",noindex"`
+	Drifted     int      `datastore:",noindex"` //needed changes, which were made unless DryRun
+	Failed      int      `datastore:",noindex"`
+	Changes     []string `datastore:",noindex"` //"uid: change", only the first MAILINGLIST_RESYNC_MAX_CHANGES
+	LastError   string   `datastore:",noindex"`
+	Date        time.Time
+	UpdatedDate time.Time
+}
+
+type MailingListResyncRecord struct {
+	DsRecord
+	data *MailingListResyncData
+}
+
+func (dsr *MailingListResyncRecord) GetRawData() interface{} {
+	return dsr.GetData()
+}
+func (dsr *MailingListResyncRecord) GetType() string {
+	return MAILINGLIST_RESYNC_TYPE
+}
+
+func (dsr *MailingListResyncRecord) GetData() *MailingListResyncData {
+	if dsr.data == nil {
+		dsr.SetData(&MailingListResyncData{})
+	}
+	return dsr.data
+}
+
+func (dsr *MailingListResyncRecord) SetData(newData *MailingListResyncData) {
+	dsr.data = newData
+}
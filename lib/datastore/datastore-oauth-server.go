@@ -0,0 +1,107 @@
+package datastore
+
+import (
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+
+	gaeds "google.golang.org/appengine/datastore"
+)
+
+const OAUTH_CLIENT_TYPE = "OauthClient"
+const OAUTH_CONSENT_TYPE = "OauthConsent"
+
+//Clients of our own oauth authorization server (i.e. apps which let users "log in with" this site)
+//The record key (string) is the client_id
+type OauthClientData struct {
+	Name          string
+	SecretHash    string   `datastore:",noindex"` //empty for public clients (mobile/spa), which must then use PKCE
+	RedirectUris  []string `datastore:",noindex"` //exact match only
+	AllowedScopes int64    `datastore:",noindex"`
+	IsFirstParty  bool     `datastore:",noindex"` //skips the consent screen
+	OwnerId       int64
+	AddedDate     time.Time
+}
+
+type OauthClientRecord struct {
+	DsRecord
+	data *OauthClientData
+}
+
+func (dsr *OauthClientRecord) GetRawData() interface{} {
+	return dsr.GetData()
+}
+func (dsr *OauthClientRecord) GetType() string {
+	return OAUTH_CLIENT_TYPE
+}
+
+func (dsr *OauthClientRecord) GetData() *OauthClientData {
+	if dsr.data == nil {
+		dsr.SetData(&OauthClientData{})
+	}
+	return dsr.data
+}
+
+func (dsr *OauthClientRecord) SetData(newData *OauthClientData) {
+	dsr.data = newData
+}
+
+func (dsr *OauthClientRecord) IsConfidential() bool {
+	return dsr.GetData().SecretHash != ""
+}
+
+//there's only ever a handful of clients, so no paging
+func GetAllOauthClients(c context.Context) ([]*OauthClientRecord, error) {
+	var dataList []*OauthClientData
+
+	keys, err := gaeds.NewQuery(OAUTH_CLIENT_TYPE).Order("Name").GetAll(c, &dataList)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*OauthClientRecord, len(keys))
+	for idx, key := range keys {
+		records[idx] = &OauthClientRecord{}
+		records[idx].SetKey(key)
+		records[idx].SetData(dataList[idx])
+	}
+
+	return records, nil
+}
+
+//What a user has already agreed to share with a client, so we don't ask every time
+//Keyed via GetOauthConsentKey
+type OauthConsentData struct {
+	UserId   int64
+	ClientId string
+	Scopes   int64 `datastore:",noindex"`
+	Date     time.Time
+}
+
+type OauthConsentRecord struct {
+	DsRecord
+	data *OauthConsentData
+}
+
+func (dsr *OauthConsentRecord) GetRawData() interface{} {
+	return dsr.GetData()
+}
+func (dsr *OauthConsentRecord) GetType() string {
+	return OAUTH_CONSENT_TYPE
+}
+
+func (dsr *OauthConsentRecord) GetData() *OauthConsentData {
+	if dsr.data == nil {
+		dsr.SetData(&OauthConsentData{})
+	}
+	return dsr.data
+}
+
+func (dsr *OauthConsentRecord) SetData(newData *OauthConsentData) {
+	dsr.data = newData
+}
+
+func GetOauthConsentKey(userId int64, clientId string) string {
+	return strconv.FormatInt(userId, 10) + ":" + clientId
+}
@@ -0,0 +1,53 @@
+package datastore
+
+import (
+	"time"
+)
+
+const PHONE_CODE_TYPE = "PhoneCode"
+
+const (
+	PHONE_CODE_PURPOSE_VERIFY   string = "verify"   //adding a number to an account, keyed by user id
+	PHONE_CODE_PURPOSE_PASSWORD string = "password" //password recovery, keyed by the number itself
+)
+
+//One-time codes sent by sms, keyed via GetPhoneCodeKey so a new request replaces the old code
+//the counts carry over to the new code until WindowStart is a day old, so requesting codes doesn't buy more guesses
+type PhoneCodeData struct {
+	UserId      int64
+	Phone       string
+	Purpose     string
+	CodeHash    string    `datastore:",noindex"` //hex hmac of the record key and code, keyed by SiteConfig.PHONE_CODE_KEY
+	Attempts    int       `datastore:",noindex"` //wrong guesses since WindowStart
+	Sends       int       `datastore:",noindex"` //codes sent since WindowStart
+	WindowStart time.Time `datastore:",noindex"`
+	Expires     time.Time
+	Date        time.Time
+}
+
+type PhoneCodeRecord struct {
+	DsRecord
+	data *PhoneCodeData
+}
+
+func (dsr *PhoneCodeRecord) GetRawData() interface{} {
+	return dsr.GetData()
+}
+func (dsr *PhoneCodeRecord) GetType() string {
+	return PHONE_CODE_TYPE
+}
+
+func (dsr *PhoneCodeRecord) GetData() *PhoneCodeData {
+	if dsr.data == nil {
+		dsr.SetData(&PhoneCodeData{})
+	}
+	return dsr.data
+}
+
+func (dsr *PhoneCodeRecord) SetData(newData *PhoneCodeData) {
+	dsr.data = newData
+}
+
+func GetPhoneCodeKey(purpose string, id string) string {
+	return purpose + ":" + id
+}
@@ -0,0 +1,46 @@
+package datastore
+
+import (
+	"strconv"
+	"time"
+)
+
+const PROVIDER_TOKEN_TYPE = "ProviderToken"
+
+//Tokens from third-party oauth providers (google etc.) for calling their apis on the user's behalf
+//Only kept for providers in SiteConfig.OAUTH_OFFLINE_PROVIDERS, keyed via GetProviderTokenKey
+type ProviderTokenData struct {
+	UserId   int64
+	Provider string
+	Username string    //the oauth lookup this token belongs to, i.e. PREFIX-provider-id
+	Token    string    `datastore:",noindex"` //json oauth2.Token, encrypted with SiteConfig.OAUTH_TOKEN_KEY
+	Date     time.Time `datastore:",noindex"`
+}
+
+type ProviderTokenRecord struct {
+	DsRecord
+	data *ProviderTokenData
+}
+
+func (dsr *ProviderTokenRecord) GetRawData() interface{} {
+	return dsr.GetData()
+}
+func (dsr *ProviderTokenRecord) GetType() string {
+	return PROVIDER_TOKEN_TYPE
+}
+
+func (dsr *ProviderTokenRecord) GetData() *ProviderTokenData {
+	if dsr.data == nil {
+		dsr.SetData(&ProviderTokenData{})
+	}
+	return dsr.data
+}
+
+func (dsr *ProviderTokenRecord) SetData(newData *ProviderTokenData) {
+	dsr.data = newData
+}
+
+//one per user and provider - linking a second identity from the same provider replaces the first one's token
+func GetProviderTokenKey(userId int64, provider string) string {
+	return strconv.FormatInt(userId, 10) + ":" + provider
+}
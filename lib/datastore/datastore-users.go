@@ -7,25 +7,45 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/log"
 
+	gaeds "google.golang.org/appengine/datastore"
 	gaesr "google.golang.org/appengine/search"
 )
 
 const USER_TYPE = "User"
 
+const (
+	USER_STATUS_PENDING   string = "pending"   //registered but email not confirmed yet
+	USER_STATUS_ACTIVE    string = "active"    //normal usage
+	USER_STATUS_SUSPENDED string = "suspended" //blocked by an admin, may be reinstated
+	USER_STATUS_DELETED   string = "deleted"   //soft deleted, record kept for lookups and history
+)
+
 type UserData struct {
 	UserMailinglistData
-	Email           string
-	DisplayName     string
-	FirstName       string
-	LastName        string
-	Password        string
-	IsActive        bool
-	AvatarId        int64
-	ExtraScopes     int64
-	ParentId        int64
-	SubAccountIds   []int64
-	UsernameLookups []string
-	AddedDate       time.Time
+	UserNotificationData
+	Email string
+	//set by delivery feedback (hard bounce, spam complaint) and cleared when the address changes
+	EmailUndeliverable       bool
+	EmailUndeliverableReason string `datastore:",noindex"`
+	Phone                    string //E.164, only set once verified - also one of the UsernameLookups
+	PhoneDate                time.Time
+	DisplayName              string
+	FirstName                string
+	LastName                 string
+	Password                 string
+	Status                   string
+	StatusReason             string `datastore:",noindex"`
+	StatusDate               time.Time
+	ActivatedDate            time.Time
+	IsActive                 bool    //legacy - kept in sync with Status so older records and queries still work
+	AvatarId                 int64   //0 for none
+	AvatarLastId             int64   //the highest id ever used, since reverting means AvatarId+1 may be taken
+	AvatarHistory            []int64 `datastore:",noindex"` //previous avatars which can be reverted to, most recent first
+	ExtraScopes              int64
+	ParentId                 int64
+	SubAccountIds            []int64
+	UsernameLookups          []string
+	AddedDate                time.Time
 }
 
 //these sub-structsjust to make it easier to manage
@@ -33,6 +53,18 @@ type UserMailinglistData struct {
 	EmailId                string
 	ListEmailId            string
 	HasMarketingNewsletter bool
+	Unsubscribed           bool //opted out of the whole list, interests are kept for when they come back
+	UnsubscribedDate       time.Time
+	Culled                 bool //taken off the list by a resync because they never activated (see lib/email/mailinglist-resync.go), not by them
+	CulledDate             time.Time
+	Interests              []string //opted in user interests other than Marketing (which is HasMarketingNewsletter)
+}
+
+type UserNotificationData struct {
+	MuteLoginNotices    bool
+	MutePasswordNotices bool
+	MuteEmailNotices    bool
+	KnownDevices        []string `datastore:",noindex"`
 }
 
 //boilerplate
@@ -62,8 +94,71 @@ func (dsr *UserRecord) SetData(newData *UserData) {
 	dsr.data = newData
 }
 
+//Satisfy PropertyLoadSaver so that records which predate Status get migrated from IsActive as they're loaded
+func (data *UserData) Load(props []gaeds.Property) error {
+	if err := gaeds.LoadStruct(data, props); err != nil {
+		return err
+	}
+
+	if data.Status == "" {
+		if data.IsActive {
+			data.Status = USER_STATUS_ACTIVE
+		} else {
+			data.Status = USER_STATUS_PENDING
+		}
+	}
+
+	return nil
+}
+
+func (data *UserData) Save() ([]gaeds.Property, error) {
+	return gaeds.SaveStruct(data)
+}
+
 /* More fun stuff.... */
 
+func (dsr *UserRecord) GetStatus() string {
+	if dsr.GetData().Status == "" {
+		//not loaded from datastore yet (e.g. brand new record)
+		if dsr.GetData().IsActive {
+			return USER_STATUS_ACTIVE
+		}
+		return USER_STATUS_PENDING
+	}
+
+	return dsr.GetData().Status
+}
+
+func (dsr *UserRecord) IsStatusActive() bool {
+	return dsr.GetStatus() == USER_STATUS_ACTIVE
+}
+
+func (dsr *UserRecord) IsStatusPending() bool {
+	return dsr.GetStatus() == USER_STATUS_PENDING
+}
+
+//Only changes the data, caller must save
+func (dsr *UserRecord) SetStatus(status string, reason string) {
+	now := time.Now()
+
+	if status == USER_STATUS_ACTIVE && dsr.GetData().ActivatedDate.IsZero() {
+		dsr.GetData().ActivatedDate = now
+	}
+
+	dsr.GetData().Status = status
+	dsr.GetData().StatusReason = reason
+	dsr.GetData().StatusDate = now
+	dsr.GetData().IsActive = (status == USER_STATUS_ACTIVE)
+}
+
+func IsValidUserStatus(status string) bool {
+	switch status {
+	case USER_STATUS_PENDING, USER_STATUS_ACTIVE, USER_STATUS_SUSPENDED, USER_STATUS_DELETED:
+		return true
+	}
+	return false
+}
+
 func (dsr *UserRecord) GetFullName() string {
 	name := dsr.GetData().FirstName
 
@@ -116,6 +211,110 @@ func (dsr *UserRecord) AddToSearch(c context.Context) error {
 	return nil
 }
 
+//For ids handed back by the mailing list provider (see lib/email/mailinglist.go)
+//checks EmailId and then the legacy ListEmailId, returns nil if nobody has it
+func GetUserRecordViaMailingListId(c context.Context, mailingListId string) (*UserRecord, error) {
+	if mailingListId == "" {
+		return nil, nil
+	}
+
+	for _, fieldName := range []string{"EmailId", "ListEmailId"} {
+		keys, err := gaeds.NewQuery(USER_TYPE).Filter(fieldName+" =", mailingListId).KeysOnly().Limit(1).GetAll(c, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			continue
+		}
+
+		var userRecord UserRecord
+		if err := LoadFromKey(c, &userRecord, keys[0].IntID()); err != nil {
+			return nil, err
+		}
+		return &userRecord, nil
+	}
+
+	return nil, nil
+}
+
+//Everyone whose current address it is (more than one account may share it), email must be lowercase like the stored ones
+func GetUserRecordsViaEmail(c context.Context, email string) ([]*UserRecord, error) {
+	if email == "" {
+		return nil, nil
+	}
+
+	keys, err := gaeds.NewQuery(USER_TYPE).Filter("Email =", email).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*UserRecord, 0, len(keys))
+	for _, key := range keys {
+		var userRecord UserRecord
+		if err := LoadFromKey(c, &userRecord, key.IntID()); err != nil {
+			return nil, err
+		}
+		records = append(records, &userRecord)
+	}
+
+	return records, nil
+}
+
+//For batch jobs over all users, in key order - activeOnly and addedAfter are optional filters (false / zero value means don't filter)
+//filtering on both needs a composite index on IsActive and AddedDate
+//returns the records and the cursor to pass in for the next batch ("" when there are no more)
+func QueryUserRecords(c context.Context, activeOnly bool, addedAfter time.Time, cursorString string, limit int) ([]*UserRecord, string, error) {
+	query := gaeds.NewQuery(USER_TYPE)
+
+	//IsActive rather than Status since older records only have the former
+	if activeOnly {
+		query = query.Filter("IsActive =", true)
+	}
+	if !addedAfter.IsZero() {
+		query = query.Filter("AddedDate >", addedAfter).Order("AddedDate")
+	}
+
+	query = query.Order("__key__").Limit(limit)
+
+	if cursorString != "" {
+		cursor, err := gaeds.DecodeCursor(cursorString)
+		if err != nil {
+			return nil, "", err
+		}
+		query = query.Start(cursor)
+	}
+
+	var records []*UserRecord
+
+	iter := query.Run(c)
+	for {
+		var data UserData
+		key, err := iter.Next(&data)
+		if err == gaeds.Done {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		record := &UserRecord{}
+		record.SetKey(key)
+		record.SetData(&data)
+		records = append(records, record)
+	}
+
+	if len(records) < limit {
+		return records, "", nil
+	}
+
+	cursor, err := iter.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return records, cursor.String(), nil
+}
+
 /* Username lookup */
 const USER_NAME_LOOKUP_TYPE = "UsernameLookup"
 
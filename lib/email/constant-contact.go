@@ -6,189 +6,234 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 
-	"github.com/dakom/basic-site-api/lib/pages"
+	"golang.org/x/net/context"
 
+	"github.com/dakom/basic-site-api/setup/config/custom"
 	"github.com/dakom/basic-site-api/setup/config/static/statuscodes"
-	"github.com/dakom/basic-site-api/lib/datastore"
 
 	"google.golang.org/appengine/urlfetch"
 )
 
-func constantContactSubscribe(rData *pages.RequestData, userRecord *datastore.UserRecord) (string, error) {
-	var contactID string
-	var ok bool
+//Constant Contact has no interests within a list, so each interest is its own list (InterestLists maps interest name -> list id)
+//ProviderId is the contact id
+type ConstantContactProvider struct {
+	ApiEndpoint   string
+	ApiKey        string
+	Token         string
+	ListId        string
+	InterestLists map[string]string
+}
 
-	contactInfo := constantContactContactInfoGet(rData, userRecord.GetData().Email, true)
+func (provider *ConstantContactProvider) Subscribe(c context.Context, contact *custom.MailingListContact) error {
+	contactInfo := provider.getContactInfo(c, contact.Email, true)
 
 	if contactInfo == nil {
-		emailAddresses := []map[string]interface{}{map[string]interface{}{
-			"email_address":  userRecord.GetData().Email,
-			"confirm_status": "NO_CONFIRMATION_REQUIRED",
-			"status":         "ACTIVE",
-		}}
-
-		lists := []map[string]interface{}{map[string]interface{}{
-			"id": rData.SiteConfig.CONSTANT_CONTACT_LIST_ID,
-		}}
-
 		contactInfo = map[string]interface{}{
-			"email_addresses": emailAddresses,
-			"first_name":      userRecord.GetData().FirstName,
-			"last_name":       userRecord.GetData().LastName,
-			"lists":           lists,
-		}
-
-		jsonData, err := json.Marshal(contactInfo)
-		if err != nil {
-			return contactID, err
+			"email_addresses": provider.getEmailAddresses(contact),
+			"first_name":      contact.FirstName,
+			"last_name":       contact.LastName,
+			"lists":           []interface{}{},
 		}
 
-		buffer := bytes.NewBuffer(jsonData)
-
-		_, userInfo, err := constantContactApiCall(rData, "POST", "contacts", "action_by=ACTION_BY_OWNER", buffer)
+		contactInfo["lists"] = provider.getUpdatedLists(contactInfo, contact, true)
 
+		userInfo, err := provider.apiCall(c, "POST", "contacts", "action_by=ACTION_BY_OWNER", contactInfo)
 		if err != nil {
-			return contactID, err
+			return err
 		}
 
-		contactID, ok = userInfo["id"].(string)
+		contactId, ok := userInfo["id"].(string)
 		if !ok {
-
-			return contactID, statuscodes.Error(statuscodes.TECHNICAL)
+			return statuscodes.Error(statuscodes.TECHNICAL)
 		}
 
-	} else {
-		contactID, ok = contactInfo["id"].(string)
+		contact.ProviderId = contactId
+		return nil
+	}
 
-		if !ok {
-			return contactID, statuscodes.Error(statuscodes.TECHNICAL)
-		}
+	contactId, _ := contactInfo["id"].(string)
 
-		lists, ok := contactInfo["lists"].([]interface{})
+	contactInfo["lists"] = provider.getUpdatedLists(contactInfo, contact, true)
 
-		if !ok {
+	if err := provider.updateContactInfo(c, contactId, contactInfo); err != nil {
+		return err
+	}
 
-			return contactID, statuscodes.Error(statuscodes.TECHNICAL)
-		}
+	contact.ProviderId = contactId
+	return nil
+}
 
-		isInList := false
+func (provider *ConstantContactProvider) UpdateEmail(c context.Context, contact *custom.MailingListContact) error {
+	contactInfo := provider.getContactInfo(c, contact.ProviderId, false)
 
-		for _, listItemInterface := range lists {
-			listItem, ok := listItemInterface.(map[string]interface{})
-			if !ok {
-				return contactID, statuscodes.Error(statuscodes.TECHNICAL)
-			}
-			if listItem["id"] == rData.SiteConfig.CONSTANT_CONTACT_LIST_ID {
-				isInList = true
-				break
-			}
-		}
+	if contactInfo == nil {
+		//never made it to the list
+		return provider.Subscribe(c, contact)
+	}
 
-		if !isInList {
-			lists = append(lists,
-				map[string]interface{}{
-					"id": rData.SiteConfig.CONSTANT_CONTACT_LIST_ID,
-				})
+	contactInfo["email_addresses"] = provider.getEmailAddresses(contact)
 
-			contactInfo["lists"] = lists
+	return provider.updateContactInfo(c, contact.ProviderId, contactInfo)
+}
 
-			err := constantContactContactInfoUpdate(rData, contactID, contactInfo)
+func (provider *ConstantContactProvider) UpdateName(c context.Context, contact *custom.MailingListContact) error {
+	contactInfo := provider.getContactInfo(c, contact.ProviderId, false)
 
-			if err != nil {
-				return contactID, err
-			}
+	if contactInfo == nil {
+		return statuscodes.Error("NO CONTACT!")
+	}
 
-		}
+	contactInfo["first_name"] = contact.FirstName
+	contactInfo["last_name"] = contact.LastName
+
+	return provider.updateContactInfo(c, contact.ProviderId, contactInfo)
+}
+
+//Takes the contact off our lists, other lists in the account are left alone
+func (provider *ConstantContactProvider) Unsubscribe(c context.Context, contact *custom.MailingListContact) error {
+	contactInfo := provider.getContactInfo(c, contact.ProviderId, false)
 
+	if contactInfo == nil {
+		return nil
 	}
 
-	return contactID, nil
+	contactInfo["lists"] = provider.getUpdatedLists(contactInfo, contact, false)
+
+	return provider.updateContactInfo(c, contact.ProviderId, contactInfo)
 }
 
-func constantContactUpdateEmail(rData *pages.RequestData, userRecord *datastore.UserRecord) error {
-	contactInfo := constantContactContactInfoGet(rData, userRecord.GetData().UserMailinglistData.EmailId, false)
+func (provider *ConstantContactProvider) SetInterests(c context.Context, contact *custom.MailingListContact) error {
+	contactInfo := provider.getContactInfo(c, contact.ProviderId, false)
 
 	if contactInfo == nil {
 		return statuscodes.Error("NO CONTACT!")
 	}
 
-	contactInfo["email_addresses"] = []map[string]interface{}{map[string]interface{}{
-		"email_address":  userRecord.GetData().Email,
-		"confirm_status": "NO_CONFIRMATION_REQUIRED",
-		"status":         "ACTIVE",
-	}}
+	contactInfo["lists"] = provider.getUpdatedLists(contactInfo, contact, true)
 
-	err := constantContactContactInfoUpdate(rData, userRecord.GetData().UserMailinglistData.EmailId, contactInfo)
+	return provider.updateContactInfo(c, contact.ProviderId, contactInfo)
+}
 
-	if err != nil {
-		return err
+//Subscribed means on ListId (and not opted out of the whole account)
+func (provider *ConstantContactProvider) Lookup(c context.Context, contact *custom.MailingListContact) (*custom.MailingListContactState, error) {
+	contactInfo := provider.getContactInfo(c, contact.ProviderId, false)
+	if contactInfo == nil {
+		contactInfo = provider.getContactInfo(c, contact.Email, true)
+	}
+	if contactInfo == nil {
+		return nil, nil
 	}
 
-	return nil
-}
-
-func constantContactUpdateName(rData *pages.RequestData, userRecord *datastore.UserRecord) error {
-	contactInfo := constantContactContactInfoGet(rData, userRecord.GetData().UserMailinglistData.EmailId, false)
+	state := &custom.MailingListContactState{}
+	state.ProviderId, _ = contactInfo["id"].(string)
+	state.FirstName, _ = contactInfo["first_name"].(string)
+	state.LastName, _ = contactInfo["last_name"].(string)
+	state.Interests = make(map[string]bool)
 
-	if contactInfo == nil {
-		return statuscodes.Error("NO CONTACT!")
+	if emailAddresses, ok := contactInfo["email_addresses"].([]interface{}); ok && len(emailAddresses) > 0 {
+		if emailAddress, ok := emailAddresses[0].(map[string]interface{}); ok {
+			state.Email, _ = emailAddress["email_address"].(string)
+		}
 	}
 
-	contactInfo["first_name"] = userRecord.GetData().FirstName
-	contactInfo["last_name"] = userRecord.GetData().LastName
+	listIds := make(map[string]bool)
+	if lists, ok := contactInfo["lists"].([]interface{}); ok {
+		for _, listItemInterface := range lists {
+			if listItem, ok := listItemInterface.(map[string]interface{}); ok {
+				if listId, ok := listItem["id"].(string); ok {
+					listIds[listId] = true
+				}
+			}
+		}
+	}
 
-	err := constantContactContactInfoUpdate(rData, userRecord.GetData().UserMailinglistData.EmailId, contactInfo)
+	status, _ := contactInfo["status"].(string)
+	state.Subscribed = listIds[provider.ListId] && status != "OPTOUT"
 
-	if err != nil {
-		return err
+	for name, listId := range provider.InterestLists {
+		if listId != "" {
+			state.Interests[name] = listIds[listId]
+		}
 	}
 
-	return nil
+	return state, nil
+}
 
+func (provider *ConstantContactProvider) getEmailAddresses(contact *custom.MailingListContact) []interface{} {
+	return []interface{}{map[string]interface{}{
+		"email_address":  contact.Email,
+		"confirm_status": "NO_CONFIRMATION_REQUIRED",
+		"status":         "ACTIVE",
+	}}
 }
 
-func constantContactContactInfoUpdate(rData *pages.RequestData, contactID string, contactInfo map[string]interface{}) error {
-	jsonData, err := json.Marshal(contactInfo)
-	if err != nil {
-		return err
+//Keeps whatever lists aren't ours, then adds the main list and the wanted interest lists if subscribed
+func (provider *ConstantContactProvider) getUpdatedLists(contactInfo map[string]interface{}, contact *custom.MailingListContact, subscribed bool) []interface{} {
+	ourLists := map[string]bool{provider.ListId: subscribed}
+	for name, listId := range provider.InterestLists {
+		if listId != "" {
+			ourLists[listId] = subscribed && contact.Interests[name]
+		}
 	}
 
-	buffer := bytes.NewBuffer(jsonData)
+	lists := []interface{}{}
 
-	_, _, err = constantContactApiCall(rData, "PUT", "contacts/"+contactID, "action_by=ACTION_BY_OWNER", buffer)
+	existingLists, _ := contactInfo["lists"].([]interface{})
+	for _, listItemInterface := range existingLists {
+		listItem, ok := listItemInterface.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		listId, _ := listItem["id"].(string)
+		if _, isOurs := ourLists[listId]; !isOurs {
+			lists = append(lists, listItem)
+		}
+	}
+
+	for listId, wanted := range ourLists {
+		if wanted {
+			lists = append(lists, map[string]interface{}{"id": listId})
+		}
+	}
+
+	return lists
+}
+
+func (provider *ConstantContactProvider) updateContactInfo(c context.Context, contactId string, contactInfo map[string]interface{}) error {
+	_, err := provider.apiCall(c, "PUT", "contacts/"+contactId, "action_by=ACTION_BY_OWNER", contactInfo)
 
 	return err
 }
 
-func constantContactContactInfoGet(rData *pages.RequestData, identifier string, isEmail bool) map[string]interface{} {
+func (provider *ConstantContactProvider) getContactInfo(c context.Context, identifier string, isEmail bool) map[string]interface{} {
 	var args string
 	var apiName string
 	var userInfo map[string]interface{}
 	var ok bool
-	var results []interface{}
+
+	if identifier == "" {
+		return nil
+	}
 
 	if isEmail {
 		apiName = "contacts"
-		args = "email=" + identifier
+		args = "email=" + url.QueryEscape(identifier)
 	} else {
 		apiName = "contacts/" + identifier
 	}
 
-	_, jsonMap, err := constantContactApiCall(rData, "GET", apiName, args, nil)
+	jsonMap, err := provider.apiCall(c, "GET", apiName, args, nil)
 
 	if err != nil {
 		return nil
 	}
 
 	if isEmail {
-		results, ok = jsonMap["results"].([]interface{})
-
-		if !ok {
-			return nil
-		}
+		results, ok := jsonMap["results"].([]interface{})
 
-		if len(results) == 0 {
+		if !ok || len(results) == 0 {
 			return nil
 		}
 
@@ -208,56 +253,56 @@ func constantContactContactInfoGet(rData *pages.RequestData, identifier string,
 	return userInfo
 }
 
-func constantContactApiCall(rData *pages.RequestData, requestType string, apiName string, extraParams string, requestData *bytes.Buffer) (int, map[string]interface{}, error) {
+func (provider *ConstantContactProvider) apiCall(c context.Context, requestType string, apiName string, extraParams string, requestData map[string]interface{}) (map[string]interface{}, error) {
 	var httpRequest *http.Request
 	var err error
 
-	client := urlfetch.Client(rData.Ctx)
-
-	params := "?api_key=" + rData.SiteConfig.CONSTANT_CONTACT_KEY
+	params := "?api_key=" + provider.ApiKey
 	if extraParams != "" {
 		params += "&" + extraParams
 	}
 
-	url := rData.SiteConfig.CONSTANT_CONTACT_API_ENDPOINT + apiName + params
+	requestUrl := provider.ApiEndpoint + apiName + params
 
 	if requestData == nil {
-		httpRequest, err = http.NewRequest(requestType, url, nil)
+		httpRequest, err = http.NewRequest(requestType, requestUrl, nil)
 	} else {
-		httpRequest, err = http.NewRequest(requestType, url, requestData)
+		var jsonData []byte
+		if jsonData, err = json.Marshal(requestData); err != nil {
+			return nil, err
+		}
+		httpRequest, err = http.NewRequest(requestType, requestUrl, bytes.NewBuffer(jsonData))
 	}
 
 	if err != nil {
-		return 0, nil, err
+		return nil, err
 	}
 
-	httpRequest.Header.Add("Authorization", "Bearer "+rData.SiteConfig.CONSTANT_CONTACT_TOKEN)
+	httpRequest.Header.Add("Authorization", "Bearer "+provider.Token)
 	httpRequest.Header.Add("Content-Type", "application/json")
 
-	httpResponse, err := client.Do(httpRequest)
+	httpResponse, err := urlfetch.Client(c).Do(httpRequest)
 
 	if err != nil {
-		return 0, nil, err
+		return nil, err
 	}
 
 	defer httpResponse.Body.Close()
 	body, err := ioutil.ReadAll(httpResponse.Body)
 	if err != nil {
-		return httpResponse.StatusCode, nil, err
+		return nil, err
 	}
 
-	if httpResponse.StatusCode != 200 && httpResponse.StatusCode != 201 {
-		return httpResponse.StatusCode, nil, statuscodes.Error(httpResponse.Status)
+	if httpResponse.StatusCode < 200 || httpResponse.StatusCode >= 300 {
+		return nil, statuscodes.Error(httpResponse.Status)
 	}
 
-	var jsonResponse interface{}
-	err = json.Unmarshal(body, &jsonResponse)
-
-	if err != nil {
-		return httpResponse.StatusCode, nil, err
+	jsonMap := make(map[string]interface{})
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &jsonMap); err != nil {
+			return nil, err
+		}
 	}
 
-	jsonMap := jsonResponse.(map[string]interface{})
-
-	return httpResponse.StatusCode, jsonMap, nil
+	return jsonMap, nil
 }
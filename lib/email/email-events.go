@@ -0,0 +1,212 @@
+package email
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	gaeds "google.golang.org/appengine/datastore"
+
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/pages"
+)
+
+const (
+	EMAIL_EVENT_BOUNCE     string = "bounce"
+	EMAIL_EVENT_DROPPED    string = "dropped"
+	EMAIL_EVENT_DEFERRED   string = "deferred"
+	EMAIL_EVENT_DELIVERED  string = "delivered"
+	EMAIL_EVENT_SPAMREPORT string = "spamreport"
+)
+
+const SENDGRID_SIGNATURE_HEADER = "X-Twilio-Email-Event-Webhook-Signature"
+const SENDGRID_TIMESTAMP_HEADER = "X-Twilio-Email-Event-Webhook-Timestamp"
+
+//how far the signed timestamp may be from our clock, anything older could be a replay
+const SENDGRID_TIMESTAMP_TOLERANCE = 5 * time.Minute
+
+var ErrInvalidSignature = errors.New("invalid event webhook signature")
+
+//Provider-neutral version of a delivery event
+type DeliveryEvent struct {
+	Id       string //provider's event id, may be empty
+	Address  string
+	Event    string
+	Reason   string
+	Provider string
+	Date     time.Time
+	Suppress bool //hard bounce or complaint - stop sending to this address
+}
+
+//the fields we use from https://sendgrid.com/docs/for-developers/tracking-events/event/
+type sendgridEvent struct {
+	Email     string `json:"email"`
+	Event     string `json:"event"`
+	Type      string `json:"type"` //for bounces: "bounce" (hard) or "blocked" (soft)
+	Reason    string `json:"reason"`
+	Timestamp int64  `json:"timestamp"`
+	EventId   string `json:"sg_event_id"`
+}
+
+//Verifies the signed event webhook (ECDSA over timestamp+body, with the key from the SendGrid settings page) and parses it
+//Events we don't keep (opens, clicks etc.) are left out
+func ParseSendgridEvents(rData *pages.RequestData, body []byte) ([]*DeliveryEvent, error) {
+	if err := verifySendgridSignature(rData.SiteConfig.SENDGRID_WEBHOOK_PUBLICKEY, rData.HttpRequest.Header.Get(SENDGRID_SIGNATURE_HEADER), rData.HttpRequest.Header.Get(SENDGRID_TIMESTAMP_HEADER), body, time.Now()); err != nil {
+		return nil, err
+	}
+
+	var rawEvents []sendgridEvent
+	if err := json.Unmarshal(body, &rawEvents); err != nil {
+		return nil, err
+	}
+
+	var events []*DeliveryEvent
+
+	for _, raw := range rawEvents {
+		if raw.Email == "" {
+			continue
+		}
+
+		event := &DeliveryEvent{
+			Id:       raw.EventId,
+			Address:  datastore.GetEmailSuppressionKey(raw.Email),
+			Event:    raw.Event,
+			Reason:   raw.Reason,
+			Provider: "sendgrid",
+			Date:     time.Unix(raw.Timestamp, 0),
+		}
+
+		switch raw.Event {
+		case EMAIL_EVENT_BOUNCE:
+			event.Suppress = raw.Type != "blocked"
+		case EMAIL_EVENT_SPAMREPORT:
+			event.Suppress = true
+		case EMAIL_EVENT_DROPPED:
+			//sendgrid drops mail to addresses on its own suppression lists - keep ours in sync
+			event.Suppress = strings.Contains(raw.Reason, "Bounced Address") || strings.Contains(raw.Reason, "Spam Reporting Address")
+		case EMAIL_EVENT_DEFERRED, EMAIL_EVENT_DELIVERED:
+		default:
+			continue
+		}
+
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+//timestamp is unix seconds, and only accepted within SENDGRID_TIMESTAMP_TOLERANCE of now
+func verifySendgridSignature(publicKey string, signature string, timestamp string, body []byte, now time.Time) error {
+	if publicKey == "" || signature == "" || timestamp == "" {
+		return ErrInvalidSignature
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > SENDGRID_TIMESTAMP_TOLERANCE || age < -SENDGRID_TIMESTAMP_TOLERANCE {
+		return ErrInvalidSignature
+	}
+
+	keyBytes, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return err
+	}
+
+	parsedKey, err := x509.ParsePKIXPublicKey(keyBytes)
+	if err != nil {
+		return err
+	}
+
+	ecKey, ok := parsedKey.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.New("event webhook key is not an ecdsa key")
+	}
+
+	sigBytes, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	var sig struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(sigBytes, &sig); err != nil {
+		return ErrInvalidSignature
+	}
+
+	hash := sha256.Sum256(append([]byte(timestamp), body...))
+	if !ecdsa.Verify(ecKey, hash[:], sig.R, sig.S) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+//Stores the event and, if needed, suppresses the address
+func RecordDeliveryEvent(c context.Context, event *DeliveryEvent) error {
+	var eventRecord datastore.EmailEventRecord
+	eventRecord.SetData(&datastore.EmailEventData{
+		Address:  event.Address,
+		Event:    event.Event,
+		Reason:   event.Reason,
+		Provider: event.Provider,
+		Date:     event.Date,
+	})
+
+	var err error
+	if event.Id != "" {
+		err = datastore.SaveToKey(c, &eventRecord, event.Provider+":"+event.Id)
+	} else {
+		err = datastore.SaveToAutoKey(c, &eventRecord)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !event.Suppress {
+		return nil
+	}
+
+	var suppressionRecord datastore.EmailSuppressionRecord
+	suppressionRecord.SetData(&datastore.EmailSuppressionData{
+		Event:  event.Event,
+		Reason: event.Reason,
+		Date:   event.Date,
+	})
+
+	return datastore.SaveToKey(c, &suppressionRecord, datastore.GetEmailSuppressionKey(event.Address))
+}
+
+func IsSuppressed(c context.Context, address string) (bool, error) {
+	var suppressionRecord datastore.EmailSuppressionRecord
+
+	err := datastore.LoadFromKey(c, &suppressionRecord, datastore.GetEmailSuppressionKey(address))
+	if err == gaeds.ErrNoSuchEntity {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+//For an address the user just proved they get mail at (email change, activation) - whatever bounced before doesn't anymore
+func Unsuppress(c context.Context, address string) error {
+	var suppressionRecord datastore.EmailSuppressionRecord
+
+	//deleting one that isn't there is fine
+	datastore.SetKey(c, &suppressionRecord, datastore.GetEmailSuppressionKey(address))
+	return datastore.Delete(c, &suppressionRecord)
+}
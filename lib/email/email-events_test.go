@@ -0,0 +1,105 @@
+package email
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"math/big"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifySendgridSignature(t *testing.T) {
+	key := generateEcdsaKey(t)
+	otherKey := generateEcdsaKey(t)
+
+	publicKey := marshalPublicKey(t, &key.PublicKey)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	fresh := strconv.FormatInt(now.Add(-30*time.Second).Unix(), 10)
+	stale := strconv.FormatInt(now.Add(-SENDGRID_TIMESTAMP_TOLERANCE-time.Second).Unix(), 10)
+	future := strconv.FormatInt(now.Add(SENDGRID_TIMESTAMP_TOLERANCE+time.Second).Unix(), 10)
+	body := []byte(`[{"email":"someone@example.com","event":"bounce","sg_event_id":"abc"}]`)
+
+	tests := []struct {
+		name      string
+		publicKey string
+		signature string
+		timestamp string
+		body      []byte
+		valid     bool
+	}{
+		{"valid", publicKey, sign(t, key, fresh, body), fresh, body, true},
+		{"tampered body", publicKey, sign(t, key, fresh, body), fresh, []byte(`[{"email":"victim@example.com","event":"bounce"}]`), false},
+		{"tampered timestamp", publicKey, sign(t, key, fresh, body), strconv.FormatInt(now.Unix(), 10), body, false},
+		{"stale", publicKey, sign(t, key, stale, body), stale, body, false},
+		{"from the future", publicKey, sign(t, key, future, body), future, body, false},
+		{"signed by another key", publicKey, sign(t, otherKey, fresh, body), fresh, body, false},
+		{"no key configured", "", sign(t, key, fresh, body), fresh, body, false},
+		{"no signature", publicKey, "", fresh, body, false},
+		{"no timestamp", publicKey, sign(t, key, fresh, body), "", body, false},
+		{"timestamp not a number", publicKey, sign(t, key, "soon", body), "soon", body, false},
+		{"signature not base64", publicKey, "not base64!", fresh, body, false},
+		{"signature not asn1", publicKey, base64.StdEncoding.EncodeToString([]byte("garbage")), fresh, body, false},
+		{"not an ecdsa key", marshalPublicKey(t, &rsaKey.PublicKey), sign(t, key, fresh, body), fresh, body, false},
+	}
+
+	for _, test := range tests {
+		err := verifySendgridSignature(test.publicKey, test.signature, test.timestamp, test.body, now)
+		if test.valid && err != nil {
+			t.Errorf("%s: expected it to verify, got %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected it to be rejected", test.name)
+		}
+	}
+
+	//exactly at the tolerance is still fine
+	edge := strconv.FormatInt(now.Add(-SENDGRID_TIMESTAMP_TOLERANCE).Unix(), 10)
+	if err := verifySendgridSignature(publicKey, sign(t, key, edge, body), edge, body, now); err != nil {
+		t.Errorf("timestamp at the tolerance was rejected: %v", err)
+	}
+}
+
+func generateEcdsaKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+//base64 DER, the way SendGrid shows it
+func marshalPublicKey(t *testing.T, publicKey interface{}) string {
+	keyBytes, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(keyBytes)
+}
+
+func sign(t *testing.T, key *ecdsa.PrivateKey, timestamp string, body []byte) string {
+	hash := sha256.Sum256(append([]byte(timestamp), body...))
+
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sigBytes, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(sigBytes)
+}
@@ -0,0 +1,222 @@
+package email
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sendgrid/rest"
+	"github.com/sendgrid/sendgrid-go"
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+
+	"github.com/dakom/basic-site-api/setup/config/custom"
+	"google.golang.org/appengine/socket"
+	"google.golang.org/appengine/urlfetch"
+)
+
+//SendGrid v3 api - the default when Config.Mailer isn't set
+type SendgridMailer struct {
+	ApiKey string
+}
+
+func (mailer *SendgridMailer) Send(c context.Context, outgoing *custom.OutgoingEmail) error {
+	from := mail.NewEmail(outgoing.FromName, outgoing.FromAddress)
+	to := mail.NewEmail(outgoing.ToName, outgoing.ToAddress)
+
+	content := []*mail.Content{}
+	if outgoing.Text != "" {
+		//sendgrid wants text/plain before text/html
+		content = append(content, mail.NewContent("text/plain", outgoing.Text))
+	}
+	content = append(content, mail.NewContent("text/html", outgoing.Html))
+	m := mail.NewV3MailInit(from, outgoing.Subject, to, content...)
+	for key, value := range outgoing.Headers {
+		m.SetHeader(key, value)
+	}
+
+	request := sendgrid.GetRequest(mailer.ApiKey, "/v3/mail/send", "https://api.sendgrid.com")
+	client := rest.Client{&http.Client{
+		Transport: &urlfetch.Transport{Context: c},
+	}}
+
+	request.Method = "POST"
+	request.Body = mail.GetRequestBody(m)
+	response, err := client.API(request)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("sendgrid returned %d: %s", response.StatusCode, response.Body)
+	}
+
+	return nil
+}
+
+//Plain SMTP over an App Engine socket
+//StartTls upgrades the connection before anything else is sent, and is required for Username/Password unless Host is local
+type SmtpMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	StartTls bool
+	Timeout  time.Duration //defaults to SMTP_DEFAULT_TIMEOUT
+}
+
+const SMTP_DEFAULT_TIMEOUT = 30 * time.Second
+
+func (mailer *SmtpMailer) Send(c context.Context, outgoing *custom.OutgoingEmail) error {
+	timeout := mailer.Timeout
+	if timeout == 0 {
+		timeout = SMTP_DEFAULT_TIMEOUT
+	}
+
+	conn, err := socket.DialTimeout(c, "tcp", net.JoinHostPort(mailer.Host, strconv.Itoa(mailer.Port)), timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	client, err := smtp.NewClient(conn, mailer.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if mailer.StartTls {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("smtp server does not support STARTTLS")
+		}
+		if err := client.StartTLS(&tls.Config{ServerName: mailer.Host}); err != nil {
+			return err
+		}
+	}
+
+	if mailer.Username != "" {
+		//PlainAuth itself refuses to send the password unencrypted to anything but localhost
+		if err := client.Auth(smtp.PlainAuth("", mailer.Username, mailer.Password, mailer.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(outgoing.FromAddress); err != nil {
+		return err
+	}
+	if err := client.Rcpt(outgoing.ToAddress); err != nil {
+		return err
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	msgBytes, err := BuildMimeMessage(outgoing)
+	if err != nil {
+		writer.Close()
+		return err
+	}
+
+	if _, err := writer.Write(msgBytes); err != nil {
+		writer.Close()
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+//Development only - every message becomes an .eml file in Dir, which most mail clients can open directly
+type FileMailer struct {
+	Dir string
+}
+
+var fileNameSanitizer = regexp.MustCompile("[^a-zA-Z0-9@._-]")
+
+func (mailer *FileMailer) Send(c context.Context, outgoing *custom.OutgoingEmail) error {
+	msgBytes, err := BuildMimeMessage(outgoing)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(mailer.Dir, 0755); err != nil {
+		return err
+	}
+
+	fileName := strconv.FormatInt(time.Now().UnixNano(), 10) + "-" + fileNameSanitizer.ReplaceAllString(outgoing.ToAddress, "_") + ".eml"
+
+	return ioutil.WriteFile(filepath.Join(mailer.Dir, fileName), msgBytes, 0644)
+}
+
+//Keeps everything in memory so tests can check what would have been sent
+type OutboxMailer struct {
+	lock     sync.Mutex
+	messages []*custom.OutgoingEmail
+}
+
+func NewOutboxMailer() *OutboxMailer {
+	return &OutboxMailer{}
+}
+
+func (mailer *OutboxMailer) Send(c context.Context, outgoing *custom.OutgoingEmail) error {
+	mailer.lock.Lock()
+	defer mailer.lock.Unlock()
+
+	copied := *outgoing
+	mailer.messages = append(mailer.messages, &copied)
+	return nil
+}
+
+//Oldest first
+func (mailer *OutboxMailer) Messages() []*custom.OutgoingEmail {
+	mailer.lock.Lock()
+	defer mailer.lock.Unlock()
+
+	return append([]*custom.OutgoingEmail{}, mailer.messages...)
+}
+
+//Everything sent to toAddress (case insensitive), oldest first
+func (mailer *OutboxMailer) MessagesTo(toAddress string) []*custom.OutgoingEmail {
+	var found []*custom.OutgoingEmail
+
+	for _, outgoing := range mailer.Messages() {
+		if strings.EqualFold(outgoing.ToAddress, toAddress) {
+			found = append(found, outgoing)
+		}
+	}
+
+	return found
+}
+
+//nil if nothing was sent to toAddress
+func (mailer *OutboxMailer) LastTo(toAddress string) *custom.OutgoingEmail {
+	found := mailer.MessagesTo(toAddress)
+	if len(found) == 0 {
+		return nil
+	}
+	return found[len(found)-1]
+}
+
+func (mailer *OutboxMailer) Clear() {
+	mailer.lock.Lock()
+	defer mailer.lock.Unlock()
+
+	mailer.messages = nil
+}
@@ -0,0 +1,117 @@
+package email
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/setup/config/custom"
+)
+
+func TestGetMailer(t *testing.T) {
+	outbox := NewOutboxMailer()
+
+	rData := &pages.RequestData{SiteConfig: &custom.Config{Mailer: outbox}}
+	if GetMailer(rData) != outbox {
+		t.Errorf("configured mailer wasn't used")
+	}
+
+	rData = &pages.RequestData{SiteConfig: &custom.Config{SENDGRID_APIKEY: "key"}}
+	if mailer, ok := GetMailer(rData).(*SendgridMailer); !ok || mailer.ApiKey != "key" {
+		t.Errorf("expected SendgridMailer by default, got %#v", GetMailer(rData))
+	}
+}
+
+func TestOutboxMailer(t *testing.T) {
+	outbox := NewOutboxMailer()
+	rData := &pages.RequestData{
+		Ctx: context.Background(),
+		SiteConfig: &custom.Config{
+			Mailer:             outbox,
+			SENDGRID_FROM_NAME: "Site",
+			SENDGRID_FROM_ADDR: "noreply@example.com",
+		},
+	}
+
+	sends := []struct {
+		toAddress string
+		render    func() (*Message, error)
+	}{
+		{"alice@example.com", func() (*Message, error) { return GetEmailActivationMessage("en", "https://example.com/activate/1") }},
+		{"bob@example.com", func() (*Message, error) { return GetEmailLoginLinkMessage("en", "https://example.com/login/2") }},
+		{"Alice@Example.com", func() (*Message, error) { return GetEmailPasswordChangedNoticeMessage("en") }},
+	}
+
+	for _, send := range sends {
+		msg, err := send.render()
+		if err != nil {
+			t.Fatalf("rendering for %s: %v", send.toAddress, err)
+		}
+		msg.SetListUnsubscribe("https://example.com/unsubscribe")
+
+		//the same as Send, which also looks up the suppression list in the datastore
+		outgoing := &custom.OutgoingEmail{
+			FromName:    rData.SiteConfig.SENDGRID_FROM_NAME,
+			FromAddress: rData.SiteConfig.SENDGRID_FROM_ADDR,
+			ToName:      "Someone",
+			ToAddress:   send.toAddress,
+			Subject:     msg.Subject,
+			Html:        msg.Body,
+			Text:        msg.Text,
+			Headers:     msg.Headers,
+		}
+		if err := GetMailer(rData).Send(rData.Ctx, outgoing); err != nil {
+			t.Fatalf("sending to %s: %v", send.toAddress, err)
+		}
+
+		//what's recorded is a copy
+		outgoing.Subject = "changed afterwards"
+	}
+
+	messages := outbox.Messages()
+	if len(messages) != len(sends) {
+		t.Fatalf("expected %d messages, got %d", len(sends), len(messages))
+	}
+
+	first := messages[0]
+	if first.FromAddress != "noreply@example.com" || first.FromName != "Site" {
+		t.Errorf("unexpected sender %q <%s>", first.FromName, first.FromAddress)
+	}
+	if first.Subject != "Confirm your registration" {
+		t.Errorf("unexpected subject %q", first.Subject)
+	}
+	if !strings.Contains(first.Html, `href="https://example.com/activate/1"`) {
+		t.Errorf("activation link missing from html: %s", first.Html)
+	}
+	if !strings.Contains(first.Text, "https://example.com/activate/1") {
+		t.Errorf("activation link missing from text: %s", first.Text)
+	}
+	if first.Headers["List-Unsubscribe"] != "<https://example.com/unsubscribe>" || first.Headers["List-Unsubscribe-Post"] != "List-Unsubscribe=One-Click" {
+		t.Errorf("unexpected headers %v", first.Headers)
+	}
+
+	aliceMessages := outbox.MessagesTo("ALICE@example.com")
+	if len(aliceMessages) != 2 {
+		t.Fatalf("expected 2 messages to alice, got %d", len(aliceMessages))
+	}
+	if aliceMessages[1].Subject != "Your password was changed" {
+		t.Errorf("messages to alice out of order: %q", aliceMessages[1].Subject)
+	}
+	if last := outbox.LastTo("alice@example.com"); last != aliceMessages[1] {
+		t.Errorf("LastTo didn't return the most recent message")
+	}
+
+	if last := outbox.LastTo("bob@example.com"); last == nil || !strings.Contains(last.Text, "https://example.com/login/2") {
+		t.Errorf("unexpected message to bob: %#v", last)
+	}
+	if outbox.LastTo("carol@example.com") != nil {
+		t.Errorf("nothing was sent to carol")
+	}
+
+	outbox.Clear()
+	if len(outbox.Messages()) != 0 {
+		t.Errorf("outbox wasn't cleared")
+	}
+}
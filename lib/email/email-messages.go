@@ -1,24 +1,31 @@
 package email
 
-import "fmt"
+//Thin wrappers around the templates (see email-templates.go), one per message we send
 
-func GetEmailActivationMessage(locale string, url string) *Message {
-	return &Message{
-		Subject: "Confirm your registration",
-		Body:    fmt.Sprintf("Thank you for creating an account!<br/>Please confirm your email address by clicking on the link below:<br/><br/><a href=\"%s\">Click here to confirm</a>", url),
-	}
+func GetEmailActivationMessage(locale string, url string) (*Message, error) {
+	return renderMessageWithFallback(locale, "activation", map[string]interface{}{"Url": url})
 }
 
-func GetEmailChangeEmailAddressMessage(locale string, url string) *Message {
-	return &Message{
-		Subject: "Confirm your email address",
-		Body:    fmt.Sprintf("You've requested an email change.<br/>Please confirm your email address by clicking on the link below:<br/><br/><a href=\"%s\">Click here to confirm</a>", url),
-	}
+func GetEmailChangeEmailAddressMessage(locale string, url string) (*Message, error) {
+	return renderMessageWithFallback(locale, "change-email", map[string]interface{}{"Url": url})
 }
 
-func GetEmailChangePasswordMessage(locale string, url string) *Message {
-	return &Message{
-		Subject: "Password Change",
-		Body:    fmt.Sprintf("You've requested to change your password.<br/>Please use the link below:<br/><br/><a href=\"%s\">Click here to confirm</a>", url),
-	}
+func GetEmailChangePasswordMessage(locale string, url string) (*Message, error) {
+	return renderMessageWithFallback(locale, "change-password", map[string]interface{}{"Url": url})
+}
+
+func GetEmailLoginLinkMessage(locale string, url string) (*Message, error) {
+	return renderMessageWithFallback(locale, "login-link", map[string]interface{}{"Url": url})
+}
+
+func GetEmailPasswordChangedNoticeMessage(locale string) (*Message, error) {
+	return renderMessageWithFallback(locale, "password-changed", nil)
+}
+
+func GetEmailAddressChangedNoticeMessage(locale string, newAddress string) (*Message, error) {
+	return renderMessageWithFallback(locale, "email-changed", map[string]interface{}{"Address": newAddress})
+}
+
+func GetEmailNewDeviceLoginNoticeMessage(locale string, ipAddress string, userAgent string) (*Message, error) {
+	return renderMessageWithFallback(locale, "new-device", map[string]interface{}{"IpAddress": ipAddress, "UserAgent": userAgent})
 }
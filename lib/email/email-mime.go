@@ -0,0 +1,125 @@
+package email
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dakom/basic-site-api/setup/config/custom"
+)
+
+//RFC 5322 message for the transports which don't build their own (smtp, .eml files)
+//multipart/alternative when there's a plaintext version, otherwise just the html
+func BuildMimeMessage(outgoing *custom.OutgoingEmail) ([]byte, error) {
+	var buf bytes.Buffer
+
+	messageId, err := newMessageId(outgoing.FromAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := []string{
+		"From: " + (&mail.Address{Name: outgoing.FromName, Address: outgoing.FromAddress}).String(),
+		"To: " + (&mail.Address{Name: outgoing.ToName, Address: outgoing.ToAddress}).String(),
+		"Subject: " + mime.QEncoding.Encode("utf-8", outgoing.Subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Message-ID: " + messageId,
+		"MIME-Version: 1.0",
+	}
+
+	headers = append(headers, getExtraHeaders(outgoing)...)
+
+	if outgoing.Text == "" {
+		headers = append(headers, "Content-Type: text/html; charset=utf-8", "Content-Transfer-Encoding: quoted-printable")
+		writeHeaders(&buf, headers)
+		if err := writeQuotedPrintable(&buf, outgoing.Html); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain", outgoing.Text},
+		{"text/html", outgoing.Html},
+	} {
+		partWriter, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(partWriter, part.content); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	headers = append(headers, "Content-Type: multipart/alternative; boundary="+parts.Boundary())
+	writeHeaders(&buf, headers)
+	buf.Write(body.Bytes())
+
+	return buf.Bytes(), nil
+}
+
+//sorted so the output is stable, and without line breaks so nothing can be smuggled into the other headers
+func getExtraHeaders(outgoing *custom.OutgoingEmail) []string {
+	var keys []string
+	for key := range outgoing.Headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	headers := make([]string, 0, len(keys))
+	for _, key := range keys {
+		headers = append(headers, textproto.CanonicalMIMEHeaderKey(stripLineBreaks(key))+": "+stripLineBreaks(outgoing.Headers[key]))
+	}
+	return headers
+}
+
+func stripLineBreaks(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
+
+func writeHeaders(buf *bytes.Buffer, headers []string) {
+	buf.WriteString(strings.Join(headers, "\r\n"))
+	buf.WriteString("\r\n\r\n")
+}
+
+func writeQuotedPrintable(w io.Writer, content string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(content)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+func newMessageId(fromAddress string) (string, error) {
+	randomBytes := make([]byte, 16)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+
+	domain := "localhost"
+	if idx := strings.LastIndex(fromAddress, "@"); idx >= 0 {
+		domain = fromAddress[idx+1:]
+	}
+
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(randomBytes), domain), nil
+}
@@ -0,0 +1,160 @@
+package email
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/dakom/basic-site-api/setup/config/custom"
+)
+
+func TestBuildMimeMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		subject string
+		text    string
+		headers map[string]string
+	}{
+		{name: "html only", subject: "Hello"},
+		{name: "multipart", subject: "Hello", text: "plain version"},
+		{name: "non-ascii subject", subject: "Grüße aus Zürich ✓", text: "plain version"},
+		{name: "extra headers", subject: "Hello", headers: map[string]string{"list-unsubscribe": "<https://example.com/u>", "X-Evil": "a\r\nBcc: victim@example.com"}},
+	}
+
+	for _, test := range tests {
+		outgoing := &custom.OutgoingEmail{
+			FromName:    "Site",
+			FromAddress: "noreply@example.com",
+			ToName:      "Zoë",
+			ToAddress:   "zoe@example.com",
+			Subject:     test.subject,
+			Html:        "<p>Hällo " + strings.Repeat("long line ", 20) + "</p>",
+			Text:        test.text,
+			Headers:     test.headers,
+		}
+
+		raw, err := BuildMimeMessage(outgoing)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		msg, err := mail.ReadMessage(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("%s: not a valid message: %v", test.name, err)
+		}
+
+		subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+		if err != nil || subject != test.subject {
+			t.Errorf("%s: subject decoded to %q (%v)", test.name, subject, err)
+		}
+		if !isAscii(msg.Header.Get("Subject")) {
+			t.Errorf("%s: subject header isn't encoded: %q", test.name, msg.Header.Get("Subject"))
+		}
+
+		to, err := msg.Header.AddressList("To")
+		if err != nil || len(to) != 1 || to[0].Address != "zoe@example.com" || to[0].Name != "Zoë" {
+			t.Errorf("%s: unexpected To %v (%v)", test.name, to, err)
+		}
+		from, err := msg.Header.AddressList("From")
+		if err != nil || len(from) != 1 || from[0].Address != "noreply@example.com" {
+			t.Errorf("%s: unexpected From %v (%v)", test.name, from, err)
+		}
+		if !strings.HasSuffix(msg.Header.Get("Message-ID"), "@example.com>") {
+			t.Errorf("%s: unexpected Message-ID %q", test.name, msg.Header.Get("Message-ID"))
+		}
+		if msg.Header.Get("MIME-Version") != "1.0" || msg.Header.Get("Date") == "" {
+			t.Errorf("%s: missing MIME-Version or Date", test.name)
+		}
+
+		for key, value := range test.headers {
+			got := msg.Header.Get(key)
+			if strings.ContainsAny(got, "\r\n") || got != strings.NewReplacer("\r", "", "\n", "").Replace(value) {
+				t.Errorf("%s: header %s is %q", test.name, key, got)
+			}
+		}
+		if msg.Header.Get("Bcc") != "" {
+			t.Errorf("%s: a header was smuggled in", test.name)
+		}
+
+		mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatalf("%s: bad Content-Type: %v", test.name, err)
+		}
+
+		if test.text == "" {
+			if mediaType != "text/html" {
+				t.Errorf("%s: expected text/html, got %s", test.name, mediaType)
+			}
+			body := readQuotedPrintable(t, msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+			if body != outgoing.Html {
+				t.Errorf("%s: html body came back as %q", test.name, body)
+			}
+			continue
+		}
+
+		if mediaType != "multipart/alternative" || params["boundary"] == "" {
+			t.Fatalf("%s: expected multipart/alternative with a boundary, got %s %v", test.name, mediaType, params)
+		}
+		if bytes.Count(raw, []byte("--"+params["boundary"]+"\r\n")) != 2 || !bytes.Contains(raw, []byte("--"+params["boundary"]+"--")) {
+			t.Errorf("%s: expected two parts and a closing boundary", test.name)
+		}
+
+		reader := multipart.NewReader(msg.Body, params["boundary"])
+		for _, expected := range []struct{ contentType, content string }{
+			{"text/plain; charset=utf-8", outgoing.Text},
+			{"text/html; charset=utf-8", outgoing.Html},
+		} {
+			part, err := reader.NextRawPart()
+			if err != nil {
+				t.Fatalf("%s: missing %s part: %v", test.name, expected.contentType, err)
+			}
+			if part.Header.Get("Content-Type") != expected.contentType {
+				t.Errorf("%s: expected %s, got %s", test.name, expected.contentType, part.Header.Get("Content-Type"))
+			}
+			if content := readQuotedPrintable(t, part.Header.Get("Content-Transfer-Encoding"), part); content != expected.content {
+				t.Errorf("%s: %s part came back as %q", test.name, expected.contentType, content)
+			}
+		}
+		if _, err := reader.NextPart(); err == nil {
+			t.Errorf("%s: unexpected third part", test.name)
+		}
+	}
+}
+
+func readQuotedPrintable(t *testing.T, encoding string, r interface {
+	Read([]byte) (int, error)
+}) string {
+	if encoding != "quoted-printable" {
+		t.Errorf("expected quoted-printable, got %q", encoding)
+	}
+
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if len(line) > 76 {
+			t.Errorf("line longer than 76 characters: %q", line)
+		}
+	}
+
+	decoded, err := ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(decoded)
+}
+
+func isAscii(value string) bool {
+	for _, r := range value {
+		if r > 127 {
+			return false
+		}
+	}
+	return true
+}
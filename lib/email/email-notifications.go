@@ -0,0 +1,93 @@
+package email
+
+import (
+	"net/url"
+	"strconv"
+
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/setup/config/static/pagenames"
+	"github.com/dakom/basic-site-api/setup/config/static/statuscodes"
+
+	"google.golang.org/appengine/taskqueue"
+)
+
+const (
+	NOTIFY_PASSWORD_CHANGED string = "password-changed"
+	NOTIFY_EMAIL_CHANGED    string = "email-changed"
+	NOTIFY_NEW_DEVICE       string = "new-device"
+)
+
+func IsNotificationMuted(userRecord *datastore.UserRecord, notifyType string) bool {
+	prefs := userRecord.GetData().UserNotificationData
+
+	switch notifyType {
+	case NOTIFY_PASSWORD_CHANGED:
+		return prefs.MutePasswordNotices
+	case NOTIFY_EMAIL_CHANGED:
+		return prefs.MuteEmailNotices
+	case NOTIFY_NEW_DEVICE:
+		return prefs.MuteLoginNotices
+	}
+
+	return false
+}
+
+//Queues up a security notification so the request isn't held up by the mail provider
+//params are passed along as-is to the message (e.g. "old" and "new" for email changes)
+func QueueNotification(rData *pages.RequestData, userRecord *datastore.UserRecord, notifyType string, params url.Values) error {
+	if IsNotificationMuted(userRecord, notifyType) {
+		return nil
+	}
+
+	if params == nil {
+		params = url.Values{}
+	}
+
+	params.Set("uid", strconv.FormatInt(userRecord.GetKey().IntID(), 10))
+	params.Set("ntype", notifyType)
+	params.Set("locale", rData.HttpRequest.FormValue("locale"))
+
+	notifyTask := taskqueue.NewPOSTTask("/"+pagenames.NOTIFICATION_SEND_WEBHOOK, params)
+	_, err := taskqueue.Add(rData.Ctx, notifyTask, rData.SiteConfig.TASKQUEUE_NOTIFY)
+
+	return err
+}
+
+//Called from the task queue
+func SendNotification(rData *pages.RequestData, userRecord *datastore.UserRecord, notifyType string, params url.Values) error {
+	var msg *Message
+	var err error
+
+	//preferences may have changed since it was queued
+	if IsNotificationMuted(userRecord, notifyType) {
+		return nil
+	}
+
+	locale := params.Get("locale")
+	toAddress := userRecord.GetData().Email
+
+	switch notifyType {
+	case NOTIFY_PASSWORD_CHANGED:
+		msg, err = GetEmailPasswordChangedNoticeMessage(locale)
+	case NOTIFY_EMAIL_CHANGED:
+		//the whole point is to warn the old address
+		toAddress = params.Get("old")
+		msg, err = GetEmailAddressChangedNoticeMessage(locale, params.Get("new"))
+	case NOTIFY_NEW_DEVICE:
+		msg, err = GetEmailNewDeviceLoginNoticeMessage(locale, params.Get("ip"), params.Get("ua"))
+	default:
+		return statuscodes.Error(statuscodes.MISSINGINFO)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if toAddress == "" {
+		//e.g. subaccounts without an email address
+		return nil
+	}
+
+	return Send(rData, userRecord.GetFullName(), toAddress, msg)
+}
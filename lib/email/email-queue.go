@@ -0,0 +1,208 @@
+package email
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+
+	gaeds "google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/taskqueue"
+
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/lib/utils/text"
+	"github.com/dakom/basic-site-api/setup/config/static/pagenames"
+)
+
+const EMAIL_TASK_RETRY_LIMIT = 8
+const EMAIL_TASK_MIN_BACKOFF = 10 * time.Second
+const EMAIL_TASK_MAX_BACKOFF = time.Hour
+const EMAIL_TASK_MAX_DOUBLINGS = 5
+
+//delivery records (sent or dead) are deleted this long after their last attempt, by CleanupDeliveries
+//it has to be well past the last retry, or a late one would send again
+const EMAIL_DELIVERY_RETENTION = 30 * 24 * time.Hour
+const EMAIL_DELIVERY_CLEANUP_BATCH_SIZE = 500 //also the most a single delete can take
+
+//how long a claimed delivery blocks other executions of the same task before it's assumed to have died
+const EMAIL_SEND_LEASE = 2 * time.Minute
+
+var errDeliveryInProgress = errors.New("email delivery already in progress")
+
+//Like Send but via TASKQUEUE_EMAIL, so the request doesn't depend on the mail provider being up
+//The message is rendered here, the task only delivers it (see DeliverQueued)
+func Queue(rData *pages.RequestData, toName string, toAddress string, msg *Message) error {
+	if rData.SiteConfig.SUSPEND_EMAIL == true {
+		return nil
+	}
+
+	idempotencyKey, err := text.RandomHexString(16)
+	if err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	params.Set("ikey", idempotencyKey)
+	params.Set("name", toName)
+	params.Set("to", toAddress)
+	params.Set("subject", msg.Subject)
+	params.Set("html", msg.Body)
+	params.Set("text", msg.Text)
+	if len(msg.Headers) > 0 {
+		headersJson, err := json.Marshal(msg.Headers)
+		if err != nil {
+			return err
+		}
+		params.Set("headers", string(headersJson))
+	}
+
+	emailTask := taskqueue.NewPOSTTask("/"+pagenames.EMAIL_SEND_WEBHOOK, params)
+	emailTask.RetryOptions = &taskqueue.RetryOptions{
+		RetryLimit:   EMAIL_TASK_RETRY_LIMIT,
+		MinBackoff:   EMAIL_TASK_MIN_BACKOFF,
+		MaxBackoff:   EMAIL_TASK_MAX_BACKOFF,
+		MaxDoublings: EMAIL_TASK_MAX_DOUBLINGS,
+	}
+
+	_, err = taskqueue.Add(rData.Ctx, emailTask, rData.SiteConfig.TASKQUEUE_EMAIL)
+	return err
+}
+
+//Called from the task queue - a returned error means the task should be retried
+//Each idempotency key is sent at most once, and the last failed attempt is kept as a dead letter instead of erroring
+//the dead letter only has the recipient, subject and error - the body may hold login links, so it isn't stored
+func DeliverQueued(rData *pages.RequestData) error {
+	request := rData.HttpRequest
+	idempotencyKey := request.FormValue("ikey")
+	toAddress := request.FormValue("to")
+
+	if idempotencyKey == "" || toAddress == "" {
+		//malformed, retrying won't help
+		rData.LogError("email task without ikey or to address")
+		return nil
+	}
+
+	record, claimed, err := claimDelivery(rData.Ctx, idempotencyKey, toAddress, request.FormValue("subject"))
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return nil
+	}
+
+	msg := &Message{
+		Subject: request.FormValue("subject"),
+		Body:    request.FormValue("html"),
+		Text:    request.FormValue("text"),
+	}
+	if headersJson := request.FormValue("headers"); headersJson != "" {
+		if err := json.Unmarshal([]byte(headersJson), &msg.Headers); err != nil {
+			rData.LogError("email task %s has bad headers: %v", idempotencyKey, err)
+		}
+	}
+
+	sendErr := Send(rData, request.FormValue("name"), toAddress, msg)
+
+	retryCount, _ := strconv.Atoi(request.Header.Get("X-AppEngine-TaskRetryCount"))
+
+	data := record.GetData()
+	data.Attempts++
+	data.UpdatedDate = time.Now()
+
+	if sendErr == nil {
+		data.Status = datastore.EMAIL_DELIVERY_SENT
+		data.LastError = ""
+	} else {
+		data.LastError = sendErr.Error()
+
+		if retryCount >= EMAIL_TASK_RETRY_LIMIT {
+			data.Status = datastore.EMAIL_DELIVERY_DEAD
+			rData.LogError("email to %s (%s) is dead after %d attempts: %v", toAddress, idempotencyKey, data.Attempts, sendErr)
+		} else {
+			data.Status = datastore.EMAIL_DELIVERY_FAILED
+		}
+	}
+
+	if err := datastore.SaveToKey(rData.Ctx, record, idempotencyKey); err != nil {
+		//if it was sent, a retry would send it again... but there's no other way to find out the save failed
+		rData.LogError("email delivery record (%s) save failed: %v", idempotencyKey, err)
+	}
+
+	if sendErr != nil && data.Status != datastore.EMAIL_DELIVERY_DEAD {
+		return sendErr
+	}
+
+	return nil
+}
+
+//Returns claimed=false if it was already sent (or given up on)
+func claimDelivery(c context.Context, idempotencyKey string, toAddress string, subject string) (*datastore.EmailDeliveryRecord, bool, error) {
+	var record datastore.EmailDeliveryRecord
+	var claimed bool
+
+	err := gaeds.RunInTransaction(c, func(c context.Context) error {
+		claimed = false
+		now := time.Now()
+
+		err := datastore.LoadFromKey(c, &record, idempotencyKey)
+		if err == gaeds.ErrNoSuchEntity {
+			record.SetData(&datastore.EmailDeliveryData{
+				ToAddress: toAddress,
+				Subject:   subject,
+				Date:      now,
+			})
+		} else if err != nil {
+			return err
+		}
+
+		switch record.GetData().Status {
+		case datastore.EMAIL_DELIVERY_SENT, datastore.EMAIL_DELIVERY_DEAD:
+			return nil
+		case datastore.EMAIL_DELIVERY_SENDING:
+			if now.Sub(record.GetData().UpdatedDate) < EMAIL_SEND_LEASE {
+				return errDeliveryInProgress
+			}
+		}
+
+		record.GetData().Status = datastore.EMAIL_DELIVERY_SENDING
+		record.GetData().UpdatedDate = now
+		claimed = true
+
+		return datastore.SaveToKey(c, &record, idempotencyKey)
+	}, nil)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &record, claimed, nil
+}
+
+//Meant to be run from cron (e.g. daily, cron requests pass as task queue requests) - deletes one batch of old delivery records
+//and queues the next one on TASKQUEUE_EMAIL if there may be more
+func CleanupDeliveries(rData *pages.RequestData) error {
+	keys, err := datastore.GetStaleEmailDeliveryKeys(rData.Ctx, time.Now().Add(-EMAIL_DELIVERY_RETENTION), EMAIL_DELIVERY_CLEANUP_BATCH_SIZE)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if err := gaeds.DeleteMulti(rData.Ctx, keys); err != nil {
+		return err
+	}
+
+	rData.LogInfo("deleted %d email delivery records", len(keys))
+
+	if len(keys) < EMAIL_DELIVERY_CLEANUP_BATCH_SIZE {
+		return nil
+	}
+
+	_, err = taskqueue.Add(rData.Ctx, taskqueue.NewPOSTTask("/"+pagenames.EMAIL_DELIVERY_CLEANUP_WEBHOOK, nil), rData.SiteConfig.TASKQUEUE_EMAIL)
+	return err
+}
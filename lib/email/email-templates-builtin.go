@@ -0,0 +1,38 @@
+package email
+
+//The default (english) templates, sites override any of these by providing the same path in Config.EmailTemplates
+var BUILTIN_TEMPLATES = map[string]string{
+	"/en/layout.html": `{{define "layout"}}<!DOCTYPE html>
+<html>
+<body>
+{{template "content" .}}{{template "footer" .}}
+</body>
+</html>{{end}}`,
+
+	"/en/layout.txt": `{{define "layout"}}{{template "content" .}}{{template "footer" .}}{{end}}`,
+
+	//empty by default - override to add a signature, unsubscribe info etc.
+	"/en/partials.html": `{{define "footer"}}{{end}}`,
+	"/en/partials.txt":  `{{define "footer"}}{{end}}`,
+
+	"/en/activation.html": `{{define "subject"}}Confirm your registration{{end}}
+{{define "content"}}Thank you for creating an account!<br/>Please confirm your email address by clicking on the link below:<br/><br/><a href="{{.Url}}">Click here to confirm</a>{{end}}`,
+
+	"/en/change-email.html": `{{define "subject"}}Confirm your email address{{end}}
+{{define "content"}}You've requested an email change.<br/>Please confirm your email address by clicking on the link below:<br/><br/><a href="{{.Url}}">Click here to confirm</a>{{end}}`,
+
+	"/en/change-password.html": `{{define "subject"}}Password Change{{end}}
+{{define "content"}}You've requested to change your password.<br/>Please use the link below:<br/><br/><a href="{{.Url}}">Click here to confirm</a>{{end}}`,
+
+	"/en/login-link.html": `{{define "subject"}}Your login link{{end}}
+{{define "content"}}You've requested to log in without a password.<br/>Please use the link below, it can only be used once:<br/><br/><a href="{{.Url}}">Click here to log in</a><br/><br/>If you did not request this, you can ignore this email.{{end}}`,
+
+	"/en/password-changed.html": `{{define "subject"}}Your password was changed{{end}}
+{{define "content"}}The password for your account was just changed.<br/><br/>If you did not do this, please reset your password right away and contact us.{{end}}`,
+
+	"/en/email-changed.html": `{{define "subject"}}Your email address was changed{{end}}
+{{define "content"}}The email address for your account was just changed to {{.Address}}.<br/><br/>If you did not do this, please contact us right away.{{end}}`,
+
+	"/en/new-device.html": `{{define "subject"}}New sign-in to your account{{end}}
+{{define "content"}}Your account was just signed in to from a new device.<br/><br/>Device: {{.UserAgent}}<br/>IP Address: {{.IpAddress}}<br/><br/>If this was you, there's nothing else to do. If not, please change your password right away.{{end}}`,
+}
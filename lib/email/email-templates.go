@@ -0,0 +1,250 @@
+package email
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+)
+
+//Every message is <name>.html, which must define "subject" and "content", plus an optional <name>.txt defining "content"
+//Without the .txt, the plaintext alternative is derived from the html
+//Shared templates (layout.html/txt defining "layout", partials.html/txt with anything else) are resolved the same way
+//Each file is looked up as /<locale>/<file> along the locale chain (e.g. pt-br, pt, default), site templates before the built-in ones
+const TEMPLATE_LAYOUT = "layout"
+const TEMPLATE_PARTIALS = "partials"
+const TEMPLATE_DEFAULT_LOCALE = "en"
+
+type templateSet struct {
+	html *htmltemplate.Template
+	text *texttemplate.Template //nil if there's no .txt for this message
+}
+
+var siteTemplates http.FileSystem
+var defaultLocale = TEMPLATE_DEFAULT_LOCALE
+
+var templateCache = make(map[string]*templateSet)
+var templateCacheLock sync.Mutex
+
+var localeSanitizer = regexp.MustCompile("[^a-z0-9-]")
+
+//Called once from init.Start - templates may be a plain http.Dir or any embedded http.FileSystem
+func SetTemplateConfig(templates http.FileSystem, locale string) {
+	templateCacheLock.Lock()
+	defer templateCacheLock.Unlock()
+
+	siteTemplates = templates
+	if locale != "" {
+		defaultLocale = normalizeLocale(locale)
+	}
+	templateCache = make(map[string]*templateSet)
+}
+
+//Renders the named message for the locale, data is passed as-is to the templates
+func RenderMessage(locale string, name string, data interface{}) (*Message, error) {
+	chain := getLocaleChain(locale)
+
+	set, err := getTemplateSet(chain, name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return set.execute(data)
+}
+
+//For the Get*Message wrappers - a broken site template falls back to the built-in one rather than not sending at all
+//only fails if the built-in one is broken too, in which case the message can't be sent
+func renderMessageWithFallback(locale string, name string, data interface{}) (*Message, error) {
+	msg, err := RenderMessage(locale, name, data)
+	if err == nil {
+		return msg, nil
+	}
+
+	set, err := getTemplateSet([]string{TEMPLATE_DEFAULT_LOCALE}, name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return set.execute(data)
+}
+
+func (set *templateSet) execute(data interface{}) (*Message, error) {
+	var subject, body, text bytes.Buffer
+
+	if err := set.html.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err := set.html.ExecuteTemplate(&body, TEMPLATE_LAYOUT, data); err != nil {
+		return nil, err
+	}
+
+	if set.text != nil {
+		if err := set.text.ExecuteTemplate(&text, TEMPLATE_LAYOUT, data); err != nil {
+			return nil, err
+		}
+	} else {
+		text.WriteString(HtmlToText(body.String()))
+	}
+
+	return &Message{
+		Subject: strings.TrimSpace(html.UnescapeString(subject.String())),
+		Body:    body.String(),
+		Text:    strings.TrimSpace(text.String()),
+	}, nil
+}
+
+func getTemplateSet(chain []string, name string, useSite bool) (*templateSet, error) {
+	cacheKey := strings.Join(chain, ",") + ":" + name
+	if !useSite {
+		cacheKey = "builtin:" + cacheKey
+	}
+
+	templateCacheLock.Lock()
+	defer templateCacheLock.Unlock()
+
+	if set, ok := templateCache[cacheKey]; ok {
+		return set, nil
+	}
+
+	set, err := parseTemplateSet(chain, name, useSite)
+	if err != nil {
+		return nil, err
+	}
+
+	templateCache[cacheKey] = set
+	return set, nil
+}
+
+func parseTemplateSet(chain []string, name string, useSite bool) (*templateSet, error) {
+	set := &templateSet{html: htmltemplate.New(name)}
+
+	for _, fileName := range []string{TEMPLATE_LAYOUT + ".html", TEMPLATE_PARTIALS + ".html", name + ".html"} {
+		src, found, err := readTemplate(chain, fileName, useSite)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			if fileName == TEMPLATE_PARTIALS+".html" {
+				continue
+			}
+			return nil, errors.New("missing email template " + fileName)
+		}
+		if _, err := set.html.New(fileName).Parse(src); err != nil {
+			return nil, err
+		}
+	}
+
+	textSrc, found, err := readTemplate(chain, name+".txt", useSite)
+	if err != nil || !found {
+		return set, err
+	}
+
+	set.text = texttemplate.New(name)
+	for _, fileName := range []string{TEMPLATE_LAYOUT + ".txt", TEMPLATE_PARTIALS + ".txt"} {
+		src, found, err := readTemplate(chain, fileName, useSite)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			if fileName == TEMPLATE_PARTIALS+".txt" {
+				continue
+			}
+			return nil, errors.New("missing email template " + fileName)
+		}
+		if _, err := set.text.New(fileName).Parse(src); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := set.text.New(name + ".txt").Parse(textSrc); err != nil {
+		return nil, err
+	}
+
+	return set, nil
+}
+
+func readTemplate(chain []string, fileName string, useSite bool) (string, bool, error) {
+	for _, locale := range chain {
+		path := "/" + locale + "/" + fileName
+
+		if useSite && siteTemplates != nil {
+			file, err := siteTemplates.Open(path)
+			if err == nil {
+				contents, err := ioutil.ReadAll(file)
+				file.Close()
+				if err != nil {
+					return "", false, err
+				}
+				return string(contents), true, nil
+			} else if !os.IsNotExist(err) {
+				return "", false, err
+			}
+		}
+
+		if src, ok := BUILTIN_TEMPLATES[path]; ok {
+			return src, true, nil
+		}
+	}
+
+	return "", false, nil
+}
+
+//"pt_BR" -> pt-br, pt, then the default locale
+func getLocaleChain(locale string) []string {
+	var chain []string
+
+	locale = normalizeLocale(locale)
+	if locale != "" {
+		chain = append(chain, locale)
+		if idx := strings.Index(locale, "-"); idx > 0 {
+			chain = append(chain, locale[:idx])
+		}
+	}
+
+	for _, fallback := range []string{defaultLocale, TEMPLATE_DEFAULT_LOCALE} {
+		exists := false
+		for _, existing := range chain {
+			if existing == fallback {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			chain = append(chain, fallback)
+		}
+	}
+
+	return chain
+}
+
+//also keeps the locale safe to use as a path segment
+func normalizeLocale(locale string) string {
+	locale = strings.Replace(strings.ToLower(strings.TrimSpace(locale)), "_", "-", -1)
+	return strings.Trim(localeSanitizer.ReplaceAllString(locale, ""), "-")
+}
+
+var htmlBreaks = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</div>|</h[1-6]>|</li>`)
+var htmlLinks = regexp.MustCompile(`(?is)<a\s[^>]*href="([^"]*)"[^>]*>(.*?)</a>`)
+var htmlTags = regexp.MustCompile(`(?s)<[^>]*>`)
+var blankLines = regexp.MustCompile(`\n{3,}`)
+
+//Good enough for our own templates - links keep their url, everything else is reduced to the text
+func HtmlToText(src string) string {
+	text := htmlBreaks.ReplaceAllString(src, "\n")
+	text = htmlLinks.ReplaceAllString(text, "$2: $1")
+	text = htmlTags.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+
+	lines := strings.Split(text, "\n")
+	for idx, line := range lines {
+		lines[idx] = strings.TrimSpace(line)
+	}
+
+	return strings.TrimSpace(blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
@@ -0,0 +1,149 @@
+package email
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGetLocaleChain(t *testing.T) {
+	tests := []struct {
+		locale        string
+		defaultLocale string
+		expected      []string
+	}{
+		{"", "en", []string{"en"}},
+		{"en", "en", []string{"en"}},
+		{"de", "en", []string{"de", "en"}},
+		{"pt_BR", "en", []string{"pt-br", "pt", "en"}},
+		{" PT-br ", "en", []string{"pt-br", "pt", "en"}},
+		{"en-GB", "en", []string{"en-gb", "en"}},
+		{"fr-CA", "de", []string{"fr-ca", "fr", "de", "en"}},
+		{"de-AT", "de", []string{"de-at", "de", "en"}},
+		{"../../etc", "en", []string{"etc", "en"}},
+		{"-", "en", []string{"en"}},
+	}
+
+	defer func(original string) { defaultLocale = original }(defaultLocale)
+
+	for _, test := range tests {
+		defaultLocale = test.defaultLocale
+		if chain := getLocaleChain(test.locale); !reflect.DeepEqual(chain, test.expected) {
+			t.Errorf("%q (default %s): expected %v, got %v", test.locale, test.defaultLocale, test.expected, chain)
+		}
+	}
+}
+
+func TestHtmlToText(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		expected string
+	}{
+		{"plain", "Hello", "Hello"},
+		{"breaks", "one<br>two<br/>three<BR />four", "one\ntwo\nthree\nfour"},
+		{"blocks", "<p>one</p><div>two</div><h1>three</h1><ul><li>a</li><li>b</li></ul>", "one\ntwo\nthree\na\nb"},
+		{"link", `Go <a href="https://example.com/x?a=1&amp;b=2" class="btn">here</a> now`, "Go here: https://example.com/x?a=1&b=2 now"},
+		{"multiline link", "<a\nhref=\"https://example.com\">click\nme</a>", "click\nme: https://example.com"},
+		{"entities", "Fish &amp; chips &lt;3 &quot;yes&quot;", `Fish & chips <3 "yes"`},
+		{"blank lines", "one<br><br><br><br>two", "one\n\ntwo"},
+		{"indentation", "<p>\n    one\n</p>\n  <p>  two  </p>", "one\n\ntwo"},
+		{"tags", "<html><head><style>x</style></head><body><b>bold</b> <i>it</i></body></html>", "xbold it"},
+	}
+
+	for _, test := range tests {
+		if text := HtmlToText(test.src); text != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, text)
+		}
+	}
+}
+
+func TestRenderMessage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "email-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"de/activation.html":       `{{define "subject"}}Registrierung bestätigen{{end}}{{define "content"}}<a href="{{.Url}}">Bestätigen</a>{{end}}`,
+		"de/activation.txt":        `{{define "content"}}Bestätigen: {{.Url}}{{end}}`,
+		"de/layout.txt":            `{{define "layout"}}{{template "content" .}}{{end}}`,
+		"fr/login-link.html":       `{{define "subject"}}{{index .Url 999}}{{end}}{{define "content"}}{{end}}`,
+		"es/login-link.html":       `{{define "subject"}}{{end`,
+		"pt/new-device.html":       `{{define "subject"}}Novo acesso{{end}}{{define "content"}}{{.IpAddress}}{{end}}`,
+		"en/password-changed.html": `{{define "subject"}}Site password changed{{end}}{{define "content"}}Changed{{end}}`,
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	SetTemplateConfig(http.Dir(dir), TEMPLATE_DEFAULT_LOCALE)
+	defer SetTemplateConfig(nil, TEMPLATE_DEFAULT_LOCALE)
+
+	//site template with its own .txt, layout from the site, html layout built in
+	msg, err := GetEmailActivationMessage("de_DE", "https://example.com/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "Registrierung bestätigen" || msg.Text != "Bestätigen: https://example.com/a" || !strings.Contains(msg.Body, `href="https://example.com/a"`) {
+		t.Errorf("unexpected de activation %#v", msg)
+	}
+
+	//pt-br falls back to pt, the text is derived from the html
+	msg, err = GetEmailNewDeviceLoginNoticeMessage("pt-BR", "10.0.0.1", "ua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "Novo acesso" || msg.Text != "10.0.0.1" {
+		t.Errorf("unexpected pt new-device %#v", msg)
+	}
+
+	//a site template for the default locale overrides the built-in one
+	msg, err = GetEmailPasswordChangedNoticeMessage("it")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "Site password changed" {
+		t.Errorf("unexpected password-changed subject %q", msg.Subject)
+	}
+
+	//unknown locales get the built-in default
+	msg, err = GetEmailActivationMessage("xx", "https://example.com/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "Confirm your registration" || !strings.Contains(msg.Text, "Click here to confirm: https://example.com/b") {
+		t.Errorf("unexpected built-in activation %#v", msg)
+	}
+
+	//broken site templates (failing to execute, or to parse) fall back to the built-in ones
+	for _, locale := range []string{"fr", "es"} {
+		if _, err := RenderMessage(locale, "login-link", map[string]interface{}{"Url": "https://example.com/c"}); err == nil {
+			t.Errorf("%s: expected the broken site template to fail", locale)
+		}
+
+		msg, err = GetEmailLoginLinkMessage(locale, "https://example.com/c")
+		if err != nil {
+			t.Fatalf("%s: %v", locale, err)
+		}
+		if msg.Subject != "Your login link" {
+			t.Errorf("%s: expected the built-in login link, got %q", locale, msg.Subject)
+		}
+	}
+
+	//and if there's nothing to fall back to, it's an error rather than a panic
+	if _, err := renderMessageWithFallback("en", "no-such-message", nil); err == nil {
+		t.Errorf("expected an error for a missing message")
+	}
+}
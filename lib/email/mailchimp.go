@@ -3,160 +3,261 @@ package email
 
 import (
 	"bytes"
+	"crypto/md5"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"strings"
 
-	"github.com/dakom/basic-site-api/lib/pages"
+	"golang.org/x/net/context"
 
-	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/setup/config/custom"
 
 	"google.golang.org/appengine/urlfetch"
 )
 
-type MailchimpAPIError struct {
-	Status string `json:"status"`
-	Code   int    `json:"code"`
-	Name   string `json:"name"`
-	Err    string `json:"error"`
+//Mailchimp api v3, members are addressed by the md5 of their lowercased email (the "subscriber hash")
+//Interests maps interest names (MAILINGLIST_INTEREST_*) to the interest ids of the list
+type MailchimpProvider struct {
+	ApiKey      string
+	ApiEndpoint string //e.g. https://us1.api.mailchimp.com/3.0/ - derived from the api key if empty
+	ListId      string
+	Interests   map[string]string
 }
 
-type MailchimpSuccessResponse struct {
-	Email       string `json:"email"`
-	EmailId     string `json:"euid"`
-	ListEmailId string `json:"leid"`
+type MailchimpApiError struct {
+	Status int    `json:"status"`
+	Title  string `json:"title"`
+	Detail string `json:"detail"`
 }
 
-type MergeVarsSubscribe struct {
-	FirstName string      `json:"FNAME"`
-	LastName  string      `json:"LNAME"`
-	NewEmail  string      `json:"new-email"`
-	Groupings []Groupings `json:"groupings"`
+func (err *MailchimpApiError) Error() string {
+	return fmt.Sprintf("mailchimp %d %s: %s", err.Status, err.Title, err.Detail)
 }
 
-type MergeVarsUpdateEmail struct {
-	NewEmail string `json:"new-email"`
+type mailchimpMember struct {
+	Id           string            `json:"id"`
+	EmailAddress string            `json:"email_address"`
+	Status       string            `json:"status"`
+	MergeFields  map[string]string `json:"merge_fields"`
+	Interests    map[string]bool   `json:"interests"`
 }
 
-type MergeVarsUpdateName struct {
-	FirstName string `json:"FNAME"`
-	LastName  string `json:"LNAME"`
-}
+func (provider *MailchimpProvider) Subscribe(c context.Context, contact *custom.MailingListContact) error {
+	request := map[string]interface{}{
+		"email_address": contact.Email,
+		"status_if_new": "subscribed",
+		"status":        "subscribed",
+		"merge_fields":  provider.getMergeFields(contact),
+	}
+	if interests := provider.getInterests(contact); len(interests) > 0 {
+		request["interests"] = interests
+	}
 
-type Groupings struct {
-	ID     int      `json:"id"`
-	Groups []string `json:"groups"`
+	//PUT is an upsert, so this also resubscribes people who left
+	return provider.memberCall(c, contact, "PUT", GetMailchimpSubscriberHash(contact.Email), request)
 }
 
-func mailchimpSubscribe(rData *pages.RequestData, userRecord *datastore.UserRecord) (*MailchimpSuccessResponse, error) {
+func (provider *MailchimpProvider) UpdateEmail(c context.Context, contact *custom.MailingListContact) error {
+	request := map[string]interface{}{
+		"email_address": contact.Email,
+	}
+
+	err := provider.memberCall(c, contact, "PATCH", provider.getMemberId(contact), request)
 
-	interestGroups := []string{"ViaRegistration"}
+	//never made it to the list (or was deleted there), so just add the new address
+	if apiErr, ok := err.(*MailchimpApiError); ok && apiErr.Status == http.StatusNotFound {
+		return provider.Subscribe(c, contact)
+	}
+
+	return err
+}
 
-	if userRecord.GetData().UserMailinglistData.HasMarketingNewsletter {
-		interestGroups = append(interestGroups, "Marketing")
+func (provider *MailchimpProvider) UpdateName(c context.Context, contact *custom.MailingListContact) error {
+	request := map[string]interface{}{
+		"merge_fields": provider.getMergeFields(contact),
 	}
 
-	mergeVars := MergeVarsSubscribe{
-		NewEmail:  userRecord.GetData().Email,
-		FirstName: userRecord.GetData().FirstName,
-		LastName:  userRecord.GetData().LastName,
-		Groupings: []Groupings{Groupings{ID: rData.SiteConfig.MAILCHIMP_GROUP_ID, Groups: interestGroups}},
+	return provider.memberCall(c, contact, "PATCH", provider.getMemberId(contact), request)
+}
+
+func (provider *MailchimpProvider) Unsubscribe(c context.Context, contact *custom.MailingListContact) error {
+	request := map[string]interface{}{
+		"status": "unsubscribed",
 	}
 
-	jsonObject := map[string]interface{}{"apikey": rData.SiteConfig.MAILCHIMP_APIKEY, "id": rData.SiteConfig.MAILCHIMP_LIST_ID, "email": map[string]string{"email": userRecord.GetData().Email}, "merge_vars": mergeVars, "update_existing": true, "replace_interests": false, "double_optin": false}
+	err := provider.memberCall(c, contact, "PATCH", provider.getMemberId(contact), request)
 
-	return mailchimpApiCall(rData, "lists/subscribe.json", jsonObject)
+	//not on the list is as unsubscribed as it gets
+	if apiErr, ok := err.(*MailchimpApiError); ok && apiErr.Status == http.StatusNotFound {
+		return nil
+	}
+
+	return err
 }
 
-func mailchimpUpdateEmail(rData *pages.RequestData, userRecord *datastore.UserRecord) (*MailchimpSuccessResponse, error) {
-	var resp *MailchimpSuccessResponse
-	var err error
+func (provider *MailchimpProvider) SetInterests(c context.Context, contact *custom.MailingListContact) error {
+	interests := provider.getInterests(contact)
+	if len(interests) == 0 {
+		return nil
+	}
 
-	mergeVars := MergeVarsUpdateEmail{
-		NewEmail: userRecord.GetData().Email,
+	request := map[string]interface{}{
+		"interests": interests,
 	}
 
-	jsonObject := map[string]interface{}{"apikey": rData.SiteConfig.MAILCHIMP_APIKEY, "id": rData.SiteConfig.MAILCHIMP_LIST_ID, "email": map[string]string{"leid": userRecord.GetData().UserMailinglistData.ListEmailId}, "merge_vars": mergeVars, "email_type": "html", "replace_interests": false}
+	return provider.memberCall(c, contact, "PATCH", provider.getMemberId(contact), request)
+}
+
+//archived members count as unknown, since they can simply be added again (unlike unsubscribed or cleaned ones)
+func (provider *MailchimpProvider) Lookup(c context.Context, contact *custom.MailingListContact) (*custom.MailingListContactState, error) {
+	var member mailchimpMember
 
-	resp, err = mailchimpApiCall(rData, "lists/update-member.json", jsonObject)
+	memberIds := []string{provider.getMemberId(contact)}
+	if hash := GetMailchimpSubscriberHash(contact.Email); hash != memberIds[0] {
+		memberIds = append(memberIds, hash)
+	}
 
-	if err != nil && err.Error() == "List_AlreadySubscribed" {
-		resp, err = mailchimpUnsubscribe(rData, userRecord.GetData().Email)
-		if err == nil {
-			resp, err = mailchimpApiCall(rData, "lists/update-member.json", jsonObject)
-		} else {
+	for _, memberId := range memberIds {
+		err := provider.apiCall(c, "GET", "lists/"+provider.ListId+"/members/"+memberId, nil, &member)
+		if apiErr, ok := err.(*MailchimpApiError); ok && apiErr.Status == http.StatusNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
 
-			resp, err = mailchimpSubscribe(rData, userRecord)
+		if member.Status == "archived" {
+			return nil, nil
+		}
+
+		state := &custom.MailingListContactState{
+			MailingListContact: custom.MailingListContact{
+				ProviderId: member.Id,
+				Email:      member.EmailAddress,
+				FirstName:  member.MergeFields["FNAME"],
+				LastName:   member.MergeFields["LNAME"],
+				Interests:  make(map[string]bool),
+			},
+			Subscribed: member.Status == "subscribed" || member.Status == "pending",
+		}
 
-			if err != nil {
-				rData.LogError("unable to update email, tried everything but ultimately got error: %v", err)
-				return nil, nil
+		for name, interestId := range provider.Interests {
+			if isSet, ok := member.Interests[interestId]; ok {
+				state.Interests[name] = isSet
 			}
 		}
+
+		return state, nil
 	}
 
-	return resp, err
+	return nil, nil
+}
 
+func GetMailchimpSubscriberHash(emailAddress string) string {
+	hash := md5.Sum([]byte(strings.ToLower(strings.TrimSpace(emailAddress))))
+	return hex.EncodeToString(hash[:])
 }
 
-func mailchimpUpdateName(rData *pages.RequestData, userRecord *datastore.UserRecord) (*MailchimpSuccessResponse, error) {
+//the stored id is the hash of the address at the time it was stored, which is what's needed to find the member after the address changed
+//ids left over from the v2 api (euid) aren't hashes and are ignored
+func (provider *MailchimpProvider) getMemberId(contact *custom.MailingListContact) string {
+	if _, err := hex.DecodeString(contact.ProviderId); err == nil && len(contact.ProviderId) == md5.Size*2 {
+		return contact.ProviderId
+	}
+	return GetMailchimpSubscriberHash(contact.Email)
+}
 
-	mergeVars := MergeVarsUpdateName{
-		FirstName: userRecord.GetData().FirstName,
-		LastName:  userRecord.GetData().LastName,
+func (provider *MailchimpProvider) getMergeFields(contact *custom.MailingListContact) map[string]string {
+	return map[string]string{
+		"FNAME": contact.FirstName,
+		"LNAME": contact.LastName,
 	}
+}
 
-	jsonObject := map[string]interface{}{"apikey": rData.SiteConfig.MAILCHIMP_APIKEY, "id": rData.SiteConfig.MAILCHIMP_LIST_ID, "email": map[string]string{"leid": userRecord.GetData().UserMailinglistData.ListEmailId}, "merge_vars": mergeVars, "email_type": "html", "replace_interests": false}
+//interests without a configured id are skipped
+func (provider *MailchimpProvider) getInterests(contact *custom.MailingListContact) map[string]bool {
+	interests := make(map[string]bool)
 
-	return mailchimpApiCall(rData, "lists/update-member.json", jsonObject)
+	for name, isSet := range contact.Interests {
+		if interestId, ok := provider.Interests[name]; ok && interestId != "" {
+			interests[interestId] = isSet
+		}
+	}
+
+	return interests
 }
 
-func mailchimpUnsubscribe(rData *pages.RequestData, emailAddress string) (*MailchimpSuccessResponse, error) {
+func (provider *MailchimpProvider) getApiEndpoint() string {
+	//anything else is a leftover v2 endpoint
+	if strings.Contains(provider.ApiEndpoint, "/3.0") {
+		return strings.TrimSuffix(provider.ApiEndpoint, "/") + "/"
+	}
 
-	jsonObject := map[string]interface{}{"apikey": rData.SiteConfig.MAILCHIMP_APIKEY, "id": rData.SiteConfig.MAILCHIMP_LIST_ID, "email": map[string]string{"email": emailAddress}, "delete_member": false, "send_goodbye": false, "send_notify": false}
+	//api keys look like key-dc
+	dc := "us1"
+	if idx := strings.LastIndex(provider.ApiKey, "-"); idx != -1 {
+		dc = provider.ApiKey[idx+1:]
+	}
 
-	return mailchimpApiCall(rData, "lists/unsubscribe.json", jsonObject)
+	return "https://" + dc + ".api.mailchimp.com/3.0/"
 }
 
-func mailchimpApiCall(rData *pages.RequestData, apiName string, jsonObject map[string]interface{}) (*MailchimpSuccessResponse, error) {
-	var mailchimpSuccessResponse MailchimpSuccessResponse
+//sets contact.ProviderId from the member which came back
+func (provider *MailchimpProvider) memberCall(c context.Context, contact *custom.MailingListContact, method string, memberId string, request map[string]interface{}) error {
+	var member mailchimpMember
 
-	client := urlfetch.Client(rData.Ctx)
+	if err := provider.apiCall(c, method, "lists/"+provider.ListId+"/members/"+memberId, request, &member); err != nil {
+		return err
+	}
 
-	jsonData, err := json.Marshal(jsonObject)
-	if err != nil {
-		return &mailchimpSuccessResponse, err
+	if member.Id != "" {
+		contact.ProviderId = member.Id
 	}
 
-	jsonBuffer := bytes.NewBuffer(jsonData)
+	return nil
+}
+
+//request is only sent if it isn't nil
+func (provider *MailchimpProvider) apiCall(c context.Context, method string, apiName string, request interface{}, response interface{}) error {
+	var requestBody bytes.Buffer
+
+	if request != nil {
+		if err := json.NewEncoder(&requestBody).Encode(request); err != nil {
+			return err
+		}
+	}
 
+	httpRequest, err := http.NewRequest(method, provider.getApiEndpoint()+apiName, &requestBody)
 	if err != nil {
-		return &mailchimpSuccessResponse, err
+		return err
 	}
 
-	httpResponse, err := client.Post(rData.SiteConfig.MAILCHIMP_APIENDPOINT+apiName, "application/json", jsonBuffer)
+	httpRequest.SetBasicAuth("apikey", provider.ApiKey)
+	httpRequest.Header.Set("Content-Type", "application/json")
+
+	httpResponse, err := urlfetch.Client(c).Do(httpRequest)
 	if err != nil {
-		return &mailchimpSuccessResponse, err
+		return err
 	}
 
 	defer httpResponse.Body.Close()
 	body, err := ioutil.ReadAll(httpResponse.Body)
 	if err != nil {
-		return &mailchimpSuccessResponse, err
+		return err
 	}
 
-	var mailchimpAPIError MailchimpAPIError
-
-	json.Unmarshal(body, &mailchimpAPIError)
-	if mailchimpAPIError.Err != "" || mailchimpAPIError.Code != 0 {
-		return &mailchimpSuccessResponse, fmt.Errorf(mailchimpAPIError.Name) //fmt.Errorf("Error: %v %v %v %v", mailchimpAPIError.Status, mailchimpAPIError.Code, mailchimpAPIError.Name, mailchimpAPIError.Err)
+	if httpResponse.StatusCode >= 300 {
+		apiErr := &MailchimpApiError{Status: httpResponse.StatusCode, Title: httpResponse.Status}
+		json.Unmarshal(body, apiErr)
+		apiErr.Status = httpResponse.StatusCode
+		return apiErr
 	}
 
-	json.Unmarshal(body, &mailchimpSuccessResponse)
-
-	if mailchimpSuccessResponse.EmailId == "" || mailchimpSuccessResponse.ListEmailId == "" {
-		return &mailchimpSuccessResponse, fmt.Errorf("NO LIST ID!")
+	if response != nil && len(body) > 0 {
+		return json.Unmarshal(body, response)
 	}
 
-	return &mailchimpSuccessResponse, nil
+	return nil
 }
@@ -0,0 +1,160 @@
+package email
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/lib/utils/slice"
+)
+
+const (
+	MAILINGLIST_EVENT_UNSUBSCRIBE string = "unsubscribe"
+	MAILINGLIST_EVENT_SUBSCRIBE   string = "subscribe"
+)
+
+var ErrInvalidWebhookKey = errors.New("invalid mailing list webhook key")
+
+//A change made on the provider's side (unsubscribe link in their email, their signup form etc.)
+//MailingListIds are whatever the provider may have handed out for the contact, to match against UserMailinglistData
+type MailingListEvent struct {
+	Provider       string
+	Type           string
+	MailingListIds []string
+	Email          string
+	Reason         string
+}
+
+//Neither provider signs its webhooks, so the url has to carry MAILINGLIST_WEBHOOK_KEY
+func ValidateMailingListWebhookKey(rData *pages.RequestData) error {
+	key := rData.HttpRequest.URL.Query().Get("key")
+
+	if rData.SiteConfig.MAILINGLIST_WEBHOOK_KEY == "" || subtle.ConstantTimeCompare([]byte(key), []byte(rData.SiteConfig.MAILINGLIST_WEBHOOK_KEY)) != 1 {
+		return ErrInvalidWebhookKey
+	}
+
+	return nil
+}
+
+//Mailchimp posts one form encoded event per request (type, data[email], data[id], data[web_id], data[list_id] ...)
+//events for other lists, and the ones which don't affect the subscription (profile, upemail), come back as nil
+func ParseMailchimpWebhook(rData *pages.RequestData) (*MailingListEvent, error) {
+	if err := ValidateMailingListWebhookKey(rData); err != nil {
+		return nil, err
+	}
+
+	request := rData.HttpRequest
+	if err := request.ParseForm(); err != nil {
+		return nil, err
+	}
+
+	if listId := request.PostForm.Get("data[list_id]"); listId != "" && listId != rData.SiteConfig.MAILCHIMP_LIST_ID {
+		return nil, nil
+	}
+
+	event := &MailingListEvent{
+		Provider: "mailchimp",
+		Email:    strings.TrimSpace(request.PostForm.Get("data[email]")),
+		Reason:   request.PostForm.Get("type"),
+	}
+
+	switch request.PostForm.Get("type") {
+	case "unsubscribe":
+		event.Type = MAILINGLIST_EVENT_UNSUBSCRIBE
+		if reason := request.PostForm.Get("data[reason]"); reason != "" {
+			event.Reason += " (" + reason + ")"
+		}
+	case "cleaned":
+		//bounced for good, mailchimp won't send there anymore either
+		event.Type = MAILINGLIST_EVENT_UNSUBSCRIBE
+	case "subscribe":
+		event.Type = MAILINGLIST_EVENT_SUBSCRIBE
+	default:
+		return nil, nil
+	}
+
+	if event.Email == "" {
+		return nil, errors.New("mailchimp webhook without an email")
+	}
+
+	//current ids are subscriber hashes, data[id] and data[web_id] are what the v2 api stored as EmailId and ListEmailId
+	event.MailingListIds = []string{GetMailchimpSubscriberHash(event.Email)}
+	for _, field := range []string{"data[id]", "data[web_id]"} {
+		if id := request.PostForm.Get(field); id != "" {
+			event.MailingListIds = append(event.MailingListIds, id)
+		}
+	}
+
+	return event, nil
+}
+
+type constantContactWebhookEvent struct {
+	EventType    string   `json:"event_type"`
+	ContactId    string   `json:"contact_id"`
+	EmailAddress string   `json:"email_address"`
+	ListIds      []string `json:"list_ids"`
+}
+
+//Constant Contact posts json, either a single event or an array of them
+//contact.unsubscribed (or contact.deleted) means gone, contact.subscribed only counts if it's for CONSTANT_CONTACT_LIST_ID
+func ParseConstantContactWebhook(rData *pages.RequestData) ([]*MailingListEvent, error) {
+	if err := ValidateMailingListWebhookKey(rData); err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(rData.HttpRequest.Body, rData.SiteConfig.MAX_READ_SIZE))
+	if err != nil {
+		return nil, err
+	}
+
+	var rawEvents []*constantContactWebhookEvent
+	if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+		err = json.Unmarshal(body, &rawEvents)
+	} else {
+		var rawEvent constantContactWebhookEvent
+		err = json.Unmarshal(body, &rawEvent)
+		rawEvents = append(rawEvents, &rawEvent)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var events []*MailingListEvent
+
+	for _, rawEvent := range rawEvents {
+		event := &MailingListEvent{
+			Provider: "constantcontact",
+			Email:    strings.TrimSpace(rawEvent.EmailAddress),
+			Reason:   rawEvent.EventType,
+		}
+
+		switch rawEvent.EventType {
+		case "contact.unsubscribed", "contact.deleted":
+			event.Type = MAILINGLIST_EVENT_UNSUBSCRIBE
+		case "contact.subscribed":
+			//no list ids means it's about the contact as a whole
+			if len(rawEvent.ListIds) > 0 && !slice.StringInSlice(rData.SiteConfig.CONSTANT_CONTACT_LIST_ID, rawEvent.ListIds) {
+				continue
+			}
+			event.Type = MAILINGLIST_EVENT_SUBSCRIBE
+		default:
+			continue
+		}
+
+		if rawEvent.ContactId != "" {
+			event.MailingListIds = []string{rawEvent.ContactId}
+		}
+
+		if event.Email == "" && len(event.MailingListIds) == 0 {
+			continue
+		}
+
+		events = append(events, event)
+	}
+
+	return events, nil
+}
@@ -0,0 +1,44 @@
+package email
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/setup/config/custom"
+)
+
+func TestValidateMailingListWebhookKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured string
+		url        string
+		valid      bool
+	}{
+		{"matching key", "secret", "/webhooks/mailinglist?key=secret", true},
+		{"matching key with other params", "secret", "/webhooks/mailinglist?provider=mailchimp&key=secret", true},
+		{"escaped key", "s3cr3t&+", "/webhooks/mailinglist?key=s3cr3t%26%2B", true},
+		{"wrong key", "secret", "/webhooks/mailinglist?key=secreT", false},
+		{"prefix of the key", "secret", "/webhooks/mailinglist?key=secre", false},
+		{"key with a suffix", "secret", "/webhooks/mailinglist?key=secrets", false},
+		{"no key sent", "secret", "/webhooks/mailinglist", false},
+		{"empty key sent", "secret", "/webhooks/mailinglist?key=", false},
+		{"no key configured", "", "/webhooks/mailinglist?key=", false},
+		{"no key configured or sent", "", "/webhooks/mailinglist", false},
+	}
+
+	for _, test := range tests {
+		rData := &pages.RequestData{
+			HttpRequest: httptest.NewRequest("POST", test.url, nil),
+			SiteConfig:  &custom.Config{MAILINGLIST_WEBHOOK_KEY: test.configured},
+		}
+
+		err := ValidateMailingListWebhookKey(rData)
+		if test.valid && err != nil {
+			t.Errorf("%s: expected it to be accepted, got %v", test.name, err)
+		}
+		if !test.valid && err != ErrInvalidWebhookKey {
+			t.Errorf("%s: expected ErrInvalidWebhookKey, got %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package email
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/lib/utils/cipher"
+	"github.com/dakom/basic-site-api/lib/utils/slice"
+	"github.com/dakom/basic-site-api/setup/config/static/pagenames"
+)
+
+var ErrNoUnsubscribeKey = errors.New("MAILINGLIST_UNSUBSCRIBE_KEY is not set")
+
+func GetMailingListUserInterests(rData *pages.RequestData) []string {
+	if len(rData.SiteConfig.MAILINGLIST_USER_INTERESTS) > 0 {
+		return rData.SiteConfig.MAILINGLIST_USER_INTERESTS
+	}
+	return []string{MAILINGLIST_INTEREST_MARKETING}
+}
+
+func IsMailingListUserInterest(rData *pages.RequestData, name string) bool {
+	return slice.StringInSlice(name, GetMailingListUserInterests(rData))
+}
+
+func HasMailingListInterest(userRecord *datastore.UserRecord, name string) bool {
+	if name == MAILINGLIST_INTEREST_MARKETING {
+		return userRecord.GetData().UserMailinglistData.HasMarketingNewsletter
+	}
+	return slice.StringInSlice(name, userRecord.GetData().UserMailinglistData.Interests)
+}
+
+//Only changes the data, caller must save
+func SetMailingListInterest(userRecord *datastore.UserRecord, name string, isSet bool) {
+	prefs := &userRecord.GetData().UserMailinglistData
+
+	if name == MAILINGLIST_INTEREST_MARKETING {
+		prefs.HasMarketingNewsletter = isSet
+		return
+	}
+
+	prefs.Interests, _ = slice.DeleteFromString(prefs.Interests, name)
+	if isSet {
+		prefs.Interests = append(prefs.Interests, name)
+	}
+}
+
+/* Unsubscribe links
+ * The token is just the user id and its hmac, so links keep working for as long as the key doesn't change
+ * and nothing needs to be stored per email
+ */
+
+func GetMailingListUnsubscribeToken(rData *pages.RequestData, userId int64) (string, error) {
+	if rData.SiteConfig.MAILINGLIST_UNSUBSCRIBE_KEY == "" {
+		return "", ErrNoUnsubscribeKey
+	}
+
+	idString := strconv.FormatInt(userId, 10)
+	sig := cipher.CreateHmac([]byte("unsubscribe-"+idString), []byte(rData.SiteConfig.MAILINGLIST_UNSUBSCRIBE_KEY))
+
+	return idString + "-" + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+//ok is false for anything which wasn't made by GetMailingListUnsubscribeToken with the current key
+func ValidateMailingListUnsubscribeToken(rData *pages.RequestData, token string) (int64, bool) {
+	if rData.SiteConfig.MAILINGLIST_UNSUBSCRIBE_KEY == "" {
+		return 0, false
+	}
+
+	parts := strings.SplitN(token, "-", 2)
+	if len(parts) != 2 {
+		return 0, false
+	}
+
+	userId, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return 0, false
+	}
+
+	if !cipher.ValidateHmac(sig, []byte("unsubscribe-"+parts[0]), []byte(rData.SiteConfig.MAILINGLIST_UNSUBSCRIBE_KEY)) {
+		return 0, false
+	}
+
+	return userId, true
+}
+
+//For the List-Unsubscribe header of list mail a site sends itself (with Message.SetListUnsubscribe - the provider adds its own to what it sends)
+//the token is in the path, since one-click mail clients POST to it with nothing but "List-Unsubscribe=One-Click" in the body (RFC 8058)
+//none of the site's own mails get this, they're all account mail which unsubscribing from the list wouldn't stop
+func GetMailingListUnsubscribeHeaderUrl(rData *pages.RequestData, userId int64) (string, error) {
+	token, err := GetMailingListUnsubscribeToken(rData, userId)
+	if err != nil {
+		return "", err
+	}
+
+	return rData.SiteConfig.API_HOSTNAME + pagenames.MAILINGLIST_UNSUBSCRIBE_SERVICE + "/" + token, nil
+}
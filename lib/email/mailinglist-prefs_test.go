@@ -0,0 +1,79 @@
+package email
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/setup/config/custom"
+)
+
+func TestMailingListUnsubscribeToken(t *testing.T) {
+	rData := &pages.RequestData{SiteConfig: &custom.Config{MAILINGLIST_UNSUBSCRIBE_KEY: "secret"}}
+	otherKey := &pages.RequestData{SiteConfig: &custom.Config{MAILINGLIST_UNSUBSCRIBE_KEY: "other"}}
+	noKey := &pages.RequestData{SiteConfig: &custom.Config{}}
+
+	token, err := GetMailingListUnsubscribeToken(rData, 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherToken, err := GetMailingListUnsubscribeToken(rData, 1235)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GetMailingListUnsubscribeToken(noKey, 1234); err != ErrNoUnsubscribeKey {
+		t.Errorf("expected ErrNoUnsubscribeKey, got %v", err)
+	}
+
+	sig := token[strings.Index(token, "-")+1:]
+	otherSig := otherToken[strings.Index(otherToken, "-")+1:]
+
+	tests := []struct {
+		name   string
+		rData  *pages.RequestData
+		token  string
+		userId int64
+		ok     bool
+	}{
+		{"round trip", rData, token, 1234, true},
+		{"other user", rData, otherToken, 1235, true},
+		{"different key", otherKey, token, 0, false},
+		{"no key", noKey, token, 0, false},
+		{"swapped user id", rData, "1235-" + sig, 0, false},
+		{"swapped signature", rData, "1234-" + otherSig, 0, false},
+		{"negative user id", rData, "-1234-" + sig, 0, false},
+		{"truncated signature", rData, token[:len(token)-2], 0, false},
+		{"signature not base64", rData, "1234-" + sig[:len(sig)-1] + "!", 0, false},
+		{"no signature", rData, "1234", 0, false},
+		{"empty signature", rData, "1234-", 0, false},
+		{"user id not a number", rData, "abc-" + sig, 0, false},
+		{"empty", rData, "", 0, false},
+	}
+
+	for _, test := range tests {
+		userId, ok := ValidateMailingListUnsubscribeToken(test.rData, test.token)
+		if ok != test.ok || userId != test.userId {
+			t.Errorf("%s: expected %d %v, got %d %v", test.name, test.userId, test.ok, userId, ok)
+		}
+	}
+}
+
+func TestGetMailingListUnsubscribeHeaderUrl(t *testing.T) {
+	rData := &pages.RequestData{SiteConfig: &custom.Config{API_HOSTNAME: "https://api.example.com/", MAILINGLIST_UNSUBSCRIBE_KEY: "secret"}}
+
+	unsubscribeUrl, err := GetMailingListUnsubscribeHeaderUrl(rData, 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//no query, one-click clients only POST "List-Unsubscribe=One-Click" to it
+	prefix := "https://api.example.com/account/mailinglist-unsubscribe/"
+	if !strings.HasPrefix(unsubscribeUrl, prefix) || strings.Contains(unsubscribeUrl, "?") {
+		t.Fatalf("unexpected url %s", unsubscribeUrl)
+	}
+
+	if userId, ok := ValidateMailingListUnsubscribeToken(rData, unsubscribeUrl[len(prefix):]); !ok || userId != 1234 {
+		t.Errorf("the token in %s didn't validate: %d %v", unsubscribeUrl, userId, ok)
+	}
+}
@@ -0,0 +1,375 @@
+package email
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	gaeds "google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/taskqueue"
+
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/setup/config/custom"
+	"github.com/dakom/basic-site-api/setup/config/static/pagenames"
+)
+
+const MAILINGLIST_RESYNC_BATCH_SIZE = 100
+const MAILINGLIST_RESYNC_MAX_CHANGES = 500
+
+//what a resync found (and fixed, unless it's a dry run)
+const (
+	MAILINGLIST_CHANGE_SUBSCRIBE         string = "subscribe"         //should be on the list but the provider doesn't know them
+	MAILINGLIST_CHANGE_UNSUBSCRIBE       string = "unsubscribe"       //on the list but shouldn't be (opted out, suspended...)
+	MAILINGLIST_CHANGE_CULL              string = "cull"              //unsubscribed because they never activated, recorded as Culled so it can be undone
+	MAILINGLIST_CHANGE_RESUBSCRIBE       string = "resubscribe"       //culled earlier and wanted again, i.e. activated since
+	MAILINGLIST_CHANGE_UNSUBSCRIBE_LOCAL string = "unsubscribe-local" //left on the provider's side and we missed it - never undone by subscribing them again
+	MAILINGLIST_CHANGE_UPDATE_EMAIL      string = "update-email"
+	MAILINGLIST_CHANGE_UPDATE_NAME       string = "update-name"
+	MAILINGLIST_CHANGE_SET_INTERESTS     string = "set-interests"
+	MAILINGLIST_CHANGE_RELINK            string = "relink" //the provider knows them under another id
+)
+
+var ErrNoMailingListLookup = errors.New("the mailing list provider can't look up contacts, so there's nothing to compare against")
+var ErrEmailSuspended = errors.New("SUSPEND_EMAIL is set, only dry runs are possible")
+
+type MailingListResyncOptions struct {
+	DryRun      bool
+	ActiveOnly  bool      //skip users who never activated
+	CullPending bool      //take users who never activated off the list (only makes sense without ActiveOnly)
+	AddedAfter  time.Time //optional
+}
+
+//Creates the job record (which is also the report) and queues its first batch
+func StartMailingListResync(rData *pages.RequestData, options *MailingListResyncOptions) (*datastore.MailingListResyncRecord, error) {
+	var record datastore.MailingListResyncRecord
+
+	if _, ok := GetMailingListProvider(rData).(custom.MailingListLookup); !ok {
+		return nil, ErrNoMailingListLookup
+	}
+
+	if !options.DryRun && rData.SiteConfig.SUSPEND_EMAIL {
+		return nil, ErrEmailSuspended
+	}
+
+	now := time.Now()
+	record.SetData(&datastore.MailingListResyncData{
+		Status:      datastore.MAILINGLIST_RESYNC_RUNNING,
+		DryRun:      options.DryRun,
+		ActiveOnly:  options.ActiveOnly,
+		CullPending: options.CullPending,
+		AddedAfter:  options.AddedAfter,
+		Date:        now,
+		UpdatedDate: now,
+	})
+
+	err := gaeds.RunInTransaction(rData.Ctx, func(c context.Context) error {
+		if err := datastore.SaveToAutoKey(c, &record); err != nil {
+			return err
+		}
+		return queueMailingListResyncBatch(c, rData, record.GetKey().IntID(), "")
+	}, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+//Called from the task queue, one batch per task, each queueing the next one
+//A retried task whose batch was already counted does nothing, though the provider may see the same fixes twice (which is harmless)
+func RunMailingListResyncBatch(rData *pages.RequestData) error {
+	var record datastore.MailingListResyncRecord
+
+	jobId, err := strconv.ParseInt(rData.HttpRequest.FormValue("job"), 10, 64)
+	if err != nil {
+		rData.LogError("mailing list resync task without a job")
+		return nil
+	}
+	cursor := rData.HttpRequest.FormValue("cursor")
+
+	if err := datastore.LoadFromKey(rData.Ctx, &record, jobId); err != nil {
+		return err
+	}
+	if record.GetData().Status != datastore.MAILINGLIST_RESYNC_RUNNING || record.GetData().NextCursor != cursor {
+		return nil
+	}
+
+	options := &MailingListResyncOptions{
+		DryRun:      record.GetData().DryRun,
+		ActiveOnly:  record.GetData().ActiveOnly,
+		CullPending: record.GetData().CullPending,
+		AddedAfter:  record.GetData().AddedAfter,
+	}
+
+	provider := GetMailingListProvider(rData)
+	lookup, ok := provider.(custom.MailingListLookup)
+	if !ok {
+		return finishMailingListResync(rData, jobId, cursor, datastore.MAILINGLIST_RESYNC_FAILED, ErrNoMailingListLookup.Error())
+	}
+
+	userRecords, nextCursor, err := datastore.QueryUserRecords(rData.Ctx, options.ActiveOnly, options.AddedAfter, cursor, MAILINGLIST_RESYNC_BATCH_SIZE)
+	if err != nil {
+		//e.g. a missing index, which retrying won't fix
+		return finishMailingListResync(rData, jobId, cursor, datastore.MAILINGLIST_RESYNC_FAILED, err.Error())
+	}
+
+	batch := datastore.MailingListResyncData{}
+	for _, userRecord := range userRecords {
+		changes, err := resyncMailingListUser(rData, provider, lookup, options, userRecord)
+
+		batch.Checked++
+		if err != nil {
+			batch.Failed++
+			batch.LastError = strconv.FormatInt(userRecord.GetKey().IntID(), 10) + ": " + err.Error()
+			continue
+		}
+		if len(changes) == 0 {
+			batch.InSync++
+			continue
+		}
+
+		batch.Drifted++
+		batch.Changes = append(batch.Changes, strconv.FormatInt(userRecord.GetKey().IntID(), 10)+": "+strings.Join(changes, ","))
+	}
+
+	return gaeds.RunInTransaction(rData.Ctx, func(c context.Context) error {
+		if err := datastore.LoadFromKey(c, &record, jobId); err != nil {
+			return err
+		}
+
+		data := record.GetData()
+		if data.Status != datastore.MAILINGLIST_RESYNC_RUNNING || data.NextCursor != cursor {
+			return nil
+		}
+
+		data.Checked += batch.Checked
+		data.InSync += batch.InSync
+		data.Drifted += batch.Drifted
+		data.Failed += batch.Failed
+		if batch.LastError != "" {
+			data.LastError = batch.LastError
+		}
+		for _, change := range batch.Changes {
+			if len(data.Changes) < MAILINGLIST_RESYNC_MAX_CHANGES {
+				data.Changes = append(data.Changes, change)
+			}
+		}
+
+		data.NextCursor = nextCursor
+		data.UpdatedDate = time.Now()
+
+		if nextCursor == "" {
+			data.Status = datastore.MAILINGLIST_RESYNC_DONE
+		} else if err := queueMailingListResyncBatch(c, rData, jobId, nextCursor); err != nil {
+			return err
+		}
+
+		return datastore.Save(c, &record)
+	}, nil)
+}
+
+func finishMailingListResync(rData *pages.RequestData, jobId int64, cursor string, status string, lastError string) error {
+	var record datastore.MailingListResyncRecord
+
+	return gaeds.RunInTransaction(rData.Ctx, func(c context.Context) error {
+		if err := datastore.LoadFromKey(c, &record, jobId); err != nil {
+			return err
+		}
+		if record.GetData().NextCursor != cursor {
+			return nil
+		}
+
+		record.GetData().Status = status
+		record.GetData().LastError = lastError
+		record.GetData().UpdatedDate = time.Now()
+
+		return datastore.Save(c, &record)
+	}, nil)
+}
+
+//must be called within the transaction that moves the cursor along, so each batch is queued exactly once
+func queueMailingListResyncBatch(c context.Context, rData *pages.RequestData, jobId int64, cursor string) error {
+	params := url.Values{}
+	params.Set("job", strconv.FormatInt(jobId, 10))
+	params.Set("cursor", cursor)
+
+	resyncTask := taskqueue.NewPOSTTask("/"+pagenames.MAILINGLIST_RESYNC_WEBHOOK, params)
+	_, err := taskqueue.Add(c, resyncTask, rData.SiteConfig.TASKQUEUE_MAILINGLIST)
+
+	return err
+}
+
+func wantsMailingList(userRecord *datastore.UserRecord, options *MailingListResyncOptions) bool {
+	if userRecord.GetData().UserMailinglistData.Unsubscribed || userRecord.GetData().Email == "" {
+		return false
+	}
+
+	switch userRecord.GetStatus() {
+	case datastore.USER_STATUS_ACTIVE:
+		return true
+	case datastore.USER_STATUS_PENDING:
+		//once culled, they only come back by activating
+		return !options.CullPending && !userRecord.GetData().UserMailinglistData.Culled
+	}
+
+	return false
+}
+
+//Returns what was out of sync, which has been fixed by the time it returns unless it's a dry run
+func resyncMailingListUser(rData *pages.RequestData, provider custom.MailingListProvider, lookup custom.MailingListLookup, options *MailingListResyncOptions, userRecord *datastore.UserRecord) ([]string, error) {
+	contact := GetMailingListContact(rData, userRecord)
+
+	state, err := lookup.Lookup(rData.Ctx, contact)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := getMailingListResyncChanges(userRecord, options, contact, state)
+	if options.DryRun || len(changes) == 0 {
+		return changes, nil
+	}
+
+	before := userRecord.GetData().UserMailinglistData
+	needsSave, err := applyMailingListResyncChanges(rData.Ctx, provider, userRecord, contact, state, changes)
+
+	//whatever did get done is saved, even if a later change failed
+	if needsSave {
+		if saveErr := saveMailingListResyncData(rData.Ctx, userRecord.GetKey().IntID(), before, userRecord.GetData().UserMailinglistData); saveErr != nil && err == nil {
+			err = saveErr
+		}
+	}
+
+	return changes, err
+}
+
+//The batch was loaded up to a batch's worth of provider calls ago, and the user may have changed anything since (password, email, their subscription...)
+//so only what the resync changed goes onto a freshly loaded record
+func saveMailingListResyncData(c context.Context, userId int64, before datastore.UserMailinglistData, after datastore.UserMailinglistData) error {
+	return gaeds.RunInTransaction(c, func(c context.Context) error {
+		//loading appends to slices, so it has to start from scratch on every attempt
+		freshRecord := &datastore.UserRecord{}
+		if err := datastore.LoadFromKey(c, freshRecord, userId); err != nil {
+			return err
+		}
+
+		mergeMailingListResyncData(&freshRecord.GetData().UserMailinglistData, before, after)
+
+		return datastore.Save(c, freshRecord)
+	}, nil)
+}
+
+//the fields applyMailingListResyncChanges may change, where it did
+func mergeMailingListResyncData(fresh *datastore.UserMailinglistData, before datastore.UserMailinglistData, after datastore.UserMailinglistData) {
+	if after.EmailId != before.EmailId {
+		fresh.EmailId = after.EmailId
+	}
+	if after.Unsubscribed != before.Unsubscribed {
+		fresh.Unsubscribed = after.Unsubscribed
+		fresh.UnsubscribedDate = after.UnsubscribedDate
+	}
+	if after.Culled != before.Culled {
+		fresh.Culled = after.Culled
+		fresh.CulledDate = after.CulledDate
+	}
+}
+
+//What's out of sync between the user and the provider's state for them (nil if the provider doesn't know them)
+//Only people who were active can opt out on the provider's side as far as we're concerned -
+//the ones we culled are unsubscribed there because of us, and pending ones may have been culled before Culled was recorded
+func getMailingListResyncChanges(userRecord *datastore.UserRecord, options *MailingListResyncOptions, contact *custom.MailingListContact, state *custom.MailingListContactState) []string {
+	var changes []string
+
+	mailingListData := userRecord.GetData().UserMailinglistData
+
+	if state != nil && state.ProviderId != "" && state.ProviderId != contact.ProviderId {
+		changes = append(changes, MAILINGLIST_CHANGE_RELINK)
+	}
+
+	if wantsMailingList(userRecord, options) {
+		if state == nil {
+			changes = append(changes, MAILINGLIST_CHANGE_SUBSCRIBE)
+		} else if !state.Subscribed {
+			if mailingListData.Culled {
+				changes = append(changes, MAILINGLIST_CHANGE_RESUBSCRIBE)
+			} else if userRecord.IsStatusActive() {
+				changes = append(changes, MAILINGLIST_CHANGE_UNSUBSCRIBE_LOCAL)
+			}
+		} else {
+			if !strings.EqualFold(state.Email, contact.Email) {
+				changes = append(changes, MAILINGLIST_CHANGE_UPDATE_EMAIL)
+			}
+			if state.FirstName != contact.FirstName || state.LastName != contact.LastName {
+				changes = append(changes, MAILINGLIST_CHANGE_UPDATE_NAME)
+			}
+			for name, isSet := range contact.Interests {
+				if remoteIsSet, known := state.Interests[name]; known && remoteIsSet != isSet {
+					changes = append(changes, MAILINGLIST_CHANGE_SET_INTERESTS)
+					break
+				}
+			}
+		}
+	} else if state != nil && state.Subscribed {
+		if options.CullPending && userRecord.IsStatusPending() && !mailingListData.Unsubscribed && userRecord.GetData().Email != "" {
+			changes = append(changes, MAILINGLIST_CHANGE_CULL)
+		} else {
+			changes = append(changes, MAILINGLIST_CHANGE_UNSUBSCRIBE)
+		}
+	}
+
+	return changes
+}
+
+//Makes the changes on the provider's side and on the user record, returns whether the record needs saving
+//stops at the first error, but still reports what was changed up to then
+func applyMailingListResyncChanges(c context.Context, provider custom.MailingListProvider, userRecord *datastore.UserRecord, contact *custom.MailingListContact, state *custom.MailingListContactState, changes []string) (bool, error) {
+	mailingListData := &userRecord.GetData().UserMailinglistData
+	originalId := mailingListData.EmailId
+	needsSave := false
+
+	for _, change := range changes {
+		var err error
+
+		switch change {
+		case MAILINGLIST_CHANGE_RELINK:
+			contact.ProviderId = state.ProviderId
+		case MAILINGLIST_CHANGE_UNSUBSCRIBE_LOCAL:
+			mailingListData.Unsubscribed = true
+			mailingListData.UnsubscribedDate = time.Now()
+			needsSave = true
+		case MAILINGLIST_CHANGE_CULL:
+			if err = provider.Unsubscribe(c, contact); err == nil {
+				mailingListData.Culled = true
+				mailingListData.CulledDate = time.Now()
+				needsSave = true
+			}
+		case MAILINGLIST_CHANGE_SUBSCRIBE, MAILINGLIST_CHANGE_RESUBSCRIBE:
+			if err = provider.Subscribe(c, contact); err == nil && mailingListData.Culled {
+				mailingListData.Culled = false
+				needsSave = true
+			}
+		case MAILINGLIST_CHANGE_UNSUBSCRIBE:
+			err = provider.Unsubscribe(c, contact)
+		case MAILINGLIST_CHANGE_UPDATE_EMAIL:
+			err = provider.UpdateEmail(c, contact)
+		case MAILINGLIST_CHANGE_UPDATE_NAME:
+			err = provider.UpdateName(c, contact)
+		case MAILINGLIST_CHANGE_SET_INTERESTS:
+			err = provider.SetInterests(c, contact)
+		}
+
+		//relinked, or changed by the provider
+		mailingListData.EmailId = contact.ProviderId
+
+		if err != nil {
+			return needsSave || mailingListData.EmailId != originalId, err
+		}
+	}
+
+	return needsSave || mailingListData.EmailId != originalId, nil
+}
@@ -0,0 +1,194 @@
+package email
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/setup/config/custom"
+)
+
+//resyncMailingListUser without the datastore - returns the changes and whether the record would have been saved
+func resyncTestUser(t *testing.T, rData *pages.RequestData, provider *FakeMailingList, options *MailingListResyncOptions, userRecord *datastore.UserRecord) ([]string, bool) {
+	contact := GetMailingListContact(rData, userRecord)
+
+	state, err := provider.Lookup(rData.Ctx, contact)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := getMailingListResyncChanges(userRecord, options, contact, state)
+
+	needsSave, err := applyMailingListResyncChanges(rData.Ctx, provider, userRecord, contact, state, changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return changes, needsSave
+}
+
+func newResyncTestUser(t *testing.T, rData *pages.RequestData, provider *FakeMailingList, status string) *datastore.UserRecord {
+	userRecord := &datastore.UserRecord{}
+	userRecord.GetData().Email = "someone@example.com"
+	userRecord.GetData().FirstName = "Some"
+	userRecord.GetData().LastName = "One"
+	userRecord.SetStatus(status, "")
+
+	//subscribed at registration, like MailingListSubscribe does
+	contact := GetMailingListContact(rData, userRecord)
+	if err := provider.Subscribe(rData.Ctx, contact); err != nil {
+		t.Fatal(err)
+	}
+	userRecord.GetData().UserMailinglistData.EmailId = contact.ProviderId
+
+	return userRecord
+}
+
+func isSubscribed(t *testing.T, provider *FakeMailingList) bool {
+	entry := provider.GetByEmail("someone@example.com")
+	if entry == nil {
+		t.Fatal("contact is gone from the provider")
+	}
+	return entry.Subscribed
+}
+
+func TestMailingListResyncCullThenActivate(t *testing.T) {
+	rData := &pages.RequestData{Ctx: context.Background(), SiteConfig: &custom.Config{}}
+	provider := NewFakeMailingList()
+	userRecord := newResyncTestUser(t, rData, provider, datastore.USER_STATUS_PENDING)
+
+	cull := &MailingListResyncOptions{CullPending: true}
+	normal := &MailingListResyncOptions{}
+
+	steps := []struct {
+		name       string
+		options    *MailingListResyncOptions
+		activate   bool
+		changes    []string
+		subscribed bool
+		culled     bool
+	}{
+		{"cull run", cull, false, []string{MAILINGLIST_CHANGE_CULL}, false, true},
+		{"cull run again", cull, false, nil, false, true},
+		{"normal run while still pending", normal, false, nil, false, true},
+		{"normal run after activating", normal, true, []string{MAILINGLIST_CHANGE_RESUBSCRIBE}, true, false},
+		{"normal run in sync", normal, false, nil, true, false},
+		{"cull run only culls pending users", cull, false, nil, true, false},
+	}
+
+	for _, step := range steps {
+		if step.activate {
+			userRecord.SetStatus(datastore.USER_STATUS_ACTIVE, "")
+		}
+
+		changes, needsSave := resyncTestUser(t, rData, provider, step.options, userRecord)
+		mailingListData := userRecord.GetData().UserMailinglistData
+
+		if !reflect.DeepEqual(changes, step.changes) {
+			t.Errorf("%s: expected changes %v, got %v", step.name, step.changes, changes)
+		}
+		if isSubscribed(t, provider) != step.subscribed {
+			t.Errorf("%s: expected subscribed to be %v on the provider's side", step.name, step.subscribed)
+		}
+		if mailingListData.Culled != step.culled {
+			t.Errorf("%s: expected Culled to be %v", step.name, step.culled)
+		}
+		if mailingListData.Unsubscribed {
+			t.Fatalf("%s: was turned into a local opt-out", step.name)
+		}
+		if needsSave != (len(step.changes) > 0) {
+			t.Errorf("%s: expected needsSave to be %v", step.name, len(step.changes) > 0)
+		}
+	}
+}
+
+func TestMailingListResyncProviderUnsubscribe(t *testing.T) {
+	rData := &pages.RequestData{Ctx: context.Background(), SiteConfig: &custom.Config{}}
+
+	tests := []struct {
+		name         string
+		status       string
+		culled       bool
+		changes      []string
+		unsubscribed bool
+	}{
+		{"active user left on the provider's side", datastore.USER_STATUS_ACTIVE, false, []string{MAILINGLIST_CHANGE_UNSUBSCRIBE_LOCAL}, true},
+		{"pending user is left alone", datastore.USER_STATUS_PENDING, false, nil, false},
+		{"culled pending user is left alone", datastore.USER_STATUS_PENDING, true, nil, false},
+		{"culled user who activated is resubscribed", datastore.USER_STATUS_ACTIVE, true, []string{MAILINGLIST_CHANGE_RESUBSCRIBE}, false},
+	}
+
+	for _, test := range tests {
+		provider := NewFakeMailingList()
+		userRecord := newResyncTestUser(t, rData, provider, test.status)
+		userRecord.GetData().UserMailinglistData.Culled = test.culled
+
+		if err := provider.Unsubscribe(rData.Ctx, GetMailingListContact(rData, userRecord)); err != nil {
+			t.Fatal(err)
+		}
+
+		changes, _ := resyncTestUser(t, rData, provider, &MailingListResyncOptions{}, userRecord)
+
+		if !reflect.DeepEqual(changes, test.changes) {
+			t.Errorf("%s: expected changes %v, got %v", test.name, test.changes, changes)
+		}
+		if userRecord.GetData().UserMailinglistData.Unsubscribed != test.unsubscribed {
+			t.Errorf("%s: expected Unsubscribed to be %v", test.name, test.unsubscribed)
+		}
+	}
+}
+
+func TestMergeMailingListResyncData(t *testing.T) {
+	rData := &pages.RequestData{Ctx: context.Background(), SiteConfig: &custom.Config{}}
+	provider := NewFakeMailingList()
+
+	//as the batch loaded it
+	userRecord := newResyncTestUser(t, rData, provider, datastore.USER_STATUS_PENDING)
+	before := userRecord.GetData().UserMailinglistData
+
+	changes, _ := resyncTestUser(t, rData, provider, &MailingListResyncOptions{CullPending: true}, userRecord)
+	if !reflect.DeepEqual(changes, []string{MAILINGLIST_CHANGE_CULL}) {
+		t.Fatalf("expected a cull, got %v", changes)
+	}
+
+	//meanwhile they picked their interests and moved to another list id
+	fresh := before
+	fresh.ListEmailId = "other-list-id"
+	fresh.HasMarketingNewsletter = true
+	fresh.Interests = []string{"Events"}
+
+	mergeMailingListResyncData(&fresh, before, userRecord.GetData().UserMailinglistData)
+
+	if !fresh.Culled || fresh.CulledDate.IsZero() {
+		t.Errorf("the cull wasn't merged: %#v", fresh)
+	}
+	if fresh.ListEmailId != "other-list-id" || !fresh.HasMarketingNewsletter || !reflect.DeepEqual(fresh.Interests, []string{"Events"}) {
+		t.Errorf("the user's own changes were reverted: %#v", fresh)
+	}
+
+	//and an opt-out made meanwhile isn't undone by a resync which didn't touch it
+	fresh = before
+	fresh.Unsubscribed = true
+	mergeMailingListResyncData(&fresh, before, userRecord.GetData().UserMailinglistData)
+	if !fresh.Unsubscribed {
+		t.Errorf("the user's opt-out was reverted")
+	}
+
+	//nor is a new EmailId they got meanwhile, unless the resync relinked them
+	fresh = before
+	fresh.EmailId = "newer-id"
+	mergeMailingListResyncData(&fresh, before, userRecord.GetData().UserMailinglistData)
+	if fresh.EmailId != "newer-id" {
+		t.Errorf("expected the newer EmailId to stay, got %q", fresh.EmailId)
+	}
+
+	relinked := before
+	relinked.EmailId = "relinked-id"
+	mergeMailingListResyncData(&fresh, before, relinked)
+	if fresh.EmailId != "relinked-id" {
+		t.Errorf("expected the relinked EmailId, got %q", fresh.EmailId)
+	}
+}
@@ -0,0 +1,279 @@
+package email
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/dakom/basic-site-api/lib/datastore"
+	"github.com/dakom/basic-site-api/lib/pages"
+	"github.com/dakom/basic-site-api/setup/config/custom"
+)
+
+//interest names, mapped to provider ids via MAILCHIMP_INTERESTS / CONSTANT_CONTACT_INTEREST_LISTS
+const MAILINGLIST_INTEREST_REGISTRATION = "ViaRegistration"
+const MAILINGLIST_INTEREST_MARKETING = "Marketing"
+
+func GetMailingListProvider(rData *pages.RequestData) custom.MailingListProvider {
+	if rData.SiteConfig.MailingListProvider != nil {
+		return rData.SiteConfig.MailingListProvider
+	}
+
+	switch rData.SiteConfig.MAILINGLIST_TYPE {
+	case "MAILCHIMP":
+		return &MailchimpProvider{
+			ApiKey:      rData.SiteConfig.MAILCHIMP_APIKEY,
+			ApiEndpoint: rData.SiteConfig.MAILCHIMP_APIENDPOINT,
+			ListId:      rData.SiteConfig.MAILCHIMP_LIST_ID,
+			Interests:   rData.SiteConfig.MAILCHIMP_INTERESTS,
+		}
+	case "CONSTANTCONTACT":
+		return &ConstantContactProvider{
+			ApiEndpoint:   rData.SiteConfig.CONSTANT_CONTACT_API_ENDPOINT,
+			ApiKey:        rData.SiteConfig.CONSTANT_CONTACT_KEY,
+			Token:         rData.SiteConfig.CONSTANT_CONTACT_TOKEN,
+			ListId:        rData.SiteConfig.CONSTANT_CONTACT_LIST_ID,
+			InterestLists: rData.SiteConfig.CONSTANT_CONTACT_INTEREST_LISTS,
+		}
+	}
+
+	return &NoopMailingList{}
+}
+
+func GetMailingListContact(rData *pages.RequestData, userRecord *datastore.UserRecord) *custom.MailingListContact {
+	interests := map[string]bool{
+		MAILINGLIST_INTEREST_REGISTRATION: true,
+	}
+	for _, name := range GetMailingListUserInterests(rData) {
+		interests[name] = HasMailingListInterest(userRecord, name)
+	}
+
+	return &custom.MailingListContact{
+		ProviderId: userRecord.GetData().UserMailinglistData.EmailId,
+		Email:      userRecord.GetData().Email,
+		FirstName:  userRecord.GetData().FirstName,
+		LastName:   userRecord.GetData().LastName,
+		Interests:  interests,
+	}
+}
+
+func MailingListSubscribe(rData *pages.RequestData, userRecord *datastore.UserRecord) error {
+	if rData.SiteConfig.SUSPEND_EMAIL == true {
+		return nil
+	}
+
+	//opted out before the subscribe task ran
+	if userRecord.GetData().UserMailinglistData.Unsubscribed {
+		return nil
+	}
+
+	return callMailingListProvider(rData, userRecord, GetMailingListProvider(rData).Subscribe)
+}
+
+func MailingListUpdate(rData *pages.RequestData, userRecord *datastore.UserRecord, updateType string) error {
+	//update in search db, errors aren't critical but should be investigated by backend
+	if err := userRecord.AddToSearch(rData.Ctx); err != nil {
+		rData.LogError("%v", err)
+	}
+
+	if rData.SiteConfig.SUSPEND_EMAIL == true {
+		return nil
+	}
+
+	provider := GetMailingListProvider(rData)
+
+	//whoever left (here or on the provider's side) stays off the list until they subscribe again, which sends the current details anyway
+	if userRecord.GetData().UserMailinglistData.Unsubscribed && (updateType == "email" || updateType == "name") {
+		return nil
+	}
+
+	switch updateType {
+	case "email":
+		return callMailingListProvider(rData, userRecord, provider.UpdateEmail)
+	case "name":
+		return callMailingListProvider(rData, userRecord, provider.UpdateName)
+	case "subscription":
+		//subscribing again also brings the interests up to date
+		if userRecord.GetData().UserMailinglistData.Unsubscribed {
+			return callMailingListProvider(rData, userRecord, provider.Unsubscribe)
+		}
+		return callMailingListProvider(rData, userRecord, provider.Subscribe)
+	case "interests":
+		return callMailingListProvider(rData, userRecord, provider.SetInterests)
+	}
+
+	return nil
+}
+
+func MailingListUnsubscribe(rData *pages.RequestData, userRecord *datastore.UserRecord) error {
+	if rData.SiteConfig.SUSPEND_EMAIL == true {
+		return nil
+	}
+
+	return callMailingListProvider(rData, userRecord, GetMailingListProvider(rData).Unsubscribe)
+}
+
+//Pushes the interests from UserMailinglistData
+func MailingListSetInterests(rData *pages.RequestData, userRecord *datastore.UserRecord) error {
+	if rData.SiteConfig.SUSPEND_EMAIL == true {
+		return nil
+	}
+
+	return callMailingListProvider(rData, userRecord, GetMailingListProvider(rData).SetInterests)
+}
+
+//saves the user if the provider changed its id for the contact
+func callMailingListProvider(rData *pages.RequestData, userRecord *datastore.UserRecord, call func(context.Context, *custom.MailingListContact) error) error {
+	contact := GetMailingListContact(rData, userRecord)
+
+	if err := call(rData.Ctx, contact); err != nil {
+		return err
+	}
+
+	if contact.ProviderId != userRecord.GetData().UserMailinglistData.EmailId {
+		userRecord.GetData().UserMailinglistData.EmailId = contact.ProviderId
+		return datastore.Save(rData.Ctx, userRecord)
+	}
+
+	return nil
+}
+
+//For sites without a mailing list
+type NoopMailingList struct{}
+
+func (provider *NoopMailingList) Subscribe(c context.Context, contact *custom.MailingListContact) error {
+	return nil
+}
+func (provider *NoopMailingList) UpdateEmail(c context.Context, contact *custom.MailingListContact) error {
+	return nil
+}
+func (provider *NoopMailingList) UpdateName(c context.Context, contact *custom.MailingListContact) error {
+	return nil
+}
+func (provider *NoopMailingList) Unsubscribe(c context.Context, contact *custom.MailingListContact) error {
+	return nil
+}
+func (provider *NoopMailingList) SetInterests(c context.Context, contact *custom.MailingListContact) error {
+	return nil
+}
+
+//In-memory list for tests, contacts are keyed by a made up ProviderId like a real provider would
+type FakeMailingList struct {
+	lock     sync.Mutex
+	contacts map[string]*FakeMailingListEntry
+	lastId   int
+}
+
+type FakeMailingListEntry struct {
+	Contact    custom.MailingListContact
+	Subscribed bool
+}
+
+func NewFakeMailingList() *FakeMailingList {
+	return &FakeMailingList{contacts: make(map[string]*FakeMailingListEntry)}
+}
+
+func (provider *FakeMailingList) Subscribe(c context.Context, contact *custom.MailingListContact) error {
+	provider.lock.Lock()
+	defer provider.lock.Unlock()
+
+	entry := provider.contacts[contact.ProviderId]
+	if entry == nil {
+		provider.lastId++
+		contact.ProviderId = "fake-" + strconv.Itoa(provider.lastId)
+		entry = &FakeMailingListEntry{}
+		provider.contacts[contact.ProviderId] = entry
+	}
+
+	entry.Contact = copyContact(contact)
+	entry.Subscribed = true
+	return nil
+}
+
+func (provider *FakeMailingList) UpdateEmail(c context.Context, contact *custom.MailingListContact) error {
+	return provider.update(contact, func(entry *FakeMailingListEntry) {
+		entry.Contact.Email = contact.Email
+	})
+}
+
+func (provider *FakeMailingList) UpdateName(c context.Context, contact *custom.MailingListContact) error {
+	return provider.update(contact, func(entry *FakeMailingListEntry) {
+		entry.Contact.FirstName = contact.FirstName
+		entry.Contact.LastName = contact.LastName
+	})
+}
+
+//Not on the list is as unsubscribed as it gets, so unknown contacts are left alone
+func (provider *FakeMailingList) Unsubscribe(c context.Context, contact *custom.MailingListContact) error {
+	provider.lock.Lock()
+	defer provider.lock.Unlock()
+
+	if entry := provider.contacts[contact.ProviderId]; entry != nil {
+		entry.Subscribed = false
+	}
+	return nil
+}
+
+func (provider *FakeMailingList) SetInterests(c context.Context, contact *custom.MailingListContact) error {
+	return provider.update(contact, func(entry *FakeMailingListEntry) {
+		entry.Contact.Interests = copyContact(contact).Interests
+	})
+}
+
+//Unknown contacts (never subscribed, or with a ProviderId from elsewhere) are subscribed as they are
+//the way MailchimpProvider.UpdateEmail adds an address that isn't on the list - simpler than a not found error for the others
+func (provider *FakeMailingList) update(contact *custom.MailingListContact, change func(*FakeMailingListEntry)) error {
+	provider.lock.Lock()
+	entry := provider.contacts[contact.ProviderId]
+	if entry != nil {
+		change(entry)
+	}
+	provider.lock.Unlock()
+
+	if entry == nil {
+		return provider.Subscribe(nil, contact)
+	}
+	return nil
+}
+
+func (provider *FakeMailingList) Lookup(c context.Context, contact *custom.MailingListContact) (*custom.MailingListContactState, error) {
+	provider.lock.Lock()
+	defer provider.lock.Unlock()
+
+	entry := provider.contacts[contact.ProviderId]
+	if entry == nil {
+		return nil, nil
+	}
+
+	return &custom.MailingListContactState{
+		MailingListContact: copyContact(&entry.Contact),
+		Subscribed:         entry.Subscribed,
+	}, nil
+}
+
+//nil if there's no such contact
+func (provider *FakeMailingList) GetByEmail(emailAddress string) *FakeMailingListEntry {
+	provider.lock.Lock()
+	defer provider.lock.Unlock()
+
+	for _, entry := range provider.contacts {
+		if strings.EqualFold(entry.Contact.Email, emailAddress) {
+			copied := *entry
+			copied.Contact = copyContact(&entry.Contact)
+			return &copied
+		}
+	}
+
+	return nil
+}
+
+func copyContact(contact *custom.MailingListContact) custom.MailingListContact {
+	copied := *contact
+	copied.Interests = make(map[string]bool)
+	for name, val := range contact.Interests {
+		copied.Interests[name] = val
+	}
+	return copied
+}
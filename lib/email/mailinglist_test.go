@@ -0,0 +1,166 @@
+package email
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/dakom/basic-site-api/setup/config/custom"
+)
+
+func TestFakeMailingList(t *testing.T) {
+	type call func(provider *FakeMailingList, contact *custom.MailingListContact) error
+
+	subscribe := func(provider *FakeMailingList, contact *custom.MailingListContact) error {
+		return provider.Subscribe(context.Background(), contact)
+	}
+	unsubscribe := func(provider *FakeMailingList, contact *custom.MailingListContact) error {
+		return provider.Unsubscribe(context.Background(), contact)
+	}
+	updateEmail := func(email string) call {
+		return func(provider *FakeMailingList, contact *custom.MailingListContact) error {
+			contact.Email = email
+			return provider.UpdateEmail(context.Background(), contact)
+		}
+	}
+	updateName := func(firstName string, lastName string) call {
+		return func(provider *FakeMailingList, contact *custom.MailingListContact) error {
+			contact.FirstName, contact.LastName = firstName, lastName
+			return provider.UpdateName(context.Background(), contact)
+		}
+	}
+	setInterests := func(interests map[string]bool) call {
+		return func(provider *FakeMailingList, contact *custom.MailingListContact) error {
+			contact.Interests = interests
+			return provider.SetInterests(context.Background(), contact)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		calls      []call
+		known      bool //nil from Lookup otherwise
+		subscribed bool
+		email      string
+		firstName  string
+		interests  map[string]bool
+	}{
+		{
+			name:  "unsubscribe unknown contact",
+			calls: []call{unsubscribe},
+		},
+		{
+			name:       "subscribe",
+			calls:      []call{subscribe},
+			known:      true,
+			subscribed: true,
+			email:      "a@example.com",
+			firstName:  "Ann",
+			interests:  map[string]bool{},
+		},
+		{
+			name:      "subscribe then unsubscribe",
+			calls:     []call{subscribe, unsubscribe},
+			known:     true,
+			email:     "a@example.com",
+			firstName: "Ann",
+			interests: map[string]bool{},
+		},
+		{
+			name:       "unsubscribe then resubscribe",
+			calls:      []call{subscribe, unsubscribe, subscribe},
+			known:      true,
+			subscribed: true,
+			email:      "a@example.com",
+			firstName:  "Ann",
+			interests:  map[string]bool{},
+		},
+		{
+			name:       "updates keep the subscription",
+			calls:      []call{subscribe, updateEmail("b@example.com"), updateName("Bea", "B"), setInterests(map[string]bool{"Marketing": true})},
+			known:      true,
+			subscribed: true,
+			email:      "b@example.com",
+			firstName:  "Bea",
+			interests:  map[string]bool{"Marketing": true},
+		},
+		{
+			name:      "updates don't resubscribe",
+			calls:     []call{subscribe, unsubscribe, updateEmail("b@example.com")},
+			known:     true,
+			email:     "b@example.com",
+			firstName: "Ann",
+			interests: map[string]bool{},
+		},
+		{
+			name:       "update of an unknown contact subscribes it",
+			calls:      []call{updateEmail("c@example.com")},
+			known:      true,
+			subscribed: true,
+			email:      "c@example.com",
+			firstName:  "Ann",
+			interests:  map[string]bool{},
+		},
+	}
+
+	for _, test := range tests {
+		provider := NewFakeMailingList()
+		contact := &custom.MailingListContact{Email: "a@example.com", FirstName: "Ann", LastName: "A"}
+
+		for idx, call := range test.calls {
+			if err := call(provider, contact); err != nil {
+				t.Fatalf("%s: call %d failed: %v", test.name, idx, err)
+			}
+		}
+
+		state, err := provider.Lookup(context.Background(), contact)
+		if err != nil {
+			t.Fatalf("%s: lookup failed: %v", test.name, err)
+		}
+
+		if !test.known {
+			if state != nil || contact.ProviderId != "" || provider.GetByEmail(contact.Email) != nil {
+				t.Errorf("%s: expected no contact, got %#v (id %q)", test.name, state, contact.ProviderId)
+			}
+			continue
+		}
+
+		if state == nil || contact.ProviderId == "" {
+			t.Fatalf("%s: expected a contact (id %q)", test.name, contact.ProviderId)
+		}
+		if state.Subscribed != test.subscribed || state.Email != test.email || state.FirstName != test.firstName || !reflect.DeepEqual(state.Interests, test.interests) {
+			t.Errorf("%s: unexpected state %#v", test.name, state)
+		}
+
+		entry := provider.GetByEmail(test.email)
+		if entry == nil || entry.Contact.ProviderId != contact.ProviderId || entry.Subscribed != test.subscribed {
+			t.Errorf("%s: GetByEmail returned %#v", test.name, entry)
+		}
+	}
+}
+
+func TestFakeMailingListCopies(t *testing.T) {
+	provider := NewFakeMailingList()
+	contact := &custom.MailingListContact{Email: "a@example.com", Interests: map[string]bool{"Marketing": true}}
+
+	if err := provider.Subscribe(context.Background(), contact); err != nil {
+		t.Fatal(err)
+	}
+
+	contact.Interests["Marketing"] = false
+	provider.GetByEmail("a@example.com").Contact.Interests["Other"] = true
+
+	state, _ := provider.Lookup(context.Background(), contact)
+	if !reflect.DeepEqual(state.Interests, map[string]bool{"Marketing": true}) {
+		t.Errorf("stored contact was changed from outside: %v", state.Interests)
+	}
+
+	other := &custom.MailingListContact{Email: "b@example.com"}
+	if err := provider.Subscribe(context.Background(), other); err != nil {
+		t.Fatal(err)
+	}
+	if other.ProviderId == contact.ProviderId {
+		t.Errorf("two contacts got the same id %q", other.ProviderId)
+	}
+}
@@ -0,0 +1,245 @@
+//OpenID Connect helpers - discovery, key sets and id_token validation
+//Anything the provider-specific code needs beyond plain oauth2 lives here
+package oidc
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/urlfetch"
+
+	"github.com/dakom/basic-site-api/setup/config/static/statuscodes"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const CACHE_DURATION = time.Hour
+
+//the subset of the discovery document that we care about
+type Discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type JsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type JsonWebKeySet struct {
+	Keys []JsonWebKey `json:"keys"`
+}
+
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+//per-instance cache, these documents change rarely and are fetched on every oauth round trip otherwise
+var cache = make(map[string]*cacheEntry)
+var cacheLock sync.Mutex
+
+func GetDiscovery(ctx context.Context, discoveryUrl string) (*Discovery, error) {
+	if cached := getCached(discoveryUrl); cached != nil {
+		return cached.(*Discovery), nil
+	}
+
+	var discovery Discovery
+	if err := fetchJson(ctx, discoveryUrl, &discovery); err != nil {
+		return nil, err
+	}
+
+	if discovery.Issuer == "" || discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JwksUri == "" {
+		return nil, fmt.Errorf("incomplete discovery document at %s", discoveryUrl)
+	}
+
+	setCached(discoveryUrl, &discovery)
+	return &discovery, nil
+}
+
+func GetKeySet(ctx context.Context, jwksUri string, forceRefresh bool) (*JsonWebKeySet, error) {
+	if !forceRefresh {
+		if cached := getCached(jwksUri); cached != nil {
+			return cached.(*JsonWebKeySet), nil
+		}
+	}
+
+	var keySet JsonWebKeySet
+	if err := fetchJson(ctx, jwksUri, &keySet); err != nil {
+		return nil, err
+	}
+
+	setCached(jwksUri, &keySet)
+	return &keySet, nil
+}
+
+//Validates signature, issuer, audience, expiry and nonce - returns the claims if all is well
+func ValidateIdToken(ctx context.Context, discovery *Discovery, clientId string, rawIdToken string, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+
+	parser := &jwt.Parser{
+		UseJSONNumber: true,
+		ValidMethods:  []string{"RS256", "RS384", "RS512"},
+	}
+
+	_, err := parser.ParseWithClaims(rawIdToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+
+		keySet, err := GetKeySet(ctx, discovery.JwksUri, false)
+		if err != nil {
+			return nil, err
+		}
+
+		key := keySet.findRsaKey(kid)
+		if key == nil {
+			//provider may have rotated keys since we cached them
+			if keySet, err = GetKeySet(ctx, discovery.JwksUri, true); err != nil {
+				return nil, err
+			}
+			key = keySet.findRsaKey(kid)
+		}
+
+		if key == nil {
+			return nil, fmt.Errorf("no matching key for kid %s", kid)
+		}
+
+		return key, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	//MapClaims.Valid() covered exp/iat/nbf, the rest is on us
+	if !claims.VerifyIssuer(discovery.Issuer, true) {
+		return nil, statuscodes.Error(statuscodes.AUTH)
+	}
+
+	if !audienceContains(claims["aud"], clientId) {
+		return nil, statuscodes.Error(statuscodes.AUTH)
+	}
+
+	if nonce != "" {
+		if tokenNonce, _ := claims["nonce"].(string); tokenNonce != nonce {
+			return nil, statuscodes.Error(statuscodes.AUTH)
+		}
+	}
+
+	return claims, nil
+}
+
+//The email claim can't be trusted unless this is true - it's only false if the issuer says so (as a bool, or a string the way Apple sends it)
+//since not every issuer sends email_verified at all
+func IsEmailVerified(claims jwt.MapClaims) bool {
+	return GetClaimString(claims, "email_verified") != "false"
+}
+
+func GetClaimString(claims jwt.MapClaims, name string) string {
+	switch val := claims[name].(type) {
+	case string:
+		return val
+	case json.Number:
+		return val.String()
+	case bool:
+		if val {
+			return "true"
+		}
+		return "false"
+	}
+
+	return ""
+}
+
+func (keySet *JsonWebKeySet) findRsaKey(kid string) *rsa.PublicKey {
+	for _, jwk := range keySet.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		if kid != "" && jwk.Kid != kid {
+			continue
+		}
+
+		nBytes, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			continue
+		}
+		eBytes, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			continue
+		}
+
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(nBytes),
+			E: int(new(big.Int).SetBytes(eBytes).Int64()),
+		}
+	}
+
+	return nil
+}
+
+//aud may be a single string or a list
+func audienceContains(aud interface{}, clientId string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientId
+	case []interface{}:
+		for _, val := range aud {
+			if str, ok := val.(string); ok && str == clientId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func fetchJson(ctx context.Context, url string, target interface{}) error {
+	client := urlfetch.Client(ctx)
+
+	response, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return fmt.Errorf("%s returned %s", url, response.Status)
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(body, target)
+}
+
+func getCached(key string) interface{} {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	if entry, ok := cache[key]; ok && time.Now().Before(entry.expires) {
+		return entry.value
+	}
+	return nil
+}
+
+func setCached(key string, value interface{}) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	cache[key] = &cacheEntry{value: value, expires: time.Now().Add(CACHE_DURATION)}
+}
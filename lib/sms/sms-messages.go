@@ -0,0 +1,11 @@
+package sms
+
+import "fmt"
+
+func GetPhoneVerifyMessage(locale string, code string) string {
+	return fmt.Sprintf("Your verification code is %s", code)
+}
+
+func GetPasswordResetMessage(locale string, code string) string {
+	return fmt.Sprintf("Your password reset code is %s. If you did not request this, you can ignore this message.", code)
+}
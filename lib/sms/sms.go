@@ -0,0 +1,61 @@
+//Text messages - the actual gateway is whatever SiteConfig.SmsSender is set to
+package sms
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+
+	"github.com/dakom/basic-site-api/lib/pages"
+)
+
+const PHONE_MIN_DIGITS = 8
+const PHONE_MAX_DIGITS = 15 //E.164 limit, including country code
+
+//Development stand-in, never set this in production since the codes end up in the logs
+type LogSender struct{}
+
+func (sender LogSender) Send(c context.Context, to string, body string) error {
+	log.Infof(c, "SMS to %s: %s", to, body)
+	return nil
+}
+
+//to must already be normalized via NormalizePhone
+func Send(rData *pages.RequestData, to string, body string) error {
+	if rData.SiteConfig.SmsSender == nil {
+		return errors.New("no sms sender configured")
+	}
+
+	return rData.SiteConfig.SmsSender.Send(rData.Ctx, to, body)
+}
+
+//Strips the usual separators and returns the E.164 form (e.g. +15551234567)
+//The country code is required since there's no way to guess it reliably
+func NormalizePhone(raw string) (string, bool) {
+	phone := strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '.', '(', ')':
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(raw))
+
+	if !strings.HasPrefix(phone, "+") {
+		return "", false
+	}
+
+	digits := phone[1:]
+	if len(digits) < PHONE_MIN_DIGITS || len(digits) > PHONE_MAX_DIGITS || digits[0] == '0' {
+		return "", false
+	}
+
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return "", false
+		}
+	}
+
+	return phone, true
+}
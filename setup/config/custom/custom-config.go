@@ -1,47 +1,210 @@
 package custom
 
+import (
+	"image"
+	"io"
+	"net/http"
+
+	"golang.org/x/net/context"
+)
+
 type DisplayNameValidator interface {
 	IsValid(string) bool
 }
 
+//Gateway for text messages, see lib/sms (sms.LogSender for development)
+type SmsSender interface {
+	Send(c context.Context, to string, body string) error
+}
+
+//Any OpenID Connect compliant issuer, keyed by provider name in Config.OIDC_PROVIDERS (names may not contain "-")
+//ClaimMap maps OAuthUserInfo fields (uid, email, fname, lname, aurl) to claim names, and only needs the ones which differ from the standard claims
+type OidcProvider struct {
+	DiscoveryUrl string
+	ClientId     string
+	ClientSecret string
+	Scopes       []string
+	ClaimMap     map[string]string
+	DisablePkce  bool //only for issuers which reject code_challenge
+}
+
+//Outgoing email transport, see lib/email (SendgridMailer, SmtpMailer, FileMailer, OutboxMailer)
+type Mailer interface {
+	Send(c context.Context, mail *OutgoingEmail) error
+}
+
+type OutgoingEmail struct {
+	FromName    string
+	FromAddress string
+	ToName      string
+	ToAddress   string
+	Subject     string
+	Html        string
+	Text        string            //may be empty
+	Headers     map[string]string //extra headers, e.g. List-Unsubscribe
+}
+
+//Newsletter list backend, see lib/email/mailinglist.go (MailchimpProvider, ConstantContactProvider, NoopMailingList, FakeMailingList)
+//Any method may change contact.ProviderId, the caller saves it
+type MailingListProvider interface {
+	Subscribe(c context.Context, contact *MailingListContact) error
+	UpdateEmail(c context.Context, contact *MailingListContact) error
+	UpdateName(c context.Context, contact *MailingListContact) error
+	Unsubscribe(c context.Context, contact *MailingListContact) error
+	SetInterests(c context.Context, contact *MailingListContact) error
+}
+
+type MailingListContact struct {
+	ProviderId string //whatever the provider needs to find the contact again, empty until subscribed
+	Email      string
+	FirstName  string
+	LastName   string
+	Interests  map[string]bool //by name, providers map these to their own ids and ignore the ones they don't know
+}
+
+//Optional for a MailingListProvider, needed to reconcile against it (see lib/email/mailinglist-resync.go)
+//Lookup returns nil if the contact isn't known to the provider at all
+type MailingListLookup interface {
+	Lookup(c context.Context, contact *MailingListContact) (*MailingListContactState, error)
+}
+
+type MailingListContactState struct {
+	MailingListContact      //Interests only has the ones the provider knows about
+	Subscribed         bool //false for contacts who unsubscribed (or bounced) but are still known
+}
+
+//Where avatars are kept, see lib/blobstore (GcsStore, FileStore, MemoryStore) - names are relative slash separated paths
+type BlobStore interface {
+	Put(c context.Context, name string, contentType string, data io.Reader) error
+	Open(c context.Context, name string) (io.ReadCloser, string, error) //also returns the content type, blobstore.ErrNotFound if it isn't there
+	Delete(c context.Context, name string) error                        //deleting something which isn't there is fine
+	List(c context.Context, prefix string) ([]string, error)            //the names starting with prefix, in no particular order
+	URL(name string) string
+}
+
+//One size of the avatar, see lib/avatars
+//the file is <avatar id><Suffix>.<extension of Format> - every Suffix must be different, not "-orig" and not start with a digit (checked by init.Start)
+type AvatarRendition struct {
+	Name    string //its key in the avatar url api, e.g. "small"
+	Suffix  string
+	Size    uint   //square, in pixels
+	Format  string //"JPEG", "PNG" or "WEBP" (which needs Config.AvatarWebpEncoder)
+	Quality int    //JPEG and WEBP only, 90 if not set
+}
+
+//Looks at every new avatar before it becomes the user's AvatarId, see lib/avatars (NoopModerator, FakeModerator)
+//an error rejects the upload too, it's better to have no avatar than one which wasn't looked at
+type AvatarModerator interface {
+	Moderate(c context.Context, userId int64, img image.Image) (*AvatarModeration, error)
+}
+
+const (
+	AVATAR_MODERATION_APPROVE    string = "approve"
+	AVATAR_MODERATION_REJECT     string = "reject"
+	AVATAR_MODERATION_QUARANTINE string = "quarantine" //kept aside until an admin approves or rejects it
+)
+
+type AvatarModeration struct {
+	Verdict string //AVATAR_MODERATION_*
+	Reason  string //for the admin reviewing it
+}
+
 type Config struct {
 	DisplayNameValidator func(string) bool
+	SmsSender            SmsSender
+	//hmac key for the sms codes (see endpoints/accounts/accounts-phone.go), they can't be sent without it
+	PHONE_CODE_KEY       string
 	VERSION              string
 	MAILINGLIST_TYPE     string
 	SENDGRID_APIKEY      string
-	SENDGRID_FROM_NAME   string
+	SENDGRID_FROM_NAME   string //the sender for every Mailer, not just SendGrid
 	SENDGRID_FROM_ADDR   string
+	EMAIL_DEFAULT_LOCALE string //fallback for email templates, "en" if not set
+
+	//nil means SendGrid with SENDGRID_APIKEY, see lib/email/email-mailers.go for the others
+	Mailer Mailer
+	//overrides for the email templates (see lib/email/email-templates.go) - http.Dir or any embedded http.FileSystem
+	EmailTemplates http.FileSystem
+	//nil means whatever MAILINGLIST_TYPE ("MAILCHIMP", "CONSTANTCONTACT") says, or nothing at all
+	MailingListProvider MailingListProvider
+	//hmac key for the one-click unsubscribe links (see lib/email/mailinglist-prefs.go), links are only added when set
+	MAILINGLIST_UNSUBSCRIBE_KEY string
+	//interest names users may change themselves, "Marketing" if not set
+	MAILINGLIST_USER_INTERESTS []string
+	//shared secret for the inbound provider webhooks, which must be set up with ?key=<this> since neither provider signs them
+	MAILINGLIST_WEBHOOK_KEY string
+	//verification key of the signed event webhook (base64, as shown in the SendGrid settings)
+	SENDGRID_WEBHOOK_PUBLICKEY string
 
 	MAILCHIMP_APIKEY      string
-	MAILCHIMP_APIENDPOINT string
+	MAILCHIMP_APIENDPOINT string //v3 only, derived from the api key's datacenter if empty (or still pointing at v2)
 	MAILCHIMP_LIST_ID     string
-	MAILCHIMP_GROUP_ID    int
+	MAILCHIMP_GROUP_ID    int //legacy v2 grouping, no longer used - see MAILCHIMP_INTERESTS
+	//interest name (see email.MAILINGLIST_INTEREST_*) -> mailchimp interest id
+	MAILCHIMP_INTERESTS map[string]string
 
 	CONSTANT_CONTACT_API_ENDPOINT string
 	CONSTANT_CONTACT_KEY          string
 	CONSTANT_CONTACT_TOKEN        string
 	CONSTANT_CONTACT_LIST_ID      string
+	//interest name -> additional list id, since constant contact has no interests within a list
+	CONSTANT_CONTACT_INTEREST_LISTS map[string]string
 
 	GCS_BUCKET_AVATAR string
+	//nil means GCS_BUCKET_AVATAR, e.g. blobstore.FileStore for local development
+	AvatarStore BlobStore
+	//nil means the original 128px JPEG ("default", no suffix) and 32px JPEG ("small", "_32")
+	//existing avatars only get new or changed renditions after admin/avatar-regenerate
+	AVATAR_RENDITIONS []AvatarRendition
+	//there's no WebP encoder in pure Go, so WEBP renditions need one plugged in (e.g. github.com/chai2010/webp where cgo is available)
+	AvatarWebpEncoder func(w io.Writer, img image.Image, quality int) error
+	//limits on uploads, checked before they're decoded - width or height, 8192 if not set, and width*height, 4 million if not set
+	AVATAR_MAX_DIMENSION int
+	AVATAR_MAX_PIXELS    int
+	//formats uploads may have, as named by the image package - "jpeg", "png" and "gif" if not set
+	AVATAR_FORMATS []string
+	//nil means every avatar is approved
+	AvatarModerator AvatarModerator
+	//how many previous avatars are kept to revert to, 3 if not set and -1 for none
+	AVATAR_HISTORY_SIZE int
 
 	MAX_READ_SIZE int64
 
 	OAUTH_ALLOWED_SCHEMES []string
-	CORS_ALLOWED_ORIGINS  []string
-	CORS_ALLOWED_HEADERS  []string
-	CORS_ALLOWED_METHODS  []string
+	//destinations for OauthRequest's "dest" param - defaults to oauth-action/login and oauth-action/register
+	OAUTH_ALLOWED_DESTINATIONS []string
+	CORS_ALLOWED_ORIGINS       []string
+	CORS_ALLOWED_HEADERS       []string
+	CORS_ALLOWED_METHODS       []string
 
 	//https://developers.google.com/identity/protocols/OAuth2InstalledApp#choosingredirecturi
 	OAUTH_GOOGLE_CLIENTID       string
 	OAUTH_GOOGLE_CLIENTSECRET   string
 	OAUTH_FACEBOOK_CLIENTID     string
 	OAUTH_FACEBOOK_CLIENTSECRET string
+	OAUTH_GITHUB_CLIENTID       string
+	OAUTH_GITHUB_CLIENTSECRET   string
 	OAUTH_USERID_PREFIX         string
 
+	//Sign in with Apple - CLIENTID is the services id, PRIVATEKEY is the contents of the .p8 file for KEYID
+	OAUTH_APPLE_CLIENTID   string
+	OAUTH_APPLE_TEAMID     string
+	OAUTH_APPLE_KEYID      string
+	OAUTH_APPLE_PRIVATEKEY string
+
+	OIDC_PROVIDERS map[string]*OidcProvider
+
+	//providers whose tokens are kept (encrypted with OAUTH_TOKEN_KEY, hex AES key) to call their apis later on
+	OAUTH_OFFLINE_PROVIDERS []string
+	OAUTH_TOKEN_KEY         string
+
 	SUSPEND_AUTH          bool
 	SUSPEND_EMAIL         bool
 	TASKQUEUE_MAILINGLIST string
 	TASKQUEUE_REGISTER    string
+	TASKQUEUE_NOTIFY      string
+	TASKQUEUE_EMAIL       string
+	TASKQUEUE_AVATAR      string
 	EMAIL_TARGET_HOSTNAME string
 	API_HOSTNAME          string
 	COOKIE_SECURE         bool
@@ -50,6 +213,7 @@ type Config struct {
 	JWT_COOKIE_NAME                string
 	JWT_COOKIE_SID_NAME            string
 	JWT_HEADER_SID_NAME            string
+	DEVICE_COOKIE_NAME             string //tells devices apart for the new login notices, "device" if not set
 	REQUEST_SOURCE_APPENGINE_APPID string
 
 	SKIP_CSRF_CHECK bool
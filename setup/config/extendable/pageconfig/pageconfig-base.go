@@ -3,6 +3,7 @@ package pageconfig
 import (
 	"github.com/dakom/basic-site-api/endpoints/accounts"
 	account_webhooks "github.com/dakom/basic-site-api/endpoints/accounts/webhooks"
+	"github.com/dakom/basic-site-api/endpoints/authserver"
 	"github.com/dakom/basic-site-api/endpoints/ping"
 	"github.com/dakom/basic-site-api/endpoints/version"
 	"github.com/dakom/basic-site-api/setup/config/static/pagenames"
@@ -22,6 +23,8 @@ func GetPageConfigs(extraPageConfigs map[string]*pages.PageConfig) map[string]*p
 		"account/login-token-refresh":         &pages.PageConfig{Handler: accounts.GotRefreshTokenRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ACCOUNT_FULL_ANY, RequiresDBScopeCheck: true},
 		pagenames.ACCOUNT_ACTIVATE_SEND_TOKEN: &pages.PageConfig{Handler: accounts.SendActivateTokenRequest, HandlerType: pages.HANDLER_TYPE_JSON},
 		pagenames.ACCOUNT_ACTIVATE_SERVICE:    &pages.PageConfig{Handler: accounts.GotActivateRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.OOB_USER_ACTIVATE},
+		"account/login-link-send":             &pages.PageConfig{Handler: accounts.SendLoginLinkRequest, HandlerType: pages.HANDLER_TYPE_JSON},
+		pagenames.ACCOUNT_LOGIN_LINK_SERVICE:  &pages.PageConfig{Handler: accounts.GotLoginLinkRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.OOB_USER_LOGIN},
 
 		"account/register":               &pages.PageConfig{Handler: accounts.GotRegisterServiceRequest, HandlerType: pages.HANDLER_TYPE_JSON},
 		"account/password-forgot-authed": &pages.PageConfig{Handler: accounts.GotChangePasswordTokenRequestBySession, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ACCOUNT_FULL_ANY},
@@ -31,25 +34,83 @@ func GetPageConfigs(extraPageConfigs map[string]*pages.PageConfig) map[string]*p
 		"account/email-send-token": &pages.PageConfig{Handler: accounts.GotEmailChangeTokenRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ACCOUNT_FULL_MASTER},
 		"account/email-change":     &pages.PageConfig{Handler: accounts.GotEmailChangeActionRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.OOB_USER_EMAIL_CHANGE},
 
+		"account/phone-add":             &pages.PageConfig{Handler: accounts.GotPhoneAddRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ACCOUNT_FULL_MASTER},
+		"account/phone-verify":          &pages.PageConfig{Handler: accounts.GotPhoneVerifyRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ACCOUNT_FULL_MASTER},
+		"account/phone-remove":          &pages.PageConfig{Handler: accounts.GotPhoneRemoveRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ACCOUNT_FULL_MASTER},
+		"account/password-forgot-phone": &pages.PageConfig{Handler: accounts.ForgotPasswordByPhone, HandlerType: pages.HANDLER_TYPE_JSON},
+		"account/password-phone-code":   &pages.PageConfig{Handler: accounts.GotPhonePasswordCodeRequest, HandlerType: pages.HANDLER_TYPE_JSON},
+
 		"account/get-info":           &pages.PageConfig{Handler: accounts.GotSettingsInfoServiceRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ACCOUNT_READ},
 		"account/name-change":        &pages.PageConfig{Handler: accounts.GotNameChangeServiceRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ACCOUNT_FULL_MASTER},
 		"account/avatar-change-file": &pages.PageConfig{Handler: accounts.GotAvatarFileChangeServiceRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ACCOUNT_FULL_MASTER},
 		"account/avatar-change-b64":  &pages.PageConfig{Handler: accounts.GotAvatarBase64ChangeServiceRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ACCOUNT_FULL_MASTER},
+		pagenames.AVATAR_SERVE:       &pages.PageConfig{Handler: accounts.GotAvatarServeRequest, HandlerType: pages.HANDLER_TYPE_HTTP_STATUS},
+		"account/avatar-urls":        &pages.PageConfig{Handler: accounts.GotAvatarUrlsRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ACCOUNT_READ},
+		"account/avatar-revert":      &pages.PageConfig{Handler: accounts.GotAvatarRevertRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ACCOUNT_FULL_MASTER},
+		"account/avatar-remove":      &pages.PageConfig{Handler: accounts.GotAvatarRemoveRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ACCOUNT_FULL_MASTER},
 
 		"webhooks/account/avatar-pull":              &pages.PageConfig{Handler: account_webhooks.AvatarPull, HandlerType: pages.HANDLER_TYPE_HTTP_STATUS, RequestSource: auth.REQUEST_SOURCE_APPENGINE_TASK},
 		"webhooks/account/mailinglist-subscribe":    &pages.PageConfig{Handler: account_webhooks.MailingListSubscribe, HandlerType: pages.HANDLER_TYPE_HTTP_STATUS, RequestSource: auth.REQUEST_SOURCE_APPENGINE_TASK},
 		"webhooks/account/mailinglist-update-email": &pages.PageConfig{Handler: account_webhooks.MailingListUpdateEmail, HandlerType: pages.HANDLER_TYPE_HTTP_STATUS, RequestSource: auth.REQUEST_SOURCE_APPENGINE_TASK},
 		"webhooks/account/mailinglist-update-name":  &pages.PageConfig{Handler: account_webhooks.MailingListUpdateName, HandlerType: pages.HANDLER_TYPE_HTTP_STATUS, RequestSource: auth.REQUEST_SOURCE_APPENGINE_TASK},
+		pagenames.NOTIFICATION_SEND_WEBHOOK:         &pages.PageConfig{Handler: account_webhooks.NotificationSend, HandlerType: pages.HANDLER_TYPE_HTTP_STATUS, RequestSource: auth.REQUEST_SOURCE_APPENGINE_TASK},
+		"webhooks/email-events":                     &pages.PageConfig{Handler: accounts.GotEmailEventsWebhook, HandlerType: pages.HANDLER_TYPE_HTTP_STATUS},
+		pagenames.EMAIL_SEND_WEBHOOK:                &pages.PageConfig{Handler: account_webhooks.EmailSend, HandlerType: pages.HANDLER_TYPE_HTTP_STATUS, RequestSource: auth.REQUEST_SOURCE_APPENGINE_TASK},
+		pagenames.EMAIL_DELIVERY_CLEANUP_WEBHOOK:    &pages.PageConfig{Handler: account_webhooks.EmailDeliveryCleanup, HandlerType: pages.HANDLER_TYPE_HTTP_STATUS, RequestSource: auth.REQUEST_SOURCE_APPENGINE_TASK},
+
+		pagenames.MAILINGLIST_UPDATE_SUBSCRIPTION_WEBHOOK: &pages.PageConfig{Handler: account_webhooks.MailingListUpdateSubscription, HandlerType: pages.HANDLER_TYPE_HTTP_STATUS, RequestSource: auth.REQUEST_SOURCE_APPENGINE_TASK},
+		pagenames.MAILINGLIST_UPDATE_INTERESTS_WEBHOOK:    &pages.PageConfig{Handler: account_webhooks.MailingListUpdateInterests, HandlerType: pages.HANDLER_TYPE_HTTP_STATUS, RequestSource: auth.REQUEST_SOURCE_APPENGINE_TASK},
+		"webhooks/mailinglist-mailchimp":                  &pages.PageConfig{Handler: accounts.GotMailchimpWebhook, HandlerType: pages.HANDLER_TYPE_HTTP_STATUS},
+		"webhooks/mailinglist-constantcontact":            &pages.PageConfig{Handler: accounts.GotConstantContactWebhook, HandlerType: pages.HANDLER_TYPE_HTTP_STATUS},
+		pagenames.MAILINGLIST_RESYNC_WEBHOOK:              &pages.PageConfig{Handler: account_webhooks.MailingListResync, HandlerType: pages.HANDLER_TYPE_HTTP_STATUS, RequestSource: auth.REQUEST_SOURCE_APPENGINE_TASK},
+		pagenames.AVATAR_REGENERATE_WEBHOOK:               &pages.PageConfig{Handler: account_webhooks.AvatarRegenerate, HandlerType: pages.HANDLER_TYPE_HTTP_STATUS, RequestSource: auth.REQUEST_SOURCE_APPENGINE_TASK},
 
 		//oauth
 		"account/oauth-request":           &pages.PageConfig{Handler: accounts.OauthRequest, HandlerType: pages.HANDLER_TYPE_JSON},
 		pagenames.INTERNAL_OAUTH_RESPONSE: &pages.PageConfig{Handler: accounts.OauthResponse, HandlerType: pages.HANDLER_TYPE_HTTP_REDIRECT},
 		"account/oauth-action":            &pages.PageConfig{Handler: accounts.OauthAction, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.OAUTH_STATE},
+		"account/oauth-link-request":      &pages.PageConfig{Handler: accounts.OauthLinkRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ACCOUNT_FULL_MASTER},
+
+		//login methods (linked identities)
+		"account/login-methods-list":   &pages.PageConfig{Handler: accounts.GotLoginMethodsListRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ACCOUNT_FULL_MASTER},
+		"account/login-methods-unlink": &pages.PageConfig{Handler: accounts.GotLoginMethodUnlinkRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ACCOUNT_FULL_MASTER},
+
+		//oauth authorization server (i.e. we're the provider)
+		pagenames.OAUTH_SERVER_AUTHORIZE: &pages.PageConfig{Handler: authserver.Authorize, HandlerType: pages.HANDLER_TYPE_HTTP_REDIRECT},
+		"oauth2/authorize-info":          &pages.PageConfig{Handler: authserver.GotAuthorizeInfoRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ACCOUNT_FULL_MASTER},
+		"oauth2/authorize-decision":      &pages.PageConfig{Handler: authserver.GotAuthorizeDecisionRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ACCOUNT_FULL_MASTER},
+		pagenames.OAUTH_SERVER_TOKEN:     &pages.PageConfig{Handler: authserver.GotTokenRequest, HandlerType: pages.HANDLER_TYPE_JSON},
+		"oauth2/introspect":              &pages.PageConfig{Handler: authserver.GotIntrospectRequest, HandlerType: pages.HANDLER_TYPE_JSON},
+		"oauth2/revoke":                  &pages.PageConfig{Handler: authserver.GotRevokeRequest, HandlerType: pages.HANDLER_TYPE_JSON},
 
 		//subaccounts
 		"account/subaccounts-list":   &pages.PageConfig{Handler: accounts.SubaccountsList, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ACCOUNT_FULL_MASTER},
 		"account/subaccounts-create": &pages.PageConfig{Handler: accounts.CreateSubaccountRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ACCOUNT_FULL_MASTER},
 
+		//security history and notices
+		"account/security-history":     &pages.PageConfig{Handler: accounts.GotSecurityHistoryRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ACCOUNT_FULL_MASTER},
+		"account/notifications-get":    &pages.PageConfig{Handler: accounts.GotNotificationSettingsRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ACCOUNT_READ},
+		"account/notifications-change": &pages.PageConfig{Handler: accounts.GotNotificationSettingsChangeRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ACCOUNT_FULL_MASTER},
+
+		//newsletter preferences
+		"account/mailinglist-get":                 &pages.PageConfig{Handler: accounts.GotMailingListSettingsRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ACCOUNT_READ},
+		"account/mailinglist-change":              &pages.PageConfig{Handler: accounts.GotMailingListSettingsChangeRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ACCOUNT_FULL_MASTER},
+		pagenames.MAILINGLIST_UNSUBSCRIBE_SERVICE: &pages.PageConfig{Handler: accounts.GotMailingListUnsubscribeRequest, HandlerType: pages.HANDLER_TYPE_JSON},
+
+		//admin
+		"admin/account-status-change": &pages.PageConfig{Handler: accounts.GotStatusChangeRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ADMIN | jwt_scopes.ACCOUNT_FULL_MASTER},
+		"admin/audit-query":           &pages.PageConfig{Handler: accounts.GotAdminAuditQueryRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ADMIN | jwt_scopes.ACCOUNT_FULL_MASTER},
+		"admin/mailinglist-resync":    &pages.PageConfig{Handler: accounts.GotAdminMailingListResyncStartRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ADMIN | jwt_scopes.ACCOUNT_FULL_MASTER},
+		"admin/mailinglist-report":    &pages.PageConfig{Handler: accounts.GotAdminMailingListResyncReportRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ADMIN | jwt_scopes.ACCOUNT_FULL_MASTER},
+		"admin/avatar-regenerate":     &pages.PageConfig{Handler: accounts.GotAdminAvatarRegenerateStartRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ADMIN | jwt_scopes.ACCOUNT_FULL_MASTER},
+		"admin/avatar-report":         &pages.PageConfig{Handler: accounts.GotAdminAvatarRegenerateReportRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ADMIN | jwt_scopes.ACCOUNT_FULL_MASTER},
+		"admin/oauth-clients-create":  &pages.PageConfig{Handler: authserver.GotClientCreateRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ADMIN | jwt_scopes.ACCOUNT_FULL_MASTER},
+		"admin/oauth-clients-list":    &pages.PageConfig{Handler: authserver.GotClientListRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ADMIN | jwt_scopes.ACCOUNT_FULL_MASTER},
+		"admin/oauth-clients-delete":  &pages.PageConfig{Handler: authserver.GotClientDeleteRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ADMIN | jwt_scopes.ACCOUNT_FULL_MASTER},
+
+		"admin/avatar-quarantine-list":   &pages.PageConfig{Handler: accounts.GotAdminAvatarQuarantineListRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ADMIN | jwt_scopes.ACCOUNT_FULL_MASTER},
+		"admin/avatar-quarantine-review": &pages.PageConfig{Handler: accounts.GotAdminAvatarQuarantineReviewRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ADMIN | jwt_scopes.ACCOUNT_FULL_MASTER},
+
 		//ping/pong - simple util to test roundtripping
 		"ping":    &pages.PageConfig{Handler: ping.GotPongRequest, HandlerType: pages.HANDLER_TYPE_JSON, Scopes: jwt_scopes.ACCOUNT_FULL_ANY},
 		"version": &pages.PageConfig{Handler: version.GotVersionRequest, HandlerType: pages.HANDLER_TYPE_JSON},
@@ -6,13 +6,26 @@ const ACCOUNT_LOGOUT_SERVICE string = "account/logout"
 const ACCOUNT_LOGIN_SERVICE string = "account/login"
 const ACCOUNT_ACTIVATE_SERVICE string = "account/activate"
 const ACCOUNT_ACTIVATE_SEND_TOKEN string = "account/activate-send-token"
+const ACCOUNT_LOGIN_LINK_SERVICE string = "account/login-link"
 const ACCOUNT_AVATAR_PULL_WEBHOOK string = "webhooks/account/avatar-pull"
+const AVATAR_SERVE string = "avatars/"
+const AVATAR_REGENERATE_WEBHOOK string = "webhooks/avatar-regenerate"
 const MAILINGLIST_SUBSCRIBE_WEBHOOK string = "webhooks/account/mailinglist-subscribe"
 const MAILINGLIST_UPDATE_EMAIL_WEBHOOK string = "webhooks/account/mailinglist-update-email"
 const MAILINGLIST_UPDATE_NAME_WEBHOOK string = "webhooks/account/mailinglist-update-name"
+const MAILINGLIST_UPDATE_SUBSCRIPTION_WEBHOOK string = "webhooks/account/mailinglist-update-subscription"
+const MAILINGLIST_UPDATE_INTERESTS_WEBHOOK string = "webhooks/account/mailinglist-update-interests"
+const MAILINGLIST_UNSUBSCRIBE_SERVICE string = "account/mailinglist-unsubscribe"
+const MAILINGLIST_RESYNC_WEBHOOK string = "webhooks/mailinglist-resync"
+const NOTIFICATION_SEND_WEBHOOK string = "webhooks/account/notification-send"
+const EMAIL_SEND_WEBHOOK string = "webhooks/email-send"
+const EMAIL_DELIVERY_CLEANUP_WEBHOOK string = "webhooks/email-delivery-cleanup"
 
 const INTERNAL_OAUTH_RESPONSE string = "account/oauth-response"
 
+const OAUTH_SERVER_AUTHORIZE string = "oauth2/authorize"
+const OAUTH_SERVER_TOKEN string = "oauth2/token"
+
 const INTERNAL_INDEX string = "index"
 const INTERNAL_STATUS_TEMPLATE string = "status"
 const INTERNAL_ACCOUNT_PASSWORD_RESET_FORM string = "account-password-reset-form"
@@ -22,3 +35,5 @@ const INTERNAL_ADMIN_EDITMEDIA string = "admin-editmedia"
 const APP_PAGE_ACCOUNT_ACTION_ACTIVATE string = "account-action/activate"
 const APP_PAGE_ACCOUNT_ACTION_EMAIL_CHANGE string = "account-action/email-change"
 const APP_PAGE_ACCOUNT_ACTION_PASSWORD_RESET string = "account-action/password-reset"
+const APP_PAGE_ACCOUNT_ACTION_LOGIN string = "account-action/login"
+const APP_PAGE_OAUTH_CONSENT string = "oauth-consent"
@@ -10,6 +10,9 @@ const API_AUTH string = "API_AUTH"
 const AUTH string = "AUTH"
 const AUTH_OOB string = "AUTH_OOB"
 const NOT_ACTIVATED string = "NOT_ACTIVATED"
+const ACCOUNT_SUSPENDED string = "ACCOUNT_SUSPENDED"
+const ACCOUNT_DELETED string = "ACCOUNT_DELETED"
+const INVALID_STATUS string = "INVALID_STATUS"
 const INVALID_DISPLAYNAME string = "INVALID_DISPLAYNAME"
 const MISSINGINFO string = "MISSINGINFO"
 const MISSING_USERNAME string = "MISSING_USERNAME"
@@ -34,6 +37,21 @@ const CONTACT_EXISTS string = "CONTACT_EXISTS"
 const EXPIRED string = "EXPIRED"
 const CHECK_EMAIL string = "CHECK_EMAIL"
 const RECORD_LENGTH_MISMATCH string = "RECORD_LENGTH_MISMATCH"
+const IDENTITY_EXISTS string = "IDENTITY_EXISTS"
+const IDENTITY_NOT_FOUND string = "IDENTITY_NOT_FOUND"
+const LAST_LOGIN_METHOD string = "LAST_LOGIN_METHOD"
+const INVALID_SCOPE string = "INVALID_SCOPE"
+const INVALID_REDIRECT string = "INVALID_REDIRECT"
+const CLIENT_NOT_FOUND string = "CLIENT_NOT_FOUND"
+const INVALID_PHONE string = "INVALID_PHONE"
+const PHONE_EXISTS string = "PHONE_EXISTS"
+const INVALID_CODE string = "INVALID_CODE"
+const TRY_LATER string = "TRY_LATER"
+const INVALID_INTEREST string = "INVALID_INTEREST"
+const INVALID_CROP string = "INVALID_CROP"
+const INVALID_IMAGE_FORMAT string = "INVALID_IMAGE_FORMAT"
+const IMAGE_TOO_LARGE string = "IMAGE_TOO_LARGE"
+const AVATAR_REJECTED string = "AVATAR_REJECTED"
 
 //success
 const ACTIVATION_COMPLETED string = "ACTIVATION_COMPLETED"
@@ -43,7 +61,21 @@ const NAME_CHANGED string = "NAME_CHANGED"
 const PASSWORD_CHANGED string = "PASSWORD_CHANGED"
 const ACTIVATION_EXISTS string = "ACTIVATION_EXISTS"
 const AVATAR_CHANGED string = "AVATAR_CHANGED"
+const AVATAR_PENDING string = "AVATAR_PENDING"
+const AVATAR_REMOVED string = "AVATAR_REMOVED"
 const LOGOUT_SUCCESS string = "LOGOUT_SUCCESS"
+const ACCOUNT_ACTIVE string = "ACCOUNT_ACTIVE"
+const STATUS_CHANGED string = "STATUS_CHANGED"
+const NOTIFICATIONS_CHANGED string = "NOTIFICATIONS_CHANGED"
+const IDENTITY_LINKED string = "IDENTITY_LINKED"
+const IDENTITY_UNLINKED string = "IDENTITY_UNLINKED"
+const CLIENT_CREATED string = "CLIENT_CREATED"
+const CLIENT_DELETED string = "CLIENT_DELETED"
+const CHECK_PHONE string = "CHECK_PHONE"
+const PHONE_CHANGED string = "PHONE_CHANGED"
+const CODE_VERIFIED string = "CODE_VERIFIED"
+const MAILINGLIST_CHANGED string = "MAILINGLIST_CHANGED"
+const UNSUBSCRIBED string = "UNSUBSCRIBED"
 
 func Error(code string) error {
 	return errors.New(code)